@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Serve the net/http/pprof handlers under /debug/pprof/
+func pprofHandler(c *gin.Context) {
+	switch c.Param("name") {
+	case "/cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "/profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "/symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "/trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		// The index and the named profiles (heap, goroutine, ...)
+		pprof.Index(c.Writer, c.Request)
+	}
+}
+
+// Register the operational routes: metrics, pprof, probes and the admin
+// API. public is set for the main router when there is no ADMIN_PORT; pprof
+// then needs the admin token like the admin API, since it exposes memory
+// contents and can slow the process down.
+func registerOpsRoutes(r *gin.Engine, cfg Config, public bool) {
+	r.GET("/metrics", metricsHandler)
+	r.GET("/livez", livez)
+	r.GET("/readyz", readyz)
+
+	if !public {
+		r.GET("/debug/pprof/*name", pprofHandler)
+	}
+
+	if cfg.AdminToken != "" {
+		if public {
+			r.GET("/debug/pprof/*name", requireAdmin(), pprofHandler)
+		}
+		admin := r.Group("/admin", requireAdmin())
+		admin.GET("/maintenance", getMaintenance)
+		admin.POST("/maintenance", updateMaintenance)
+		admin.GET("/log-level", getLogLevel)
+		admin.POST("/log-level", updateLogLevel)
+	}
+}
+
+// Router for ADMIN_PORT, which serves only the operational routes
+func newAdminRouter(cfg Config) *gin.Engine {
+	r := gin.New()
+	_ = r.SetTrustedProxies(cfg.trustedProxies())
+	r.Use(assignRequestID(), logRequests(), securityHeaders(), recoverPanics(), compressResponses())
+	r.NoRoute(noRoute)
+	registerOpsRoutes(r, cfg, false)
+	return r
+}
+
+// Server for ADMIN_PORT; nil when ops routes stay on the main port. Meant
+// for a private network: it has no TLS.
+func newAdminServer(cfg Config, baseCtx context.Context) *http.Server {
+	if cfg.AdminPort == "" {
+		return nil
+	}
+	return &http.Server{
+		Addr:              ":" + cfg.AdminPort,
+		Handler:           newAdminRouter(cfg),
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
+		ReadHeaderTimeout: cfg.ServerReadHeaderTimeout,
+		IdleTimeout:       cfg.ServerIdleTimeout,
+	}
+}
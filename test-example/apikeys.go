@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// API keys, sent as "X-API-Key: <key>" or "Authorization: Bearer <key>".
+// Keys are 32 random bytes, so a plain SHA-256 is enough to store them: the
+// key is looked up by its hash.
+
+// Keys are this followed by 43 URL-safe base64 characters
+const apiKeyTokenPrefix = "sk_"
+
+// Leading characters of a key that are stored in plaintext, to tell keys
+// apart in listings and logs
+const apiKeyPrefixLen = 11
+
+// How long a key looked up in the database is trusted before it is read
+// again (API_KEY_CACHE_TTL); unknown keys are remembered as long. Revoking a
+// key drops it from this instance's cache, so this bounds how long other
+// instances keep accepting it.
+var apiKeyCacheTTL = 10 * time.Second
+
+// Cached lookups; the cache starts over when it fills up
+const maxAPIKeyCacheEntries = 10000
+
+// How often last_used_at is written; uses in between are only kept in memory
+const apiKeyUsageFlushInterval = 30 * time.Second
+
+var errAPIKeyNotFound = errors.New("API key not found")
+
+// A stored API key, without its secret
+type apiKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Prefix    string    `json:"prefix"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+	// Lags by up to apiKeyUsageFlushInterval on other instances
+	LastUsedAt *time.Time `json:"last_used_at"`
+	// Requests per second; nil applies RATE_LIMIT
+	RateLimit *float64 `json:"rate_limit"`
+	// Requests per UTC day; nil is unlimited
+	DailyQuota *int64 `json:"daily_quota"`
+}
+
+// Columns scanned by scanAPIKey
+const apiKeyColumns = "id, name, prefix, role, created_at, last_used_at, rate_limit, daily_quota"
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }, key *apiKey, extra ...interface{}) error {
+	return row.Scan(append([]interface{}{&key.ID, &key.Name, &key.Prefix, &key.Role, &key.CreatedAt, &key.LastUsedAt, &key.RateLimit, &key.DailyQuota}, extra...)...)
+}
+
+// Stored API keys and their daily request counts
+type apiKeyRepository interface {
+	// Store key under the hash of its plaintext
+	Create(ctx context.Context, key apiKey, hash string) error
+	// The unrevoked key with the given hash; errAPIKeyNotFound when there is
+	// none
+	FindByHash(ctx context.Context, hash string) (apiKey, error)
+	// The unrevoked key with the given id; errAPIKeyNotFound when there is
+	// none
+	Get(ctx context.Context, id string) (apiKey, error)
+	// Unrevoked keys, oldest first
+	List(ctx context.Context) ([]apiKey, error)
+	// errAPIKeyNotFound when there is no such unrevoked key
+	Revoke(ctx context.Context, id string) error
+	SetLastUsed(ctx context.Context, id string, t time.Time) error
+	// Add n requests to the count of a key for a UTC day
+	AddUsage(ctx context.Context, id, day string, n int64) error
+	// Request counts of every key for a UTC day
+	Usage(ctx context.Context, day string) (map[string]int64, error)
+}
+
+// Create a key with the name, role and limits of key, returning it with the
+// plaintext key, which is not stored anywhere
+func newAPIKey(ctx context.Context, keys apiKeyRepository, key apiKey) (apiKey, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return apiKey{}, "", err
+	}
+	plaintext := apiKeyTokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	key.ID, key.Prefix, key.CreatedAt, key.LastUsedAt = newUUID(), plaintext[:apiKeyPrefixLen], time.Now().UTC(), nil
+	if err := keys.Create(ctx, key, hashAPIKey(plaintext)); err != nil {
+		return apiKey{}, "", err
+	}
+	return key, plaintext, nil
+}
+
+// Hex SHA-256 of a plaintext key, as stored in api_keys.key_hash
+func hashAPIKey(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyRepository on a database/sql pool of any dialect
+type sqlAPIKeyRepository struct {
+	db *sql.DB
+}
+
+func (r *sqlAPIKeyRepository) Create(ctx context.Context, key apiKey, hash string) error {
+	query, args := bindQuery("INSERT INTO api_keys (id, name, prefix, role, rate_limit, daily_quota, key_hash, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		key.ID, key.Name, key.Prefix, key.Role, key.RateLimit, key.DailyQuota, hash, key.CreatedAt)
+	_, err := r.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+func (r *sqlAPIKeyRepository) FindByHash(ctx context.Context, hash string) (apiKey, error) {
+	var key apiKey
+	var storedHash string
+	query, args := bindQuery("SELECT "+apiKeyColumns+", key_hash FROM api_keys WHERE key_hash = $1 AND revoked_at IS NULL", hash)
+	err := scanAPIKey(r.db.QueryRowContext(ctx, query, args...), &key, &storedHash)
+	if err == sql.ErrNoRows {
+		return apiKey{}, errAPIKeyNotFound
+	}
+	if err != nil {
+		return apiKey{}, err
+	}
+	// The index lookup only reveals timing about the hash, never the key,
+	// but the match itself is still checked in constant time
+	if subtle.ConstantTimeCompare([]byte(storedHash), []byte(hash)) != 1 {
+		return apiKey{}, errAPIKeyNotFound
+	}
+	return key, nil
+}
+
+func (r *sqlAPIKeyRepository) Get(ctx context.Context, id string) (apiKey, error) {
+	var key apiKey
+	query, args := bindQuery("SELECT "+apiKeyColumns+" FROM api_keys WHERE id = $1 AND revoked_at IS NULL", id)
+	err := scanAPIKey(r.db.QueryRowContext(ctx, query, args...), &key)
+	if err == sql.ErrNoRows {
+		return apiKey{}, errAPIKeyNotFound
+	}
+	return key, err
+}
+
+func (r *sqlAPIKeyRepository) List(ctx context.Context) ([]apiKey, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE revoked_at IS NULL ORDER BY created_at, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []apiKey{}
+	for rows.Next() {
+		var key apiKey
+		if err := scanAPIKey(rows, &key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (r *sqlAPIKeyRepository) Revoke(ctx context.Context, id string) error {
+	query, args := bindQuery("UPDATE api_keys SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL", time.Now().UTC(), id)
+	result, err := r.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errAPIKeyNotFound
+	}
+	return nil
+}
+
+func (r *sqlAPIKeyRepository) SetLastUsed(ctx context.Context, id string, t time.Time) error {
+	query, args := bindQuery("UPDATE api_keys SET last_used_at = $1 WHERE id = $2", t, id)
+	_, err := r.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Use key's last use on this instance when it hasn't been written yet
+func withPendingUse(key apiKey, pending map[string]time.Time) apiKey {
+	if used, ok := pending[key.ID]; ok && (key.LastUsedAt == nil || used.After(*key.LastUsedAt)) {
+		key.LastUsedAt = &used
+	}
+	return key
+}
+
+// The unrevoked key with the given id, with the use this instance hasn't
+// written yet; errAPIKeyNotFound when there is none
+func getAPIKey(ctx context.Context, keys apiKeyRepository, id string) (apiKey, error) {
+	key, err := keys.Get(ctx, id)
+	if err != nil {
+		return apiKey{}, err
+	}
+	return withPendingUse(key, keyUsage.pending()), nil
+}
+
+// Unrevoked keys, oldest first, with the uses this instance hasn't written yet
+func listAPIKeys(ctx context.Context, keys apiKeyRepository) ([]apiKey, error) {
+	list, err := keys.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pending := keyUsage.pending()
+	for i := range list {
+		list[i] = withPendingUse(list[i], pending)
+	}
+	return list, nil
+}
+
+// Revoke a key and drop it from the cache; errAPIKeyNotFound when there is
+// no such unrevoked key
+func revokeAPIKey(ctx context.Context, keys apiKeyRepository, id string) error {
+	if err := keys.Revoke(ctx, id); err != nil {
+		return err
+	}
+	apiKeys.forget(id)
+	return nil
+}
+
+// Lookups by key hash; a nil key records that there is no such key
+type apiKeyCache struct {
+	mu      sync.Mutex
+	entries map[string]apiKeyCacheEntry
+}
+
+type apiKeyCacheEntry struct {
+	key     *apiKey
+	expires time.Time
+}
+
+var apiKeys = &apiKeyCache{entries: map[string]apiKeyCacheEntry{}}
+
+func (c *apiKeyCache) get(hash string) (*apiKey, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[hash]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.key, true
+}
+
+func (c *apiKeyCache) put(hash string, key *apiKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxAPIKeyCacheEntries {
+		c.entries = map[string]apiKeyCacheEntry{}
+	}
+	c.entries[hash] = apiKeyCacheEntry{key: key, expires: time.Now().Add(apiKeyCacheTTL)}
+}
+
+// Drop the cached lookup of the key with the given id
+func (c *apiKeyCache) forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for hash, entry := range c.entries {
+		if entry.key != nil && entry.key.ID == id {
+			delete(c.entries, hash)
+		}
+	}
+}
+
+// The key matching a plaintext key, from the cache or the database;
+// errAPIKeyNotFound when there is none
+func (c *apiKeyCache) authenticate(ctx context.Context, keys apiKeyRepository, plaintext string) (*apiKey, error) {
+	hash := hashAPIKey(plaintext)
+	if key, ok := c.get(hash); ok {
+		if key == nil {
+			return nil, errAPIKeyNotFound
+		}
+		return key, nil
+	}
+
+	key, err := keys.FindByHash(ctx, hash)
+	if err == errAPIKeyNotFound {
+		c.put(hash, nil)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.put(hash, &key)
+	return &key, nil
+}
+
+// When each key was last used on this instance, since the last flush
+type apiKeyUsage struct {
+	mu       sync.Mutex
+	lastUsed map[string]time.Time
+}
+
+var keyUsage = &apiKeyUsage{lastUsed: map[string]time.Time{}}
+
+func (u *apiKeyUsage) record(id string) {
+	u.mu.Lock()
+	u.lastUsed[id] = time.Now().UTC()
+	u.mu.Unlock()
+}
+
+// A copy of the uses not written yet
+func (u *apiKeyUsage) pending() map[string]time.Time {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	pending := make(map[string]time.Time, len(u.lastUsed))
+	for id, t := range u.lastUsed {
+		pending[id] = t
+	}
+	return pending
+}
+
+// Write the recorded uses to last_used_at. Failed writes are logged and
+// dropped; the next use records the key again.
+func (u *apiKeyUsage) flush(ctx context.Context, keys apiKeyRepository) {
+	u.mu.Lock()
+	lastUsed := u.lastUsed
+	u.lastUsed = map[string]time.Time{}
+	u.mu.Unlock()
+
+	for id, t := range lastUsed {
+		if err := keys.SetLastUsed(ctx, id, t); err != nil {
+			loggerFrom(ctx).Error("Failed to record use of API key", "api_key_id", id, "error", err)
+		}
+	}
+}
+
+// Flush every interval, forever, logging through ctx's logger; main flushes
+// once more at shutdown
+func (u *apiKeyUsage) flushEvery(ctx context.Context, keys apiKeyRepository, interval time.Duration) {
+	for range time.Tick(interval) {
+		u.flush(ctx, keys)
+	}
+}
+
+// Principal for a plaintext API key
+func apiKeyPrincipal(ctx context.Context, plaintext string) (*principal, error) {
+	key, err := apiKeys.authenticate(ctx, repositoriesFrom(ctx).apiKeys, plaintext)
+	if err == errAPIKeyNotFound {
+		return nil, authError{message: "Invalid API key", invalid: true}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("look up API key: %w", err)
+	}
+	keyUsage.record(key.ID)
+	return &principal{Mode: authModeAPIKey, Subject: key.ID, Scopes: grantedScopes([]string{key.Role}, nil), APIKey: key}, nil
+}
+
+type apiKeyInput struct {
+	Name       string   `json:"name"`
+	Role       string   `json:"role"`
+	RateLimit  *float64 `json:"rate_limit"`
+	DailyQuota *int64   `json:"daily_quota"`
+}
+
+// A new key with its plaintext, as answered once
+type createdAPIKey struct {
+	apiKey
+	Key string `json:"key"`
+}
+
+// Create an API key
+//
+// Body: {"name": "...", "role": "viewer", "rate_limit": 10, "daily_quota":
+// 10000}; the role is one of ROLE_SCOPES and defaults to the default user
+// role, and the limits are optional. The response includes the plaintext key,
+// which is never shown again.
+func createKey(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var input apiKeyInput
+	if !bindJSON(c, &input) {
+		return
+	}
+	name, err := normalizeName(input.Name)
+	if err != nil {
+		respondInvalid(c, err)
+		return
+	}
+	if input.Role == "" {
+		input.Role = defaultRole
+	}
+	if !isGrantableRole(input.Role) {
+		respondInvalid(c, fieldError{Field: "role", Rule: "oneof", Message: "role must be one of: " + strings.Join(sortedKeys(roleScopes), ", ")})
+		return
+	}
+	if input.RateLimit != nil && !(*input.RateLimit > 0) {
+		respondInvalid(c, fieldError{Field: "rate_limit", Rule: "gt", Message: "rate_limit must be greater than 0"})
+		return
+	}
+	if input.DailyQuota != nil && *input.DailyQuota < 1 {
+		respondInvalid(c, fieldError{Field: "daily_quota", Rule: "min", Message: "daily_quota must be at least 1"})
+		return
+	}
+
+	key, plaintext, err := newAPIKey(ctx, repositoriesFrom(ctx).apiKeys, apiKey{Name: name, Role: input.Role, RateLimit: input.RateLimit, DailyQuota: input.DailyQuota})
+	if err != nil {
+		respondInternal(c, "Failed to create API key")
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusCreated, createdAPIKey{key, plaintext})
+}
+
+// List the unrevoked API keys, without their secrets
+func getKeys(c *gin.Context) {
+	ctx := c.Request.Context()
+	keys, err := listAPIKeys(ctx, repositoriesFrom(ctx).apiKeys)
+	if err != nil {
+		respondInternal(c, "Failed to list API keys")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": keys})
+}
+
+// Revoke an API key; requests using it are refused from now on
+func deleteKey(c *gin.Context) {
+	ctx := c.Request.Context()
+	err := revokeAPIKey(ctx, repositoriesFrom(ctx).apiKeys, c.Param("id"))
+	if err == errAPIKeyNotFound {
+		respondError(c, codeAPIKeyNotFound, "API key not found")
+		return
+	}
+	if err != nil {
+		respondInternal(c, "Failed to revoke API key")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
+
+// The API key the request was authenticated with; nil outside /api and for
+// tokens
+func currentAPIKey(c *gin.Context) *apiKey {
+	if p := currentPrincipal(c); p != nil {
+		return p.APIKey
+	}
+	return nil
+}
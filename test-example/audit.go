@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Changes to users are recorded in audit_log in the transaction that makes
+// them, so an entry exists exactly when its change was committed. Each entry
+// holds who made the change (the API key or token subject), the changed
+// fields' old and new values, and the request ID.
+
+// Actions recorded in audit_log
+const (
+	auditCreate  = "create"
+	auditUpdate  = "update"
+	auditDelete  = "delete"
+	auditRestore = "restore"
+	// Only that it changed or was reset; the entries have no changes
+	auditPasswordChange = "password_change"
+	auditPasswordReset  = "password_reset"
+	// Login locked after too many failures, and unlocked by an admin; no
+	// changes either
+	auditLockout = "lockout"
+	auditUnlock  = "unlock"
+)
+
+// Actor of changes made outside a request
+const auditActorSystem = "system"
+
+// Mask email addresses in recorded changes (AUDIT_MASK_EMAILS)
+var auditMaskEmails = false
+
+// User fields whose changes are recorded; timestamps and the version change
+// with every write and say nothing about what changed
+var auditedFields = []string{"email", "email_verified", "name", "phone", "status", "role", "metadata", "avatar_url", "deleted_at"}
+
+// One recorded change of a user
+type auditEntry struct {
+	ID         int64     `json:"id"`
+	OccurredAt time.Time `json:"occurred_at"`
+	// "api_key:<key id>", "jwt:<subject>", "session:<user id>" or "system"
+	Actor  string `json:"actor"`
+	Action string `json:"action"`
+	UserID string `json:"user_id"`
+	// By field; only the fields that changed
+	Changes   map[string]auditChange `json:"changes"`
+	RequestID string                 `json:"request_id,omitempty"`
+	// The user after the change, or before a deletion, for the outbox
+	// event; not stored here
+	user *User
+}
+
+// A field's value before and after a change; null when the user didn't
+// exist before (create) or after (delete)
+type auditChange struct {
+	From json.RawMessage `json:"from"`
+	To   json.RawMessage `json:"to"`
+}
+
+// An entry for a change of a user from before to after; nil before records
+// a creation and nil after a deletion
+func newAuditEntry(ctx context.Context, action string, before, after *User) auditEntry {
+	user := after
+	if user == nil {
+		user = before
+	}
+	userID := ""
+	if user != nil {
+		userID = user.ID
+	}
+	return auditEntry{
+		OccurredAt: time.Now().UTC(),
+		Actor:      auditActor(ctx),
+		Action:     action,
+		UserID:     userID,
+		Changes:    diffUsers(before, after),
+		RequestID:  requestIDFrom(ctx),
+		user:       user,
+	}
+}
+
+// Who is making the request of ctx
+func auditActor(ctx context.Context) string {
+	p := principalFrom(ctx)
+	if p == nil {
+		return auditActorSystem
+	}
+	return p.Mode + ":" + p.Subject
+}
+
+// The audited fields that differ between two versions of a user
+func diffUsers(before, after *User) map[string]auditChange {
+	from, to := auditFieldValues(before), auditFieldValues(after)
+	changes := map[string]auditChange{}
+	for _, field := range auditedFields {
+		f, t := from[field], to[field]
+		if bytes.Equal(f, t) {
+			continue
+		}
+		if field == "email" && auditMaskEmails {
+			f, t = maskEmailJSON(f), maskEmailJSON(t)
+		}
+		changes[field] = auditChange{From: f, To: t}
+	}
+	return changes
+}
+
+// The JSON value of each audited field, null for missing ones
+func auditFieldValues(u *User) map[string]json.RawMessage {
+	values := map[string]json.RawMessage{}
+	if u != nil {
+		data, _ := json.Marshal(u)
+		json.Unmarshal(data, &values)
+	}
+	for _, field := range auditedFields {
+		if values[field] == nil {
+			values[field] = json.RawMessage("null")
+		}
+	}
+	return values
+}
+
+// Mask a JSON email string like maskEmail; null stays null
+func maskEmailJSON(value json.RawMessage) json.RawMessage {
+	var email *string
+	if json.Unmarshal(value, &email) != nil || email == nil {
+		return value
+	}
+	masked, _ := json.Marshal(maskEmail(*email))
+	return masked
+}
+
+// "jane@example.com" becomes "j***@example.com"
+func maskEmail(email string) string {
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok || local == "" {
+		local = "*"
+	}
+	return local[:1] + "***@" + domain
+}
+
+// Insert entries with one statement, through tx so they commit with the
+// change, with their events for the outbox.
+func insertAuditEntries(ctx context.Context, tx execer, entries ...auditEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	query, args := auditInsertSQL(entries)
+	query, args = bindQuery(query, args...)
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return err
+	}
+	return insertOutboxEvents(ctx, tx, entries)
+}
+
+// A dbtx, or anything else that can run a statement
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// The INSERT for entries, with Postgres placeholders
+func auditInsertSQL(entries []auditEntry) (string, []interface{}) {
+	values := []string{}
+	args := []interface{}{}
+	for _, e := range entries {
+		changes, _ := json.Marshal(e.Changes)
+		n := len(args)
+		values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5, n+6))
+		args = append(args, e.OccurredAt, e.Actor, e.Action, e.UserID, string(changes), e.RequestID)
+	}
+	return "INSERT INTO audit_log (occurred_at, actor, action, user_id, changes, request_id) VALUES " + strings.Join(values, ", "), args
+}
+
+// Update a user through the repository and record the change. The update
+// only applies to the version read for the diff; when the user changes in
+// between and the caller didn't ask for a version, it is tried again.
+func updateUserAudited(ctx context.Context, users UserRepository, id string, patch userPatch, versions []int64) (User, error) {
+	var user User
+	for attempt := 1; ; attempt++ {
+		err := users.WithTx(ctx, func(tx UserRepository) error {
+			before, err := tx.GetByID(ctx, id, nil, false)
+			if err != nil {
+				return err
+			}
+			if versions != nil && !slices.Contains(versions, before.Version) {
+				return errVersionMismatch
+			}
+			user, err = tx.Update(ctx, id, patch, []int64{before.Version})
+			if err != nil {
+				return err
+			}
+			return tx.RecordAudit(ctx, newAuditEntry(ctx, auditUpdate, &before, &user))
+		})
+		if err == errVersionMismatch && versions == nil && attempt < maxTxAttempts {
+			continue
+		}
+		return user, err
+	}
+}
+
+// Create a validated user through the repository, with its password and
+// email verification token, and record it. Deleted users keep their email
+// reserved unless reuse is allowed, which takes a check and an insert, so
+// they run in one transaction.
+func createUserAudited(ctx context.Context, users UserRepository, input createUserInput) (User, error) {
+	var passwordHash string
+	if input.Password != nil {
+		// Hashed before the transaction, which shouldn't wait on bcrypt
+		var err error
+		if passwordHash, err = hashPassword(*input.Password); err != nil {
+			return User{}, err
+		}
+	}
+
+	var user User
+	var verificationToken string
+	err := users.WithTx(ctx, func(tx UserRepository) error {
+		var err error
+		user, err = tx.Create(ctx, User{
+			Email:    input.Email,
+			Name:     input.Name,
+			Phone:    input.Phone,
+			Role:     input.Role,
+			Metadata: input.Metadata,
+		})
+		if err != nil {
+			return err
+		}
+		if passwordHash != "" {
+			if err := tx.SetPasswordHash(ctx, user.ID, passwordHash); err != nil {
+				return err
+			}
+		}
+		if verificationToken, err = newVerificationToken(ctx, tx, user.ID); err != nil {
+			return err
+		}
+		return tx.RecordAudit(ctx, newAuditEntry(ctx, auditCreate, nil, &user))
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	// After the commit, so a slow mail server doesn't hold the transaction;
+	// a failure is logged and the link can be sent again
+	sendVerificationEmail(ctx, user.Email, verificationToken)
+	return user, nil
+}
+
+// Soft-delete a user through the repository and record it
+func deleteUserAudited(ctx context.Context, users UserRepository, id string) error {
+	return users.WithTx(ctx, func(tx UserRepository) error {
+		before, err := tx.GetByID(ctx, id, nil, false)
+		if err != nil {
+			return err
+		}
+		if err := tx.Delete(ctx, id); err != nil {
+			return err
+		}
+		return tx.RecordAudit(ctx, newAuditEntry(ctx, auditDelete, &before, nil))
+	})
+}
+
+// Filters and page of an audit_log read
+type auditQuery struct {
+	UserID string
+	Actor  string
+	After  *time.Time
+	Before *time.Time
+	Limit  int
+	Offset int
+}
+
+func (q auditQuery) where() (string, []interface{}) {
+	w := &whereBuilder{}
+	if q.UserID != "" {
+		w.add("user_id = " + w.arg(strings.ToLower(q.UserID)))
+	}
+	if q.Actor != "" {
+		w.add("actor = " + w.arg(q.Actor))
+	}
+	if q.After != nil {
+		w.add("occurred_at >= " + w.arg(q.After.UTC()))
+	}
+	if q.Before != nil {
+		w.add("occurred_at < " + w.arg(q.Before.UTC()))
+	}
+	return w.sql(), w.args
+}
+
+func countAuditEntries(ctx context.Context, conn dbtx, q auditQuery) (int64, error) {
+	where, args := q.where()
+	query, args := bindQuery("SELECT COUNT(*) FROM audit_log"+where, args...)
+	var n int64
+	err := conn.QueryRowContext(ctx, query, args...).Scan(&n)
+	return n, err
+}
+
+func listAuditEntries(ctx context.Context, conn dbtx, q auditQuery) ([]auditEntry, error) {
+	where, args := q.where()
+	query := fmt.Sprintf("SELECT id, occurred_at, actor, action, user_id, changes, request_id FROM audit_log%s ORDER BY id DESC LIMIT $%d OFFSET $%d",
+		where, len(args)+1, len(args)+2)
+	query, args = bindQuery(query, append(args, q.Limit, q.Offset)...)
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []auditEntry{}
+	for rows.Next() {
+		var e auditEntry
+		var changes []byte
+		if err := rows.Scan(&e.ID, &e.OccurredAt, &e.Actor, &e.Action, &e.UserID, &changes, &e.RequestID); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(changes, &e.Changes); err != nil {
+			return nil, fmt.Errorf("audit entry %d: %w", e.ID, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Respond with a page of entries and the total in X-Total-Count
+func respondAuditEntries(c *gin.Context, q auditQuery) {
+	ctx := c.Request.Context()
+
+	var err error
+	if q.Limit, q.Offset, err = parsePagination(c); err != nil {
+		respondError(c, codeInvalidRequest, err.Error())
+		return
+	}
+
+	users := repositoriesFrom(ctx).users
+	total, err := users.CountAudit(ctx, q)
+	if err != nil {
+		respondInternal(c, "Failed to count audit entries")
+		return
+	}
+	entries, err := users.ListAudit(ctx, q)
+	if err != nil {
+		respondInternal(c, "Failed to fetch audit entries")
+		return
+	}
+
+	c.Header("X-Total-Count", strconv.FormatInt(total, 10))
+	c.JSON(http.StatusOK, gin.H{"items": entries})
+}
+
+// Change history of a user, newest first, paginated with limit and offset.
+// Deleted users keep their history.
+func getUserAudit(c *gin.Context) {
+	ctx := c.Request.Context()
+	_, err := repositoriesFrom(ctx).users.GetByID(ctx, c.Param("id"), nil, true)
+	if err == errUserNotFound {
+		respondError(c, codeUserNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		respondInternal(c, "Failed to fetch user")
+		return
+	}
+	respondAuditEntries(c, auditQuery{UserID: c.Param("id")})
+}
+
+// Changes to any user, newest first, paginated with limit and offset
+//
+// Filters: actor (exact, e.g. "api_key:<id>"), occurred_after and
+// occurred_before (RFC 3339 or YYYY-MM-DD; after is inclusive, before
+// exclusive).
+func getAudit(c *gin.Context) {
+	q := auditQuery{Actor: c.Query("actor")}
+	var err error
+	if q.After, err = parseTimeParam(c, "occurred_after"); err != nil {
+		respondError(c, codeInvalidRequest, err.Error())
+		return
+	}
+	if q.Before, err = parseTimeParam(c, "occurred_before"); err != nil {
+		respondError(c, codeInvalidRequest, err.Error())
+		return
+	}
+	if q.After != nil && q.Before != nil && q.After.After(*q.Before) {
+		respondError(c, codeInvalidRequest, "occurred_after must not be later than occurred_before")
+		return
+	}
+	respondAuditEntries(c, q)
+}
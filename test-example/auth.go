@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Ways a request can authenticate (AUTH_MODES)
+const (
+	authModeAPIKey  = "api_key"
+	authModeJWT     = "jwt"
+	authModeSession = "session"
+)
+
+// Enabled authentication modes
+var authModes = map[string]bool{authModeAPIKey: true}
+
+// Context key holding the request's *principal
+const principalKey = "principal"
+
+// Who a request was made by
+type principal struct {
+	// authModeAPIKey, authModeJWT or authModeSession
+	Mode string
+	// The API key's id, the token's sub claim, or the session's user id
+	Subject string
+	// What the caller may do, sorted
+	Scopes []string
+	// Set for API keys
+	APIKey *apiKey
+	// Set for tokens: every claim
+	Claims map[string]interface{}
+}
+
+// Credentials that were missing or rejected; answered with 401
+type authError struct {
+	message string
+	// The credentials were present but wrong (error="invalid_token")
+	invalid bool
+}
+
+func (e authError) Error() string {
+	return e.message
+}
+
+// Parse a comma-separated AUTH_MODES value
+func parseAuthModes(value string) (map[string]bool, error) {
+	modes := map[string]bool{}
+	for _, mode := range strings.Split(value, ",") {
+		mode = strings.TrimSpace(mode)
+		switch mode {
+		case authModeAPIKey, authModeJWT, authModeSession:
+			modes[mode] = true
+		case "":
+		default:
+			return nil, fmt.Errorf("%q is not one of %s, %s, %s", mode, authModeAPIKey, authModeJWT, authModeSession)
+		}
+	}
+	if len(modes) == 0 {
+		return nil, errors.New("at least one mode is required")
+	}
+	return modes, nil
+}
+
+// Authenticate a request with the enabled modes. X-API-Key carries an API
+// key; a bearer token is a session token when it has the session prefix, is
+// verified as a JWT when it looks like one and JWTs are enabled, and as an
+// API key otherwise.
+func authenticateRequest(c *gin.Context) (*principal, error) {
+	return authenticateHeaders(c.Request.Context(), c.Request.Header)
+}
+
+// Authenticate the credentials in header, for requests that don't go through
+// gin (gRPC metadata arrives as headers too)
+func authenticateHeaders(ctx context.Context, header http.Header) (*principal, error) {
+	if key := header.Get("X-API-Key"); key != "" && authModes[authModeAPIKey] {
+		return apiKeyPrincipal(ctx, key)
+	}
+
+	token, ok := strings.CutPrefix(header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, authError{message: credentialsRequiredMessage()}
+	}
+	if authModes[authModeSession] && strings.HasPrefix(token, sessionTokenPrefix) {
+		return sessionPrincipal(ctx, token)
+	}
+	if authModes[authModeJWT] && strings.Count(token, ".") == 2 {
+		return jwtPrincipal(ctx, token)
+	}
+	if authModes[authModeAPIKey] {
+		return apiKeyPrincipal(ctx, token)
+	}
+	return nil, authError{message: "Invalid bearer token", invalid: true}
+}
+
+func credentialsRequiredMessage() string {
+	switch {
+	case authModes[authModeAPIKey] && len(authModes) > 1:
+		return "API key or bearer token required"
+	case authModes[authModeAPIKey]:
+		return "API key required"
+	default:
+		return "Bearer token required"
+	}
+}
+
+// Middleware answering 401 with a WWW-Authenticate challenge unless one of
+// the enabled modes accepts the request's credentials. Handlers get the
+// caller through currentPrincipal.
+func requireAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p, err := authenticateRequest(c)
+		var authErr authError
+		if errors.As(err, &authErr) {
+			// Rejected credentials count against the client IP, so guessing
+			// keys is limited like requests without any
+			if hasCredentials(c) && !limitByIP(c) {
+				return
+			}
+			challenge := `Bearer realm="api"`
+			if authErr.invalid {
+				challenge += fmt.Sprintf(`, error="invalid_token", error_description=%q`, authErr.message)
+			}
+			c.Header("WWW-Authenticate", challenge)
+			respondError(c, codeUnauthorized, authErr.message)
+			return
+		}
+		if err != nil {
+			loggerFrom(c.Request.Context()).Error("Failed to authenticate request", "error", err)
+			respondInternal(c, "Failed to check credentials")
+			return
+		}
+
+		c.Set(principalKey, p)
+		c.Request = c.Request.WithContext(withPrincipal(c.Request.Context(), p))
+		c.Next()
+	}
+}
+
+// The caller of an authenticated request, nil outside /api
+func currentPrincipal(c *gin.Context) *principal {
+	p, _ := c.Get(principalKey)
+	pr, _ := p.(*principal)
+	return pr
+}
+
+type principalContextKey struct{}
+
+// A context carrying the caller p, whose logger names it
+func withPrincipal(ctx context.Context, p *principal) context.Context {
+	ctx = context.WithValue(ctx, principalContextKey{}, p)
+	return withLogger(ctx, loggerFrom(ctx).With(slog.Group("principal", "mode", p.Mode, "subject", p.Subject)))
+}
+
+// The caller of the request of ctx, for code that only gets the context; nil
+// outside /api
+func principalFrom(ctx context.Context) *principal {
+	p, _ := ctx.Value(principalContextKey{}).(*principal)
+	return p
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scopes required by the route groups
+const (
+	scopeUsersRead  = "users:read"
+	scopeUsersWrite = "users:write"
+	// Deletes, restores and bulk operations
+	scopeUsersAdmin = "users:admin"
+	// Managing API keys
+	scopeKeysAdmin = "keys:admin"
+	// Managing webhooks, which receive every user
+	scopeWebhooksAdmin = "webhooks:admin"
+)
+
+var knownScopes = []string{scopeUsersRead, scopeUsersWrite, scopeUsersAdmin, scopeKeysAdmin, scopeWebhooksAdmin}
+
+// Scopes granted by each role (ROLE_SCOPES). API keys have one role; tokens
+// get the roles in their JWT_ROLES_CLAIM claim on top of their own scope
+// claim. Roles are not limited to the user roles, so identity provider roles
+// can be mapped too.
+var roleScopes = map[string][]string{
+	roleViewer: {scopeUsersRead},
+	roleMember: {scopeUsersRead, scopeUsersWrite},
+	roleAdmin:  {scopeUsersRead, scopeUsersWrite, scopeUsersAdmin, scopeKeysAdmin, scopeWebhooksAdmin},
+}
+
+// Token claim listing the caller's roles, a string or an array (JWT_ROLES_CLAIM)
+var jwtRolesClaim = "roles"
+
+// Parse ROLE_SCOPES: "role=scope,scope;role=scope"
+func parseRoleScopes(value string) (map[string][]string, error) {
+	mapping := map[string][]string{}
+	for _, entry := range strings.Split(value, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		role, list, ok := strings.Cut(entry, "=")
+		role = strings.TrimSpace(role)
+		if !ok || role == "" {
+			return nil, fmt.Errorf("%q is not role=scope,scope", entry)
+		}
+		scopes := []string{}
+		for _, scope := range strings.Split(list, ",") {
+			scope = strings.TrimSpace(scope)
+			if scope == "" {
+				continue
+			}
+			if !slices.Contains(knownScopes, scope) {
+				return nil, fmt.Errorf("role %s: %q is not one of %s", role, scope, strings.Join(knownScopes, ", "))
+			}
+			scopes = append(scopes, scope)
+		}
+		mapping[role] = scopes
+	}
+	if len(mapping) == 0 {
+		return nil, fmt.Errorf("at least one role is required")
+	}
+	return mapping, nil
+}
+
+// The ROLE_SCOPES form of a mapping, roles sorted
+func formatRoleScopes(mapping map[string][]string) string {
+	entries := []string{}
+	for _, role := range sortedKeys(mapping) {
+		entries = append(entries, role+"="+strings.Join(mapping[role], ","))
+	}
+	return strings.Join(entries, ";")
+}
+
+// Whether role is in ROLE_SCOPES
+func isGrantableRole(role string) bool {
+	_, ok := roleScopes[role]
+	return ok
+}
+
+// The scopes of a set of roles plus explicit scopes, sorted and without
+// duplicates; unknown roles and scopes grant nothing
+func grantedScopes(roles, scopes []string) []string {
+	granted := []string{}
+	for _, role := range roles {
+		granted = append(granted, roleScopes[role]...)
+	}
+	for _, scope := range scopes {
+		if slices.Contains(knownScopes, scope) {
+			granted = append(granted, scope)
+		}
+	}
+	sort.Strings(granted)
+	return slices.Compact(granted)
+}
+
+// Strings in a claim: a space-separated string (like the OAuth scope claim)
+// or an array of strings
+func claimStrings(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		values := []string{}
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// Scopes of a token: its scope and scp claims plus those of its roles
+func tokenScopes(claims map[string]interface{}) []string {
+	scopes := append(claimStrings(claims["scope"]), claimStrings(claims["scp"])...)
+	return grantedScopes(claimStrings(claims[jwtRolesClaim]), scopes)
+}
+
+// Whether the caller may give a user role: any role with users:admin,
+// otherwise only roles granting no scope the caller lacks, so nobody can
+// promote themselves or others above their own access
+func canAssignRole(p *principal, role string) bool {
+	if p == nil {
+		return false
+	}
+	if slices.Contains(p.Scopes, scopeUsersAdmin) {
+		return true
+	}
+	for _, scope := range roleScopes[role] {
+		if !slices.Contains(p.Scopes, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// The refusal of a role the caller may not give
+func roleAssignmentRefused(role string) apiError {
+	return apiError{Code: codeForbidden, Message: "Assigning role " + role + " requires scope " + scopeUsersAdmin}
+}
+
+// Answer 403 unless the caller may give a user role
+func checkRoleAssignment(c *gin.Context, role string) bool {
+	if !canAssignRole(currentPrincipal(c), role) {
+		e := roleAssignmentRefused(role)
+		respondError(c, e.Code, e.Message)
+		return false
+	}
+	return true
+}
+
+// Middleware answering 403 unless the caller has scope
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if p := currentPrincipal(c); p == nil || !slices.Contains(p.Scopes, scope) {
+			c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer realm="api", error="insufficient_scope", scope=%q`, scope))
+			respondError(c, codeForbidden, "Missing scope "+scope)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Every authorized route with the roles allowed to call it. Allowed calls
+// may still fail (a missing user, an empty body, 501 off Postgres); only
+// 401 and 403 count as refusals. Streams are only called where refused,
+// since an allowed one runs until the client leaves.
+var authzMatrix = []struct {
+	method, path string
+	roles        []string
+	stream       bool
+}{
+	{"GET", "/users", []string{roleViewer, roleMember, roleAdmin}, false},
+	{"GET", "/users/search?q=a", []string{roleViewer, roleMember, roleAdmin}, false},
+	{"GET", "/users/count", []string{roleViewer, roleMember, roleAdmin}, false},
+	{"GET", "/users/stats", []string{roleViewer, roleMember, roleAdmin}, false},
+	{"GET", "/users/{id}", []string{roleViewer, roleMember, roleAdmin}, false},
+	{"HEAD", "/users/{id}", []string{roleViewer, roleMember, roleAdmin}, false},
+	{"GET", "/users/events", []string{roleViewer, roleMember, roleAdmin}, true},
+	{"GET", "/users/export", []string{roleViewer, roleMember, roleAdmin}, true},
+	{"GET", "/users/by-email/nobody@example.com", []string{roleViewer, roleMember, roleAdmin}, false},
+	{"GET", "/users/{id}/avatar", []string{roleViewer, roleMember, roleAdmin}, false},
+	{"GET", "/users/{id}/audit", []string{roleViewer, roleMember, roleAdmin}, false},
+
+	{"POST", "/users", []string{roleMember, roleAdmin}, false},
+	{"PUT", "/users/{id}", []string{roleMember, roleAdmin}, false},
+	{"PATCH", "/users/{id}", []string{roleMember, roleAdmin}, false},
+	{"PUT", "/users/by-email/nobody@example.com", []string{roleMember, roleAdmin}, false},
+	{"POST", "/users/{id}/suspend", []string{roleMember, roleAdmin}, false},
+	{"POST", "/users/{id}/activate", []string{roleMember, roleAdmin}, false},
+	{"POST", "/users/{id}/deactivate", []string{roleMember, roleAdmin}, false},
+	{"POST", "/users/{id}/avatar", []string{roleMember, roleAdmin}, false},
+	{"DELETE", "/users/{id}/avatar", []string{roleMember, roleAdmin}, false},
+	{"POST", "/users/{id}/password", []string{roleMember, roleAdmin}, false},
+	{"POST", "/users/{id}/verification/resend", []string{roleMember, roleAdmin}, false},
+
+	{"DELETE", "/users/{id}", []string{roleAdmin}, false},
+	{"POST", "/users/{id}/restore", []string{roleAdmin}, false},
+	{"POST", "/users/{id}/unlock", []string{roleAdmin}, false},
+	{"POST", "/users/batch", []string{roleAdmin}, false},
+	{"POST", "/users/import", []string{roleAdmin}, false},
+	{"PATCH", "/users/bulk", []string{roleAdmin}, false},
+	{"DELETE", "/users", []string{roleAdmin}, false},
+	{"POST", "/keys", []string{roleAdmin}, false},
+	{"GET", "/keys", []string{roleAdmin}, false},
+	{"DELETE", "/keys/{id}", []string{roleAdmin}, false},
+	{"GET", "/keys/{id}/usage", []string{roleAdmin}, false},
+	{"GET", "/audit", []string{roleAdmin}, false},
+	{"POST", "/webhooks", []string{roleAdmin}, false},
+	{"GET", "/webhooks", []string{roleAdmin}, false},
+	{"GET", "/webhooks/{id}", []string{roleAdmin}, false},
+	{"PATCH", "/webhooks/{id}", []string{roleAdmin}, false},
+	{"DELETE", "/webhooks/{id}", []string{roleAdmin}, false},
+	{"GET", "/webhooks/{id}/deliveries", []string{roleAdmin}, false},
+}
+
+func TestAuthorizationMatrix(t *testing.T) {
+	b := newMemoryBackend(t)
+	keys := map[string]string{roleAdmin: b.key}
+	for _, role := range []string{roleViewer, roleMember} {
+		keys[role] = testAPIKey(t, b.repos, role)
+	}
+	// An ID that passes validation and matches nothing
+	const id = "00000000-0000-4000-8000-000000000000"
+
+	for _, tt := range authzMatrix {
+		path := apiV1Prefix + strings.ReplaceAll(tt.path, "{id}", id)
+		name := tt.method + " " + tt.path
+
+		if w := request(b.api, tt.method, path, nil); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s without credentials: status %d, want 401", name, w.Code)
+		}
+		for _, role := range []string{roleViewer, roleMember, roleAdmin} {
+			allowed := slices.Contains(tt.roles, role)
+			if allowed && tt.stream {
+				continue
+			}
+			w := request(b.api, tt.method, path, nil, "X-API-Key", keys[role])
+			switch {
+			case allowed && (w.Code == http.StatusUnauthorized || w.Code == http.StatusForbidden):
+				t.Errorf("%s as %s: status %d, want it allowed: %s", name, role, w.Code, w.Body)
+			case !allowed && w.Code != http.StatusForbidden:
+				t.Errorf("%s as %s: status %d, want 403", name, role, w.Code)
+			}
+		}
+	}
+}
+
+// Refused writes change nothing
+func TestForbiddenWritesHaveNoEffect(t *testing.T) {
+	b := newMemoryBackend(t)
+	viewer := testAPIKey(t, b.repos, roleViewer)
+	member := testAPIKey(t, b.repos, roleMember)
+	u := createTestUser(t, b, "Protected")
+
+	for _, tt := range []struct {
+		name, key, method, path string
+		body                    interface{}
+	}{
+		{"viewer create", viewer, "POST", "/api/v1/users", map[string]string{"email": uniqueEmail("viewer"), "name": "Viewer"}},
+		{"viewer update", viewer, "PATCH", "/api/v1/users/" + u.ID, map[string]string{"name": "Changed"}},
+		{"viewer role change", viewer, "PATCH", "/api/v1/users/" + u.ID, map[string]string{"role": roleAdmin}},
+		{"member delete", member, "DELETE", "/api/v1/users/" + u.ID, nil},
+		{"member promotion to admin", member, "PATCH", "/api/v1/users/" + u.ID, map[string]string{"role": roleAdmin}},
+		{"member creating an admin", member, "POST", "/api/v1/users", map[string]string{"email": uniqueEmail("admin"), "name": "Admin", "role": roleAdmin}},
+		{"member bulk role change", member, "PATCH", "/api/v1/users/bulk", map[string]interface{}{"ids": []string{u.ID}, "set": map[string]string{"role": roleAdmin}}},
+	} {
+		if w := request(b.api, tt.method, tt.path, tt.body, "X-API-Key", tt.key); w.Code != http.StatusForbidden {
+			t.Errorf("%s: status %d, want 403", tt.name, w.Code)
+		}
+	}
+
+	w := request(b.api, "GET", "/api/v1/users/"+u.ID, nil, "X-API-Key", b.key)
+	var got User
+	decode(t, w, &got)
+	if w.Code != http.StatusOK || got.Name != "Protected" || got.Role != defaultRole || got.DeletedAt != nil {
+		t.Errorf("user after refused writes: status %d, %+v", w.Code, got)
+	}
+	if w := request(b.api, "GET", "/api/v1/users/count", nil, "X-API-Key", b.key); !strings.Contains(w.Body.String(), `"count":1`) {
+		t.Errorf("count after refused create: %s", w.Body)
+	}
+}
+
+// A user logged in with a member session can't make itself an admin, but
+// may give roles below its own
+func TestMemberCannotPromoteItself(t *testing.T) {
+	previousModes, previousSecret, previousCost := authModes, sessionSecret, bcryptCost
+	authModes = map[string]bool{authModeAPIKey: true, authModeSession: true}
+	sessionSecret = []byte(strings.Repeat("s", 32))
+	bcryptCost = bcrypt.MinCost
+	t.Cleanup(func() { authModes, sessionSecret, bcryptCost = previousModes, previousSecret, previousCost })
+
+	b := newMemoryBackend(t)
+	email := uniqueEmail("member")
+	u := createTestUserFrom(t, b, map[string]interface{}{"email": email, "name": "Member", "password": "correct horse"})
+	w := request(b.api, "POST", "/api/v1/auth/login", map[string]string{"email": email, "password": "correct horse"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("login: status %d: %s", w.Code, w.Body)
+	}
+	var session struct{ Token string }
+	decode(t, w, &session)
+	bearer := "Bearer " + session.Token
+
+	if w := request(b.api, "PATCH", "/api/v1/users/"+u.ID, map[string]string{"role": roleAdmin}, "Authorization", bearer); w.Code != http.StatusForbidden {
+		t.Errorf("self-promotion: status %d, want 403: %s", w.Code, w.Body)
+	}
+	var got User
+	decode(t, request(b.api, "GET", "/api/v1/users/"+u.ID, nil, "X-API-Key", b.key), &got)
+	if got.Role != roleMember {
+		t.Errorf("role after refused self-promotion: %q", got.Role)
+	}
+
+	other := createTestUser(t, b, "Other")
+	if w := request(b.api, "PATCH", "/api/v1/users/"+other.ID, map[string]string{"role": roleViewer}, "Authorization", bearer); w.Code != http.StatusOK {
+		t.Errorf("member giving viewer: status %d, want 200: %s", w.Code, w.Body)
+	}
+}
+
+// New routes behind requireAuth need a row in authzMatrix
+func TestAuthorizationMatrixCoversRoutes(t *testing.T) {
+	// Routes taking no credentials
+	public := map[string]bool{"/auth/login": true, "/auth/password-reset": true, "/auth/password-reset/confirm": true, "/verify": true}
+	covered := map[string]bool{}
+	for _, tt := range authzMatrix {
+		path, _, _ := strings.Cut(tt.path, "?")
+		path = strings.ReplaceAll(path, "{id}", ":id")
+		path = strings.ReplaceAll(path, "nobody@example.com", ":email")
+		covered[tt.method+" "+apiV1Prefix+path] = true
+	}
+	for _, route := range newTestRouter(newMemoryRepositories()).Routes() {
+		path, ok := strings.CutPrefix(route.Path, apiV1Prefix)
+		if !ok || public[path] || route.Method == "OPTIONS" {
+			continue
+		}
+		if !covered[route.Method+" "+route.Path] {
+			t.Errorf("%s %s is not in authzMatrix", route.Method, route.Path)
+		}
+	}
+}
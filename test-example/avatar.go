@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Maximum accepted avatar size
+const maxAvatarSize = 2 << 20
+
+// Body limit for avatar uploads, leaving room for the multipart envelope
+// around the file itself
+const avatarBodyBytes = maxAvatarSize + 64<<10
+
+// Image types accepted as avatars, detected from the file's magic bytes
+var avatarContentTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+}
+
+var errAvatarNotFound = errors.New("avatar not found")
+
+// A stored avatar image
+type avatar struct {
+	ContentType string
+	Data        []byte
+	UpdatedAt   time.Time
+}
+
+// Storage backend for avatar images
+type AvatarStore interface {
+	Put(ctx context.Context, userID string, a avatar) error
+	Get(ctx context.Context, userID string) (avatar, error)
+	Delete(ctx context.Context, userID string) error
+}
+
+// Stores avatars in the user_avatars table as bytea
+type postgresAvatarStore struct {
+	db *sql.DB
+}
+
+func (s *postgresAvatarStore) Put(ctx context.Context, userID string, a avatar) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO user_avatars (user_id, content_type, data, updated_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE
+		SET content_type = EXCLUDED.content_type, data = EXCLUDED.data, updated_at = EXCLUDED.updated_at`,
+		userID, a.ContentType, a.Data, a.UpdatedAt,
+	)
+	return err
+}
+
+func (s *postgresAvatarStore) Get(ctx context.Context, userID string) (avatar, error) {
+	var a avatar
+	err := s.db.QueryRowContext(ctx,
+		"SELECT content_type, data, updated_at FROM user_avatars WHERE user_id = $1",
+		userID,
+	).Scan(&a.ContentType, &a.Data, &a.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return avatar{}, errAvatarNotFound
+	}
+	return a, err
+}
+
+func (s *postgresAvatarStore) Delete(ctx context.Context, userID string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM user_avatars WHERE user_id = $1", userID)
+	return err
+}
+
+// Check that a non-deleted user exists
+func userExists(ctx context.Context, id string) (bool, error) {
+	_, err := repositoriesFrom(ctx).users.GetByID(ctx, id, withField(nil, "id"), false)
+	if err == errUserNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Upload avatar (multipart/form-data, field "avatar")
+func uploadAvatar(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	id := c.Param("id")
+
+	file, _, err := c.Request.FormFile("avatar")
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			respondError(c, codePayloadTooLarge, fmt.Sprintf("Avatar cannot be larger than %d bytes", maxAvatarSize))
+			return
+		}
+		respondInvalid(c, fieldError{Field: "avatar", Rule: "required", Message: "Missing avatar file"})
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxAvatarSize+1))
+	if err != nil {
+		respondError(c, codeInvalidRequest, "Failed to read avatar file")
+		return
+	}
+
+	if len(data) > maxAvatarSize {
+		respondError(c, codePayloadTooLarge, fmt.Sprintf("Avatar cannot be larger than %d bytes", maxAvatarSize))
+		return
+	}
+
+	// Trust the file contents, not the client's Content-Type header
+	contentType := http.DetectContentType(data)
+	if !avatarContentTypes[contentType] {
+		respondInvalid(c, fieldError{Field: "avatar", Rule: "image_type", Message: "Avatar must be a PNG or JPEG image"})
+		return
+	}
+
+	exists, err := userExists(ctx, id)
+	if err != nil {
+		respondInternal(c, "Failed to fetch user")
+		return
+	}
+	if !exists {
+		respondError(c, codeUserNotFound, "User not found")
+		return
+	}
+
+	now := time.Now().UTC()
+	if err := repositoriesFrom(ctx).avatars.Put(ctx, id, avatar{ContentType: contentType, Data: data, UpdatedAt: now}); err != nil {
+		respondInternal(c, "Failed to save avatar")
+		return
+	}
+
+	user, err := repositoriesFrom(ctx).postgres.SetAvatarUpdatedAt(ctx, id, &now)
+	if err != nil {
+		respondInternal(c, "Failed to save avatar")
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+// Serve a user's avatar image
+func getAvatar(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	id := c.Param("id")
+
+	exists, err := userExists(ctx, id)
+	if err != nil {
+		respondInternal(c, "Failed to fetch user")
+		return
+	}
+	if !exists {
+		respondError(c, codeUserNotFound, "User not found")
+		return
+	}
+
+	a, err := repositoriesFrom(ctx).avatars.Get(ctx, id)
+	if errors.Is(err, errAvatarNotFound) {
+		respondError(c, codeAvatarNotFound, "Avatar not found")
+		return
+	}
+	if err != nil {
+		respondInternal(c, "Failed to fetch avatar")
+		return
+	}
+
+	// avatar_url carries a version parameter, so a changed avatar gets a new URL
+	c.Header("Cache-Control", "public, max-age=86400")
+	http.ServeContent(c.Writer, c.Request, "", a.UpdatedAt, bytes.NewReader(a.Data))
+}
+
+// Remove a user's avatar
+func deleteAvatar(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	id := c.Param("id")
+
+	_, err := repositoriesFrom(ctx).postgres.SetAvatarUpdatedAt(ctx, id, nil)
+	if err == errUserNotFound {
+		respondError(c, codeUserNotFound, "User not found")
+		return
+	}
+	if err == errAvatarNotFound {
+		respondError(c, codeAvatarNotFound, "Avatar not found")
+		return
+	}
+	if err != nil {
+		respondInternal(c, "Failed to delete avatar")
+		return
+	}
+
+	if err := repositoriesFrom(ctx).avatars.Delete(ctx, id); err != nil {
+		respondInternal(c, "Failed to delete avatar")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Avatar deleted successfully"})
+}
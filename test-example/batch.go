@@ -0,0 +1,424 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Maximum number of items accepted by the bulk endpoints
+const maxBatchSize = 1000
+
+// Outcome of one item in a batch request
+type batchItemResult struct {
+	Index int    `json:"index"`
+	ID    string `json:"id,omitempty"`
+	Email string `json:"email,omitempty"`
+	Error string `json:"error,omitempty"`
+	// The failure behind Error, for error responses
+	failure fieldError
+}
+
+var errEmailExists = fieldError{Field: "email", Rule: "unique", Message: "Email already exists"}
+
+// Whether an item failed because its email is taken, by a stored user
+// (errEmailExists) or by an earlier item of the same batch. Either way the
+// email ends up with one user, so both count as skipped rather than invalid.
+func emailTaken(fe fieldError) bool {
+	return fe.Field == "email" && fe.Rule == "unique"
+}
+
+// Record why the item failed
+func (r *batchItemResult) fail(err error) {
+	r.Error = err.Error()
+	if !errors.As(err, &r.failure) {
+		r.failure = fieldError{Message: err.Error()}
+	}
+}
+
+// Failures of the given kind as error details, fields prefixed with the item
+// index (e.g. "[3].email"); a nil match selects every failure
+func batchErrorDetails(results []batchItemResult, match func(fieldError) bool) []fieldError {
+	details := []fieldError{}
+	for _, r := range results {
+		if r.Error == "" || (match != nil && !match(r.failure)) {
+			continue
+		}
+		fe := r.failure
+		fe.Field = fmt.Sprintf("[%d].%s", r.Index, fe.Field)
+		details = append(details, fe)
+	}
+	return details
+}
+
+// Summarize batch results for the response body; failed items are either
+// skipped (email taken, see emailTaken) or invalid
+func batchResponse(results []batchItemResult) gin.H {
+	failed, skipped := 0, 0
+	for _, r := range results {
+		if r.Error != "" {
+			failed++
+			if emailTaken(r.failure) {
+				skipped++
+			}
+		}
+	}
+	return gin.H{
+		"created": len(results) - failed,
+		"failed":  failed,
+		"skipped": skipped,
+		"invalid": failed - skipped,
+		"results": results,
+	}
+}
+
+type batchUserInput struct {
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+type bulkDeleteInput struct {
+	IDs []string `json:"ids"`
+}
+
+type bulkUpdateInput struct {
+	IDs []string  `json:"ids"`
+	Set userPatch `json:"set"`
+}
+
+// Create many users in one transaction
+//
+// Every item is validated up front. By default any invalid item or email
+// conflict rejects the whole batch; with ?partial=true valid items are
+// inserted and failures are reported per item. An email repeated within the
+// payload is found before the database is involved, so without partial it
+// fails validation (422) while a stored one conflicts (409); with partial
+// both are skipped.
+func createUsersBatch(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var input []batchUserInput
+
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	if len(input) == 0 {
+		respondError(c, codeInvalidRequest, "Batch must contain at least one user")
+		return
+	}
+
+	if len(input) > maxBatchSize {
+		respondError(c, codePayloadTooLarge, fmt.Sprintf("Batch cannot contain more than %d users", maxBatchSize))
+		return
+	}
+
+	partial, err := parseBoolParam(c, "partial", false)
+	if err != nil {
+		respondError(c, codeInvalidRequest, err.Error())
+		return
+	}
+
+	// Validate every item, including duplicates within the payload
+	results := make([]batchItemResult, len(input))
+	firstIndex := map[string]int{}
+	invalid := false
+	for i := range input {
+		input[i].Email = normalizeEmail(input[i].Email)
+		name, nameErr := normalizeName(input[i].Name)
+		if nameErr == nil {
+			input[i].Name = name
+		}
+		item := input[i]
+		results[i] = batchItemResult{Index: i, Email: item.Email}
+		switch {
+		case item.Email == "":
+			results[i].fail(fieldError{Field: "email", Rule: "required", Message: "Email is required"})
+		case nameErr != nil:
+			results[i].fail(nameErr)
+		case !isValidEmail(item.Email):
+			results[i].fail(errInvalidEmail)
+		default:
+			if j, dup := firstIndex[item.Email]; dup {
+				results[i].fail(fieldError{Field: "email", Rule: "unique", Message: fmt.Sprintf("Duplicate of item %d", j)})
+			} else {
+				firstIndex[item.Email] = i
+			}
+		}
+		if results[i].Error != "" {
+			invalid = true
+		}
+	}
+
+	if invalid && !partial {
+		details := batchErrorDetails(results, nil)
+		respondError(c, codeValidationFailed, fmt.Sprintf("%d of %d users are invalid", len(details), len(results)), details...)
+		return
+	}
+
+	users := []User{}
+	for i, item := range input {
+		if results[i].Error == "" {
+			users = append(users, User{Email: item.Email, Name: item.Name, Role: defaultRole, Metadata: Metadata{}})
+		}
+	}
+
+	// Valid items missing from inserted have an email that is taken, by an
+	// existing user (or a deleted one, unless reuse is allowed) or concurrently
+	inserted := map[string]string{}
+	if len(users) > 0 {
+		inserted, err = repositoriesFrom(ctx).postgres.CreateMany(ctx, users, !partial)
+		if err != nil && err != errRollback {
+			respondInternal(c, "Failed to create users")
+			return
+		}
+	}
+
+	conflict := false
+	for i := range results {
+		if results[i].Error != "" {
+			continue
+		}
+		id, ok := inserted[results[i].Email]
+		if !ok {
+			results[i].fail(errEmailExists)
+			conflict = true
+			continue
+		}
+		results[i].ID = id
+	}
+
+	if conflict && !partial {
+		respondError(c, codeEmailConflict, "Email already exists",
+			batchErrorDetails(results, emailTaken)...)
+		return
+	}
+
+	status := http.StatusCreated
+	if invalid || conflict {
+		status = http.StatusMultiStatus
+	}
+	c.JSON(status, batchResponse(results))
+}
+
+// Soft delete many users by ID in one statement
+func deleteUsersBatch(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var input bulkDeleteInput
+
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	if len(input.IDs) == 0 {
+		respondError(c, codeInvalidRequest, "ids must contain at least one id")
+		return
+	}
+
+	if len(input.IDs) > maxBatchSize {
+		respondError(c, codePayloadTooLarge, fmt.Sprintf("Cannot delete more than %d users at once", maxBatchSize))
+		return
+	}
+
+	for _, id := range input.IDs {
+		if !uuidRegex.MatchString(id) {
+			respondError(c, codeInvalidRequest, fmt.Sprintf("Invalid user id %q", id))
+			return
+		}
+	}
+
+	deleted, err := repositoriesFrom(ctx).postgres.DeleteMany(ctx, input.IDs)
+	if err != nil {
+		respondInternal(c, "Failed to delete users")
+		return
+	}
+
+	// Postgres returns ids in canonical lowercase form
+	notFound := []string{}
+	seen := map[string]bool{}
+	for _, id := range input.IDs {
+		key := strings.ToLower(id)
+		if !deleted[key] && !seen[key] {
+			notFound = append(notFound, id)
+		}
+		seen[key] = true
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"deleted":   len(deleted),
+		"not_found": notFound,
+	})
+}
+
+// Apply the same change to many users in one UPDATE
+//
+// With ?dry_run=true the update runs inside a transaction that is rolled
+// back, so the response reports exactly what would change.
+func updateUsersBatch(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var input bulkUpdateInput
+
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	if len(input.IDs) == 0 {
+		respondError(c, codeInvalidRequest, "ids must contain at least one id")
+		return
+	}
+
+	if len(input.IDs) > maxBatchSize {
+		respondError(c, codePayloadTooLarge, fmt.Sprintf("Cannot update more than %d users at once", maxBatchSize))
+		return
+	}
+
+	ids := []string{}
+	seen := map[string]bool{}
+	for _, id := range input.IDs {
+		if !uuidRegex.MatchString(id) {
+			respondError(c, codeInvalidRequest, fmt.Sprintf("Invalid user id %q", id))
+			return
+		}
+		if key := strings.ToLower(id); !seen[key] {
+			seen[key] = true
+			ids = append(ids, key)
+		}
+	}
+
+	if err := input.Set.validate(); err != nil {
+		var fe fieldError
+		if errors.As(err, &fe) {
+			fe.Field = "set." + fe.Field
+			err = fe
+		}
+		respondInvalid(c, err)
+		return
+	}
+
+	if input.Set.Role.Set && !checkRoleAssignment(c, input.Set.Role.Value) {
+		return
+	}
+
+	dryRun, err := parseBoolParam(c, "dry_run", false)
+	if err != nil {
+		respondError(c, codeInvalidRequest, err.Error())
+		return
+	}
+
+	// An email can belong to a single user, so it can only be bulk-set on one
+	if input.Set.Email.Set && len(ids) > 1 {
+		respondError(c, codeEmailConflict, "Email must be unique and cannot be set on more than one user",
+			fieldError{Field: "set.email", Rule: "unique", Message: input.Set.Email.Value + " would be shared by several users"})
+		return
+	}
+
+	if input.Set.empty() {
+		respondError(c, codeValidationFailed, "No fields to update")
+		return
+	}
+
+	updated, err := repositoriesFrom(ctx).postgres.UpdateMany(ctx, ids, input.Set, dryRun)
+	if err == errMetadataTooLarge {
+		respondInvalid(c, errMetadataTooLarge)
+		return
+	}
+	if err == errEmailTaken {
+		respondError(c, codeEmailConflict, "Email already exists",
+			fieldError{Field: "set.email", Rule: "unique", Message: input.Set.Email.Value + " is already taken"})
+		return
+	}
+	if err != nil {
+		respondInternal(c, "Failed to update users")
+		return
+	}
+
+	notFound := []string{}
+	for _, id := range ids {
+		if !updated[id] {
+			notFound = append(notFound, id)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"updated":   len(updated),
+		"not_found": notFound,
+		"dry_run":   dryRun,
+	})
+}
+
+// Maximum number of ids accepted by GET /api/users?ids=
+const maxLookupIDs = 200
+
+// Fetch the users named in ?ids=a,b,c with one query
+//
+// Users are returned in the order their ids were requested (duplicates
+// collapsed); ids that don't match a non-deleted user are listed in not_found,
+// which XML and CSV responses leave out.
+func getUsersByIDs(c *gin.Context, param, format string) {
+	ctx := c.Request.Context()
+
+	fields, err := parseFields(c.Query("fields"))
+	if err != nil {
+		respondError(c, codeInvalidRequest, err.Error())
+		return
+	}
+
+	ids := []string{}
+	seen := map[string]bool{}
+	for _, id := range strings.Split(param, ",") {
+		id = strings.ToLower(strings.TrimSpace(id))
+		if !uuidRegex.MatchString(id) {
+			respondError(c, codeInvalidRequest, fmt.Sprintf("Invalid user id %q", id))
+			return
+		}
+		if !seen[id] {
+			ids = append(ids, id)
+			seen[id] = true
+		}
+	}
+
+	if len(ids) > maxLookupIDs {
+		respondError(c, codeInvalidRequest, fmt.Sprintf("Cannot look up more than %d users at once", maxLookupIDs))
+		return
+	}
+
+	// id is needed to restore request order
+	selected := userFields
+	if fields != nil {
+		selected = withField(fields, "id")
+	}
+
+	matched, err := repositoriesFrom(ctx).reader.List(ctx, userListQuery{Filter: userFilter{IDs: ids}, Fields: selected, Limit: len(ids)})
+	if err != nil {
+		respondInternal(c, "Failed to fetch users")
+		return
+	}
+	found := map[string]User{}
+	for _, user := range matched {
+		found[user.ID] = user
+	}
+
+	users := []User{}
+	notFound := []string{}
+	for _, id := range ids {
+		if user, ok := found[id]; ok {
+			users = append(users, user)
+		} else {
+			notFound = append(notFound, id)
+		}
+	}
+
+	if format != mediaJSON {
+		writeUsers(c, format, users, fields, nil)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"items":     renderUsers(users, fields),
+		"not_found": notFound,
+	})
+}
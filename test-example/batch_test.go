@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// The batch route needs Postgres; the classification of its failures
+// doesn't
+func TestBatchResponseClassifiesFailures(t *testing.T) {
+	results := make([]batchItemResult, 6)
+	for i := range results {
+		results[i] = batchItemResult{Index: i, Email: fmt.Sprintf("user%d@example.com", i)}
+	}
+	results[0].ID = "created"
+	results[1].fail(errEmailExists)
+	results[2].fail(fieldError{Field: "email", Rule: "unique", Message: "Duplicate of item 0"})
+	results[3].fail(errInvalidEmail)
+	results[4].fail(fieldError{Field: "email", Rule: "required", Message: "Email is required"})
+	results[5].fail(fieldError{Field: "name", Rule: "max", Message: "Name is too long"})
+
+	got := batchResponse(results)
+	want := map[string]int{"created": 1, "failed": 5, "skipped": 2, "invalid": 3}
+	for key, n := range want {
+		if got[key] != n {
+			t.Errorf("%s %v, want %d", key, got[key], n)
+		}
+	}
+}
+
+func TestEmailTaken(t *testing.T) {
+	for _, tt := range []struct {
+		fe   fieldError
+		want bool
+	}{
+		{errEmailExists, true},
+		{fieldError{Field: "email", Rule: "unique", Message: "Duplicate of item 3"}, true},
+		{errInvalidEmail, false},
+		{fieldError{Field: "name", Rule: "unique"}, false},
+		{fieldError{Message: "something else"}, false},
+	} {
+		if got := emailTaken(tt.fe); got != tt.want {
+			t.Errorf("emailTaken(%+v) = %v, want %v", tt.fe, got, tt.want)
+		}
+	}
+}
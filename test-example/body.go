@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// Default request body limit in bytes for every route (MAX_BODY_BYTES)
+var maxBodyBytes int64 = 1 << 20
+
+// Body limit for bulk endpoints, which accept up to maxBatchSize items
+const bulkBodyBytes = 10 << 20
+
+// Context key holding the request body as received, before any limit
+const originalBodyKey = "originalBody"
+
+// Middleware capping the request body at limit bytes
+//
+// It is installed for all routes with the default limit and can be added to
+// individual routes again with a larger one: the limit is always applied to
+// the original body, so the route-level limit replaces the global one instead
+// of nesting inside it.
+func limitBody(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body := c.Request.Body
+		if original, ok := c.Get(originalBodyKey); ok {
+			body = original.(io.ReadCloser)
+		} else {
+			c.Set(originalBodyKey, body)
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, body, limit)
+		c.Next()
+	}
+}
+
+// Content types accepted by write routes that don't take JSON, keyed by
+// method and route
+var routeContentTypes = map[string][]string{
+	"POST /api/v1/users/:id/avatar": {"multipart/form-data"},
+	"POST /api/v1/users/import":     {mediaCSV},
+}
+
+// Middleware rejecting POST, PUT and PATCH requests with a body whose
+// Content-Type isn't application/json (parameters such as charset are
+// allowed), or the types listed for the route in routeContentTypes
+func requireContentType() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+		default:
+			c.Next()
+			return
+		}
+		// Bodiless actions such as /restore don't need a Content-Type
+		if c.Request.ContentLength == 0 {
+			c.Next()
+			return
+		}
+
+		accepted, ok := routeContentTypes[c.Request.Method+" "+canonicalRoute(c.FullPath())]
+		if !ok {
+			accepted = []string{"application/json"}
+		}
+
+		mediaType, _, err := mime.ParseMediaType(c.GetHeader("Content-Type"))
+		if err == nil {
+			for _, t := range accepted {
+				if mediaType == t {
+					c.Next()
+					return
+				}
+			}
+		}
+
+		list := strings.Join(accepted, ", ")
+		respondError(c, codeUnsupportedMedia, "Content-Type must be "+list,
+			fieldError{Field: "Content-Type", Rule: "media_type", Message: "accepted types: " + list})
+	}
+}
+
+// Check whether err came from reading a body past its limit
+func isBodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// Respond 413 for a body that exceeded its limit
+func bodyTooLarge(c *gin.Context, err error) {
+	var maxErr *http.MaxBytesError
+	errors.As(err, &maxErr)
+	respondError(c, codePayloadTooLarge, fmt.Sprintf("Request body cannot be larger than %d bytes", maxErr.Limit))
+}
+
+// Bind a JSON request body into obj, writing the error response and
+// returning false when it can't be bound
+//
+// Decoding errors become 400 invalid_request with a message that doesn't leak
+// Go internals; binding tag failures become validation_failed with one
+// details entry per field, named by its JSON key.
+func bindJSON(c *gin.Context, obj interface{}) bool {
+	err := c.ShouldBindJSON(obj)
+	if err == nil {
+		return true
+	}
+	if isBodyTooLarge(err) {
+		bodyTooLarge(c, err)
+		return false
+	}
+
+	var validationErrs validator.ValidationErrors
+	var fe fieldError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &validationErrs):
+		details := make([]fieldError, len(validationErrs))
+		for i, ve := range validationErrs {
+			details[i] = bindingFieldError(ve)
+		}
+		respondError(c, codeValidationFailed, details[0].Message, details...)
+	case errors.As(err, &fe):
+		// Raised while decoding (e.g. metadata that isn't an object), so this
+		// is a malformed body rather than a rule violation
+		respondError(c, codeInvalidRequest, fe.Message, fe)
+	case errors.As(err, &syntaxErr):
+		respondError(c, codeInvalidRequest, fmt.Sprintf("body is not valid JSON at offset %d", syntaxErr.Offset))
+	case errors.As(err, &typeErr):
+		msg := fmt.Sprintf("body has a %s where a %s is expected", typeErr.Value, typeErr.Type)
+		if typeErr.Field != "" {
+			msg = fmt.Sprintf("%s must be a %s, not a %s", typeErr.Field, typeErr.Type, typeErr.Value)
+		}
+		respondError(c, codeInvalidRequest, msg)
+	case errors.Is(err, io.EOF):
+		respondError(c, codeInvalidRequest, "body is empty; expected JSON")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		respondError(c, codeInvalidRequest, "body is not valid JSON: unexpected end of input")
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no error type for DisallowUnknownFields
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		respondError(c, codeInvalidRequest, fmt.Sprintf("unknown field %q", field),
+			fieldError{Field: field, Rule: "unknown", Message: fmt.Sprintf("unknown field %q", field)})
+	default:
+		respondError(c, codeInvalidRequest, "body is not valid JSON")
+	}
+	return false
+}
+
+// Translate a failed binding tag into a fieldError
+func bindingFieldError(ve validator.FieldError) fieldError {
+	fe := fieldError{Field: ve.Field(), Rule: ve.Tag()}
+	switch ve.Tag() {
+	case "required":
+		fe.Message = ve.Field() + " is required"
+	case "oneof":
+		fe.Message = fmt.Sprintf("%s must be one of: %s", ve.Field(), strings.ReplaceAll(ve.Param(), " ", ", "))
+	default:
+		fe.Message = fmt.Sprintf("%s failed the %s rule", ve.Field(), ve.Tag())
+	}
+	return fe
+}
+
+// Make validation errors name fields by their JSON key instead of the Go
+// struct field
+func useJSONFieldNames() {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return
+	}
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+		if name == "" || name == "-" {
+			return f.Name
+		}
+		return name
+	})
+}
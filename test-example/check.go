@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// How long -check waits for the database
+const checkTimeout = 5 * time.Second
+
+// Outcome of one -check step
+type checkResult struct {
+	Name    string   `json:"name"`
+	OK      bool     `json:"ok"`
+	Message string   `json:"message"`
+	Pending []string `json:"pending,omitempty"`
+}
+
+// Verify the configuration, database connectivity and the schema version
+// without starting the server, print the results (as JSON with asJSON) and
+// return the exit code: 0 when every step passed. Pending migrations are
+// reported but don't fail the check, since deploys usually apply them next.
+func runCheck(configFile string, flagValues map[string]string, asJSON bool) int {
+	results := checkSteps(configFile, flagValues)
+
+	ok := true
+	for _, r := range results {
+		ok = ok && r.OK
+	}
+
+	if asJSON {
+		out, _ := json.MarshalIndent(struct {
+			OK     bool          `json:"ok"`
+			Checks []checkResult `json:"checks"`
+		}{ok, results}, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		for _, r := range results {
+			status := "ok"
+			if !r.OK {
+				status = "FAILED"
+			}
+			fmt.Printf("%-10s %-6s %s\n", r.Name, status, r.Message)
+		}
+	}
+
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
+// Run the steps in order, stopping at the first failure since the later ones
+// depend on it
+func checkSteps(configFile string, flagValues map[string]string) []checkResult {
+	cfg, err := loadConfig(configFile, flagValues)
+	if err != nil {
+		// One line per problem, for both output formats
+		return []checkResult{{Name: "config", Message: strings.ReplaceAll(err.Error(), "\n", "; ")}}
+	}
+	cfg.apply()
+	results := []checkResult{{Name: "config", OK: true, Message: fmt.Sprintf("driver %s, listening on %s", cfg.DBDriver, cfg.listenAddr())}}
+
+	if cfg.TLSCertFile != "" {
+		if _, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile, slog.Default()); err != nil {
+			return append(results, checkResult{Name: "tls", Message: err.Error()})
+		}
+		results = append(results, checkResult{Name: "tls", OK: true, Message: "certificate loaded"})
+	}
+
+	pool, pgx, err := openPool(cfg, slog.Default())
+	if err != nil {
+		return append(results, checkResult{Name: "database", Message: err.Error()})
+	}
+	defer pool.Close()
+	if pgx != nil {
+		defer pgx.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	start := time.Now()
+	if err := pool.PingContext(ctx); err != nil {
+		return append(results, checkResult{Name: "database", Message: err.Error()})
+	}
+	results = append(results, checkResult{Name: "database", OK: true, Message: fmt.Sprintf("connected in %.1fms", float64(time.Since(start).Microseconds())/1000)})
+
+	pending, err := pendingMigrations(ctx, pool)
+	if err != nil {
+		return append(results, checkResult{Name: "migrations", Message: err.Error()})
+	}
+	message := "up to date"
+	if len(pending) > 0 {
+		message = fmt.Sprintf("%d pending: %s", len(pending), strings.Join(pending, ", "))
+	}
+	return append(results, checkResult{Name: "migrations", OK: true, Message: message, Pending: pending})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// CloudEvents: with EVENT_FORMAT=cloudevents, webhook bodies and bus
+// messages are CloudEvents 1.0 in the structured JSON format. The event's
+// outbox id is its id, so the webhooks and the bus agree on it and a
+// repeated delivery keeps it.
+
+// Body format of webhook deliveries and published messages (EVENT_FORMAT)
+const (
+	eventFormatPlain       = "plain"
+	eventFormatCloudEvents = "cloudevents"
+)
+
+var eventFormat = eventFormatPlain
+
+// The CloudEvents source attribute (EVENT_SOURCE), a URI reference naming
+// this service
+var eventSource = "/sample-api"
+
+// Prefix of the CloudEvents type; user.created becomes
+// com.gibrun.user.created
+const cloudEventTypePrefix = "com.gibrun."
+
+// Content-Type of a CloudEvent in structured mode
+const cloudEventsContentType = "application/cloudevents+json; charset=UTF-8"
+
+// A user event as a CloudEvent
+type cloudEvent struct {
+	SpecVersion string `json:"specversion"`
+	ID          string `json:"id"`
+	Source      string `json:"source"`
+	Type        string `json:"type"`
+	// The user's id
+	Subject         string         `json:"subject"`
+	Time            time.Time      `json:"time"`
+	DataContentType string         `json:"datacontenttype"`
+	Data            cloudEventData `json:"data"`
+}
+
+type cloudEventData struct {
+	// The user after the change; before it for user.deleted
+	User User `json:"user"`
+	// Of the request that made the change
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func newCloudEvent(id int64, event string, user User, occurredAt time.Time, requestID string) cloudEvent {
+	return cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              strconv.FormatInt(id, 10),
+		Source:          eventSource,
+		Type:            cloudEventTypePrefix + event,
+		Subject:         user.ID,
+		Time:            occurredAt,
+		DataContentType: "application/json",
+		Data:            cloudEventData{User: user, RequestID: requestID},
+	}
+}
+
+// The body of a message published to the bus
+func (m eventMessage) encode() ([]byte, error) {
+	if eventFormat == eventFormatCloudEvents {
+		return json.Marshal(newCloudEvent(m.ID, m.Event, m.User, m.OccurredAt, m.RequestID))
+	}
+	return json.Marshal(m)
+}
+
+// Content-Type of encoded messages
+func (m eventMessage) contentType() string {
+	if eventFormat == eventFormatCloudEvents {
+		return cloudEventsContentType
+	}
+	return "application/json"
+}
+
+// The body of the webhook deliveries of an outbox event; the outbox payload
+// itself in the plain format
+func webhookPayload(id int64, payload string) (string, error) {
+	if eventFormat != eventFormatCloudEvents {
+		return payload, nil
+	}
+	var e userEvent
+	if err := json.Unmarshal([]byte(payload), &e); err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(newCloudEvent(id, e.Event, e.User, e.Timestamp, e.RequestID))
+	return string(body), err
+}
+
+// Content-Type and request ID of a webhook body. Deliveries keep the body
+// they were recorded with, so both are read from it rather than from the
+// setting.
+func webhookBodyInfo(payload []byte) (contentType, requestID string) {
+	var body struct {
+		SpecVersion string `json:"specversion"`
+		RequestID   string `json:"request_id"`
+		Data        struct {
+			RequestID string `json:"request_id"`
+		} `json:"data"`
+	}
+	json.Unmarshal(payload, &body)
+	if body.SpecVersion != "" {
+		return cloudEventsContentType, body.Data.RequestID
+	}
+	return "application/json", body.RequestID
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// CloudEvents 1.0 attribute names: lowercase letters and digits, at most 20
+var cloudEventAttributeRegex = regexp.MustCompile(`^[a-z0-9]{1,20}$`)
+
+// Check body against the CloudEvents 1.0 structured JSON format, returning
+// its attributes
+func checkCloudEvent(t *testing.T, body []byte) map[string]interface{} {
+	t.Helper()
+	var event map[string]interface{}
+	if err := json.Unmarshal(body, &event); err != nil {
+		t.Fatalf("event is not a JSON object: %v\n%s", err, body)
+	}
+	for name := range event {
+		if !cloudEventAttributeRegex.MatchString(name) {
+			t.Errorf("attribute name %q is not lowercase alphanumeric", name)
+		}
+	}
+	for _, name := range []string{"specversion", "id", "source", "type"} {
+		if s, ok := event[name].(string); !ok || s == "" {
+			t.Errorf("required attribute %s is %v, want a non-empty string", name, event[name])
+		}
+	}
+	if event["specversion"] != "1.0" {
+		t.Errorf("specversion %v", event["specversion"])
+	}
+	if source, _ := event["source"].(string); source != "" {
+		if _, err := url.Parse(source); err != nil {
+			t.Errorf("source %q is not a URI reference: %v", source, err)
+		}
+	}
+	if at, ok := event["time"].(string); ok {
+		if _, err := time.Parse(time.RFC3339, at); err != nil {
+			t.Errorf("time %q is not RFC 3339: %v", at, err)
+		}
+	}
+	if event["datacontenttype"] != "application/json" {
+		t.Errorf("datacontenttype %v", event["datacontenttype"])
+	}
+	if _, ok := event["data"].(map[string]interface{}); !ok {
+		t.Errorf("data %v is not a JSON object", event["data"])
+	}
+	return event
+}
+
+// Use format and source for events until the test ends
+func setEventFormat(t *testing.T, format, source string) {
+	previousFormat, previousSource := eventFormat, eventSource
+	eventFormat, eventSource = format, source
+	t.Cleanup(func() { eventFormat, eventSource = previousFormat, previousSource })
+}
+
+func TestCloudEventEnvelope(t *testing.T) {
+	setEventFormat(t, eventFormatCloudEvents, "/test-api")
+	user := User{ID: "7f9c24e5-2b9a-4a8e-9d7c-1f0e5c3a2b1d", Email: "ada@example.com", Name: "Ada"}
+	at := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+
+	message := eventMessage{ID: 42, Event: "user.created", User: user, OccurredAt: at, RequestID: "req-1"}
+	published, err := message.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.contentType() != cloudEventsContentType {
+		t.Errorf("message Content-Type %q", message.contentType())
+	}
+
+	payload, _ := json.Marshal(userEvent{Event: "user.created", User: user, Timestamp: at, RequestID: "req-1"})
+	delivered, err := webhookPayload(42, string(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, body := range map[string][]byte{"bus message": published, "webhook body": []byte(delivered)} {
+		t.Run(name, func(t *testing.T) {
+			event := checkCloudEvent(t, body)
+			want := map[string]interface{}{
+				"id":      "42",
+				"source":  "/test-api",
+				"type":    "com.gibrun.user.created",
+				"subject": user.ID,
+				"time":    "2024-05-06T07:08:09Z",
+			}
+			for attr, value := range want {
+				if event[attr] != value {
+					t.Errorf("%s %v, want %v", attr, event[attr], value)
+				}
+			}
+			contentType, requestID := webhookBodyInfo(body)
+			if contentType != cloudEventsContentType || requestID != "req-1" {
+				t.Errorf("webhookBodyInfo: %q, %q", contentType, requestID)
+			}
+		})
+	}
+}
+
+// The plain format keeps the outbox payload as it is
+func TestPlainEventFormat(t *testing.T) {
+	setEventFormat(t, eventFormatPlain, eventSource)
+	payload := `{"event":"user.deleted","user":{},"timestamp":"2024-05-06T07:08:09Z","request_id":"req-2"}`
+	delivered, err := webhookPayload(7, payload)
+	if err != nil || delivered != payload {
+		t.Errorf("webhookPayload: %q, %v", delivered, err)
+	}
+	if contentType, requestID := webhookBodyInfo([]byte(payload)); contentType != "application/json" || requestID != "req-2" {
+		t.Errorf("webhookBodyInfo: %q, %q", contentType, requestID)
+	}
+}
@@ -0,0 +1,900 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// Settings loaded once at startup. Each field has a key in the config file
+// (yaml tag, also the flag name with dashes) and an environment variable (env
+// tag). Defaults are the initial values of the package variables they end up
+// in (see apply).
+type Config struct {
+	// Only "development" allows running without a database URL
+	Env string `yaml:"env" env:"ENV"`
+	// debug, info, warn or error; POST /admin/log-level changes it at runtime
+	LogLevel string `yaml:"log_level" env:"LOG_LEVEL"`
+	// json or text; json unless ENV=development
+	LogFormat string `yaml:"log_format" env:"LOG_FORMAT"`
+	Port      string `yaml:"port" env:"PORT"`
+	// host:port or unix:///path/to.sock; empty listens on every interface on
+	// Port
+	ListenAddr string `yaml:"listen_addr" env:"LISTEN_ADDR"`
+	// Octal permissions of a Unix socket
+	SocketMode string `yaml:"socket_mode" env:"SOCKET_MODE"`
+	// Serve HTTPS with this certificate; both files or neither
+	TLSCertFile string `yaml:"tls_cert_file" env:"TLS_CERT_FILE"`
+	TLSKeyFile  string `yaml:"tls_key_file" env:"TLS_KEY_FILE"`
+	// Port redirecting plain HTTP to HTTPS; empty for none
+	HTTPRedirectPort string `yaml:"http_redirect_port" env:"HTTP_REDIRECT_PORT"`
+
+	DBDriver string `yaml:"db_driver" env:"DB_DRIVER"`
+	// Checked and normalized for DBDriver
+	DatabaseURL string `yaml:"database_url" env:"DATABASE_URL"`
+	// Empty reads from the primary
+	DatabaseReadURL     string        `yaml:"database_read_url" env:"DATABASE_READ_URL"`
+	DBMaxOpenConns      int           `yaml:"db_max_open_conns" env:"DB_MAX_OPEN_CONNS"`
+	DBMaxIdleConns      int           `yaml:"db_max_idle_conns" env:"DB_MAX_IDLE_CONNS"`
+	DBConnMaxLifetime   time.Duration `yaml:"db_conn_max_lifetime" env:"DB_CONN_MAX_LIFETIME"`
+	DBConnMaxIdleTime   time.Duration `yaml:"db_conn_max_idle_time" env:"DB_CONN_MAX_IDLE_TIME"`
+	DBConnectTimeout    time.Duration `yaml:"db_connect_timeout" env:"DB_CONNECT_TIMEOUT"`
+	DBPrepareStatements bool          `yaml:"db_prepare_statements" env:"DB_PREPARE_STATEMENTS"`
+	AutoMigrate         bool          `yaml:"auto_migrate" env:"AUTO_MIGRATE"`
+	LogQueries          bool          `yaml:"log_queries" env:"LOG_QUERIES"`
+	SlowQueryThreshold  time.Duration `yaml:"slow_query_threshold" env:"SLOW_QUERY_THRESHOLD"`
+
+	SearchMaxResults       int           `yaml:"search_max_results" env:"SEARCH_MAX_RESULTS"`
+	AllowDeletedEmailReuse bool          `yaml:"allow_deleted_email_reuse" env:"ALLOW_DELETED_EMAIL_REUSE"`
+	RequireIfMatch         bool          `yaml:"require_if_match" env:"REQUIRE_IF_MATCH"`
+	AllowIDNEmail          bool          `yaml:"allow_idn_email" env:"ALLOW_IDN_EMAIL"`
+	IdempotencyTTL         time.Duration `yaml:"idempotency_ttl" env:"IDEMPOTENCY_TTL"`
+	StrictJSON             bool          `yaml:"strict_json" env:"STRICT_JSON"`
+	MaxBodyBytes           int64         `yaml:"max_body_bytes" env:"MAX_BODY_BYTES"`
+	RequestTimeout         time.Duration `yaml:"request_timeout" env:"REQUEST_TIMEOUT"`
+
+	// Requests per second per client IP and API key without a limit of its
+	// own; 0 turns these limits off
+	RateLimit      float64 `yaml:"rate_limit" env:"RATE_LIMIT"`
+	RateLimitBurst int     `yaml:"rate_limit_burst" env:"RATE_LIMIT_BURST"`
+	// Comma-separated IPs and CIDRs whose X-Forwarded-For is believed
+	TrustedProxies string `yaml:"trusted_proxies" env:"TRUSTED_PROXIES"`
+
+	// Comma-separated; empty origins turns CORS off
+	CORSAllowedOrigins   string        `yaml:"cors_allowed_origins" env:"CORS_ALLOWED_ORIGINS"`
+	CORSAllowedMethods   string        `yaml:"cors_allowed_methods" env:"CORS_ALLOWED_METHODS"`
+	CORSAllowedHeaders   string        `yaml:"cors_allowed_headers" env:"CORS_ALLOWED_HEADERS"`
+	CORSExposedHeaders   string        `yaml:"cors_exposed_headers" env:"CORS_EXPOSED_HEADERS"`
+	CORSAllowCredentials bool          `yaml:"cors_allow_credentials" env:"CORS_ALLOW_CREDENTIALS"`
+	CORSMaxAge           time.Duration `yaml:"cors_max_age" env:"CORS_MAX_AGE"`
+
+	// Response header values; "off" leaves the header out
+	SecurityContentTypeOptions      string `yaml:"security_content_type_options" env:"SECURITY_CONTENT_TYPE_OPTIONS"`
+	SecurityFrameOptions            string `yaml:"security_frame_options" env:"SECURITY_FRAME_OPTIONS"`
+	SecurityReferrerPolicy          string `yaml:"security_referrer_policy" env:"SECURITY_REFERRER_POLICY"`
+	SecurityContentSecurityPolicy   string `yaml:"security_content_security_policy" env:"SECURITY_CONTENT_SECURITY_POLICY"`
+	SecurityStrictTransportSecurity string `yaml:"security_strict_transport_security" env:"SECURITY_STRICT_TRANSPORT_SECURITY"`
+	// Serves the API explorer at /docs/
+	DocsEnabled bool `yaml:"docs_enabled" env:"DOCS_ENABLED"`
+	// Limits on /graphql documents, checked before they run
+	GraphQLMaxDepth      int `yaml:"graphql_max_depth" env:"GRAPHQL_MAX_DEPTH"`
+	GraphQLMaxComplexity int `yaml:"graphql_max_complexity" env:"GRAPHQL_MAX_COMPLEXITY"`
+	// Serves the GraphQL playground at /graphql/playground/; meant for
+	// development
+	GraphQLPlayground bool `yaml:"graphql_playground" env:"GRAPHQL_PLAYGROUND"`
+	// Gzips responses of at least GzipMinBytes for clients that accept it
+	GzipEnabled  bool `yaml:"gzip_enabled" env:"GZIP_ENABLED"`
+	GzipMinBytes int  `yaml:"gzip_min_bytes" env:"GZIP_MIN_BYTES"`
+	// envelope ({"error": {...}}) or problem (RFC 7807 problem+json)
+	ErrorFormat string `yaml:"error_format" env:"ERROR_FORMAT"`
+	// Prefix of the problem type URIs; the error code is appended
+	ErrorTypeBase string `yaml:"error_type_base" env:"ERROR_TYPE_BASE"`
+	// YYYY-MM-DD the unversioned /api aliases go away, sent in Sunset
+	APISunset string `yaml:"api_sunset" env:"API_SUNSET"`
+
+	AuditMaskEmails bool `yaml:"audit_mask_emails" env:"AUDIT_MASK_EMAILS"`
+
+	ServerReadHeaderTimeout time.Duration `yaml:"server_read_header_timeout" env:"SERVER_READ_HEADER_TIMEOUT"`
+	ServerReadTimeout       time.Duration `yaml:"server_read_timeout" env:"SERVER_READ_TIMEOUT"`
+	ServerWriteTimeout      time.Duration `yaml:"server_write_timeout" env:"SERVER_WRITE_TIMEOUT"`
+	ServerIdleTimeout       time.Duration `yaml:"server_idle_timeout" env:"SERVER_IDLE_TIMEOUT"`
+	ServerMaxHeaderBytes    int           `yaml:"server_max_header_bytes" env:"SERVER_MAX_HEADER_BYTES"`
+
+	MaintenanceMode       bool          `yaml:"maintenance_mode" env:"MAINTENANCE_MODE"`
+	MaintenanceReadOnly   bool          `yaml:"maintenance_read_only" env:"MAINTENANCE_READ_ONLY"`
+	MaintenanceMessage    string        `yaml:"maintenance_message" env:"MAINTENANCE_MESSAGE"`
+	MaintenanceRetryAfter time.Duration `yaml:"maintenance_retry_after" env:"MAINTENANCE_RETRY_AFTER"`
+	// Comma-separated: api_key, jwt, session
+	AuthModes string `yaml:"auth_modes" env:"AUTH_MODES"`
+	// Scopes granted by each role: "role=scope,scope;role=scope"
+	RoleScopes string `yaml:"role_scopes" env:"ROLE_SCOPES"`
+	// How long an API key lookup is cached
+	APIKeyCacheTTL time.Duration `yaml:"api_key_cache_ttl" env:"API_KEY_CACHE_TTL"`
+	// Required with AUTH_MODES including jwt
+	JWTJWKSURL     string        `yaml:"jwt_jwks_url" env:"JWT_JWKS_URL"`
+	JWTIssuer      string        `yaml:"jwt_issuer" env:"JWT_ISSUER"`
+	JWTAudience    string        `yaml:"jwt_audience" env:"JWT_AUDIENCE"`
+	JWTJWKSRefresh time.Duration `yaml:"jwt_jwks_refresh" env:"JWT_JWKS_REFRESH"`
+	JWTRolesClaim  string        `yaml:"jwt_roles_claim" env:"JWT_ROLES_CLAIM"`
+	// Required with AUTH_MODES including session
+	SessionSecret     string        `yaml:"session_secret" env:"SESSION_SECRET"`
+	SessionTTL        time.Duration `yaml:"session_ttl" env:"SESSION_TTL"`
+	BcryptCost        int           `yaml:"bcrypt_cost" env:"BCRYPT_COST"`
+	PasswordMinLength int           `yaml:"password_min_length" env:"PASSWORD_MIN_LENGTH"`
+	// Failed login throttling and lockout
+	LoginMaxFailures  int64         `yaml:"login_max_failures" env:"LOGIN_MAX_FAILURES"`
+	LoginLockout      time.Duration `yaml:"login_lockout" env:"LOGIN_LOCKOUT"`
+	LoginBackoffBase  time.Duration `yaml:"login_backoff_base" env:"LOGIN_BACKOFF_BASE"`
+	LoginBackoffMax   time.Duration `yaml:"login_backoff_max" env:"LOGIN_BACKOFF_MAX"`
+	LoginAttemptStore string        `yaml:"login_attempt_store" env:"LOGIN_ATTEMPT_STORE"`
+	// Required with LOGIN_ATTEMPT_STORE=redis
+	RedisURL string `yaml:"redis_url" env:"REDIS_URL"`
+	// Email verification links
+	EmailVerificationTTL time.Duration `yaml:"email_verification_ttl" env:"EMAIL_VERIFICATION_TTL"`
+	VerificationURL      string        `yaml:"verification_url" env:"VERIFICATION_URL"`
+	// Password reset tokens; without a URL the token is mailed alone
+	PasswordResetTTL time.Duration `yaml:"password_reset_ttl" env:"PASSWORD_RESET_TTL"`
+	PasswordResetURL string        `yaml:"password_reset_url" env:"PASSWORD_RESET_URL"`
+	// log, smtp or none; empty is log with ENV=development, none otherwise
+	Mailer string `yaml:"mailer" env:"MAILER"`
+	// Required with MAILER=smtp, except the credentials
+	SMTPAddr     string `yaml:"smtp_addr" env:"SMTP_ADDR"`
+	SMTPUsername string `yaml:"smtp_username" env:"SMTP_USERNAME"`
+	SMTPPassword string `yaml:"smtp_password" env:"SMTP_PASSWORD"`
+	MailFrom     string `yaml:"mail_from" env:"MAIL_FROM"`
+	// Webhook deliveries
+	WebhookMaxAttempts int           `yaml:"webhook_max_attempts" env:"WEBHOOK_MAX_ATTEMPTS"`
+	WebhookRetryBase   time.Duration `yaml:"webhook_retry_base" env:"WEBHOOK_RETRY_BASE"`
+	WebhookRetryMax    time.Duration `yaml:"webhook_retry_max" env:"WEBHOOK_RETRY_MAX"`
+	WebhookTimeout     time.Duration `yaml:"webhook_timeout" env:"WEBHOOK_TIMEOUT"`
+	// Outbox the events are relayed from
+	OutboxPollInterval time.Duration `yaml:"outbox_poll_interval" env:"OUTBOX_POLL_INTERVAL"`
+	OutboxRetention    time.Duration `yaml:"outbox_retention" env:"OUTBOX_RETENTION"`
+	// none, nats or kafka
+	EventPublisher string `yaml:"event_publisher" env:"EVENT_PUBLISHER"`
+	// Required with a publisher: comma-separated nats:// URLs or Kafka
+	// host:port brokers
+	EventBrokers string `yaml:"event_brokers" env:"EVENT_BROKERS"`
+	// Kafka topic, or the prefix of the NATS subjects
+	EventTopic     string `yaml:"event_topic" env:"EVENT_TOPIC"`
+	EventTLS       bool   `yaml:"event_tls" env:"EVENT_TLS"`
+	EventTLSCAFile string `yaml:"event_tls_ca_file" env:"EVENT_TLS_CA_FILE"`
+	// NATS user or SASL PLAIN login for Kafka
+	EventUsername string `yaml:"event_username" env:"EVENT_USERNAME"`
+	EventPassword string `yaml:"event_password" env:"EVENT_PASSWORD"`
+	// plain or cloudevents, for webhooks and the bus
+	EventFormat string `yaml:"event_format" env:"EVENT_FORMAT"`
+	EventSource string `yaml:"event_source" env:"EVENT_SOURCE"`
+	// Enables the /admin endpoints
+	AdminToken string `yaml:"admin_token" env:"ADMIN_TOKEN"`
+	// Port for the ops routes (metrics, pprof, probes, admin API); empty
+	// keeps them on the main port
+	AdminPort string `yaml:"admin_port" env:"ADMIN_PORT"`
+	// Port for the gRPC user service (users.proto); empty turns it off
+	GRPCPort string `yaml:"grpc_port" env:"GRPC_PORT"`
+
+	HealthCheckTimeout time.Duration `yaml:"health_check_timeout" env:"HEALTH_CHECK_TIMEOUT"`
+	ShutdownDrainDelay time.Duration `yaml:"shutdown_drain_delay" env:"SHUTDOWN_DRAIN_DELAY"`
+	ShutdownTimeout    time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+}
+
+const envDevelopment = "development"
+
+// The configuration without a file, environment or flags: what the package
+// variables currently hold
+func defaultConfig() Config {
+	return Config{
+		Port:       "8080",
+		SocketMode: "0660",
+		DBDriver:   dbDriver,
+		LogLevel:   "info",
+
+		DBMaxOpenConns:      dbMaxOpenConns,
+		DBMaxIdleConns:      dbMaxIdleConns,
+		DBConnMaxLifetime:   dbConnMaxLifetime,
+		DBConnMaxIdleTime:   dbConnMaxIdleTime,
+		DBConnectTimeout:    dbConnectTimeout,
+		DBPrepareStatements: dbPrepareStatements,
+		AutoMigrate:         autoMigrate,
+		LogQueries:          logQueries,
+		SlowQueryThreshold:  slowQueryThreshold,
+
+		SearchMaxResults:       searchMaxResults,
+		AllowDeletedEmailReuse: allowDeletedEmailReuse,
+		RequireIfMatch:         requireIfMatch,
+		AllowIDNEmail:          allowIDNEmail,
+		IdempotencyTTL:         idempotencyTTL,
+		StrictJSON:             strictJSON,
+		MaxBodyBytes:           maxBodyBytes,
+		RequestTimeout:         requestTimeout,
+
+		RateLimit:      rateLimitRate,
+		RateLimitBurst: rateLimitBurst,
+
+		CORSAllowedMethods:   strings.Join(corsAllowedMethods, ","),
+		CORSAllowedHeaders:   strings.Join(corsAllowedHeaders, ","),
+		CORSExposedHeaders:   strings.Join(corsExposedHeaders, ","),
+		CORSAllowCredentials: corsAllowCredentials,
+		CORSMaxAge:           corsMaxAge,
+
+		SecurityContentTypeOptions:      contentTypeOptions,
+		SecurityFrameOptions:            frameOptions,
+		SecurityReferrerPolicy:          referrerPolicy,
+		SecurityContentSecurityPolicy:   contentSecurityPolicy,
+		SecurityStrictTransportSecurity: strictTransportSecurity,
+		DocsEnabled:                     true,
+		GraphQLMaxDepth:                 graphQLMaxDepth,
+		GraphQLMaxComplexity:            graphQLMaxComplexity,
+		GzipEnabled:                     gzipEnabled,
+		GzipMinBytes:                    gzipMinBytes,
+		ErrorFormat:                     errorFormat,
+		ErrorTypeBase:                   errorTypeBase,
+		APISunset:                       apiSunset.Format(time.DateOnly),
+
+		AuditMaskEmails: auditMaskEmails,
+
+		ServerReadHeaderTimeout: serverReadHeaderTimeout,
+		ServerReadTimeout:       serverReadTimeout,
+		ServerWriteTimeout:      serverWriteTimeout,
+		ServerIdleTimeout:       serverIdleTimeout,
+		ServerMaxHeaderBytes:    serverMaxHeaderBytes,
+
+		MaintenanceRetryAfter: maintenanceRetryAfter,
+		AuthModes:             authModeAPIKey,
+		RoleScopes:            formatRoleScopes(roleScopes),
+		APIKeyCacheTTL:        apiKeyCacheTTL,
+		JWTJWKSRefresh:        jwksRefreshInterval,
+		JWTRolesClaim:         jwtRolesClaim,
+		SessionTTL:            sessionTTL,
+		BcryptCost:            bcryptCost,
+		PasswordMinLength:     passwordMinLength,
+		LoginMaxFailures:      loginMaxFailures,
+		LoginLockout:          loginLockout,
+		LoginBackoffBase:      loginBackoffBase,
+		LoginBackoffMax:       loginBackoffMax,
+		LoginAttemptStore:     loginStoreMemory,
+		EmailVerificationTTL:  emailVerificationTTL,
+		VerificationURL:       verificationURL,
+		PasswordResetTTL:      passwordResetTTL,
+		WebhookMaxAttempts:    webhookMaxAttempts,
+		WebhookRetryBase:      webhookRetryBase,
+		WebhookRetryMax:       webhookRetryMax,
+		WebhookTimeout:        webhookTimeout,
+		OutboxPollInterval:    outboxPollInterval,
+		OutboxRetention:       outboxRetention,
+		EventPublisher:        publisherNone,
+		EventTopic:            "user-events",
+		EventFormat:           eventFormat,
+		EventSource:           eventSource,
+		AdminToken:            adminToken,
+
+		HealthCheckTimeout: healthCheckTimeout,
+		ShutdownDrainDelay: shutdownDrainDelay,
+		ShutdownTimeout:    shutdownTimeout,
+	}
+}
+
+// A Config field with its file key and environment variable
+type setting struct {
+	key   string
+	env   string
+	field reflect.Value
+}
+
+func (cfg *Config) settings() []setting {
+	v := reflect.ValueOf(cfg).Elem()
+	settings := make([]setting, v.NumField())
+	for i := range settings {
+		f := v.Type().Field(i)
+		settings[i] = setting{key: f.Tag.Get("yaml"), env: f.Tag.Get("env"), field: v.Field(i)}
+	}
+	return settings
+}
+
+// Flag name for a config file key, e.g. -db-max-open-conns
+func flagName(key string) string {
+	return strings.ReplaceAll(key, "_", "-")
+}
+
+// Register a flag for every setting on fs. The returned map holds the values
+// of the flags that were set, by config file key, once fs is parsed.
+func configFlags(fs *flag.FlagSet) map[string]string {
+	values := map[string]string{}
+	for _, s := range (&Config{}).settings() {
+		key := s.key
+		fs.Func(flagName(key), "overrides "+s.env, func(v string) error {
+			values[key] = v
+			return nil
+		})
+	}
+	return values
+}
+
+// Load the configuration from the defaults, the config file (path, or
+// CONFIG_FILE when path is empty), the environment and the flags, each
+// overriding the ones before, and validate it. Every missing or invalid
+// setting is reported in the returned error, one per line.
+func loadConfig(path string, flags map[string]string) (Config, error) {
+	cfg := defaultConfig()
+	r := &configReader{}
+
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return cfg, fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+
+	for _, s := range cfg.settings() {
+		if v := os.Getenv(s.env); v != "" {
+			r.set(s.env, v, s.field)
+		}
+	}
+	for _, s := range cfg.settings() {
+		if v, ok := flags[s.key]; ok {
+			r.set("-"+flagName(s.key), v, s.field)
+		}
+	}
+
+	cfg.validate(r)
+	return cfg, errors.Join(r.errs...)
+}
+
+// Decode a YAML (or JSON, which YAML includes) file over cfg. Unknown keys
+// are an error, to catch typos.
+func (cfg *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// Checks between and beyond single settings, recorded on r
+func (cfg *Config) validate(r *configReader) {
+	if _, ok := defaultDatabaseURLs[cfg.DBDriver]; !ok {
+		r.fail("DB_DRIVER", "%q is not one of %s, %s, %s, %s", cfg.DBDriver, driverPostgres, driverPgx, driverSQLite, driverMySQL)
+		// The URLs can't be checked without a driver
+		return
+	}
+
+	if cfg.DatabaseURL == "" {
+		if cfg.Env != envDevelopment {
+			r.fail("DATABASE_URL", "required unless ENV=%s", envDevelopment)
+		} else {
+			cfg.DatabaseURL = defaultDatabaseURLs[cfg.DBDriver]
+		}
+	}
+	if cfg.DatabaseURL != "" {
+		dsn, err := validateDSN(cfg.DBDriver, cfg.DatabaseURL)
+		if err != nil {
+			r.fail("DATABASE_URL", "invalid for %s: %v", cfg.DBDriver, err)
+		}
+		cfg.DatabaseURL = dsn
+	}
+	if cfg.DatabaseReadURL != "" {
+		dsn, err := validateDSN(cfg.DBDriver, cfg.DatabaseReadURL)
+		if err != nil {
+			r.fail("DATABASE_READ_URL", "invalid for %s: %v", cfg.DBDriver, err)
+		}
+		cfg.DatabaseReadURL = dsn
+	}
+
+	r.port("PORT", cfg.Port)
+	cfg.validateListen(r)
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		r.fail("TLS_CERT_FILE", "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if cfg.AdminPort != "" {
+		r.port("ADMIN_PORT", cfg.AdminPort)
+		if cfg.AdminPort == cfg.listenPort() || cfg.AdminPort == cfg.HTTPRedirectPort {
+			r.fail("ADMIN_PORT", "must differ from the listening and redirect ports")
+		}
+	}
+	if cfg.GRPCPort != "" {
+		r.port("GRPC_PORT", cfg.GRPCPort)
+		if cfg.GRPCPort == cfg.listenPort() || cfg.GRPCPort == cfg.HTTPRedirectPort || cfg.GRPCPort == cfg.AdminPort {
+			r.fail("GRPC_PORT", "must differ from the listening, redirect and admin ports")
+		}
+	}
+	if cfg.HTTPRedirectPort != "" {
+		r.port("HTTP_REDIRECT_PORT", cfg.HTTPRedirectPort)
+		if cfg.TLSCertFile == "" {
+			r.fail("HTTP_REDIRECT_PORT", "requires TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		if cfg.socketPath() != "" {
+			r.fail("HTTP_REDIRECT_PORT", "can't redirect to a Unix socket")
+		} else if cfg.HTTPRedirectPort == cfg.listenPort() {
+			r.fail("HTTP_REDIRECT_PORT", "must differ from the listening port")
+		}
+	}
+	r.atLeast("DB_MAX_OPEN_CONNS", int64(cfg.DBMaxOpenConns), 0)
+	r.atLeast("DB_MAX_IDLE_CONNS", int64(cfg.DBMaxIdleConns), 0)
+	r.atLeast("SEARCH_MAX_RESULTS", int64(cfg.SearchMaxResults), 1)
+	r.atLeast("MAX_BODY_BYTES", cfg.MaxBodyBytes, 1)
+	r.atLeast("GRAPHQL_MAX_DEPTH", int64(cfg.GraphQLMaxDepth), 1)
+	r.atLeast("GRAPHQL_MAX_COMPLEXITY", int64(cfg.GraphQLMaxComplexity), 1)
+	r.atLeast("GZIP_MIN_BYTES", int64(cfg.GzipMinBytes), 0)
+	if cfg.ErrorFormat != errorFormatEnvelope && cfg.ErrorFormat != errorFormatProblem {
+		r.fail("ERROR_FORMAT", "must be %s or %s, got %q", errorFormatEnvelope, errorFormatProblem, cfg.ErrorFormat)
+	}
+	if u, err := url.Parse(cfg.ErrorTypeBase); err != nil || u.Scheme == "" {
+		r.fail("ERROR_TYPE_BASE", "must be an absolute URI, got %q", cfg.ErrorTypeBase)
+	}
+	if sunset, err := time.Parse(time.DateOnly, cfg.APISunset); err != nil {
+		r.fail("API_SUNSET", "must be a YYYY-MM-DD date, got %q", cfg.APISunset)
+	} else if sunset.Before(legacyAPIDeprecated) {
+		r.fail("API_SUNSET", "cannot be before the deprecation on %s, got %s", legacyAPIDeprecated.Format(time.DateOnly), cfg.APISunset)
+	}
+	r.positive("DB_CONNECT_TIMEOUT", cfg.DBConnectTimeout)
+	r.positive("REQUEST_TIMEOUT", cfg.RequestTimeout)
+	r.positive("HEALTH_CHECK_TIMEOUT", cfg.HealthCheckTimeout)
+	r.positive("SHUTDOWN_TIMEOUT", cfg.ShutdownTimeout)
+	r.positive("IDEMPOTENCY_TTL", cfg.IdempotencyTTL)
+	r.positive("SERVER_READ_HEADER_TIMEOUT", cfg.ServerReadHeaderTimeout)
+	r.positive("MAINTENANCE_RETRY_AFTER", cfg.MaintenanceRetryAfter)
+	r.positive("API_KEY_CACHE_TTL", cfg.APIKeyCacheTTL)
+	if cfg.RateLimit < 0 {
+		r.fail("RATE_LIMIT", "must be 0 or positive, got %g", cfg.RateLimit)
+	}
+	r.atLeast("RATE_LIMIT_BURST", int64(cfg.RateLimitBurst), 1)
+	for _, proxy := range cfg.trustedProxies() {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			r.fail("TRUSTED_PROXIES", "%q is not an IP address or CIDR", proxy)
+		}
+	}
+	cfg.validateCORS(r)
+	for _, h := range []struct{ name, value string }{
+		{"SECURITY_CONTENT_TYPE_OPTIONS", cfg.SecurityContentTypeOptions},
+		{"SECURITY_FRAME_OPTIONS", cfg.SecurityFrameOptions},
+		{"SECURITY_REFERRER_POLICY", cfg.SecurityReferrerPolicy},
+		{"SECURITY_CONTENT_SECURITY_POLICY", cfg.SecurityContentSecurityPolicy},
+		{"SECURITY_STRICT_TRANSPORT_SECURITY", cfg.SecurityStrictTransportSecurity},
+	} {
+		if strings.ContainsAny(h.value, "\r\n") {
+			r.fail(h.name, "can't contain line breaks")
+		}
+	}
+	cfg.validateLogging(r)
+	cfg.validateAuth(r)
+	cfg.validateMail(r)
+	r.atLeast("WEBHOOK_MAX_ATTEMPTS", int64(cfg.WebhookMaxAttempts), 1)
+	r.positive("WEBHOOK_RETRY_BASE", cfg.WebhookRetryBase)
+	if cfg.WebhookRetryMax < cfg.WebhookRetryBase {
+		r.fail("WEBHOOK_RETRY_MAX", "must be at least WEBHOOK_RETRY_BASE (%s), got %s", cfg.WebhookRetryBase, cfg.WebhookRetryMax)
+	}
+	r.positive("WEBHOOK_TIMEOUT", cfg.WebhookTimeout)
+	r.positive("OUTBOX_POLL_INTERVAL", cfg.OutboxPollInterval)
+	r.positive("OUTBOX_RETENTION", cfg.OutboxRetention)
+	cfg.validateEvents(r)
+	if cfg.AdminToken != "" && len(cfg.AdminToken) < 16 {
+		r.fail("ADMIN_TOKEN", "must be at least 16 characters")
+	}
+	r.atLeast("SERVER_READ_TIMEOUT", int64(cfg.ServerReadTimeout), 0)
+	r.atLeast("SERVER_IDLE_TIMEOUT", int64(cfg.ServerIdleTimeout), 0)
+	r.atLeast("SERVER_MAX_HEADER_BYTES", int64(cfg.ServerMaxHeaderBytes), 1)
+	// A write deadline before the request deadline would cut off responses
+	// the handlers are still allowed to produce
+	if cfg.ServerWriteTimeout != 0 && cfg.ServerWriteTimeout <= cfg.RequestTimeout {
+		r.fail("SERVER_WRITE_TIMEOUT", "must be 0 or longer than REQUEST_TIMEOUT (%s), got %s", cfg.RequestTimeout, cfg.ServerWriteTimeout)
+	}
+}
+
+// The TRUSTED_PROXIES entries; nil trusts no proxy
+func (cfg Config) trustedProxies() []string {
+	return commaList(cfg.TrustedProxies)
+}
+
+// The non-empty, trimmed entries of a comma-separated setting
+func commaList(value string) []string {
+	var entries []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func (cfg *Config) validateCORS(r *configReader) {
+	origins := commaList(cfg.CORSAllowedOrigins)
+	for _, origin := range origins {
+		if err := validateCORSOrigin(origin); err != nil {
+			r.fail("CORS_ALLOWED_ORIGINS", "%v", err)
+		}
+		// Browsers ignore Access-Control-Allow-Origin: * on requests with
+		// credentials
+		if origin == "*" && cfg.CORSAllowCredentials {
+			r.fail("CORS_ALLOWED_ORIGINS", "* can't be combined with CORS_ALLOW_CREDENTIALS=true; list the origins instead")
+		}
+	}
+	if len(origins) == 0 {
+		return
+	}
+	for _, method := range commaList(cfg.CORSAllowedMethods) {
+		if method != strings.ToUpper(method) || strings.ContainsAny(method, " *") {
+			r.fail("CORS_ALLOWED_METHODS", "%q is not an HTTP method in upper case", method)
+		}
+	}
+	if len(commaList(cfg.CORSAllowedMethods)) == 0 {
+		r.fail("CORS_ALLOWED_METHODS", "at least one method is required with CORS_ALLOWED_ORIGINS")
+	}
+	r.atLeast("CORS_MAX_AGE", int64(cfg.CORSMaxAge), 0)
+}
+
+func (cfg *Config) validateAuth(r *configReader) {
+	if _, err := parseRoleScopes(cfg.RoleScopes); err != nil {
+		r.fail("ROLE_SCOPES", "%v", err)
+	}
+
+	if cfg.BcryptCost < bcrypt.MinCost || cfg.BcryptCost > bcrypt.MaxCost {
+		r.fail("BCRYPT_COST", "must be between %d and %d, got %d", bcrypt.MinCost, bcrypt.MaxCost, cfg.BcryptCost)
+	}
+	if cfg.PasswordMinLength < 1 || cfg.PasswordMinLength > maxPasswordBytes {
+		r.fail("PASSWORD_MIN_LENGTH", "must be between 1 and %d, got %d", maxPasswordBytes, cfg.PasswordMinLength)
+	}
+
+	modes, err := parseAuthModes(cfg.AuthModes)
+	if err != nil {
+		r.fail("AUTH_MODES", "%v", err)
+		return
+	}
+	if modes[authModeSession] {
+		if len(cfg.SessionSecret) < 32 {
+			r.fail("SESSION_SECRET", "at least 32 characters are required with AUTH_MODES=%s", cfg.AuthModes)
+		}
+		r.positive("SESSION_TTL", cfg.SessionTTL)
+	}
+	r.atLeast("LOGIN_MAX_FAILURES", cfg.LoginMaxFailures, 1)
+	r.positive("LOGIN_LOCKOUT", cfg.LoginLockout)
+	r.atLeast("LOGIN_BACKOFF_BASE", int64(cfg.LoginBackoffBase), 0)
+	if cfg.LoginBackoffMax < cfg.LoginBackoffBase {
+		r.fail("LOGIN_BACKOFF_MAX", "cannot be less than LOGIN_BACKOFF_BASE (%s), got %s", cfg.LoginBackoffBase, cfg.LoginBackoffMax)
+	}
+	switch cfg.LoginAttemptStore {
+	case loginStoreMemory:
+	case loginStoreRedis:
+		if _, err := newRedisClient(cfg.RedisURL); err != nil {
+			r.fail("REDIS_URL", "a redis:// URL is required with LOGIN_ATTEMPT_STORE=redis: %v", err)
+		}
+	default:
+		r.fail("LOGIN_ATTEMPT_STORE", "must be %s or %s, got %q", loginStoreMemory, loginStoreRedis, cfg.LoginAttemptStore)
+	}
+	if !modes[authModeJWT] {
+		return
+	}
+	if u, err := url.Parse(cfg.JWTJWKSURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		r.fail("JWT_JWKS_URL", "an http(s) URL is required with AUTH_MODES=%s", cfg.AuthModes)
+	}
+	if cfg.JWTIssuer == "" {
+		r.fail("JWT_ISSUER", "required with AUTH_MODES=%s", cfg.AuthModes)
+	}
+	if cfg.JWTAudience == "" {
+		r.fail("JWT_AUDIENCE", "required with AUTH_MODES=%s", cfg.AuthModes)
+	}
+	r.positive("JWT_JWKS_REFRESH", cfg.JWTJWKSRefresh)
+	if cfg.JWTRolesClaim == "" {
+		r.fail("JWT_ROLES_CLAIM", "cannot be empty")
+	}
+}
+
+func (cfg *Config) validateEvents(r *configReader) {
+	if cfg.EventFormat != eventFormatPlain && cfg.EventFormat != eventFormatCloudEvents {
+		r.fail("EVENT_FORMAT", "must be %s or %s, got %q", eventFormatPlain, eventFormatCloudEvents, cfg.EventFormat)
+	}
+	if _, err := url.Parse(cfg.EventSource); err != nil || cfg.EventSource == "" {
+		r.fail("EVENT_SOURCE", "must be a URI reference, got %q", cfg.EventSource)
+	}
+
+	switch cfg.EventPublisher {
+	case publisherNone:
+		return
+	case publisherNATS, publisherKafka:
+	default:
+		r.fail("EVENT_PUBLISHER", "must be %s, %s or %s, got %q", publisherNone, publisherNATS, publisherKafka, cfg.EventPublisher)
+		return
+	}
+	if !validTopic(cfg.EventTopic) {
+		r.fail("EVENT_TOPIC", "must be letters, digits, '.', '_' or '-', got %q", cfg.EventTopic)
+	}
+	if cfg.EventTLSCAFile != "" && !cfg.EventTLS {
+		r.fail("EVENT_TLS_CA_FILE", "requires EVENT_TLS=true")
+	}
+	if _, err := newEventPublisher(*cfg); err != nil {
+		r.fail("EVENT_BROKERS", "invalid for EVENT_PUBLISHER=%s: %v", cfg.EventPublisher, err)
+	}
+}
+
+func (cfg *Config) validateLogging(r *configReader) {
+	if _, err := parseLogLevel(cfg.LogLevel); err != nil {
+		r.fail("LOG_LEVEL", "must be debug, info, warn or error, got %q", cfg.LogLevel)
+	}
+	if cfg.LogFormat == "" {
+		cfg.LogFormat = logFormatJSON
+		if cfg.Env == envDevelopment {
+			cfg.LogFormat = logFormatText
+		}
+	}
+	if cfg.LogFormat != logFormatJSON && cfg.LogFormat != logFormatText {
+		r.fail("LOG_FORMAT", "must be %s or %s, got %q", logFormatJSON, logFormatText, cfg.LogFormat)
+	}
+}
+
+func (cfg *Config) validateMail(r *configReader) {
+	r.positive("EMAIL_VERIFICATION_TTL", cfg.EmailVerificationTTL)
+	if u, err := url.Parse(cfg.VerificationURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		r.fail("VERIFICATION_URL", "must be an http(s) URL, got %q", cfg.VerificationURL)
+	}
+	r.positive("PASSWORD_RESET_TTL", cfg.PasswordResetTTL)
+	if cfg.PasswordResetURL != "" {
+		if u, err := url.Parse(cfg.PasswordResetURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			r.fail("PASSWORD_RESET_URL", "must be an http(s) URL, got %q", cfg.PasswordResetURL)
+		}
+	}
+
+	if cfg.Mailer == "" {
+		cfg.Mailer = mailerNone
+		if cfg.Env == envDevelopment {
+			cfg.Mailer = mailerLog
+		}
+	}
+	switch cfg.Mailer {
+	case mailerLog, mailerNone:
+	case mailerSMTP:
+		if _, _, err := net.SplitHostPort(cfg.SMTPAddr); err != nil {
+			r.fail("SMTP_ADDR", "host:port is required with MAILER=smtp")
+		}
+		if _, err := mail.ParseAddress(cfg.MailFrom); err != nil {
+			r.fail("MAIL_FROM", "an email address is required with MAILER=smtp: %v", err)
+		}
+	default:
+		r.fail("MAILER", "must be %s, %s or %s, got %q", mailerLog, mailerSMTP, mailerNone, cfg.Mailer)
+	}
+}
+
+// Set the package variables the handlers and repositories read
+func (cfg Config) apply() {
+	dbDriver = cfg.DBDriver
+	level, _ := parseLogLevel(cfg.LogLevel)
+	logLevel.Set(level)
+	dbMaxOpenConns = cfg.DBMaxOpenConns
+	dbMaxIdleConns = cfg.DBMaxIdleConns
+	dbConnMaxLifetime = cfg.DBConnMaxLifetime
+	dbConnMaxIdleTime = cfg.DBConnMaxIdleTime
+	dbConnectTimeout = cfg.DBConnectTimeout
+	dbPrepareStatements = cfg.DBPrepareStatements
+	autoMigrate = cfg.AutoMigrate
+	logQueries = cfg.LogQueries
+	slowQueryThreshold = cfg.SlowQueryThreshold
+
+	searchMaxResults = cfg.SearchMaxResults
+	allowDeletedEmailReuse = cfg.AllowDeletedEmailReuse
+	requireIfMatch = cfg.RequireIfMatch
+	allowIDNEmail = cfg.AllowIDNEmail
+	idempotencyTTL = cfg.IdempotencyTTL
+	strictJSON = cfg.StrictJSON
+	maxBodyBytes = cfg.MaxBodyBytes
+	requestTimeout = cfg.RequestTimeout
+
+	rateLimitRate = cfg.RateLimit
+	rateLimitBurst = cfg.RateLimitBurst
+
+	corsAllowedOrigins = commaList(cfg.CORSAllowedOrigins)
+	corsAllowedMethods = commaList(cfg.CORSAllowedMethods)
+	corsAllowedHeaders = commaList(cfg.CORSAllowedHeaders)
+	corsExposedHeaders = commaList(cfg.CORSExposedHeaders)
+	corsAllowCredentials = cfg.CORSAllowCredentials
+	corsMaxAge = cfg.CORSMaxAge
+
+	contentTypeOptions = cfg.SecurityContentTypeOptions
+	frameOptions = cfg.SecurityFrameOptions
+	referrerPolicy = cfg.SecurityReferrerPolicy
+	contentSecurityPolicy = cfg.SecurityContentSecurityPolicy
+	strictTransportSecurity = cfg.SecurityStrictTransportSecurity
+	graphQLMaxDepth = cfg.GraphQLMaxDepth
+	graphQLMaxComplexity = cfg.GraphQLMaxComplexity
+	gzipEnabled = cfg.GzipEnabled
+	gzipMinBytes = cfg.GzipMinBytes
+	errorFormat = cfg.ErrorFormat
+	errorTypeBase = cfg.ErrorTypeBase
+	apiSunset, _ = time.Parse(time.DateOnly, cfg.APISunset)
+
+	auditMaskEmails = cfg.AuditMaskEmails
+
+	serverReadHeaderTimeout = cfg.ServerReadHeaderTimeout
+	serverReadTimeout = cfg.ServerReadTimeout
+	serverWriteTimeout = cfg.ServerWriteTimeout
+	serverIdleTimeout = cfg.ServerIdleTimeout
+	serverMaxHeaderBytes = cfg.ServerMaxHeaderBytes
+
+	maintenanceRetryAfter = cfg.MaintenanceRetryAfter
+	apiKeyCacheTTL = cfg.APIKeyCacheTTL
+	authModes, _ = parseAuthModes(cfg.AuthModes)
+	roleScopes, _ = parseRoleScopes(cfg.RoleScopes)
+	jwtRolesClaim = cfg.JWTRolesClaim
+	jwtIssuer = cfg.JWTIssuer
+	jwtAudience = cfg.JWTAudience
+	jwksRefreshInterval = cfg.JWTJWKSRefresh
+	if authModes[authModeJWT] {
+		jwks = newJWKSCache(cfg.JWTJWKSURL)
+	}
+	sessionSecret = []byte(cfg.SessionSecret)
+	sessionTTL = cfg.SessionTTL
+	bcryptCost = cfg.BcryptCost
+	passwordMinLength = cfg.PasswordMinLength
+	loginMaxFailures = cfg.LoginMaxFailures
+	loginLockout = cfg.LoginLockout
+	loginBackoffBase = cfg.LoginBackoffBase
+	loginBackoffMax = cfg.LoginBackoffMax
+	if cfg.LoginAttemptStore == loginStoreRedis {
+		client, _ := newRedisClient(cfg.RedisURL)
+		loginAttempts = &redisLoginAttemptStore{client: client}
+	}
+	emailVerificationTTL = cfg.EmailVerificationTTL
+	verificationURL = cfg.VerificationURL
+	passwordResetTTL = cfg.PasswordResetTTL
+	passwordResetURL = cfg.PasswordResetURL
+	switch cfg.Mailer {
+	case mailerSMTP:
+		from, _ := mail.ParseAddress(cfg.MailFrom)
+		mailer = smtpMailer{addr: cfg.SMTPAddr, username: cfg.SMTPUsername, password: cfg.SMTPPassword, from: from}
+	case mailerNone:
+		mailer = discardMailer{}
+	}
+	webhookMaxAttempts = cfg.WebhookMaxAttempts
+	webhookRetryBase = cfg.WebhookRetryBase
+	webhookRetryMax = cfg.WebhookRetryMax
+	webhookTimeout = cfg.WebhookTimeout
+	outboxPollInterval = cfg.OutboxPollInterval
+	outboxRetention = cfg.OutboxRetention
+	publisher, _ = newEventPublisher(cfg)
+	eventFormat = cfg.EventFormat
+	eventSource = cfg.EventSource
+	adminToken = cfg.AdminToken
+	if cfg.MaintenanceMode {
+		setMaintenance(true, cfg.MaintenanceReadOnly, cfg.MaintenanceMessage)
+	}
+
+	healthCheckTimeout = cfg.HealthCheckTimeout
+	shutdownDrainDelay = cfg.ShutdownDrainDelay
+	shutdownTimeout = cfg.ShutdownTimeout
+}
+
+// The configuration as YAML, with database passwords and secrets redacted
+func (cfg Config) String() string {
+	if cfg.AdminToken != "" {
+		cfg.AdminToken = "xxxxx"
+	}
+	if cfg.SessionSecret != "" {
+		cfg.SessionSecret = "xxxxx"
+	}
+	if cfg.SMTPPassword != "" {
+		cfg.SMTPPassword = "xxxxx"
+	}
+	if cfg.EventPassword != "" {
+		cfg.EventPassword = "xxxxx"
+	}
+	cfg.DatabaseURL = redactDSN(cfg.DBDriver, cfg.DatabaseURL)
+	cfg.DatabaseReadURL = redactDSN(cfg.DBDriver, cfg.DatabaseReadURL)
+	cfg.RedisURL = redactDSN("", cfg.RedisURL)
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err.Error()
+	}
+	return string(out)
+}
+
+var dsnPasswordRegex = regexp.MustCompile(`(password=)('[^']*'|[^\s&]*)`)
+
+// Replace the password in a DSN with xxxxx
+func redactDSN(driver, dsn string) string {
+	if dsn == "" {
+		return dsn
+	}
+	if driver == driverMySQL {
+		c, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return "(unparsable)"
+		}
+		if c.Passwd != "" {
+			c.Passwd = "xxxxx"
+		}
+		return c.FormatDSN()
+	}
+	if strings.Contains(dsn, "://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "(unparsable)"
+		}
+		dsn = u.Redacted()
+	}
+	// Postgres key=value strings and password URL parameters
+	return dsnPasswordRegex.ReplaceAllString(dsn, "${1}xxxxx")
+}
+
+// Collects the errors of every setting instead of stopping at the first
+type configReader struct {
+	errs []error
+}
+
+func (r *configReader) fail(name, format string, args ...interface{}) {
+	r.errs = append(r.errs, fmt.Errorf("%s: %s", name, fmt.Sprintf(format, args...)))
+}
+
+// Parse raw into field according to its type; name is the variable or flag
+// it came from
+func (r *configReader) set(name, raw string, field reflect.Value) {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(raw)
+	case bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			r.fail(name, "%q is not a boolean", raw)
+			return
+		}
+		field.SetBool(b)
+	case float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			r.fail(name, "%q is not a number", raw)
+			return
+		}
+		field.SetFloat(f)
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			r.fail(name, "%q is not a duration", raw)
+			return
+		}
+		field.SetInt(int64(d))
+	case int, int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			r.fail(name, "%q is not an integer", raw)
+			return
+		}
+		field.SetInt(n)
+	}
+}
+
+func (r *configReader) port(name, port string) {
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		r.fail(name, "%q is not a port number", port)
+	}
+}
+
+func (r *configReader) atLeast(name string, n, min int64) {
+	if n < min {
+		r.fail(name, "must be at least %d, got %d", min, n)
+	}
+}
+
+func (r *configReader) positive(name string, d time.Duration) {
+	if d <= 0 {
+		r.fail(name, "must be positive, got %s", d)
+	}
+}
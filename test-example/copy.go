@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/lib/pq"
+)
+
+// Columns written by CreateMany, in COPY order
+var copyColumns = []string{"email", "name", "phone", "role", "metadata"}
+
+// Statement that moves the copied rows into users. Taken emails are skipped:
+// those of active users by ON CONFLICT, reserved ones of deleted users by the
+// NOT EXISTS (unless reuse is allowed).
+func copyInsertSQL(reserveDeletedEmails bool) string {
+	reserved := ""
+	if !reserveDeletedEmails {
+		reserved = " AND u.deleted_at IS NULL"
+	}
+	return `
+		INSERT INTO users (email, name, phone, role, metadata)
+		SELECT i.email, i.name, i.phone, i.role, i.metadata FROM users_import i
+		WHERE NOT EXISTS (SELECT 1 FROM users u WHERE u.email = i.email` + reserved + `)
+		ON CONFLICT DO NOTHING
+		RETURNING ` + selectColumns(userFields)
+}
+
+const createImportTableSQL = `
+	CREATE TEMPORARY TABLE users_import (
+		email TEXT NOT NULL,
+		name TEXT NOT NULL,
+		phone TEXT,
+		role TEXT NOT NULL,
+		metadata JSONB NOT NULL
+	) ON COMMIT DROP`
+
+// The rows are streamed with COPY into a temporary table and moved into users
+// with one INSERT, which is much faster than INSERT statements for large
+// imports. Canceling ctx aborts the copy and rolls it back.
+func (r *postgresUserRepository) CreateMany(ctx context.Context, users []User, allOrNothing bool) (map[string]string, error) {
+	if r.pool != nil && r.tx == nil {
+		return r.copyPgx(ctx, users, allOrNothing)
+	}
+
+	var inserted map[string]string
+	err := inTx(ctx, r.db, r.tx, func(tx *sql.Tx) error {
+		inserted = map[string]string{}
+
+		if _, err := tx.ExecContext(ctx, createImportTableSQL); err != nil {
+			return err
+		}
+		if err := r.fillImportTable(ctx, tx, users); err != nil {
+			return err
+		}
+
+		rows, err := tx.QueryContext(ctx, copyInsertSQL(r.reserveDeletedEmails))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		entries := []auditEntry{}
+		for rows.Next() {
+			var user User
+			if err := rows.Scan(scanDest(&user, userFields)...); err != nil {
+				return err
+			}
+			inserted[user.Email] = user.ID
+			entries = append(entries, newAuditEntry(ctx, auditCreate, nil, &user))
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+		if err := insertAuditEntries(ctx, tx, entries...); err != nil {
+			return err
+		}
+
+		// ON COMMIT DROP only fires at the end of a joined transaction, which
+		// may call CreateMany again
+		if _, err := tx.ExecContext(ctx, "DROP TABLE users_import"); err != nil {
+			return err
+		}
+
+		if allOrNothing && len(inserted) < len(users) {
+			return errRollback
+		}
+		return nil
+	})
+	return inserted, err
+}
+
+// Write users into users_import on tx. lib/pq copies through a prepared
+// statement; pgx only copies on its own connections, so within a
+// database/sql transaction the rows are inserted one by one instead.
+func (r *postgresUserRepository) fillImportTable(ctx context.Context, tx *sql.Tx, users []User) error {
+	copying := dbDriver != driverPgx
+	query := pq.CopyIn("users_import", copyColumns...)
+	if !copying {
+		query = "INSERT INTO users_import (" + strings.Join(copyColumns, ", ") + ") VALUES ($1, $2, $3, $4, $5)"
+	}
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, u := range users {
+		if _, err := stmt.ExecContext(ctx, u.Email, u.Name, u.Phone, u.Role, u.Metadata); err != nil {
+			return err
+		}
+	}
+	if copying {
+		// An Exec without arguments ends the COPY
+		if _, err := stmt.ExecContext(ctx); err != nil {
+			return err
+		}
+	}
+	return stmt.Close()
+}
+
+// Runs database/sql style statements on a pgx transaction, collecting the
+// functions afterCommit registers for the caller to run once it commits
+type pgxExecer struct {
+	tx    pgx.Tx
+	hooks []func()
+}
+
+func (e *pgxExecer) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	tag, err := e.tx.Exec(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(tag.RowsAffected()), nil
+}
+
+// CreateMany through pgx's native COPY, which database/sql can't express.
+// Only used outside WithTx, since the copy needs a transaction of its own.
+func (r *postgresUserRepository) copyPgx(ctx context.Context, users []User, allOrNothing bool) (map[string]string, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.WithoutCancel(ctx))
+
+	if _, err := tx.Exec(ctx, createImportTableSQL); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"users_import"}, copyColumns, pgx.CopyFromSlice(len(users), func(i int) ([]interface{}, error) {
+		u := users[i]
+		metadata, err := u.Metadata.Value()
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{u.Email, u.Name, u.Phone, u.Role, metadata}, nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(ctx, copyInsertSQL(r.reserveDeletedEmails))
+	if err != nil {
+		return nil, err
+	}
+	inserted := map[string]string{}
+	entries := []auditEntry{}
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(scanDest(&user, userFields)...); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		inserted[user.Email] = user.ID
+		entries = append(entries, newAuditEntry(ctx, auditCreate, nil, &user))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	exec := &pgxExecer{tx: tx}
+	if err := insertAuditEntries(ctx, exec, entries...); err != nil {
+		return nil, err
+	}
+
+	if allOrNothing && len(inserted) < len(users) {
+		return inserted, errRollback
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return inserted, err
+	}
+	for _, hook := range exec.hooks {
+		hook()
+	}
+	return inserted, nil
+}
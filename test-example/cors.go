@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Origins allowed to call the API from a browser (CORS_ALLOWED_ORIGINS):
+// exact origins such as "https://app.example.com", patterns such as
+// "https://*.example.com" matching any subdomain, or "*" for any origin.
+// Empty turns CORS off.
+var corsAllowedOrigins []string
+
+// Methods and request headers allowed in cross-origin requests
+// (CORS_ALLOWED_METHODS, CORS_ALLOWED_HEADERS)
+var (
+	corsAllowedMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+	corsAllowedHeaders = []string{"Authorization", "Content-Type", "X-API-Key", "If-Match", "If-None-Match", "Idempotency-Key", "X-Request-ID"}
+)
+
+// Response headers scripts may read besides the CORS-safelisted ones
+// (CORS_EXPOSED_HEADERS)
+var corsExposedHeaders = []string{
+	"ETag", "Location", "X-Total-Count", "X-Next-Cursor", "Retry-After", "WWW-Authenticate", "Idempotent-Replayed",
+	"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset",
+	"X-Quota-Limit", "X-Quota-Remaining", "X-Quota-Reset", "X-Request-ID",
+	"Deprecation", "Sunset", "Link",
+}
+
+// Whether cross-origin requests may carry cookies and Authorization
+// (CORS_ALLOW_CREDENTIALS); not allowed with the "*" origin
+var corsAllowCredentials = false
+
+// How long browsers may cache a preflight response (CORS_MAX_AGE)
+var corsMaxAge = 10 * time.Minute
+
+// Check a CORS_ALLOWED_ORIGINS entry: "*", or scheme://host[:port] where the
+// host may start with "*." for any subdomain
+func validateCORSOrigin(origin string) error {
+	if origin == "*" {
+		return nil
+	}
+	u, err := url.Parse(strings.Replace(origin, "*.", "wildcard.", 1))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+		return fmt.Errorf("%q is not an origin such as https://app.example.com", origin)
+	}
+	if n := strings.Count(origin, "*"); n > 1 || n == 1 && !strings.HasPrefix(origin, u.Scheme+"://*.") {
+		return fmt.Errorf("%q: only a leading *. is allowed in the host", origin)
+	}
+	return nil
+}
+
+// Whether an Origin header matches one of CORS_ALLOWED_ORIGINS
+func corsOriginAllowed(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range corsAllowedOrigins {
+		allowed = strings.ToLower(allowed)
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		if prefix, suffix, ok := strings.Cut(allowed, "*"); ok {
+			sub, found := strings.CutPrefix(origin, prefix)
+			sub, found2 := strings.CutSuffix(sub, suffix)
+			if found && found2 && isSubdomainLabels(sub) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Whether s is one or more DNS labels, such as "app" or "eu.app"
+func isSubdomainLabels(s string) bool {
+	for _, label := range strings.Split(s, ".") {
+		if label == "" {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Middleware adding CORS headers for allowed origins and answering their
+// preflight requests with 204, before authentication, rate limiting and
+// maintenance mode get to them. Requests from other origins get no CORS
+// headers, so browsers refuse to hand the response to the page.
+func handleCORS() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if len(corsAllowedOrigins) == 0 || origin == "" {
+			c.Next()
+			return
+		}
+		// Caches must not serve one origin's response to another
+		c.Writer.Header().Add("Vary", "Origin")
+		preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+		if preflight {
+			c.Writer.Header().Add("Vary", "Access-Control-Request-Method")
+			c.Writer.Header().Add("Vary", "Access-Control-Request-Headers")
+		}
+		if !corsOriginAllowed(origin) {
+			c.Next()
+			return
+		}
+
+		if len(corsAllowedOrigins) == 1 && corsAllowedOrigins[0] == "*" {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Header("Access-Control-Allow-Origin", origin)
+		}
+		if corsAllowCredentials {
+			c.Header("Access-Control-Allow-Credentials", "true")
+		}
+
+		if preflight {
+			c.Header("Access-Control-Allow-Methods", strings.Join(corsAllowedMethods, ", "))
+			c.Header("Access-Control-Allow-Headers", strings.Join(corsAllowedHeaders, ", "))
+			c.Header("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		if len(corsExposedHeaders) > 0 {
+			c.Header("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Driver-independent classes of database errors
+type dbErrorClass int
+
+const (
+	dbErrOther dbErrorClass = iota
+	dbErrUniqueViolation
+	dbErrCheckViolation
+	// The transaction lost a conflict with a concurrent one and can be retried
+	dbErrSerializationFailure
+	// A prepared statement's plan no longer matches the schema, e.g. after a
+	// migration changed the users table
+	dbErrStalePlan
+	// The query names a table that doesn't exist
+	dbErrUndefinedTable
+)
+
+// Classify an error from any supported driver. constraint is the violated
+// constraint's name when the driver reports it (Postgres only).
+func classifyDBError(err error) (class dbErrorClass, constraint string) {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return classifyPostgresCode(string(pqErr.Code)), pqErr.Constraint
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return classifyPostgresCode(pgErr.Code), pgErr.ConstraintName
+	}
+
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code() {
+		case sqlite3.SQLITE_CONSTRAINT_UNIQUE:
+			return dbErrUniqueViolation, ""
+		case sqlite3.SQLITE_CONSTRAINT_CHECK:
+			return dbErrCheckViolation, ""
+		case sqlite3.SQLITE_ERROR:
+			// SQLite has no code of its own for this
+			if strings.Contains(sqliteErr.Error(), "no such table") {
+				return dbErrUndefinedTable, ""
+			}
+		}
+		return dbErrOther, ""
+	}
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		case 1062: // ER_DUP_ENTRY
+			return dbErrUniqueViolation, ""
+		case 3819: // ER_CHECK_CONSTRAINT_VIOLATED
+			return dbErrCheckViolation, ""
+		case 1213: // ER_LOCK_DEADLOCK, InnoDB's way of reporting a lost conflict
+			return dbErrSerializationFailure, ""
+		case 1146: // ER_NO_SUCH_TABLE
+			return dbErrUndefinedTable, ""
+		}
+	}
+
+	return dbErrOther, ""
+}
+
+// Map a Postgres SQLSTATE to its class
+func classifyPostgresCode(code string) dbErrorClass {
+	switch code {
+	case "23505":
+		return dbErrUniqueViolation
+	case "23514":
+		return dbErrCheckViolation
+	case "40001", "40P01": // serialization_failure, deadlock_detected
+		return dbErrSerializationFailure
+	case "0A000": // "cached plan must not change result type"
+		return dbErrStalePlan
+	case "42P01": // undefined_table
+		return dbErrUndefinedTable
+	}
+	return dbErrOther
+}
+
+// Check whether an error is a unique constraint violation
+func isUniqueViolation(err error) bool {
+	class, _ := classifyDBError(err)
+	return class == dbErrUniqueViolation
+}
+
+// Check whether an error is a violation of the named CHECK constraint
+func isCheckViolation(err error, constraint string) bool {
+	class, name := classifyDBError(err)
+	return class == dbErrCheckViolation && name == constraint
+}
+
+// Check whether a prepared statement has to be prepared again
+func isStalePlan(err error) bool {
+	class, _ := classifyDBError(err)
+	return class == dbErrStalePlan
+}
+
+// Check whether an error means the transaction should be retried
+func isSerializationFailure(err error) bool {
+	class, _ := classifyDBError(err)
+	return class == dbErrSerializationFailure
+}
+
+// Check whether an error means a table doesn't exist
+func isUndefinedTable(err error) bool {
+	class, _ := classifyDBError(err)
+	return class == dbErrUndefinedTable
+}
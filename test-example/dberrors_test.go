@@ -0,0 +1,119 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+)
+
+func TestClassifyPostgresErrors(t *testing.T) {
+	for _, tt := range []struct {
+		code       string
+		class      dbErrorClass
+		constraint string
+	}{
+		{"23505", dbErrUniqueViolation, "users_email_key"},
+		{"23514", dbErrCheckViolation, "users_status_check"},
+		{"40001", dbErrSerializationFailure, ""},
+		{"42P01", dbErrUndefinedTable, ""},
+		{"23503", dbErrOther, "users_fk"},
+		{"57014", dbErrOther, ""},
+	} {
+		for _, err := range []error{
+			&pq.Error{Code: pq.ErrorCode(tt.code), Constraint: tt.constraint},
+			&pgconn.PgError{Code: tt.code, ConstraintName: tt.constraint},
+			fmt.Errorf("insert user: %w", &pq.Error{Code: pq.ErrorCode(tt.code), Constraint: tt.constraint}),
+		} {
+			class, constraint := classifyDBError(err)
+			if class != tt.class || constraint != tt.constraint {
+				t.Errorf("%T %s: class %d constraint %q, want %d %q", err, tt.code, class, constraint, tt.class, tt.constraint)
+			}
+		}
+	}
+
+	unique := &pq.Error{Code: "23505", Constraint: "users_email_key"}
+	check := &pgconn.PgError{Code: "23514", ConstraintName: "users_status_check"}
+	if !isUniqueViolation(unique) || isUniqueViolation(check) {
+		t.Error("isUniqueViolation")
+	}
+	if !isCheckViolation(check, "users_status_check") || isCheckViolation(check, "users_role_check") || isCheckViolation(unique, "users_email_key") {
+		t.Error("isCheckViolation")
+	}
+}
+
+func TestClassifyMySQLErrors(t *testing.T) {
+	for _, tt := range []struct {
+		number uint16
+		class  dbErrorClass
+	}{
+		{1062, dbErrUniqueViolation},
+		{3819, dbErrCheckViolation},
+		{1213, dbErrSerializationFailure},
+		{1146, dbErrUndefinedTable},
+		{1452, dbErrOther},
+		{1205, dbErrOther},
+	} {
+		err := fmt.Errorf("query: %w", &mysql.MySQLError{Number: tt.number})
+		if class, constraint := classifyDBError(err); class != tt.class || constraint != "" {
+			t.Errorf("MySQL error %d: class %d constraint %q, want %d", tt.number, class, constraint, tt.class)
+		}
+	}
+	if !isUniqueViolation(&mysql.MySQLError{Number: 1062}) || isUniqueViolation(&mysql.MySQLError{Number: 3819}) {
+		t.Error("isUniqueViolation")
+	}
+	// MySQL doesn't name the constraint, so no named check matches
+	if isCheckViolation(&mysql.MySQLError{Number: 3819}, "users_status_check") {
+		t.Error("isCheckViolation matched without a constraint name")
+	}
+}
+
+// SQLite errors can't be made up, so these come from a real database
+func TestClassifySQLiteErrors(t *testing.T) {
+	pool, err := sql.Open("sqlite", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	pool.SetMaxOpenConns(1)
+	if _, err := pool.Exec("CREATE TABLE t (email TEXT UNIQUE, n INTEGER CHECK (n > 0))"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Exec("INSERT INTO t VALUES ('a', 1)"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		query string
+		class dbErrorClass
+	}{
+		{"INSERT INTO t VALUES ('a', 2)", dbErrUniqueViolation},
+		{"INSERT INTO t VALUES ('b', 0)", dbErrCheckViolation},
+		{"SELECT * FROM missing", dbErrUndefinedTable},
+		{"SELEC 1", dbErrOther},
+	} {
+		_, err := pool.Exec(tt.query)
+		if err == nil {
+			t.Errorf("%s: no error", tt.query)
+			continue
+		}
+		if class, _ := classifyDBError(err); class != tt.class {
+			t.Errorf("%s: class %d, want %d (%v)", tt.query, class, tt.class, err)
+		}
+	}
+}
+
+func TestClassifyOtherErrors(t *testing.T) {
+	for _, err := range []error{nil, sql.ErrNoRows, errors.New("23505"), errEmailTaken} {
+		if class, _ := classifyDBError(err); class != dbErrOther {
+			t.Errorf("%v: class %d", err, class)
+		}
+		if isUniqueViolation(err) || isSerializationFailure(err) || isUndefinedTable(err) {
+			t.Errorf("%v classified", err)
+		}
+	}
+}
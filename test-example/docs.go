@@ -0,0 +1,40 @@
+package main
+
+import (
+	"embed"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// API explorer at /docs/: a page that renders /openapi.json and sends
+// requests with the credentials typed into it. Its files are embedded, so it
+// loads nothing from elsewhere. Off with DOCS_ENABLED=false.
+//
+//go:embed docs
+var docsFiles embed.FS
+
+// The explorer's own scripts, styles and requests to this origin, and
+// nothing else; replaces SECURITY_CONTENT_SECURITY_POLICY on its route
+const docsContentSecurityPolicy = "default-src 'none'; script-src 'self'; style-src 'self'; connect-src 'self'; img-src 'self' data:; base-uri 'none'; form-action 'none'; frame-ancestors 'none'"
+
+// Serve the explorer's files, index.html for /docs/
+func getDocs(c *gin.Context) {
+	name := strings.TrimPrefix(c.Param("file"), "/")
+	if name == "" {
+		name = "index.html"
+	}
+	data, err := docsFiles.ReadFile("docs/" + name)
+	if err != nil {
+		noRoute(c)
+		return
+	}
+	if !strings.EqualFold(contentSecurityPolicy, headerOff) {
+		c.Header("Content-Security-Policy", docsContentSecurityPolicy)
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, mime.TypeByExtension(path.Ext(name)), data)
+}
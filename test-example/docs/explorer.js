@@ -0,0 +1,232 @@
+// API explorer: renders ../openapi.json and sends requests from the page
+// with the credentials typed into the header. No inline scripts or styles,
+// so the page works under the docs Content-Security-Policy.
+"use strict";
+
+const specURL = "../openapi.json";
+const methods = ["get", "head", "post", "put", "patch", "delete"];
+let spec;
+
+// An element with attributes and children; strings become text nodes
+function el(tag, attrs, ...children) {
+  const e = document.createElement(tag);
+  for (const [name, value] of Object.entries(attrs || {})) {
+    if (name.startsWith("on")) {
+      e.addEventListener(name.slice(2), value);
+    } else if (value !== undefined && value !== false) {
+      e.setAttribute(name, value === true ? "" : value);
+    }
+  }
+  for (const child of children.flat()) {
+    if (child !== null && child !== undefined) {
+      e.append(child);
+    }
+  }
+  return e;
+}
+
+function resolve(schema) {
+  while (schema && schema.$ref) {
+    schema = spec.components.schemas[schema.$ref.split("/").pop()];
+  }
+  return schema || {};
+}
+
+// A sample value for schema, to start a request body from
+function example(schema, depth = 0) {
+  schema = resolve(schema);
+  if (schema.allOf) return example(schema.allOf[0], depth);
+  if (schema.oneOf) return example(schema.oneOf[0], depth);
+  if (schema.enum) return schema.enum[0];
+  switch (schema.type) {
+    case "object": {
+      const obj = {};
+      if (depth > 3 || !schema.properties) return obj;
+      const names = schema.required && schema.required.length ? schema.required : Object.keys(schema.properties);
+      for (const name of names) obj[name] = example(schema.properties[name], depth + 1);
+      return obj;
+    }
+    case "array":
+      return depth > 3 ? [] : [example(schema.items, depth + 1)];
+    case "integer":
+    case "number":
+      return 0;
+    case "boolean":
+      return false;
+    case "string":
+      if (schema.format === "date-time") return new Date().toISOString();
+      if (schema.format === "email") return "user@example.com";
+      return "";
+  }
+  return null;
+}
+
+// schema with its $refs expanded, for display
+function expand(schema, seen = new Set()) {
+  if (schema && schema.$ref) {
+    const name = schema.$ref.split("/").pop();
+    if (seen.has(name)) return name;
+    return expand(resolve(schema), new Set(seen).add(name));
+  }
+  if (Array.isArray(schema)) return schema.map((s) => expand(s, seen));
+  if (schema && typeof schema === "object") {
+    const out = {};
+    for (const [k, v] of Object.entries(schema)) out[k] = expand(v, seen);
+    return out;
+  }
+  return schema;
+}
+
+function schemaView(label, schema) {
+  return el("details", { class: "schema" },
+    el("summary", {}, label),
+    el("pre", {}, JSON.stringify(expand(schema), null, 2)));
+}
+
+function credentials() {
+  const headers = {};
+  const key = document.getElementById("api-key").value.trim();
+  const bearer = document.getElementById("bearer").value.trim();
+  if (key) headers["X-API-Key"] = key;
+  if (bearer) headers["Authorization"] = "Bearer " + bearer;
+  return headers;
+}
+
+function operationView(path, method, op) {
+  const inputs = [];
+  const form = el("div", { class: "form" });
+
+  for (const p of op.parameters || []) {
+    const input = el("input", { type: "text", placeholder: p.schema.type || "", "data-name": p.name, "data-in": p.in });
+    inputs.push(input);
+    form.append(el("label", {},
+      el("span", { class: "param" }, p.name, p.required ? " *" : "", el("small", {}, " " + p.in)),
+      input,
+      p.description ? el("small", { class: "hint" }, p.description) : null));
+  }
+
+  let body = null;
+  let bodyType = null;
+  if (op.requestBody) {
+    bodyType = Object.keys(op.requestBody.content)[0];
+    const schema = op.requestBody.content[bodyType].schema;
+    if (bodyType === "multipart/form-data") {
+      body = el("div", {});
+      for (const [name, prop] of Object.entries(resolve(schema).properties || {})) {
+        body.append(el("label", {}, el("span", { class: "param" }, name),
+          el("input", { type: prop.format === "binary" ? "file" : "text", "data-name": name })));
+      }
+    } else {
+      body = el("textarea", { rows: 8, spellcheck: "false" });
+      body.value = JSON.stringify(example(schema), null, 2);
+    }
+    form.append(el("label", {}, el("span", { class: "param" }, "Body", el("small", {}, " " + bodyType)), body),
+      schemaView("Body schema", schema));
+  }
+
+  const result = el("div", { class: "result" });
+  const send = el("button", {
+    type: "button",
+    onclick: async () => {
+      let url = path;
+      const query = new URLSearchParams();
+      const headers = credentials();
+      for (const input of inputs) {
+        const value = input.value;
+        if (value === "") continue;
+        const name = input.dataset.name;
+        if (input.dataset.in === "path") url = url.replace("{" + name + "}", encodeURIComponent(value));
+        else if (input.dataset.in === "query") query.append(name, value);
+        else if (input.dataset.in === "header") headers[name] = value;
+      }
+      if ([...query].length) url += "?" + query;
+      const init = { method: method.toUpperCase(), headers };
+      if (body && bodyType === "multipart/form-data") {
+        const data = new FormData();
+        for (const input of body.querySelectorAll("input")) {
+          if (input.type === "file" && input.files[0]) data.append(input.dataset.name, input.files[0]);
+          else if (input.type !== "file" && input.value !== "") data.append(input.dataset.name, input.value);
+        }
+        init.body = data;
+      } else if (body && body.value.trim() !== "") {
+        headers["Content-Type"] = bodyType;
+        init.body = body.value;
+      }
+
+      result.replaceChildren(el("p", {}, init.method + " " + url + " …"));
+      try {
+        const resp = await fetch(url, init);
+        const type = resp.headers.get("Content-Type") || "";
+        let text;
+        if (type.includes("event-stream")) {
+          text = "(event stream; open it with EventSource or curl -N)";
+        } else if (type.startsWith("image/")) {
+          text = "(" + type + ", " + (await resp.blob()).size + " bytes)";
+        } else {
+          text = await resp.text();
+          if (type.includes("json") && text) text = JSON.stringify(JSON.parse(text), null, 2);
+        }
+        const shown = [];
+        for (const [name, value] of resp.headers) shown.push(name + ": " + value);
+        result.replaceChildren(
+          el("p", { class: resp.ok ? "ok" : "failed" }, resp.status + " " + resp.statusText),
+          el("pre", { class: "headers" }, shown.join("\n")),
+          el("pre", {}, text));
+      } catch (err) {
+        result.replaceChildren(el("p", { class: "failed" }, String(err)));
+      }
+    },
+  }, "Send");
+
+  const responses = [];
+  for (const [status, r] of Object.entries(op.responses || {})) {
+    const content = r.content && Object.values(r.content)[0];
+    responses.push(el("li", {}, el("b", {}, status), " " + r.description,
+      content ? schemaView("Schema", content.schema) : null));
+  }
+
+  return el("details", { class: "operation " + method },
+    el("summary", {}, el("span", { class: "method" }, method.toUpperCase()), el("code", {}, path), " ", op.summary || ""),
+    op.description ? el("p", {}, op.description) : null,
+    form,
+    el("div", {}, send),
+    result,
+    el("h4", {}, "Responses"),
+    el("ul", { class: "responses" }, responses));
+}
+
+async function main() {
+  for (const id of ["api-key", "bearer"]) {
+    const input = document.getElementById(id);
+    input.value = sessionStorage.getItem(id) || "";
+    input.addEventListener("change", () => sessionStorage.setItem(id, input.value));
+  }
+
+  const container = document.getElementById("operations");
+  try {
+    const resp = await fetch(specURL);
+    spec = await resp.json();
+  } catch (err) {
+    container.replaceChildren(el("p", { class: "failed" }, "Failed to load " + specURL + ": " + err));
+    return;
+  }
+  document.getElementById("title").textContent = spec.info.title + " " + spec.info.version;
+  document.title = spec.info.title;
+
+  const tags = new Map();
+  for (const [path, item] of Object.entries(spec.paths).sort()) {
+    for (const method of methods) {
+      const op = item[method];
+      if (!op) continue;
+      const tag = (op.tags && op.tags[0]) || "other";
+      if (!tags.has(tag)) tags.set(tag, []);
+      tags.get(tag).push(operationView(path, method, op));
+    }
+  }
+  container.replaceChildren(el("p", { class: "hint" }, spec.info.description || ""));
+  for (const [tag, ops] of tags) {
+    container.append(el("section", {}, el("h2", {}, tag), ops));
+  }
+}
+
+main();
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// One-shot backfill for emails stored before normalization (-normalize-emails)
+//
+// Every email whose normalized form is not shared with another user (deleted
+// or not) is trimmed and lowercased. Emails that would collide are left
+// untouched and reported so the duplicates can be resolved by hand; nothing
+// is merged or deleted.
+func normalizeStoredEmails() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE users u
+		SET email = lower(trim(u.email)), updated_at = NOW(), version = u.version + 1
+		WHERE u.email <> lower(trim(u.email))
+		  AND NOT EXISTS (
+			SELECT 1 FROM users o
+			WHERE o.id <> u.id AND lower(trim(o.email)) = lower(trim(u.email))
+		  )`)
+	if err != nil {
+		return fmt.Errorf("normalize emails: %w", err)
+	}
+	normalized, _ := result.RowsAffected()
+
+	// Arrays are read as text so lib/pq and pgx hand pq.Array the same format
+	rows, err := tx.Query(`
+		SELECT lower(trim(email)),
+		       array_agg(id::text ORDER BY created_at)::text,
+		       array_agg(email ORDER BY created_at)::text
+		FROM users
+		GROUP BY 1
+		HAVING count(*) > 1
+		ORDER BY 1`)
+	if err != nil {
+		return fmt.Errorf("find duplicate emails: %w", err)
+	}
+	defer rows.Close()
+
+	duplicates := 0
+	for rows.Next() {
+		var email string
+		var ids, emails []string
+		if err := rows.Scan(&email, pq.Array(&ids), pq.Array(&emails)); err != nil {
+			return fmt.Errorf("find duplicate emails: %w", err)
+		}
+		duplicates++
+		fmt.Printf("duplicate %s:\n", email)
+		for i := range ids {
+			fmt.Printf("  %s %s\n", ids[i], emails[i])
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("find duplicate emails: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	fmt.Printf("normalized %d email(s); %d duplicate group(s) left for manual resolution\n", normalized, duplicates)
+	return nil
+}
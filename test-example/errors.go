@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Machine-readable error codes. These are part of the API: clients match on
+// them, so existing codes must not change.
+const (
+	codeInvalidRequest       = "invalid_request"
+	codeRouteNotFound        = "route_not_found"
+	codeMethodNotAllowed     = "method_not_allowed"
+	codeValidationFailed     = "validation_failed"
+	codeUserNotFound         = "user_not_found"
+	codeAvatarNotFound       = "avatar_not_found"
+	codeAPIKeyNotFound       = "api_key_not_found"
+	codeWebhookNotFound      = "webhook_not_found"
+	codeAlreadyVerified      = "already_verified"
+	codeEmailConflict        = "email_conflict"
+	codeInvalidTransition    = "invalid_status_transition"
+	codePreconditionFailed   = "precondition_failed"
+	codePreconditionRequired = "precondition_required"
+	codePayloadTooLarge      = "payload_too_large"
+	codeUnsupportedMedia     = "unsupported_media_type"
+	codeNotAcceptable        = "not_acceptable"
+	codeIdempotencyConflict  = "idempotency_conflict"
+	codeIdempotencyKeyReused = "idempotency_key_reused"
+	codeTimeout              = "timeout"
+	codeNotImplemented       = "not_implemented"
+	codeUnauthorized         = "unauthorized"
+	codeInvalidCredentials   = "invalid_credentials"
+	codeAccountLocked        = "account_locked"
+	codeInvalidToken         = "invalid_token"
+	codeTokenExpired         = "token_expired"
+	codeTokenUsed            = "token_used"
+	codeForbidden            = "forbidden"
+	codeMaintenance          = "maintenance"
+	codeRateLimited          = "rate_limited"
+	codeQuotaExceeded        = "quota_exceeded"
+	codeInternal             = "internal"
+)
+
+// HTTP status for each error code. Malformed requests are 400, while
+// well-formed requests that fail business rules are 422 so clients can tell
+// "fix the encoding" from "fix the data".
+var codeStatus = map[string]int{
+	codeInvalidRequest:       http.StatusBadRequest,
+	codeRouteNotFound:        http.StatusNotFound,
+	codeMethodNotAllowed:     http.StatusMethodNotAllowed,
+	codeValidationFailed:     http.StatusUnprocessableEntity,
+	codeUserNotFound:         http.StatusNotFound,
+	codeAvatarNotFound:       http.StatusNotFound,
+	codeAPIKeyNotFound:       http.StatusNotFound,
+	codeWebhookNotFound:      http.StatusNotFound,
+	codeAlreadyVerified:      http.StatusConflict,
+	codeEmailConflict:        http.StatusConflict,
+	codeInvalidTransition:    http.StatusUnprocessableEntity,
+	codePreconditionFailed:   http.StatusPreconditionFailed,
+	codePreconditionRequired: http.StatusPreconditionRequired,
+	codePayloadTooLarge:      http.StatusRequestEntityTooLarge,
+	codeUnsupportedMedia:     http.StatusUnsupportedMediaType,
+	codeNotAcceptable:        http.StatusNotAcceptable,
+	codeIdempotencyConflict:  http.StatusConflict,
+	codeIdempotencyKeyReused: http.StatusUnprocessableEntity,
+	codeTimeout:              http.StatusGatewayTimeout,
+	codeNotImplemented:       http.StatusNotImplemented,
+	codeUnauthorized:         http.StatusUnauthorized,
+	codeInvalidCredentials:   http.StatusUnauthorized,
+	codeAccountLocked:        http.StatusLocked,
+	codeInvalidToken:         http.StatusBadRequest,
+	codeTokenExpired:         http.StatusGone,
+	codeTokenUsed:            http.StatusGone,
+	codeForbidden:            http.StatusForbidden,
+	codeMaintenance:          http.StatusServiceUnavailable,
+	codeRateLimited:          http.StatusTooManyRequests,
+	codeQuotaExceeded:        http.StatusTooManyRequests,
+	codeInternal:             http.StatusInternalServerError,
+}
+
+// Title of each error code in problem+json bodies: a fixed summary of the
+// problem type, unlike the message which describes the occurrence
+var codeTitle = map[string]string{
+	codeInvalidRequest:       "Invalid request",
+	codeRouteNotFound:        "Route not found",
+	codeMethodNotAllowed:     "Method not allowed",
+	codeValidationFailed:     "Validation failed",
+	codeUserNotFound:         "User not found",
+	codeAvatarNotFound:       "Avatar not found",
+	codeAPIKeyNotFound:       "API key not found",
+	codeWebhookNotFound:      "Webhook not found",
+	codeAlreadyVerified:      "Email already verified",
+	codeEmailConflict:        "Email already in use",
+	codeInvalidTransition:    "Invalid status transition",
+	codePreconditionFailed:   "Precondition failed",
+	codePreconditionRequired: "Precondition required",
+	codePayloadTooLarge:      "Payload too large",
+	codeUnsupportedMedia:     "Unsupported media type",
+	codeNotAcceptable:        "Not acceptable",
+	codeIdempotencyConflict:  "Idempotency key conflict",
+	codeIdempotencyKeyReused: "Idempotency key reused",
+	codeTimeout:              "Request timed out",
+	codeNotImplemented:       "Not implemented",
+	codeUnauthorized:         "Unauthorized",
+	codeInvalidCredentials:   "Invalid credentials",
+	codeAccountLocked:        "Account locked",
+	codeInvalidToken:         "Invalid token",
+	codeTokenExpired:         "Token expired",
+	codeTokenUsed:            "Token already used",
+	codeForbidden:            "Forbidden",
+	codeMaintenance:          "Under maintenance",
+	codeRateLimited:          "Rate limited",
+	codeQuotaExceeded:        "Quota exceeded",
+	codeInternal:             "Internal error",
+}
+
+// Error body formats: errorResponse, or RFC 7807 problemDetails
+const (
+	errorFormatEnvelope = "envelope"
+	errorFormatProblem  = "problem"
+)
+
+const mediaProblem = "application/problem+json"
+
+var (
+	errorFormat = errorFormatEnvelope
+	// The type of a problem is this followed by its code
+	errorTypeBase = "urn:sample-api:error:"
+)
+
+// Status logged for requests the client abandoned (nginx's "client closed
+// request"); the client never sees it
+const statusClientClosed = 499
+
+// A validation failure of a single field: which field, the rule it broke and
+// a human-readable message. It is also an error so validators can return it.
+type fieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+func (e fieldError) Error() string {
+	return e.Message
+}
+
+// The body of every error response: {"error": {"code", "message", "details"}}
+type apiError struct {
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	Details   []fieldError `json:"details,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+}
+
+type errorResponse struct {
+	Error apiError `json:"error"`
+}
+
+// The body of every error response in the problem format (RFC 7807), with
+// code, request_id and errors (the fieldError details) as extensions
+type problemDetails struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail"`
+	Instance  string       `json:"instance"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []fieldError `json:"errors,omitempty"`
+}
+
+// Context key holding the request ID (see assignRequestID)
+const requestIDKey = "requestID"
+
+var errInvalidEmail = fieldError{Field: "email", Rule: "email", Message: "Invalid email format"}
+
+// Respond with a structured error and stop the handler chain. The status
+// comes from codeStatus; the body is a problemDetails when ERROR_FORMAT is
+// problem or the client accepts application/problem+json, otherwise an
+// errorResponse.
+func respondError(c *gin.Context, code, message string, details ...fieldError) {
+	status, ok := codeStatus[code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	requestID := c.GetString(requestIDKey)
+	if !wantsProblem(c.Request) {
+		c.AbortWithStatusJSON(status, errorResponse{apiError{Code: code, Message: message, Details: details, RequestID: requestID}})
+		return
+	}
+
+	title, ok := codeTitle[code]
+	if !ok {
+		title = http.StatusText(status)
+	}
+	c.Header("Content-Type", mediaProblem)
+	c.AbortWithStatusJSON(status, problemDetails{
+		Type:      errorTypeBase + code,
+		Title:     title,
+		Status:    status,
+		Detail:    message,
+		Instance:  c.Request.URL.Path,
+		Code:      code,
+		RequestID: requestID,
+		Errors:    details,
+	})
+}
+
+// Whether errors are rendered as problem+json: always with ERROR_FORMAT=problem,
+// otherwise when Accept names application/problem+json with a non-zero q
+func wantsProblem(r *http.Request) bool {
+	if errorFormat == errorFormatProblem {
+		return true
+	}
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			if rng, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && rng == mediaProblem {
+				return acceptQuality(part, mediaProblem) > 0
+			}
+		}
+	}
+	return false
+}
+
+// Respond validation_failed for a validation error; a fieldError becomes the
+// single entry of details
+func respondInvalid(c *gin.Context, err error) {
+	var fe fieldError
+	if errors.As(err, &fe) {
+		respondError(c, codeValidationFailed, fe.Message, fe)
+		return
+	}
+	respondError(c, codeValidationFailed, err.Error())
+}
+
+// Respond 500 with a generic message; the cause is not exposed to clients
+//
+// Failures caused by the request context are reported as what they are: 504
+// when the request timeout expired, and nothing (only a log line) when the
+// client went away.
+func respondInternal(c *gin.Context, message string) {
+	switch c.Request.Context().Err() {
+	case context.DeadlineExceeded:
+		respondError(c, codeTimeout, "Request timed out")
+	case context.Canceled:
+		loggerFrom(c.Request.Context()).Info("Client aborted the request")
+		c.AbortWithStatus(statusClientClosed)
+	default:
+		respondError(c, codeInternal, message)
+	}
+}
+
+// A failed repository call as the error respondInternal would answer, for
+// the gRPC and GraphQL handlers; the cause is logged unless the context ended
+func internalError(ctx context.Context, message string, err error) error {
+	if ctx.Err() == nil {
+		loggerFrom(ctx).Error(message, "error", err)
+	}
+	return apiError{Code: codeInternal, Message: message}
+}
+
+// Handler for requests that match no route
+func noRoute(c *gin.Context) {
+	respondError(c, codeRouteNotFound, "No route for "+c.Request.Method+" "+c.Request.URL.Path)
+}
+
+// Handler for requests whose path exists but not for the method. OPTIONS is
+// answered with 204 and the Allow header; other methods get 405.
+func noMethod(r *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		allowed := allowedMethods(r.Routes(), c.Request.URL.Path)
+		c.Header("Allow", strings.Join(append(allowed, http.MethodOptions), ", "))
+
+		if c.Request.Method == http.MethodOptions {
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		respondError(c, codeMethodNotAllowed, c.Request.Method+" is not allowed on "+c.Request.URL.Path)
+	}
+}
+
+// Methods registered for routes matching path, in registration order
+func allowedMethods(routes gin.RoutesInfo, path string) []string {
+	methods := []string{}
+	seen := map[string]bool{}
+	for _, route := range routes {
+		if !seen[route.Method] && routeMatches(route.Path, path) {
+			methods = append(methods, route.Method)
+			seen[route.Method] = true
+		}
+	}
+	return methods
+}
+
+// Check whether a request path matches a route pattern with :param and
+// *catchall segments
+func routeMatches(pattern, path string) bool {
+	patternParts := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathParts := strings.Split(strings.Trim(path, "/"), "/")
+	for i, part := range patternParts {
+		if strings.HasPrefix(part, "*") {
+			return true
+		}
+		if i >= len(pathParts) {
+			return false
+		}
+		if !strings.HasPrefix(part, ":") && part != pathParts[i] {
+			return false
+		}
+	}
+	return len(patternParts) == len(pathParts)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A request answered with an error, and the status and code it is answered
+// with
+type errorCase struct {
+	name, method, path string
+	body               interface{}
+	status             int
+	code               string
+}
+
+// The error paths that don't need the database
+var errorCases = []errorCase{
+	{"invalid id", "GET", "/api/users/42", nil, http.StatusBadRequest, codeInvalidRequest},
+	{"invalid query", "GET", "/api/users?limit=0", nil, http.StatusBadRequest, codeInvalidRequest},
+	{"malformed body", "POST", "/api/users", `{"name":`, http.StatusBadRequest, codeInvalidRequest},
+	{"validation", "POST", "/api/users", map[string]string{"name": "Ada", "email": "nope"}, http.StatusUnprocessableEntity, codeValidationFailed},
+	{"too large", "POST", "/api/users", `{"name": "` + strings.Repeat("a", 2<<20) + `"}`, http.StatusRequestEntityTooLarge, codePayloadTooLarge},
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	r := gin.New()
+	r.Use(limitBody(maxBodyBytes), validateUserID())
+	r.GET("/api/users", getUsers)
+	r.GET("/api/users/:id", getUserByID)
+	r.POST("/api/users", createUser)
+
+	for _, tt := range errorCases {
+		w := request(r, tt.method, tt.path, tt.body)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+			continue
+		}
+		if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "application/json") {
+			t.Errorf("%s: Content-Type %q", tt.name, contentType)
+		}
+		var got map[string]map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || len(got) != 1 || got["error"] == nil {
+			t.Errorf("%s: body is not an error envelope: %s", tt.name, w.Body)
+			continue
+		}
+		e := got["error"]
+		if e["code"] != tt.code || e["message"] == "" {
+			t.Errorf("%s: error %v, want code %s and a message", tt.name, e, tt.code)
+		}
+		if tt.code == codeValidationFailed {
+			details, _ := e["details"].([]interface{})
+			if len(details) != 1 || details[0].(map[string]interface{})["field"] != "email" {
+				t.Errorf("%s: details %v, want the email field", tt.name, e["details"])
+			}
+		} else if _, ok := e["details"]; ok {
+			t.Errorf("%s: details %v on a %s error", tt.name, e["details"], tt.code)
+		}
+	}
+}
+
+// Internal errors don't expose their cause
+func TestRespondInternal(t *testing.T) {
+	c, w := testContext("GET", "/api/users")
+	respondInternal(c, "Failed to fetch users")
+	if w.Code != http.StatusInternalServerError || !c.IsAborted() {
+		t.Errorf("status %d, aborted %v", w.Code, c.IsAborted())
+	}
+	var body struct{ Error apiError }
+	decode(t, w, &body)
+	if body.Error.Code != codeInternal || body.Error.Message != "Failed to fetch users" || body.Error.Details != nil {
+		t.Errorf("error %+v", body.Error)
+	}
+}
+
+func TestUnknownRoutesAndMethods(t *testing.T) {
+	r := gin.New()
+	r.HandleMethodNotAllowed = true
+	r.NoRoute(noRoute)
+	r.NoMethod(noMethod(r))
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.GET("/api/users", ok)
+	r.POST("/api/users", ok)
+	r.DELETE("/api/users", ok)
+	r.GET("/api/users/:id", ok)
+	r.HEAD("/api/users/:id", ok)
+	r.PUT("/api/users/:id", ok)
+	r.PATCH("/api/users/:id", ok)
+	r.DELETE("/api/users/:id", ok)
+	r.POST("/api/users/:id/suspend", ok)
+	id := "6f1c2a4e-8b3d-4c5e-9f7a-1b2c3d4e5f60"
+
+	for _, tt := range []struct {
+		method, path string
+		status       int
+		// The Allow header; empty when there is none
+		allow string
+	}{
+		{"GET", "/api/user", http.StatusNotFound, ""},
+		{"GET", "/api/userz/" + id, http.StatusNotFound, ""},
+		{"GET", "/api/v2/users", http.StatusNotFound, ""},
+		{"POST", "/api/users/" + id + "/suspendd", http.StatusNotFound, ""},
+		{"PUT", "/api/users", http.StatusMethodNotAllowed, "GET, POST, DELETE, OPTIONS"},
+		{"POST", "/api/users/" + id, http.StatusMethodNotAllowed, "GET, DELETE, HEAD, PUT, PATCH, OPTIONS"},
+		{"GET", "/api/users/" + id + "/suspend", http.StatusMethodNotAllowed, "POST, OPTIONS"},
+		{"OPTIONS", "/api/users/" + id, http.StatusNoContent, "GET, DELETE, HEAD, PUT, PATCH, OPTIONS"},
+		{"OPTIONS", "/api/users", http.StatusNoContent, "GET, POST, DELETE, OPTIONS"},
+	} {
+		w := request(r, tt.method, tt.path, nil)
+		if w.Code != tt.status {
+			t.Errorf("%s %s: status %d, want %d: %s", tt.method, tt.path, w.Code, tt.status, w.Body)
+		}
+		if got := w.Header().Get("Allow"); got != tt.allow {
+			t.Errorf("%s %s: Allow %q, want %q", tt.method, tt.path, got, tt.allow)
+		}
+		switch tt.status {
+		case http.StatusNoContent:
+			if w.Body.Len() != 0 {
+				t.Errorf("%s %s: body %q", tt.method, tt.path, w.Body)
+			}
+		case http.StatusNotFound, http.StatusMethodNotAllowed:
+			var body struct{ Error apiError }
+			decode(t, w, &body)
+			if body.Error.Code != codeRouteNotFound && body.Error.Code != codeMethodNotAllowed {
+				t.Errorf("%s %s: code %q", tt.method, tt.path, body.Error.Code)
+			}
+		}
+	}
+}
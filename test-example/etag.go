@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Strong ETag for a user representation, derived from the row version which
+// is incremented on every write. variant distinguishes representations of the
+// same row (e.g. ?fields=) and is empty for the full user.
+func userETag(version int64, variant string) string {
+	if variant == "" {
+		return fmt.Sprintf(`"%d"`, version)
+	}
+	sum := sha256.Sum256([]byte(variant))
+	return fmt.Sprintf(`"%d-%s"`, version, hex.EncodeToString(sum[:4]))
+}
+
+// Check an If-None-Match header value against an ETag. Uses weak comparison
+// as required for If-None-Match, so W/"x" matches "x", and the ETag of the
+// gzipped body matches too.
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = identityETag(strings.TrimSpace(candidate))
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse an If-Match header into the user versions it accepts. wildcard is true for
+// "*". Weak ETags never match (If-Match uses strong comparison), so a header
+// with none of our strong ETags yields an empty list. The ETag of a gzipped
+// body names the same version.
+func parseIfMatch(header string) (versions []int64, wildcard bool) {
+	versions = []int64{}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = identityETag(strings.TrimSpace(candidate))
+		if candidate == "*" {
+			return nil, true
+		}
+		if len(candidate) < 2 || candidate[0] != '"' || candidate[len(candidate)-1] != '"' {
+			continue
+		}
+		// Only full-representation ETags identify a version on their own
+		if v, err := strconv.ParseInt(candidate[1:len(candidate)-1], 10, 64); err == nil {
+			versions = append(versions, v)
+		}
+	}
+	return versions, false
+}
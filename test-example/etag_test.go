@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEtagMatches(t *testing.T) {
+	etag := userETag(3, "")
+	for _, tt := range []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{`"3"`, true},
+		{`W/"3"`, true},
+		{`"1", "2", "3"`, true},
+		{` "2" ,W/"3" `, true},
+		{"*", true},
+		{`"4"`, false},
+		{`"1", "2"`, false},
+		{`3`, false},
+		{`"3-abcd"`, false},
+		{`W/"30"`, false},
+	} {
+		if got := etagMatches(tt.header, etag); got != tt.want {
+			t.Errorf("etagMatches(%q, %s) = %v, want %v", tt.header, etag, got, tt.want)
+		}
+	}
+}
+
+func TestParseIfMatch(t *testing.T) {
+	for _, tt := range []struct {
+		header   string
+		versions []int64
+		wildcard bool
+	}{
+		// A missing header is not passed here; an empty one matches nothing
+		{"", []int64{}, false},
+		{`"3"`, []int64{3}, false},
+		{`"3", "5"`, []int64{3, 5}, false},
+		{"*", nil, true},
+		{`"3", *`, nil, true},
+		// Weak ETags never match If-Match
+		{`W/"3"`, []int64{}, false},
+		// Nor do representations restricted by ?fields=
+		{userETag(3, "id,name"), []int64{}, false},
+		{`3`, []int64{}, false},
+		{`"abc"`, []int64{}, false},
+		{`"`, []int64{}, false},
+	} {
+		versions, wildcard := parseIfMatch(tt.header)
+		if !reflect.DeepEqual(versions, tt.versions) || wildcard != tt.wildcard {
+			t.Errorf("parseIfMatch(%q) = %v, %v; want %v, %v", tt.header, versions, wildcard, tt.versions, tt.wildcard)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Server-Sent Events: GET /api/users/events streams the user events in the
+// outbox as they are committed, on any instance. Each event's SSE id is its
+// outbox id, which only grows, so a client reconnecting with Last-Event-ID
+// first gets the events it missed, as long as the outbox still has them
+// (OUTBOX_RETENTION).
+
+// Interval of the comments that keep idle streams open through proxies
+const streamHeartbeatInterval = 15 * time.Second
+
+// How long the stream waits for a lower outbox id to commit before passing
+// over it. Ids are taken in order but can commit out of order, and a
+// rolled-back transaction leaves a gap that never fills.
+const streamGapWait = 5 * time.Second
+
+// Events buffered per stream; a client that falls this far behind is
+// disconnected and catches up from the outbox when it reconnects
+const streamBufferSize = 64
+
+// A user event as stored in the outbox
+type outboxEvent struct {
+	ID      int64
+	Event   string
+	Payload string
+}
+
+// Tails the outbox for the open streams
+type userEventHub struct {
+	mu   sync.Mutex
+	subs map[chan outboxEvent]struct{}
+	// Id of the last event handed to the streams; loaded is false until it
+	// has been read
+	last   int64
+	loaded bool
+	// When the gap after last was first seen
+	gapSince time.Time
+	closed   bool
+}
+
+var userEventStreams = &userEventHub{subs: map[chan outboxEvent]struct{}{}}
+
+// Read the id of the newest outbox event, where the streams start
+func (h *userEventHub) load(ctx context.Context) error {
+	if h.loaded {
+		return nil
+	}
+	if err := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(id), 0) FROM outbox").Scan(&h.last); err != nil {
+		return err
+	}
+	h.loaded = true
+	return nil
+}
+
+// A channel of the events after the returned id; closed when the stream
+// falls behind or the server shuts down
+func (h *userEventHub) subscribe(ctx context.Context) (chan outboxEvent, int64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.load(ctx); err != nil {
+		return nil, 0, err
+	}
+	ch := make(chan outboxEvent, streamBufferSize)
+	if h.closed {
+		close(ch)
+	} else {
+		h.subs[ch] = struct{}{}
+	}
+	return ch, h.last, nil
+}
+
+func (h *userEventHub) unsubscribe(ch chan outboxEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// End every stream; called when the server starts shutting down, so
+// clients reconnect to another instance
+func (h *userEventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch := range h.subs {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// Open streams
+func (h *userEventHub) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+// Hand the outbox events committed since the last call to the streams, in
+// id order; called by the outbox dispatcher on every poll
+func (h *userEventHub) tail(ctx context.Context) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.load(ctx); err != nil {
+		loggerFrom(ctx).Error("Failed to read outbox position", "error", err)
+		return
+	}
+	events, err := outboxEventsAfter(ctx, h.last, 0)
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to read outbox for event streams", "error", err)
+		return
+	}
+	for _, e := range events {
+		if e.ID != h.last+1 {
+			if h.gapSince.IsZero() {
+				h.gapSince = time.Now()
+			}
+			if time.Since(h.gapSince) < streamGapWait {
+				return
+			}
+		}
+		h.gapSince = time.Time{}
+		h.last = e.ID
+		for ch := range h.subs {
+			select {
+			case ch <- e:
+			default:
+				delete(h.subs, ch)
+				close(ch)
+			}
+		}
+	}
+}
+
+// Up to outboxBatchSize outbox events after id, and up to upTo unless it
+// is 0
+func outboxEventsAfter(ctx context.Context, id, upTo int64) ([]outboxEvent, error) {
+	query, args := bindQuery("SELECT id, event, payload FROM outbox WHERE id > $1 ORDER BY id LIMIT $2", id, outboxBatchSize)
+	if upTo > 0 {
+		query, args = bindQuery("SELECT id, event, payload FROM outbox WHERE id > $1 AND id <= $2 ORDER BY id LIMIT $3", id, upTo, outboxBatchSize)
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []outboxEvent{}
+	for rows.Next() {
+		var e outboxEvent
+		if err := rows.Scan(&e.ID, &e.Event, &e.Payload); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// Stream user events until the client disconnects or the server shuts
+// down. Starts after Last-Event-ID (or ?last_event_id, for clients that
+// can't set headers) when given, else with the next event.
+func streamUserEvents(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	after := int64(-1)
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+	if lastEventID != "" {
+		id, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || id < 0 {
+			respondError(c, codeInvalidRequest, "Last-Event-ID must be an event id")
+			return
+		}
+		after = id
+	}
+
+	events, upTo, err := userEventStreams.subscribe(ctx)
+	if err != nil {
+		respondInternal(c, "Failed to open event stream")
+		return
+	}
+	defer userEventStreams.unsubscribe(events)
+	if after < 0 {
+		after = upTo
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	// Stops nginx from buffering the stream
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	// Events missed since Last-Event-ID, from the outbox
+	for after < upTo {
+		missed, err := outboxEventsAfter(ctx, after, upTo)
+		if err != nil {
+			loggerFrom(ctx).Error("Failed to replay user events", "after", after, "error", err)
+			return
+		}
+		if len(missed) == 0 {
+			break
+		}
+		for _, e := range missed {
+			if !writeEvent(c, e) {
+				return
+			}
+			after = e.ID
+		}
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(c.Writer, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if e.ID > after && !writeEvent(c, e) {
+				return
+			}
+		}
+	}
+}
+
+// Write one event and flush it; false once the client is gone
+func writeEvent(c *gin.Context, e outboxEvent) bool {
+	if _, err := fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Event, e.Payload); err != nil {
+		return false
+	}
+	c.Writer.Flush()
+	return true
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/users/export writes every matching user as a line of JSON
+// (NDJSON), straight from the query's rows, so neither side holds the whole
+// table in memory. It is exempt from REQUEST_TIMEOUT; a client that
+// disconnects cancels the query.
+
+const mediaNDJSON = "application/x-ndjson"
+
+// Users written between flushes of the response
+const exportFlushRows = 500
+
+// Export the users matching the list filters, and with ?since= only those
+// updated or deleted at or after it
+func exportUsers(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	filter, err := parseUserFilter(c)
+	if err != nil {
+		respondError(c, codeInvalidRequest, err.Error())
+		return
+	}
+	if filter.UpdatedSince, err = parseTimeParam(c, "since"); err != nil {
+		respondError(c, codeInvalidRequest, err.Error())
+		return
+	}
+
+	fields, err := parseFields(c.Query("fields"))
+	if err != nil {
+		respondError(c, codeInvalidRequest, err.Error())
+		return
+	}
+
+	c.Header("Content-Type", mediaNDJSON)
+	c.Status(http.StatusOK)
+
+	enc := json.NewEncoder(c.Writer)
+	written := 0
+	err = repositoriesFrom(ctx).reader.Each(ctx, userListQuery{Filter: filter, Fields: fields}, func(u User) error {
+		if err := enc.Encode(renderUser(u, fields)); err != nil {
+			return err
+		}
+		written++
+		if written%exportFlushRows == 0 {
+			c.Writer.Flush()
+		}
+		return nil
+	})
+	switch {
+	case err == nil:
+	case !c.Writer.Written():
+		if ctx.Err() == nil {
+			loggerFrom(ctx).Error("Failed to export users", "error", err)
+		}
+		respondInternal(c, "Failed to export users")
+	case ctx.Err() != nil:
+		// The client went away, which canceled the query
+	default:
+		loggerFrom(ctx).Error("Export failed", "written", written, "error", err)
+		// Too late for an error status; leaving out the final chunk tells
+		// the client the export is incomplete
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A user field that can be selected via ?fields=: its JSON name, the SQL
+// expression it is read from, and accessors into the User struct
+type userField struct {
+	name   string
+	column string
+	dest   func(u *User) interface{}
+	value  func(u *User) interface{}
+}
+
+// All selectable user fields in SELECT order. This is the whitelist for
+// ?fields= and the single source of the column list used by user queries.
+var userFields = []userField{
+	{"id", "id", func(u *User) interface{} { return &u.ID }, func(u *User) interface{} { return u.ID }},
+	{"email", "email", func(u *User) interface{} { return &u.Email }, func(u *User) interface{} { return u.Email }},
+	{"email_verified", "email_verified", func(u *User) interface{} { return &u.EmailVerified }, func(u *User) interface{} { return u.EmailVerified }},
+	// Legacy rows may predate the NOT NULL constraint on name
+	{"name", "COALESCE(name, '')", func(u *User) interface{} { return &u.Name }, func(u *User) interface{} { return u.Name }},
+	{"created_at", "created_at", func(u *User) interface{} { return &u.CreatedAt }, func(u *User) interface{} { return u.CreatedAt }},
+	// Rows that were never updated may have a NULL updated_at
+	{"updated_at", "COALESCE(updated_at, created_at)", func(u *User) interface{} { return &u.UpdatedAt }, func(u *User) interface{} { return u.UpdatedAt }},
+	{"deleted_at", "deleted_at", func(u *User) interface{} { return &u.DeletedAt }, func(u *User) interface{} { return u.DeletedAt }},
+	{"phone", "phone", func(u *User) interface{} { return &u.Phone }, func(u *User) interface{} { return u.Phone }},
+	{"status", "status", func(u *User) interface{} { return &u.Status }, func(u *User) interface{} { return u.Status }},
+	{"role", "role", func(u *User) interface{} { return &u.Role }, func(u *User) interface{} { return u.Role }},
+	{"version", "version", func(u *User) interface{} { return &u.Version }, func(u *User) interface{} { return u.Version }},
+	{"metadata", "metadata", func(u *User) interface{} { return &u.Metadata }, func(u *User) interface{} { return u.Metadata }},
+	// Versioned by upload time so clients can cache the image indefinitely
+	{"avatar_url", "CASE WHEN avatar_updated_at IS NULL THEN NULL ELSE '/api/v1/users/' || id || '/avatar?v=' || floor(extract(epoch FROM avatar_updated_at))::bigint END", func(u *User) interface{} { return &u.AvatarURL }, func(u *User) interface{} { return u.AvatarURL }},
+}
+
+// Look up a field by JSON name
+func findUserField(name string) (userField, bool) {
+	for _, f := range userFields {
+		if f.name == name {
+			return f, true
+		}
+	}
+	return userField{}, false
+}
+
+// Names of all selectable fields, for error messages
+func userFieldNames() []string {
+	names := make([]string, len(userFields))
+	for i, f := range userFields {
+		names[i] = f.name
+	}
+	return names
+}
+
+// Parse a ?fields= parameter. An empty parameter returns nil, meaning the full
+// user. id is always included even when not requested.
+func parseFields(param string) ([]userField, error) {
+	if strings.TrimSpace(param) == "" {
+		return nil, nil
+	}
+
+	requested := map[string]bool{"id": true}
+	for _, name := range strings.Split(param, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := findUserField(name); !ok {
+			return nil, fmt.Errorf("unknown field %q (valid fields: %s)", name, strings.Join(userFieldNames(), ", "))
+		}
+		requested[name] = true
+	}
+
+	// Keep SELECT order stable regardless of the order requested
+	fields := []userField{}
+	for _, f := range userFields {
+		if requested[f.name] {
+			fields = append(fields, f)
+		}
+	}
+	return fields, nil
+}
+
+// Return fields with the named field added if it is missing
+func withField(fields []userField, name string) []userField {
+	for _, f := range fields {
+		if f.name == name {
+			return fields
+		}
+	}
+	f, _ := findUserField(name)
+	return append(append([]userField{}, fields...), f)
+}
+
+// Comma-separated SQL column list for the given fields
+func selectColumns(fields []userField) string {
+	columns := make([]string, len(fields))
+	for i, f := range fields {
+		columns[i] = f.column
+	}
+	return strings.Join(columns, ", ")
+}
+
+// Scan destinations for the given fields, in SELECT order
+func scanDest(u *User, fields []userField) []interface{} {
+	dest := make([]interface{}, len(fields))
+	for i, f := range fields {
+		dest[i] = f.dest(u)
+	}
+	return dest
+}
+
+// Render a user restricted to the given fields; nil fields renders the full user
+func renderUser(u User, fields []userField) interface{} {
+	if fields == nil {
+		return u
+	}
+	out := gin.H{}
+	for _, f := range fields {
+		out[f.name] = f.value(&u)
+	}
+	return out
+}
+
+// Render a list of users restricted to the given fields
+func renderUsers(users []User, fields []userField) interface{} {
+	if fields == nil {
+		return users
+	}
+	out := make([]interface{}, len(users))
+	for i, u := range users {
+		out[i] = renderUser(u, fields)
+	}
+	return out
+}
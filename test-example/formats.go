@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Response media types of the user read endpoints, chosen with Accept
+const (
+	mediaJSON = "application/json"
+	mediaXML  = "application/xml"
+	mediaCSV  = "text/csv"
+	// What older XML clients ask for; answered like application/xml
+	mediaTextXML = "text/xml"
+)
+
+// Media types getUsers and getUserByID answer in, the default first
+var userMediaTypes = []string{mediaJSON, mediaXML, mediaCSV, mediaTextXML}
+
+// Pick the response media type from the Accept header: the offer with the
+// highest q-value, ties going to the earlier one. Without Accept it is the
+// first offer. Answers 406 and returns "" when no offer is acceptable.
+func negotiateFormat(c *gin.Context, offers []string) string {
+	c.Writer.Header().Add("Vary", "Accept")
+	accept := strings.Join(c.Request.Header.Values("Accept"), ",")
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		if q := acceptQuality(accept, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	if best == "" {
+		respondError(c, codeNotAcceptable, "Acceptable media types: "+strings.Join(offers, ", "))
+	}
+	return best
+}
+
+// The q-value Accept gives mediaType through its most specific matching
+// range; 0 when no range matches
+func acceptQuality(accept, mediaType string) float64 {
+	group, _, _ := strings.Cut(mediaType, "/")
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		rng, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		s := 0
+		switch rng {
+		case mediaType:
+			s = 2
+		case group + "/*":
+			s = 1
+		case "*/*":
+		default:
+			continue
+		}
+		if s <= specificity {
+			continue
+		}
+		specificity, q = s, 1
+		if v, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil && f >= 0 && f <= 1 {
+				q = f
+			}
+		}
+	}
+	return q
+}
+
+// Write users as XML or CSV, a user at a time: <users><user>…</user></users>
+// (next_cursor an attribute in cursor mode), or a header row and a row per
+// user (next_cursor in X-Next-Cursor)
+func writeUsers(c *gin.Context, format string, users []User, fields []userField, nextCursor *string) {
+	if format == mediaCSV && nextCursor != nil {
+		c.Header("X-Next-Cursor", *nextCursor)
+	}
+	startStream(c, format)
+
+	var err error
+	if format == mediaCSV {
+		err = writeUsersCSV(c.Writer, users, fields)
+	} else {
+		err = writeUsersXML(c.Writer, users, fields, nextCursor)
+	}
+	if err != nil && c.Request.Context().Err() == nil {
+		loggerFrom(c.Request.Context()).Error("Failed to write users", "format", format, "error", err)
+	}
+}
+
+// Write one user as XML (<user>…</user>) or CSV (a header row and its row)
+func writeUser(c *gin.Context, format string, user User, fields []userField) {
+	startStream(c, format)
+
+	var err error
+	if format == mediaCSV {
+		err = writeUsersCSV(c.Writer, []User{user}, fields)
+	} else {
+		err = xml.NewEncoder(c.Writer).Encode(xmlUser{user, fields})
+	}
+	if err != nil && c.Request.Context().Err() == nil {
+		loggerFrom(c.Request.Context()).Error("Failed to write user", "format", format, "error", err)
+	}
+}
+
+// Send the 200 status and Content-Type before the rows
+func startStream(c *gin.Context, format string) {
+	c.Header("Content-Type", format+"; charset=utf-8")
+	c.Status(http.StatusOK)
+	if format != mediaCSV {
+		_, _ = io.WriteString(c.Writer, xml.Header)
+	}
+}
+
+func writeUsersXML(w io.Writer, users []User, fields []userField, nextCursor *string) error {
+	enc := xml.NewEncoder(w)
+	start := xml.StartElement{Name: xml.Name{Local: "users"}}
+	if nextCursor != nil {
+		start.Attr = []xml.Attr{{Name: xml.Name{Local: "next_cursor"}, Value: *nextCursor}}
+	}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, user := range users {
+		if err := enc.Encode(xmlUser{user, fields}); err != nil {
+			return err
+		}
+	}
+	if err := enc.EncodeToken(start.End()); err != nil {
+		return err
+	}
+	return enc.Flush()
+}
+
+// A user as a <user> element restricted to fields; nil fields uses User's
+// xml tags
+type xmlUser struct {
+	User   User
+	Fields []userField
+}
+
+func (u xmlUser) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Name = xml.Name{Local: "user"}
+	if u.Fields == nil {
+		return e.EncodeElement(u.User, start)
+	}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, f := range u.Fields {
+		if err := e.EncodeElement(f.value(&u.User), xml.StartElement{Name: xml.Name{Local: f.name}}); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// Write a header row of the field names and a row per user. encoding/csv
+// quotes values containing commas, quotes or line breaks.
+func writeUsersCSV(w io.Writer, users []User, fields []userField) error {
+	if fields == nil {
+		fields = userFields
+	}
+	cw := csv.NewWriter(w)
+	row := make([]string, len(fields))
+	for i, f := range fields {
+		row[i] = f.name
+	}
+	if err := cw.Write(row); err != nil {
+		return err
+	}
+	for i := range users {
+		for j, f := range fields {
+			row[j] = csvValue(f.value(&users[i]))
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// A field's value in a CSV cell: empty for null, RFC 3339 for times and JSON
+// for metadata
+func csvValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case *string:
+		if v != nil {
+			return *v
+		}
+		return ""
+	case bool:
+		return strconv.FormatBool(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case *time.Time:
+		if v != nil {
+			return v.Format(time.RFC3339Nano)
+		}
+		return ""
+	case Metadata:
+		if v == nil {
+			return "{}"
+		}
+		data, err := json.Marshal(map[string]interface{}(v))
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+	return fmt.Sprint(v)
+}
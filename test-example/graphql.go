@@ -0,0 +1,2103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// A small GraphQL engine for /graphql: it parses and validates executable
+// documents and runs them against a schema of Go resolvers. It covers what
+// the users API needs: queries and mutations, variables, fragments, aliases,
+// @skip/@include and introspection; there are no subscriptions, interfaces
+// or unions.
+
+// Limits checked before a document runs (GRAPHQL_MAX_DEPTH,
+// GRAPHQL_MAX_COMPLEXITY). Every field costs 1, and the selections of a list
+// field count once per item it may return. Introspection is left out of both;
+// it is bounded by introspectionMaxLists instead.
+var (
+	graphQLMaxDepth      = 10
+	graphQLMaxComplexity = 1000
+)
+
+// Selections a document may expand to with its fragments, which stops
+// fragments spreading each other many times over before the complexity is
+// known
+const graphQLMaxSelections = 10000
+
+// List fields an introspection query may nest (types { fields { args } }
+// is three), so it can't fan out through the schema's cycles
+const introspectionMaxLists = 3
+
+// Nesting of selections and values the parser accepts
+const graphQLMaxNesting = 64
+
+type gqlLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// An entry of a response's errors
+type gqlError struct {
+	Message    string                 `json:"message"`
+	Locations  []gqlLocation          `json:"locations,omitempty"`
+	Path       []interface{}          `json:"path,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+func (e *gqlError) Error() string {
+	return e.Message
+}
+
+func gqlErrorf(loc gqlLocation, format string, args ...interface{}) *gqlError {
+	return &gqlError{Message: fmt.Sprintf(format, args...), Locations: []gqlLocation{loc}}
+}
+
+// Lexer
+
+type gqlTokenKind int
+
+const (
+	gqlTokEOF gqlTokenKind = iota
+	gqlTokPunct
+	gqlTokName
+	gqlTokInt
+	gqlTokFloat
+	gqlTokString
+)
+
+type gqlToken struct {
+	kind  gqlTokenKind
+	value string
+	loc   gqlLocation
+}
+
+func (t gqlToken) String() string {
+	switch t.kind {
+	case gqlTokEOF:
+		return "<EOF>"
+	case gqlTokString:
+		return "string " + strconv.Quote(t.value)
+	case gqlTokName:
+		return "Name " + strconv.Quote(t.value)
+	case gqlTokInt, gqlTokFloat:
+		return "number " + t.value
+	}
+	return strconv.Quote(t.value)
+}
+
+type gqlLexer struct {
+	src       string
+	pos       int
+	line      int
+	lineStart int
+}
+
+func lexGraphQL(src string) ([]gqlToken, error) {
+	l := &gqlLexer{src: src, line: 1}
+	var tokens []gqlToken
+	for {
+		tok, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, tok)
+		if tok.kind == gqlTokEOF {
+			return tokens, nil
+		}
+	}
+}
+
+func (l *gqlLexer) loc() gqlLocation {
+	return gqlLocation{Line: l.line, Column: l.pos - l.lineStart + 1}
+}
+
+func (l *gqlLexer) peek() byte {
+	if l.pos < len(l.src) {
+		return l.src[l.pos]
+	}
+	return 0
+}
+
+func (l *gqlLexer) newline() {
+	l.line++
+	l.lineStart = l.pos
+}
+
+// Skip whitespace, commas, comments and byte order marks
+func (l *gqlLexer) skipIgnored() {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == ' ' || c == '\t' || c == ',':
+			l.pos++
+		case c == '\n':
+			l.pos++
+			l.newline()
+		case c == '\r':
+			l.pos++
+			if l.peek() == '\n' {
+				l.pos++
+			}
+			l.newline()
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' && l.src[l.pos] != '\r' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.src[l.pos:], "\ufeff"):
+			l.pos += len("\ufeff")
+		default:
+			return
+		}
+	}
+}
+
+func (l *gqlLexer) next() (gqlToken, error) {
+	l.skipIgnored()
+	loc := l.loc()
+	if l.pos >= len(l.src) {
+		return gqlToken{kind: gqlTokEOF, loc: loc}, nil
+	}
+	c := l.src[l.pos]
+	switch {
+	case strings.HasPrefix(l.src[l.pos:], "..."):
+		l.pos += 3
+		return gqlToken{kind: gqlTokPunct, value: "...", loc: loc}, nil
+	case strings.IndexByte("!$&()=:@[]{}|", c) >= 0:
+		l.pos++
+		return gqlToken{kind: gqlTokPunct, value: string(c), loc: loc}, nil
+	case isNameStart(c):
+		start := l.pos
+		for l.pos < len(l.src) && (isNameStart(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		return gqlToken{kind: gqlTokName, value: l.src[start:l.pos], loc: loc}, nil
+	case c == '-' || isDigit(c):
+		return l.number(loc)
+	case strings.HasPrefix(l.src[l.pos:], `"""`):
+		return l.blockString(loc)
+	case c == '"':
+		return l.string(loc)
+	}
+	return gqlToken{}, gqlErrorf(loc, "Syntax Error: Unexpected character %q", c)
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (l *gqlLexer) digits() bool {
+	start := l.pos
+	for isDigit(l.peek()) {
+		l.pos++
+	}
+	return l.pos > start
+}
+
+func (l *gqlLexer) number(loc gqlLocation) (gqlToken, error) {
+	start := l.pos
+	kind := gqlTokInt
+	invalid := func() (gqlToken, error) {
+		return gqlToken{}, gqlErrorf(loc, "Syntax Error: Invalid number %q", l.src[start:min(l.pos+1, len(l.src))])
+	}
+	if l.peek() == '-' {
+		l.pos++
+	}
+	if l.peek() == '0' {
+		l.pos++
+		if isDigit(l.peek()) {
+			return invalid()
+		}
+	} else if !l.digits() {
+		return invalid()
+	}
+	if l.peek() == '.' {
+		kind = gqlTokFloat
+		l.pos++
+		if !l.digits() {
+			return invalid()
+		}
+	}
+	if c := l.peek(); c == 'e' || c == 'E' {
+		kind = gqlTokFloat
+		l.pos++
+		if c := l.peek(); c == '+' || c == '-' {
+			l.pos++
+		}
+		if !l.digits() {
+			return invalid()
+		}
+	}
+	if c := l.peek(); c == '.' || isNameStart(c) {
+		return invalid()
+	}
+	return gqlToken{kind: kind, value: l.src[start:l.pos], loc: loc}, nil
+}
+
+func (l *gqlLexer) string(loc gqlLocation) (gqlToken, error) {
+	l.pos++
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch c {
+		case '"':
+			l.pos++
+			return gqlToken{kind: gqlTokString, value: b.String(), loc: loc}, nil
+		case '\n', '\r':
+			return gqlToken{}, gqlErrorf(loc, "Syntax Error: Unterminated string")
+		case '\\':
+			r, n, err := l.escape()
+			if err != nil {
+				return gqlToken{}, gqlErrorf(l.loc(), "Syntax Error: %v", err)
+			}
+			b.WriteRune(r)
+			l.pos += n
+		default:
+			b.WriteByte(c)
+			l.pos++
+		}
+	}
+	return gqlToken{}, gqlErrorf(loc, "Syntax Error: Unterminated string")
+}
+
+// The escape sequence at the lexer's position and its length
+func (l *gqlLexer) escape() (rune, int, error) {
+	rest := l.src[l.pos:]
+	if len(rest) < 2 {
+		return 0, 0, errors.New("unterminated string")
+	}
+	switch rest[1] {
+	case '"', '\\', '/':
+		return rune(rest[1]), 2, nil
+	case 'b':
+		return '\b', 2, nil
+	case 'f':
+		return '\f', 2, nil
+	case 'n':
+		return '\n', 2, nil
+	case 'r':
+		return '\r', 2, nil
+	case 't':
+		return '\t', 2, nil
+	case 'u':
+		r, ok := unicodeEscape(rest[2:])
+		if !ok {
+			return 0, 0, errors.New("invalid Unicode escape sequence")
+		}
+		if utf16.IsSurrogate(r) && strings.HasPrefix(rest[6:], `\u`) {
+			if low, ok := unicodeEscape(rest[8:]); ok {
+				return utf16.DecodeRune(r, low), 12, nil
+			}
+		}
+		return r, 6, nil
+	}
+	return 0, 0, fmt.Errorf("invalid escape sequence \\%c", rest[1])
+}
+
+func unicodeEscape(s string) (rune, bool) {
+	if len(s) < 4 {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(s[:4], 16, 32)
+	return rune(n), err == nil
+}
+
+func (l *gqlLexer) blockString(loc gqlLocation) (gqlToken, error) {
+	l.pos += 3
+	var raw strings.Builder
+	for l.pos < len(l.src) {
+		switch rest := l.src[l.pos:]; {
+		case strings.HasPrefix(rest, `"""`):
+			l.pos += 3
+			return gqlToken{kind: gqlTokString, value: blockStringValue(raw.String()), loc: loc}, nil
+		case strings.HasPrefix(rest, `\"""`):
+			raw.WriteString(`"""`)
+			l.pos += 4
+		default:
+			c := l.src[l.pos]
+			raw.WriteByte(c)
+			l.pos++
+			if c == '\n' || (c == '\r' && l.peek() != '\n') {
+				l.newline()
+			}
+		}
+	}
+	return gqlToken{}, gqlErrorf(loc, "Syntax Error: Unterminated string")
+}
+
+// The value of a block string: the common indentation and blank leading and
+// trailing lines removed
+func blockStringValue(raw string) string {
+	lines := strings.Split(strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(raw), "\n")
+	common := -1
+	for _, line := range lines[1:] {
+		indent := len(line) - len(strings.TrimLeft(line, " \t"))
+		if indent < len(line) && (common < 0 || indent < common) {
+			common = indent
+		}
+	}
+	if common > 0 {
+		for i := 1; i < len(lines); i++ {
+			lines[i] = lines[i][min(common, len(lines[i])):]
+		}
+	}
+	for len(lines) > 0 && strings.TrimLeft(lines[0], " \t") == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimLeft(lines[len(lines)-1], " \t") == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Documents
+
+type gqlDocument struct {
+	Operations []*gqlOperation
+	Fragments  map[string]*gqlFragment
+}
+
+type gqlOperation struct {
+	// query, mutation or subscription
+	Kind       string
+	Name       string
+	Vars       []*gqlVarDef
+	Directives []*gqlDirective
+	Selections []*gqlSelection
+	Loc        gqlLocation
+}
+
+type gqlVarDef struct {
+	Name    string
+	Type    *gqlTypeRef
+	Default *gqlValue
+	Loc     gqlLocation
+}
+
+// A type in a variable definition: a named type or a list, maybe non-null
+type gqlTypeRef struct {
+	Name    string
+	Elem    *gqlTypeRef
+	NonNull bool
+}
+
+func (t *gqlTypeRef) String() string {
+	s := t.Name
+	if t.Elem != nil {
+		s = "[" + t.Elem.String() + "]"
+	}
+	if t.NonNull {
+		s += "!"
+	}
+	return s
+}
+
+type gqlFragment struct {
+	Name          string
+	TypeCondition string
+	Directives    []*gqlDirective
+	Selections    []*gqlSelection
+	Loc           gqlLocation
+}
+
+// A field, a fragment spread (Spread set) or an inline fragment (Inline set)
+type gqlSelection struct {
+	Alias      string
+	Name       string
+	Args       []*gqlArgument
+	Directives []*gqlDirective
+	Selections []*gqlSelection
+
+	Spread        string
+	Inline        bool
+	TypeCondition string
+
+	Loc gqlLocation
+}
+
+// The selection's key in the response
+func (s *gqlSelection) key() string {
+	if s.Alias != "" {
+		return s.Alias
+	}
+	return s.Name
+}
+
+// An argument, or a field of an object value
+type gqlArgument struct {
+	Name  string
+	Value *gqlValue
+	Loc   gqlLocation
+}
+
+type gqlDirective struct {
+	Name string
+	Args []*gqlArgument
+	Loc  gqlLocation
+}
+
+type gqlValueKind int
+
+const (
+	gqlVariable gqlValueKind = iota
+	gqlIntLiteral
+	gqlFloatLiteral
+	gqlStringLiteral
+	gqlBooleanLiteral
+	gqlNullLiteral
+	gqlEnumLiteral
+	gqlListLiteral
+	gqlObjectLiteral
+)
+
+// A value in a document
+type gqlValue struct {
+	Kind gqlValueKind
+	// The variable's name, the enum value or the literal's text
+	Raw    string
+	List   []*gqlValue
+	Fields []*gqlArgument
+	Loc    gqlLocation
+}
+
+// An enum value written in a document, which only enum types accept; values
+// of variables are plain strings
+type gqlEnumName string
+
+// The value with variables substituted, shaped like decoded JSON input
+// (numbers are json.Number); ok is false for a variable that wasn't
+// provided
+func (v *gqlValue) resolve(vars map[string]interface{}) (interface{}, bool) {
+	switch v.Kind {
+	case gqlVariable:
+		val, ok := vars[v.Raw]
+		return val, ok
+	case gqlIntLiteral, gqlFloatLiteral:
+		return json.Number(v.Raw), true
+	case gqlStringLiteral:
+		return v.Raw, true
+	case gqlBooleanLiteral:
+		return v.Raw == "true", true
+	case gqlEnumLiteral:
+		return gqlEnumName(v.Raw), true
+	case gqlListLiteral:
+		items := make([]interface{}, len(v.List))
+		for i, item := range v.List {
+			items[i], _ = item.resolve(vars)
+		}
+		return items, true
+	case gqlObjectLiteral:
+		fields := map[string]interface{}{}
+		for _, f := range v.Fields {
+			if val, ok := f.Value.resolve(vars); ok {
+				fields[f.Name] = val
+			}
+		}
+		return fields, true
+	}
+	return nil, true
+}
+
+// The value in GraphQL syntax
+func (v *gqlValue) String() string {
+	switch v.Kind {
+	case gqlVariable:
+		return "$" + v.Raw
+	case gqlStringLiteral:
+		return strconv.Quote(v.Raw)
+	case gqlListLiteral:
+		items := make([]string, len(v.List))
+		for i, item := range v.List {
+			items[i] = item.String()
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case gqlObjectLiteral:
+		fields := make([]string, len(v.Fields))
+		for i, f := range v.Fields {
+			fields[i] = f.Name + ": " + f.Value.String()
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	case gqlNullLiteral:
+		return "null"
+	}
+	return v.Raw
+}
+
+// Parser
+
+type gqlParser struct {
+	tokens  []gqlToken
+	pos     int
+	nesting int
+}
+
+func parseGraphQL(src string) (*gqlDocument, error) {
+	tokens, err := lexGraphQL(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{tokens: tokens}
+	doc := &gqlDocument{Fragments: map[string]*gqlFragment{}}
+	if p.peek().kind == gqlTokEOF {
+		return nil, p.unexpected()
+	}
+	for p.peek().kind != gqlTokEOF {
+		t := p.peek()
+		switch {
+		case p.is("{"):
+			sels, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.Operations = append(doc.Operations, &gqlOperation{Kind: "query", Selections: sels, Loc: t.loc})
+		case t.kind == gqlTokName && (t.value == "query" || t.value == "mutation" || t.value == "subscription"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.Operations = append(doc.Operations, op)
+		case t.kind == gqlTokName && t.value == "fragment":
+			frag, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			if doc.Fragments[frag.Name] != nil {
+				return nil, gqlErrorf(frag.Loc, "There can be only one fragment named %q", frag.Name)
+			}
+			doc.Fragments[frag.Name] = frag
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) peek() gqlToken {
+	return p.tokens[p.pos]
+}
+
+func (p *gqlParser) advance() gqlToken {
+	t := p.tokens[p.pos]
+	if t.kind != gqlTokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *gqlParser) is(punct string) bool {
+	t := p.peek()
+	return t.kind == gqlTokPunct && t.value == punct
+}
+
+func (p *gqlParser) skip(punct string) bool {
+	if p.is(punct) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *gqlParser) expect(punct string) error {
+	if p.skip(punct) {
+		return nil
+	}
+	return p.unexpected()
+}
+
+func (p *gqlParser) keyword(name string) bool {
+	if t := p.peek(); t.kind == gqlTokName && t.value == name {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *gqlParser) unexpected() error {
+	t := p.peek()
+	return gqlErrorf(t.loc, "Syntax Error: Unexpected %s", t)
+}
+
+func (p *gqlParser) name() (string, error) {
+	if t := p.peek(); t.kind == gqlTokName {
+		p.pos++
+		return t.value, nil
+	}
+	return "", p.unexpected()
+}
+
+func (p *gqlParser) nest() error {
+	p.nesting++
+	if p.nesting > graphQLMaxNesting {
+		return gqlErrorf(p.peek().loc, "Syntax Error: Document is nested more than %d levels deep", graphQLMaxNesting)
+	}
+	return nil
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	t := p.advance()
+	op := &gqlOperation{Kind: t.value, Loc: t.loc}
+	if p.peek().kind == gqlTokName {
+		op.Name = p.advance().value
+	}
+	if p.skip("(") {
+		for !p.skip(")") {
+			def := &gqlVarDef{Loc: p.peek().loc}
+			if err := p.expect("$"); err != nil {
+				return nil, err
+			}
+			var err error
+			if def.Name, err = p.name(); err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if def.Type, err = p.typeRef(); err != nil {
+				return nil, err
+			}
+			if p.skip("=") {
+				if def.Default, err = p.value(true); err != nil {
+					return nil, err
+				}
+			}
+			if _, err := p.directives(true); err != nil {
+				return nil, err
+			}
+			op.Vars = append(op.Vars, def)
+		}
+	}
+	var err error
+	if op.Directives, err = p.directives(false); err != nil {
+		return nil, err
+	}
+	op.Selections, err = p.selectionSet()
+	return op, err
+}
+
+func (p *gqlParser) typeRef() (*gqlTypeRef, error) {
+	if err := p.nest(); err != nil {
+		return nil, err
+	}
+	defer func() { p.nesting-- }()
+
+	t := &gqlTypeRef{}
+	if p.skip("[") {
+		elem, err := p.typeRef()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		t.Elem = elem
+	} else {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		t.Name = name
+	}
+	t.NonNull = p.skip("!")
+	return t, nil
+}
+
+func (p *gqlParser) fragment() (*gqlFragment, error) {
+	frag := &gqlFragment{Loc: p.advance().loc}
+	var err error
+	if frag.Name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if frag.Name == "on" || !p.keyword("on") {
+		return nil, p.unexpected()
+	}
+	if frag.TypeCondition, err = p.name(); err != nil {
+		return nil, err
+	}
+	if frag.Directives, err = p.directives(false); err != nil {
+		return nil, err
+	}
+	frag.Selections, err = p.selectionSet()
+	return frag, err
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlSelection, error) {
+	if err := p.nest(); err != nil {
+		return nil, err
+	}
+	defer func() { p.nesting-- }()
+
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	if p.is("}") {
+		return nil, p.unexpected()
+	}
+	var sels []*gqlSelection
+	for !p.skip("}") {
+		sel, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		sels = append(sels, sel)
+	}
+	return sels, nil
+}
+
+func (p *gqlParser) selection() (*gqlSelection, error) {
+	sel := &gqlSelection{Loc: p.peek().loc}
+	var err error
+	if p.skip("...") {
+		if t := p.peek(); t.kind == gqlTokName && t.value != "on" {
+			sel.Spread = p.advance().value
+			sel.Directives, err = p.directives(false)
+			return sel, err
+		}
+		sel.Inline = true
+		if p.keyword("on") {
+			if sel.TypeCondition, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if sel.Directives, err = p.directives(false); err != nil {
+			return nil, err
+		}
+		sel.Selections, err = p.selectionSet()
+		return sel, err
+	}
+
+	if sel.Name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if p.skip(":") {
+		sel.Alias = sel.Name
+		if sel.Name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if sel.Args, err = p.arguments(false); err != nil {
+		return nil, err
+	}
+	if sel.Directives, err = p.directives(false); err != nil {
+		return nil, err
+	}
+	if p.is("{") {
+		sel.Selections, err = p.selectionSet()
+	}
+	return sel, err
+}
+
+func (p *gqlParser) arguments(constant bool) ([]*gqlArgument, error) {
+	if !p.skip("(") {
+		return nil, nil
+	}
+	var args []*gqlArgument
+	for !p.skip(")") {
+		arg := &gqlArgument{Loc: p.peek().loc}
+		var err error
+		if arg.Name, err = p.name(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		if arg.Value, err = p.value(constant); err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+func (p *gqlParser) directives(constant bool) ([]*gqlDirective, error) {
+	var dirs []*gqlDirective
+	for p.is("@") {
+		dir := &gqlDirective{Loc: p.advance().loc}
+		var err error
+		if dir.Name, err = p.name(); err != nil {
+			return nil, err
+		}
+		if dir.Args, err = p.arguments(constant); err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs, nil
+}
+
+// A value; constant values can't contain variables
+func (p *gqlParser) value(constant bool) (*gqlValue, error) {
+	if err := p.nest(); err != nil {
+		return nil, err
+	}
+	defer func() { p.nesting-- }()
+
+	t := p.peek()
+	v := &gqlValue{Raw: t.value, Loc: t.loc}
+	switch {
+	case p.is("$") && !constant:
+		p.pos++
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		v.Kind, v.Raw = gqlVariable, name
+	case p.skip("["):
+		v.Kind = gqlListLiteral
+		for !p.skip("]") {
+			item, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			v.List = append(v.List, item)
+		}
+	case p.skip("{"):
+		v.Kind = gqlObjectLiteral
+		for !p.skip("}") {
+			f := &gqlArgument{Loc: p.peek().loc}
+			var err error
+			if f.Name, err = p.name(); err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if f.Value, err = p.value(constant); err != nil {
+				return nil, err
+			}
+			v.Fields = append(v.Fields, f)
+		}
+	case t.kind == gqlTokInt:
+		p.pos++
+		v.Kind = gqlIntLiteral
+	case t.kind == gqlTokFloat:
+		p.pos++
+		v.Kind = gqlFloatLiteral
+	case t.kind == gqlTokString:
+		p.pos++
+		v.Kind = gqlStringLiteral
+	case t.kind == gqlTokName:
+		p.pos++
+		switch t.value {
+		case "true", "false":
+			v.Kind = gqlBooleanLiteral
+		case "null":
+			v.Kind = gqlNullLiteral
+		default:
+			v.Kind = gqlEnumLiteral
+		}
+	default:
+		return nil, p.unexpected()
+	}
+	return v, nil
+}
+
+// Parse a constant value, such as a default
+func parseGraphQLValue(src string) (*gqlValue, error) {
+	tokens, err := lexGraphQL(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{tokens: tokens}
+	v, err := p.value(true)
+	if err == nil && p.peek().kind != gqlTokEOF {
+		err = p.unexpected()
+	}
+	return v, err
+}
+
+// Schema
+
+// Type kinds, as introspection names them
+const (
+	gqlScalarKind      = "SCALAR"
+	gqlObjectKind      = "OBJECT"
+	gqlEnumKind        = "ENUM"
+	gqlInputObjectKind = "INPUT_OBJECT"
+	gqlListKind        = "LIST"
+	gqlNonNullKind     = "NON_NULL"
+)
+
+type gqlType struct {
+	Kind        string
+	Name        string
+	Description string
+	// OBJECT
+	Fields []*gqlField
+	// INPUT_OBJECT
+	InputFields []*gqlInputValue
+	// ENUM
+	EnumValues []*gqlEnumValue
+	// LIST and NON_NULL
+	OfType *gqlType
+	// SCALAR: convert an input value (decoded JSON, or a literal resolved to
+	// that shape) for resolvers, and a resolver's value for the response
+	Parse     func(v interface{}) (interface{}, error)
+	Serialize func(v interface{}) (interface{}, error)
+}
+
+type gqlResolver func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error)
+
+type gqlField struct {
+	Name        string
+	Description string
+	Args        []*gqlInputValue
+	Type        *gqlType
+	// Scope the caller needs, checked like requireScope; "" for any caller
+	Scope string
+	// The most items a list field returns for args, so its selections count
+	// that many times in the complexity; nil counts them once
+	Size    func(args map[string]interface{}) int
+	Resolve gqlResolver
+}
+
+// An argument or input field
+type gqlInputValue struct {
+	Name        string
+	Description string
+	Type        *gqlType
+	// A GraphQL literal; "" for none
+	Default string
+}
+
+type gqlEnumValue struct {
+	Name        string
+	Description string
+	// What resolvers get and return for it
+	Value interface{}
+}
+
+type gqlDirectiveDef struct {
+	Name        string
+	Description string
+	Locations   []string
+	Args        []*gqlInputValue
+}
+
+func gqlNonNull(t *gqlType) *gqlType {
+	return &gqlType{Kind: gqlNonNullKind, OfType: t}
+}
+
+func gqlListOf(t *gqlType) *gqlType {
+	return &gqlType{Kind: gqlListKind, OfType: t}
+}
+
+// An enum whose values are their own names
+func gqlEnum(name, description string, values ...string) *gqlType {
+	t := &gqlType{Kind: gqlEnumKind, Name: name, Description: description}
+	for _, v := range values {
+		t.EnumValues = append(t.EnumValues, &gqlEnumValue{Name: v, Value: v})
+	}
+	return t
+}
+
+func (t *gqlType) String() string {
+	switch t.Kind {
+	case gqlListKind:
+		return "[" + t.OfType.String() + "]"
+	case gqlNonNullKind:
+		return t.OfType.String() + "!"
+	}
+	return t.Name
+}
+
+// The type without its list and non-null wrappers
+func (t *gqlType) named() *gqlType {
+	for t.OfType != nil {
+		t = t.OfType
+	}
+	return t
+}
+
+func (t *gqlType) inputField(name string) *gqlInputValue {
+	for _, f := range t.InputFields {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// Built-in scalars
+
+var (
+	gqlStringType = &gqlType{Kind: gqlScalarKind, Name: "String", Description: "UTF-8 text.",
+		Parse: func(v interface{}) (interface{}, error) {
+			if s, ok := v.(string); ok {
+				return s, nil
+			}
+			return nil, gqlInvalid("String", v)
+		},
+		Serialize: func(v interface{}) (interface{}, error) {
+			if s, ok := v.(string); ok {
+				return s, nil
+			}
+			return nil, gqlInvalid("String", v)
+		},
+	}
+	gqlIntType = &gqlType{Kind: gqlScalarKind, Name: "Int", Description: "A signed 32-bit integer.",
+		Parse: func(v interface{}) (interface{}, error) {
+			if n, ok := v.(json.Number); ok {
+				if f, err := n.Float64(); err == nil && f == math.Trunc(f) && f >= math.MinInt32 && f <= math.MaxInt32 {
+					return int(f), nil
+				}
+			}
+			return nil, gqlInvalid("Int", v)
+		},
+		Serialize: func(v interface{}) (interface{}, error) {
+			switch n := v.(type) {
+			case int, int32, int64:
+				return n, nil
+			}
+			return nil, gqlInvalid("Int", v)
+		},
+	}
+	gqlFloatType = &gqlType{Kind: gqlScalarKind, Name: "Float", Description: "A double-precision number.",
+		Parse: func(v interface{}) (interface{}, error) {
+			if n, ok := v.(json.Number); ok {
+				if f, err := n.Float64(); err == nil {
+					return f, nil
+				}
+			}
+			return nil, gqlInvalid("Float", v)
+		},
+		Serialize: func(v interface{}) (interface{}, error) {
+			switch n := v.(type) {
+			case float64, float32, int, int64:
+				return n, nil
+			}
+			return nil, gqlInvalid("Float", v)
+		},
+	}
+	gqlBooleanType = &gqlType{Kind: gqlScalarKind, Name: "Boolean", Description: "true or false.",
+		Parse: func(v interface{}) (interface{}, error) {
+			if b, ok := v.(bool); ok {
+				return b, nil
+			}
+			return nil, gqlInvalid("Boolean", v)
+		},
+		Serialize: func(v interface{}) (interface{}, error) {
+			if b, ok := v.(bool); ok {
+				return b, nil
+			}
+			return nil, gqlInvalid("Boolean", v)
+		},
+	}
+	gqlIDType = &gqlType{Kind: gqlScalarKind, Name: "ID", Description: "An identifier, serialized as a string.",
+		Parse: func(v interface{}) (interface{}, error) {
+			switch id := v.(type) {
+			case string:
+				return id, nil
+			case json.Number:
+				if _, err := id.Int64(); err == nil {
+					return id.String(), nil
+				}
+			}
+			return nil, gqlInvalid("ID", v)
+		},
+		Serialize: func(v interface{}) (interface{}, error) {
+			if s, ok := v.(string); ok {
+				return s, nil
+			}
+			return nil, gqlInvalid("ID", v)
+		},
+	}
+)
+
+func gqlInvalid(typ string, v interface{}) error {
+	switch v := v.(type) {
+	case gqlEnumName:
+		return fmt.Errorf("%s cannot represent the enum value %s", typ, v)
+	case string:
+		return fmt.Errorf("%s cannot represent %q", typ, v)
+	}
+	return fmt.Errorf("%s cannot represent %v", typ, v)
+}
+
+type gqlSchema struct {
+	Description string
+	Query       *gqlType
+	Mutation    *gqlType
+	// Every named type, by name
+	Types      map[string]*gqlType
+	Directives []*gqlDirectiveDef
+
+	typenameField *gqlField
+	schemaField   *gqlField
+	typeField     *gqlField
+}
+
+var gqlIfArg = []*gqlInputValue{{Name: "if", Type: gqlNonNull(gqlBooleanType)}}
+
+func newGQLSchema(description string, query, mutation *gqlType) *gqlSchema {
+	s := &gqlSchema{
+		Description: description,
+		Query:       query,
+		Mutation:    mutation,
+		Types:       map[string]*gqlType{},
+		Directives: []*gqlDirectiveDef{
+			{Name: "include", Description: "Include the selection only when if is true.", Locations: []string{"FIELD", "FRAGMENT_SPREAD", "INLINE_FRAGMENT"}, Args: gqlIfArg},
+			{Name: "skip", Description: "Skip the selection when if is true.", Locations: []string{"FIELD", "FRAGMENT_SPREAD", "INLINE_FRAGMENT"}, Args: gqlIfArg},
+		},
+	}
+	schemaType, typeType := introspectionTypes(s)
+	s.typenameField = &gqlField{Name: "__typename", Type: gqlNonNull(gqlStringType)}
+	s.schemaField = &gqlField{Name: "__schema", Type: gqlNonNull(schemaType),
+		Resolve: func(context.Context, interface{}, map[string]interface{}) (interface{}, error) {
+			return s, nil
+		},
+	}
+	s.typeField = &gqlField{Name: "__type", Type: typeType, Args: []*gqlInputValue{{Name: "name", Type: gqlNonNull(gqlStringType)}},
+		Resolve: func(_ context.Context, _ interface{}, args map[string]interface{}) (interface{}, error) {
+			if t, ok := s.Types[args["name"].(string)]; ok {
+				return t, nil
+			}
+			return nil, nil
+		},
+	}
+
+	var add func(t *gqlType)
+	add = func(t *gqlType) {
+		t = t.named()
+		if s.Types[t.Name] != nil {
+			return
+		}
+		s.Types[t.Name] = t
+		for _, f := range t.Fields {
+			add(f.Type)
+			for _, arg := range f.Args {
+				add(arg.Type)
+			}
+		}
+		for _, f := range t.InputFields {
+			add(f.Type)
+		}
+	}
+	for _, t := range []*gqlType{query, mutation, schemaType, gqlStringType, gqlBooleanType} {
+		if t != nil {
+			add(t)
+		}
+	}
+	return s
+}
+
+// The definition of a field of t, including the meta fields
+func (s *gqlSchema) field(t *gqlType, name string) *gqlField {
+	switch {
+	case name == "__typename":
+		return s.typenameField
+	case t == s.Query && name == "__schema":
+		return s.schemaField
+	case t == s.Query && name == "__type":
+		return s.typeField
+	}
+	for _, f := range t.Fields {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// The schema's type for a variable's type
+func (s *gqlSchema) typeOf(ref *gqlTypeRef) *gqlType {
+	var t *gqlType
+	if ref.Elem != nil {
+		elem := s.typeOf(ref.Elem)
+		if elem == nil {
+			return nil
+		}
+		t = gqlListOf(elem)
+	} else if t = s.Types[ref.Name]; t == nil {
+		return nil
+	}
+	if ref.NonNull {
+		t = gqlNonNull(t)
+	}
+	return t
+}
+
+// Input coercion
+
+// Convert an input value (decoded JSON, or a literal resolved to that shape)
+// to what resolvers get: scalars parsed, enums as their values, input objects
+// as maps that only have the fields that were given or have defaults
+func coerceGQLInput(v interface{}, t *gqlType) (interface{}, error) {
+	if t.Kind == gqlNonNullKind {
+		if v == nil {
+			return nil, fmt.Errorf("expected a non-null %s", t.OfType)
+		}
+		return coerceGQLInput(v, t.OfType)
+	}
+	if v == nil {
+		return nil, nil
+	}
+	switch t.Kind {
+	case gqlListKind:
+		items, ok := v.([]interface{})
+		if !ok {
+			item, err := coerceGQLInput(v, t.OfType)
+			if err != nil {
+				return nil, err
+			}
+			return []interface{}{item}, nil
+		}
+		out := make([]interface{}, len(items))
+		for i, item := range items {
+			var err error
+			if out[i], err = coerceGQLInput(item, t.OfType); err != nil {
+				return nil, fmt.Errorf("item %d: %w", i, err)
+			}
+		}
+		return out, nil
+	case gqlInputObjectKind:
+		fields, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected a %s object", t.Name)
+		}
+		for _, name := range sortedKeys(fields) {
+			if t.inputField(name) == nil {
+				return nil, fmt.Errorf("field %q is not defined by %s", name, t.Name)
+			}
+		}
+		out := map[string]interface{}{}
+		for _, f := range t.InputFields {
+			val, present := fields[f.Name]
+			if !present && f.Default != "" {
+				val, present = gqlDefault(f.Default), true
+			}
+			if !present {
+				if f.Type.Kind == gqlNonNullKind {
+					return nil, fmt.Errorf("field %q of type %s is required", f.Name, f.Type)
+				}
+				continue
+			}
+			coerced, err := coerceGQLInput(val, f.Type)
+			if err != nil {
+				return nil, fmt.Errorf("field %q: %w", f.Name, err)
+			}
+			out[f.Name] = coerced
+		}
+		return out, nil
+	case gqlEnumKind:
+		var name string
+		switch n := v.(type) {
+		case gqlEnumName:
+			name = string(n)
+		case string:
+			name = n
+		}
+		for _, ev := range t.EnumValues {
+			if ev.Name == name {
+				return ev.Value, nil
+			}
+		}
+		return nil, fmt.Errorf("%v is not a value of %s", v, t.Name)
+	}
+	return t.Parse(v)
+}
+
+// The resolved value of a default literal; defaults are part of the schema,
+// so a bad one is a bug
+func gqlDefault(literal string) interface{} {
+	v, err := parseGraphQLValue(literal)
+	if err != nil {
+		panic(fmt.Sprintf("invalid GraphQL default %q: %v", literal, err))
+	}
+	val, _ := v.resolve(nil)
+	return val
+}
+
+// Coerce the arguments given to a field or directive
+func coerceGQLArgs(defs []*gqlInputValue, args []*gqlArgument, vars map[string]interface{}) (map[string]interface{}, *gqlError) {
+	given := map[string]*gqlArgument{}
+	for _, arg := range args {
+		if given[arg.Name] != nil {
+			return nil, gqlErrorf(arg.Loc, "There can be only one argument named %q", arg.Name)
+		}
+		if !slices.ContainsFunc(defs, func(d *gqlInputValue) bool { return d.Name == arg.Name }) {
+			return nil, gqlErrorf(arg.Loc, "Unknown argument %q", arg.Name)
+		}
+		given[arg.Name] = arg
+	}
+
+	out := map[string]interface{}{}
+	for _, def := range defs {
+		var val interface{}
+		present := false
+		loc := gqlLocation{}
+		if arg := given[def.Name]; arg != nil {
+			val, present = arg.Value.resolve(vars)
+			loc = arg.Loc
+		}
+		if !present && def.Default != "" {
+			val, present = gqlDefault(def.Default), true
+		}
+		if !present {
+			if def.Type.Kind == gqlNonNullKind {
+				return nil, &gqlError{Message: fmt.Sprintf("Argument %q of type %s is required", def.Name, def.Type)}
+			}
+			continue
+		}
+		coerced, err := coerceGQLInput(val, def.Type)
+		if err != nil {
+			return nil, gqlErrorf(loc, "Argument %q has an invalid value: %v", def.Name, err)
+		}
+		out[def.Name] = coerced
+	}
+	return out, nil
+}
+
+// A document ready to run: its operation and the variables, checked against
+// their types
+type gqlPrepared struct {
+	schema *gqlSchema
+	doc    *gqlDocument
+	op     *gqlOperation
+	vars   map[string]interface{}
+}
+
+// Parse and validate a request. Variables keep their decoded form (numbers as
+// json.Number) and are coerced with the arguments they are used in.
+func (s *gqlSchema) prepare(query, operationName string, variables map[string]interface{}) (*gqlPrepared, []*gqlError) {
+	doc, err := parseGraphQL(query)
+	if err != nil {
+		return nil, []*gqlError{err.(*gqlError)}
+	}
+
+	var op *gqlOperation
+	for _, o := range doc.Operations {
+		if o.Name == operationName || (operationName == "" && len(doc.Operations) == 1) {
+			op = o
+		}
+	}
+	switch {
+	case len(doc.Operations) == 0:
+		return nil, []*gqlError{{Message: "The document has no operation"}}
+	case op == nil && operationName == "":
+		return nil, []*gqlError{{Message: "operationName is required when the document has several operations"}}
+	case op == nil:
+		return nil, []*gqlError{{Message: fmt.Sprintf("Unknown operation %q", operationName)}}
+	case op.Kind == "subscription":
+		return nil, []*gqlError{gqlErrorf(op.Loc, "Subscriptions are not supported")}
+	case op.Kind == "mutation" && s.Mutation == nil:
+		return nil, []*gqlError{gqlErrorf(op.Loc, "The schema has no mutations")}
+	}
+
+	p := &gqlPrepared{schema: s, doc: doc, op: op, vars: map[string]interface{}{}}
+	var errs []*gqlError
+	for _, def := range op.Vars {
+		if _, dup := p.vars[def.Name]; dup {
+			errs = append(errs, gqlErrorf(def.Loc, "There can be only one variable named \"$%s\"", def.Name))
+			continue
+		}
+		t := s.typeOf(def.Type)
+		if t == nil {
+			errs = append(errs, gqlErrorf(def.Loc, "Unknown type %q", def.Type))
+			continue
+		}
+		if kind := t.named().Kind; kind == gqlObjectKind {
+			errs = append(errs, gqlErrorf(def.Loc, "Variable \"$%s\" cannot be of the output type %s", def.Name, def.Type))
+			continue
+		}
+		val, present := variables[def.Name]
+		if !present && def.Default != nil {
+			val, present = def.Default.resolve(nil)
+		}
+		if !present {
+			if t.Kind == gqlNonNullKind {
+				errs = append(errs, gqlErrorf(def.Loc, "Variable \"$%s\" of type %s is required", def.Name, def.Type))
+			}
+			continue
+		}
+		if _, err := coerceGQLInput(val, t); err != nil {
+			errs = append(errs, gqlErrorf(def.Loc, "Variable \"$%s\" has an invalid value: %v", def.Name, err))
+			continue
+		}
+		p.vars[def.Name] = val
+	}
+	if errs != nil {
+		return nil, errs
+	}
+
+	if errs := p.validate(); errs != nil {
+		return nil, errs
+	}
+	return p, nil
+}
+
+func (p *gqlPrepared) root() *gqlType {
+	if p.op.Kind == "mutation" {
+		return p.schema.Mutation
+	}
+	return p.schema.Query
+}
+
+// Validation
+
+type gqlValidator struct {
+	p       *gqlPrepared
+	defined map[string]bool
+	errs    []*gqlError
+	// Fragments being expanded, to catch cycles
+	spreading  map[string]bool
+	selections int
+}
+
+// Check the operation's selections against the schema and its depth and
+// complexity against the limits
+func (p *gqlPrepared) validate() []*gqlError {
+	v := &gqlValidator{p: p, defined: map[string]bool{}, spreading: map[string]bool{}}
+	for _, def := range p.op.Vars {
+		v.defined[def.Name] = true
+	}
+	v.directives(p.op.Directives, strings.ToUpper(p.op.Kind))
+	cost, depth := v.selectionSet(p.root(), p.op.Selections, -1)
+	if v.errs != nil {
+		return v.errs
+	}
+	if depth > graphQLMaxDepth {
+		return []*gqlError{gqlErrorf(p.op.Loc, "The query is %d levels deep; the limit is %d", depth, graphQLMaxDepth)}
+	}
+	if cost > graphQLMaxComplexity {
+		return []*gqlError{gqlErrorf(p.op.Loc, "The query has a complexity of %d; the limit is %d", cost, graphQLMaxComplexity)}
+	}
+	return nil
+}
+
+func (v *gqlValidator) errorf(loc gqlLocation, format string, args ...interface{}) {
+	v.errs = append(v.errs, gqlErrorf(loc, format, args...))
+}
+
+// Check the selections on t, returning their complexity and depth.
+// introspection counts the list fields above them inside __schema or
+// __type; it is -1 outside.
+func (v *gqlValidator) selectionSet(t *gqlType, sels []*gqlSelection, introspection int) (cost, depth int) {
+	for _, sel := range sels {
+		v.selections++
+		if v.selections > graphQLMaxSelections {
+			if v.selections == graphQLMaxSelections+1 {
+				v.errorf(sel.Loc, "The query expands to more than %d selections", graphQLMaxSelections)
+			}
+			return 0, 0
+		}
+
+		var c, d int
+		switch {
+		case sel.Spread != "":
+			v.directives(sel.Directives, "FRAGMENT_SPREAD")
+			frag := v.p.doc.Fragments[sel.Spread]
+			switch {
+			case frag == nil:
+				v.errorf(sel.Loc, "Unknown fragment %q", sel.Spread)
+			case v.spreading[frag.Name]:
+				v.errorf(sel.Loc, "Cannot spread fragment %q within itself", frag.Name)
+			case v.typeCondition(frag.TypeCondition, t, sel.Loc):
+				v.spreading[frag.Name] = true
+				v.directives(frag.Directives, "FRAGMENT_DEFINITION")
+				c, d = v.selectionSet(t, frag.Selections, introspection)
+				delete(v.spreading, frag.Name)
+			}
+		case sel.Inline:
+			v.directives(sel.Directives, "INLINE_FRAGMENT")
+			if sel.TypeCondition == "" || v.typeCondition(sel.TypeCondition, t, sel.Loc) {
+				c, d = v.selectionSet(t, sel.Selections, introspection)
+			}
+		default:
+			v.directives(sel.Directives, "FIELD")
+			c, d = v.field(t, sel, introspection)
+		}
+		cost += c
+		depth = max(depth, d)
+	}
+	v.mergeable(t, sels)
+	return cost, depth
+}
+
+// Fragments only apply to the object type they name, as there are no
+// interfaces or unions
+func (v *gqlValidator) typeCondition(name string, t *gqlType, loc gqlLocation) bool {
+	cond := v.p.schema.Types[name]
+	switch {
+	case cond == nil:
+		v.errorf(loc, "Unknown type %q", name)
+	case cond.Kind != gqlObjectKind:
+		v.errorf(loc, "Fragments cannot condition on the non-object type %q", name)
+	case cond != t:
+		v.errorf(loc, "A fragment on %q can never apply to %q", name, t.Name)
+	default:
+		return true
+	}
+	return false
+}
+
+func (v *gqlValidator) field(t *gqlType, sel *gqlSelection, introspection int) (cost, depth int) {
+	f := v.p.schema.field(t, sel.Name)
+	if f == nil {
+		v.errorf(sel.Loc, "Cannot query field %q on type %q", sel.Name, t.Name)
+		return 0, 0
+	}
+	v.variables(sel.Args)
+	args, err := coerceGQLArgs(f.Args, sel.Args, v.p.vars)
+	if err != nil {
+		if err.Locations == nil {
+			err.Locations = []gqlLocation{sel.Loc}
+		}
+		v.errs = append(v.errs, err)
+	}
+
+	named := f.Type.named()
+	if named.Kind != gqlObjectKind {
+		if len(sel.Selections) > 0 {
+			v.errorf(sel.Loc, "Field %q of type %s cannot have selections", sel.Name, f.Type)
+		}
+		if introspection >= 0 {
+			return 0, 0
+		}
+		return 1, 1
+	}
+	if len(sel.Selections) == 0 {
+		v.errorf(sel.Loc, "Field %q of type %s must have selections", sel.Name, f.Type)
+		return 0, 0
+	}
+
+	switch {
+	case sel.Name == "__schema" || sel.Name == "__type":
+		v.selectionSet(named, sel.Selections, 0)
+		return 0, 0
+	case introspection >= 0:
+		if f.Type.named() != f.Type && strings.Contains(f.Type.String(), "[") {
+			introspection++
+		}
+		if introspection > introspectionMaxLists {
+			v.errorf(sel.Loc, "Introspection can nest at most %d list fields", introspectionMaxLists)
+			return 0, 0
+		}
+		v.selectionSet(named, sel.Selections, introspection)
+		return 0, 0
+	}
+
+	childCost, childDepth := v.selectionSet(named, sel.Selections, -1)
+	size := 1
+	if f.Size != nil && err == nil {
+		size = f.Size(args)
+	}
+	return 1 + size*childCost, 1 + childDepth
+}
+
+// Check the directives of a selection or operation at location
+func (v *gqlValidator) directives(dirs []*gqlDirective, location string) {
+	for _, dir := range dirs {
+		i := slices.IndexFunc(v.p.schema.Directives, func(d *gqlDirectiveDef) bool { return d.Name == dir.Name })
+		if i < 0 {
+			v.errorf(dir.Loc, "Unknown directive \"@%s\"", dir.Name)
+			continue
+		}
+		def := v.p.schema.Directives[i]
+		if !slices.Contains(def.Locations, location) {
+			v.errorf(dir.Loc, "Directive \"@%s\" may not be used on %s", dir.Name, location)
+			continue
+		}
+		v.variables(dir.Args)
+		if _, err := coerceGQLArgs(def.Args, dir.Args, v.p.vars); err != nil {
+			if err.Locations == nil {
+				err.Locations = []gqlLocation{dir.Loc}
+			}
+			v.errs = append(v.errs, err)
+		}
+	}
+}
+
+// Check that the variables used in args are defined by the operation
+func (v *gqlValidator) variables(args []*gqlArgument) {
+	var walk func(val *gqlValue)
+	walk = func(val *gqlValue) {
+		switch val.Kind {
+		case gqlVariable:
+			if !v.defined[val.Raw] {
+				v.errorf(val.Loc, "Variable \"$%s\" is not defined", val.Raw)
+			}
+		case gqlListLiteral:
+			for _, item := range val.List {
+				walk(item)
+			}
+		case gqlObjectLiteral:
+			for _, f := range val.Fields {
+				walk(f.Value)
+			}
+		}
+	}
+	for _, arg := range args {
+		walk(arg.Value)
+	}
+}
+
+// Check that selections sharing a response key select the same field with
+// the same arguments
+func (v *gqlValidator) mergeable(t *gqlType, sels []*gqlSelection) {
+	for _, group := range v.p.collectFields(t, sels) {
+		first := group.fields[0]
+		for _, other := range group.fields[1:] {
+			if other.Name != first.Name || !sameGQLArgs(first.Args, other.Args) {
+				v.errorf(other.Loc, "%q selects different fields or arguments in one place; use an alias", group.key)
+			}
+		}
+	}
+}
+
+func sameGQLArgs(a, b []*gqlArgument) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	values := map[string]string{}
+	for _, arg := range a {
+		values[arg.Name] = arg.Value.String()
+	}
+	for _, arg := range b {
+		if val, ok := values[arg.Name]; !ok || val != arg.Value.String() {
+			return false
+		}
+	}
+	return true
+}
+
+// Execution
+
+// Selections of one response key, merged
+type gqlFieldGroup struct {
+	key    string
+	fields []*gqlSelection
+}
+
+// The fields selected on t, grouped by response key in order, with fragments
+// expanded and @skip and @include applied
+func (p *gqlPrepared) collectFields(t *gqlType, sels []*gqlSelection) []*gqlFieldGroup {
+	var groups []*gqlFieldGroup
+	index := map[string]*gqlFieldGroup{}
+	visited := map[string]bool{}
+	var collect func(sels []*gqlSelection)
+	collect = func(sels []*gqlSelection) {
+		for _, sel := range sels {
+			if !p.included(sel.Directives) {
+				continue
+			}
+			switch {
+			case sel.Spread != "":
+				frag := p.doc.Fragments[sel.Spread]
+				if frag == nil || visited[frag.Name] || frag.TypeCondition != t.Name {
+					continue
+				}
+				visited[frag.Name] = true
+				collect(frag.Selections)
+			case sel.Inline:
+				if sel.TypeCondition == "" || sel.TypeCondition == t.Name {
+					collect(sel.Selections)
+				}
+			default:
+				group := index[sel.key()]
+				if group == nil {
+					group = &gqlFieldGroup{key: sel.key()}
+					index[group.key] = group
+					groups = append(groups, group)
+				}
+				group.fields = append(group.fields, sel)
+			}
+		}
+	}
+	collect(sels)
+	return groups
+}
+
+// Whether @skip and @include keep a selection
+func (p *gqlPrepared) included(dirs []*gqlDirective) bool {
+	for _, dir := range dirs {
+		if dir.Name != "skip" && dir.Name != "include" {
+			continue
+		}
+		args, err := coerceGQLArgs(gqlIfArg, dir.Args, p.vars)
+		if err != nil {
+			continue
+		}
+		if args["if"].(bool) == (dir.Name == "skip") {
+			return false
+		}
+	}
+	return true
+}
+
+// An object in a response, with its fields in the order they were selected
+type gqlObject []gqlEntry
+
+type gqlEntry struct {
+	Key   string
+	Value interface{}
+}
+
+func (o gqlObject) MarshalJSON() ([]byte, error) {
+	if o == nil {
+		return []byte("null"), nil
+	}
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, e := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(e.Key)
+		b.Write(key)
+		b.WriteByte(':')
+		value, err := json.Marshal(e.Value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+type gqlExecutor struct {
+	p *gqlPrepared
+	// Turns a resolver's error into a response error
+	fieldError func(ctx context.Context, err error) *gqlError
+	errs       []*gqlError
+}
+
+// Run the operation. data is nil when a null reached the root.
+func (p *gqlPrepared) execute(ctx context.Context, fieldError func(context.Context, error) *gqlError) (gqlObject, []*gqlError) {
+	e := &gqlExecutor{p: p, fieldError: fieldError}
+	// Fields of the root run one after the other, which mutations need
+	data, _ := e.selectionSet(ctx, p.root(), nil, p.op.Selections, nil)
+	return data, e.errs
+}
+
+// Resolve the selections on a value of object type t. ok is false when a
+// non-null field is null, which makes the object null.
+func (e *gqlExecutor) selectionSet(ctx context.Context, t *gqlType, source interface{}, sels []*gqlSelection, path []interface{}) (gqlObject, bool) {
+	groups := e.p.collectFields(t, sels)
+	out := make(gqlObject, 0, len(groups))
+	ok := true
+	for _, group := range groups {
+		fieldPath := append(slices.Clip(path), group.key)
+		sel := group.fields[0]
+		if sel.Name == "__typename" {
+			out = append(out, gqlEntry{group.key, t.Name})
+			continue
+		}
+		value, fieldOK := e.resolveField(ctx, e.p.schema.field(t, sel.Name), group, source, fieldPath)
+		if !fieldOK {
+			// The other fields still run: a mutation's effects shouldn't
+			// depend on an earlier field's result
+			ok = false
+			continue
+		}
+		out = append(out, gqlEntry{group.key, value})
+	}
+	if !ok {
+		return nil, false
+	}
+	return out, true
+}
+
+func (e *gqlExecutor) resolveField(ctx context.Context, f *gqlField, group *gqlFieldGroup, source interface{}, path []interface{}) (interface{}, bool) {
+	sel := group.fields[0]
+	args, argErr := coerceGQLArgs(f.Args, sel.Args, e.p.vars)
+	var err error
+	if argErr != nil {
+		err = argErr
+	} else if f.Scope != "" {
+		if p := principalFrom(ctx); p == nil || !slices.Contains(p.Scopes, f.Scope) {
+			err = apiError{Code: codeForbidden, Message: "Missing scope " + f.Scope}
+		}
+	}
+	var value interface{}
+	if err == nil {
+		value, err = f.Resolve(ctx, source, args)
+	}
+	if err != nil {
+		e.addError(ctx, err, sel, path)
+		return nil, f.Type.Kind != gqlNonNullKind
+	}
+	return e.complete(ctx, f.Type, group.fields, value, path)
+}
+
+func (e *gqlExecutor) addError(ctx context.Context, err error, sel *gqlSelection, path []interface{}) {
+	ge := e.fieldError(ctx, err)
+	ge.Locations = []gqlLocation{sel.Loc}
+	ge.Path = path
+	e.errs = append(e.errs, ge)
+}
+
+// Turn a resolved value into its response value for type t. ok is false when
+// a non-null position is null; the enclosing nullable position becomes null.
+func (e *gqlExecutor) complete(ctx context.Context, t *gqlType, fields []*gqlSelection, value interface{}, path []interface{}) (interface{}, bool) {
+	if t.Kind == gqlNonNullKind {
+		out, ok := e.complete(ctx, t.OfType, fields, value, path)
+		if ok && out == nil {
+			e.addError(ctx, errors.New("Cannot return null for a non-null field"), fields[0], path)
+		}
+		return out, ok && out != nil
+	}
+
+	rv := reflect.ValueOf(value)
+	if !rv.IsValid() {
+		return nil, true
+	}
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Slice, reflect.Interface:
+		if rv.IsNil() {
+			return nil, true
+		}
+	}
+
+	switch t.Kind {
+	case gqlListKind:
+		if rv.Kind() != reflect.Slice {
+			e.addError(ctx, fmt.Errorf("%s resolved to a %T", t, value), fields[0], path)
+			return nil, true
+		}
+		items := make([]interface{}, rv.Len())
+		for i := range items {
+			item, ok := e.complete(ctx, t.OfType, fields, rv.Index(i).Interface(), append(slices.Clip(path), i))
+			if !ok {
+				return nil, true
+			}
+			items[i] = item
+		}
+		return items, true
+	case gqlObjectKind:
+		var sels []*gqlSelection
+		for _, f := range fields {
+			sels = append(sels, f.Selections...)
+		}
+		out, ok := e.selectionSet(ctx, t, value, sels, path)
+		if !ok {
+			return nil, true
+		}
+		return out, true
+	}
+
+	if rv.Kind() == reflect.Pointer {
+		value = rv.Elem().Interface()
+	}
+	if t.Kind == gqlEnumKind {
+		for _, ev := range t.EnumValues {
+			if ev.Value == value {
+				return ev.Name, true
+			}
+		}
+		e.addError(ctx, fmt.Errorf("%s cannot represent %v", t.Name, value), fields[0], path)
+		return nil, true
+	}
+	out, err := t.Serialize(value)
+	if err != nil {
+		e.addError(ctx, err, fields[0], path)
+		return nil, true
+	}
+	return out, true
+}
+
+// Introspection
+
+// The __Schema and __Type types, whose resolvers read the schema's own
+// definitions
+func introspectionTypes(s *gqlSchema) (schemaType, typeType *gqlType) {
+	schemaType = &gqlType{Kind: gqlObjectKind, Name: "__Schema", Description: "The types, root operations and directives of the schema."}
+	typeType = &gqlType{Kind: gqlObjectKind, Name: "__Type", Description: "A type of the schema, or a list or non-null wrapper of one."}
+	fieldType := &gqlType{Kind: gqlObjectKind, Name: "__Field", Description: "A field of an object type."}
+	inputValueType := &gqlType{Kind: gqlObjectKind, Name: "__InputValue", Description: "An argument or an input object's field."}
+	enumValueType := &gqlType{Kind: gqlObjectKind, Name: "__EnumValue", Description: "A value of an enum."}
+	directiveType := &gqlType{Kind: gqlObjectKind, Name: "__Directive", Description: "A directive the server accepts."}
+	typeKind := gqlEnum("__TypeKind", "The kinds of __Type.",
+		gqlScalarKind, gqlObjectKind, "INTERFACE", "UNION", gqlEnumKind, gqlInputObjectKind, gqlListKind, gqlNonNullKind)
+	directiveLocation := gqlEnum("__DirectiveLocation", "Where a directive may be used.",
+		"QUERY", "MUTATION", "SUBSCRIPTION", "FIELD", "FRAGMENT_DEFINITION", "FRAGMENT_SPREAD", "INLINE_FRAGMENT", "VARIABLE_DEFINITION",
+		"SCHEMA", "SCALAR", "OBJECT", "FIELD_DEFINITION", "ARGUMENT_DEFINITION", "INTERFACE", "UNION", "ENUM", "ENUM_VALUE", "INPUT_OBJECT", "INPUT_FIELD_DEFINITION")
+
+	includeDeprecated := []*gqlInputValue{{Name: "includeDeprecated", Type: gqlBooleanType, Default: "false"}}
+	// Nothing is deprecated
+	notDeprecated := []*gqlField{
+		{Name: "isDeprecated", Type: gqlNonNull(gqlBooleanType), Resolve: gqlConst(false)},
+		{Name: "deprecationReason", Type: gqlStringType, Resolve: gqlConst(nil)},
+	}
+	nonNullList := func(t *gqlType) *gqlType { return gqlListOf(gqlNonNull(t)) }
+
+	schemaType.Fields = []*gqlField{
+		{Name: "description", Type: gqlStringType, Resolve: gqlFrom(func(s *gqlSchema) interface{} { return gqlOptional(s.Description) })},
+		{Name: "types", Type: gqlNonNull(nonNullList(typeType)), Resolve: gqlFrom(func(s *gqlSchema) interface{} {
+			types := make([]*gqlType, 0, len(s.Types))
+			for _, name := range sortedKeys(s.Types) {
+				types = append(types, s.Types[name])
+			}
+			return types
+		})},
+		{Name: "queryType", Type: gqlNonNull(typeType), Resolve: gqlFrom(func(s *gqlSchema) interface{} { return s.Query })},
+		{Name: "mutationType", Type: typeType, Resolve: gqlFrom(func(s *gqlSchema) interface{} { return s.Mutation })},
+		{Name: "subscriptionType", Type: typeType, Resolve: gqlConst(nil)},
+		{Name: "directives", Type: gqlNonNull(nonNullList(directiveType)), Resolve: gqlFrom(func(s *gqlSchema) interface{} { return s.Directives })},
+	}
+
+	typeType.Fields = []*gqlField{
+		{Name: "kind", Type: gqlNonNull(typeKind), Resolve: gqlFrom(func(t *gqlType) interface{} { return t.Kind })},
+		{Name: "name", Type: gqlStringType, Resolve: gqlFrom(func(t *gqlType) interface{} { return gqlOptional(t.Name) })},
+		{Name: "description", Type: gqlStringType, Resolve: gqlFrom(func(t *gqlType) interface{} { return gqlOptional(t.Description) })},
+		{Name: "specifiedByURL", Type: gqlStringType, Resolve: gqlConst(nil)},
+		{Name: "fields", Args: includeDeprecated, Type: nonNullList(fieldType), Resolve: gqlFrom(func(t *gqlType) interface{} {
+			if t.Kind != gqlObjectKind {
+				return nil
+			}
+			return t.Fields
+		})},
+		{Name: "interfaces", Type: nonNullList(typeType), Resolve: gqlFrom(func(t *gqlType) interface{} {
+			if t.Kind != gqlObjectKind {
+				return nil
+			}
+			return []*gqlType{}
+		})},
+		{Name: "possibleTypes", Type: nonNullList(typeType), Resolve: gqlConst(nil)},
+		{Name: "enumValues", Args: includeDeprecated, Type: nonNullList(enumValueType), Resolve: gqlFrom(func(t *gqlType) interface{} {
+			if t.Kind != gqlEnumKind {
+				return nil
+			}
+			return t.EnumValues
+		})},
+		{Name: "inputFields", Args: includeDeprecated, Type: nonNullList(inputValueType), Resolve: gqlFrom(func(t *gqlType) interface{} {
+			if t.Kind != gqlInputObjectKind {
+				return nil
+			}
+			return t.InputFields
+		})},
+		{Name: "ofType", Type: typeType, Resolve: gqlFrom(func(t *gqlType) interface{} { return t.OfType })},
+		{Name: "isOneOf", Type: gqlBooleanType, Resolve: gqlFrom(func(t *gqlType) interface{} {
+			if t.Kind != gqlInputObjectKind {
+				return nil
+			}
+			return false
+		})},
+	}
+
+	fieldType.Fields = append([]*gqlField{
+		{Name: "name", Type: gqlNonNull(gqlStringType), Resolve: gqlFrom(func(f *gqlField) interface{} { return f.Name })},
+		{Name: "description", Type: gqlStringType, Resolve: gqlFrom(func(f *gqlField) interface{} { return gqlOptional(f.Description) })},
+		{Name: "args", Args: includeDeprecated, Type: gqlNonNull(nonNullList(inputValueType)), Resolve: gqlFrom(func(f *gqlField) interface{} {
+			return append([]*gqlInputValue{}, f.Args...)
+		})},
+		{Name: "type", Type: gqlNonNull(typeType), Resolve: gqlFrom(func(f *gqlField) interface{} { return f.Type })},
+	}, notDeprecated...)
+
+	inputValueType.Fields = append([]*gqlField{
+		{Name: "name", Type: gqlNonNull(gqlStringType), Resolve: gqlFrom(func(v *gqlInputValue) interface{} { return v.Name })},
+		{Name: "description", Type: gqlStringType, Resolve: gqlFrom(func(v *gqlInputValue) interface{} { return gqlOptional(v.Description) })},
+		{Name: "type", Type: gqlNonNull(typeType), Resolve: gqlFrom(func(v *gqlInputValue) interface{} { return v.Type })},
+		{Name: "defaultValue", Type: gqlStringType, Resolve: gqlFrom(func(v *gqlInputValue) interface{} { return gqlOptional(v.Default) })},
+	}, notDeprecated...)
+
+	enumValueType.Fields = append([]*gqlField{
+		{Name: "name", Type: gqlNonNull(gqlStringType), Resolve: gqlFrom(func(v *gqlEnumValue) interface{} { return v.Name })},
+		{Name: "description", Type: gqlStringType, Resolve: gqlFrom(func(v *gqlEnumValue) interface{} { return gqlOptional(v.Description) })},
+	}, notDeprecated...)
+
+	directiveType.Fields = []*gqlField{
+		{Name: "name", Type: gqlNonNull(gqlStringType), Resolve: gqlFrom(func(d *gqlDirectiveDef) interface{} { return d.Name })},
+		{Name: "description", Type: gqlStringType, Resolve: gqlFrom(func(d *gqlDirectiveDef) interface{} { return gqlOptional(d.Description) })},
+		{Name: "locations", Type: gqlNonNull(nonNullList(directiveLocation)), Resolve: gqlFrom(func(d *gqlDirectiveDef) interface{} { return d.Locations })},
+		{Name: "args", Args: includeDeprecated, Type: gqlNonNull(nonNullList(inputValueType)), Resolve: gqlFrom(func(d *gqlDirectiveDef) interface{} { return d.Args })},
+		{Name: "isRepeatable", Type: gqlNonNull(gqlBooleanType), Resolve: gqlConst(false)},
+	}
+	return schemaType, typeType
+}
+
+// A resolver reading a field from a source of type S
+func gqlFrom[S any](get func(S) interface{}) gqlResolver {
+	return func(_ context.Context, source interface{}, _ map[string]interface{}) (interface{}, error) {
+		return get(source.(S)), nil
+	}
+}
+
+func gqlConst(v interface{}) gqlResolver {
+	return func(context.Context, interface{}, map[string]interface{}) (interface{}, error) {
+		return v, nil
+	}
+}
+
+// nil for an empty string, so it comes out as null
+func gqlOptional(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// The schema in the GraphQL schema language
+func (s *gqlSchema) sdl() string {
+	var b strings.Builder
+	args := func(defs []*gqlInputValue) string {
+		if len(defs) == 0 {
+			return ""
+		}
+		parts := make([]string, len(defs))
+		for i, a := range defs {
+			parts[i] = a.Name + ": " + a.Type.String()
+			if a.Default != "" {
+				parts[i] += " = " + a.Default
+			}
+		}
+		return "(" + strings.Join(parts, ", ") + ")"
+	}
+	describe := func(indent, description string) {
+		if description != "" {
+			b.WriteString(indent + strconv.Quote(description) + "\n")
+		}
+	}
+
+	names := sortedKeys(s.Types)
+	sort.SliceStable(names, func(i, j int) bool {
+		// Root types first
+		return s.Types[names[i]] == s.Query || (s.Types[names[i]] == s.Mutation && s.Types[names[j]] != s.Query)
+	})
+	for _, name := range names {
+		t := s.Types[name]
+		if strings.HasPrefix(name, "__") || slices.Contains([]*gqlType{gqlStringType, gqlIntType, gqlFloatType, gqlBooleanType, gqlIDType}, t) {
+			continue
+		}
+		describe("", t.Description)
+		switch t.Kind {
+		case gqlScalarKind:
+			b.WriteString("scalar " + name + "\n\n")
+		case gqlEnumKind:
+			b.WriteString("enum " + name + " {\n")
+			for _, v := range t.EnumValues {
+				describe("  ", v.Description)
+				b.WriteString("  " + v.Name + "\n")
+			}
+			b.WriteString("}\n\n")
+		case gqlInputObjectKind:
+			b.WriteString("input " + name + " {\n")
+			for _, f := range t.InputFields {
+				describe("  ", f.Description)
+				b.WriteString("  " + strings.TrimSuffix(strings.TrimPrefix(args([]*gqlInputValue{f}), "("), ")") + "\n")
+			}
+			b.WriteString("}\n\n")
+		case gqlObjectKind:
+			b.WriteString("type " + name + " {\n")
+			for _, f := range t.Fields {
+				describe("  ", f.Description)
+				b.WriteString("  " + f.Name + args(f.Args) + ": " + f.Type.String() + "\n")
+			}
+			b.WriteString("}\n\n")
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
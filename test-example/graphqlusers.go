@@ -0,0 +1,606 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The users API over GraphQL at /graphql. Resolvers call the same
+// validation, repository and audit code as the REST handlers, and each
+// field needs the scope its REST route does.
+
+var graphQLSchema = newUsersGraphQLSchema()
+
+// GraphiQL-like page at /graphql/playground/ (GRAPHQL_PLAYGROUND)
+//
+//go:embed playground
+var playgroundFiles embed.FS
+
+var (
+	gqlDateTimeType = &gqlType{Kind: gqlScalarKind, Name: "DateTime", Description: "An RFC 3339 timestamp. Inputs may also be a YYYY-MM-DD date, meaning midnight UTC.",
+		Parse: func(v interface{}) (interface{}, error) {
+			if s, ok := v.(string); ok {
+				for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+					if t, err := time.Parse(layout, s); err == nil {
+						return t, nil
+					}
+				}
+			}
+			return nil, gqlInvalid("DateTime", v)
+		},
+		Serialize: func(v interface{}) (interface{}, error) {
+			if t, ok := v.(time.Time); ok {
+				return t.Format(time.RFC3339Nano), nil
+			}
+			return nil, gqlInvalid("DateTime", v)
+		},
+	}
+	gqlJSONType = &gqlType{Kind: gqlScalarKind, Name: "JSON", Description: "Any JSON value.",
+		Parse: parseGQLJSON,
+		Serialize: func(v interface{}) (interface{}, error) {
+			return v, nil
+		},
+	}
+)
+
+// A JSON input as decoded JSON; enum values aren't JSON
+func parseGQLJSON(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case gqlEnumName:
+		return nil, gqlInvalid("JSON", v)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			var err error
+			if out[i], err = parseGQLJSON(item); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			var err error
+			if out[key], err = parseGQLJSON(item); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+// Enum values are the REST values in upper case
+func gqlValuesEnum(name, description string, values []string) *gqlType {
+	t := &gqlType{Kind: gqlEnumKind, Name: name, Description: description}
+	for _, v := range values {
+		t.EnumValues = append(t.EnumValues, &gqlEnumValue{Name: strings.ToUpper(v), Value: v})
+	}
+	return t
+}
+
+// A page of users and what's needed to count all of them
+type gqlUserPage struct {
+	Users      []User
+	NextCursor *string
+	Filter     userFilter
+}
+
+var errGraphQLUserNotFound = apiError{Code: codeUserNotFound, Message: "User not found"}
+
+func newUsersGraphQLSchema() *gqlSchema {
+	statusType := gqlValuesEnum("UserStatus", "Account state; changed through the REST suspend, activate and deactivate endpoints.", userStatuses)
+	roleType := gqlValuesEnum("UserRole", "", userRoles)
+
+	userType := &gqlType{Kind: gqlObjectKind, Name: "User", Description: "A user, as GET /api/users/{id} returns it."}
+	userType.Fields = []*gqlField{
+		{Name: "id", Type: gqlNonNull(gqlIDType), Resolve: gqlFrom(func(u User) interface{} { return u.ID })},
+		{Name: "email", Type: gqlNonNull(gqlStringType), Resolve: gqlFrom(func(u User) interface{} { return u.Email })},
+		{Name: "emailVerified", Type: gqlNonNull(gqlBooleanType), Resolve: gqlFrom(func(u User) interface{} { return u.EmailVerified })},
+		{Name: "name", Type: gqlNonNull(gqlStringType), Resolve: gqlFrom(func(u User) interface{} { return u.Name })},
+		{Name: "createdAt", Type: gqlNonNull(gqlDateTimeType), Resolve: gqlFrom(func(u User) interface{} { return u.CreatedAt })},
+		{Name: "updatedAt", Type: gqlNonNull(gqlDateTimeType), Resolve: gqlFrom(func(u User) interface{} { return u.UpdatedAt })},
+		{Name: "deletedAt", Description: "Set for deleted users.", Type: gqlDateTimeType, Resolve: gqlFrom(func(u User) interface{} { return u.DeletedAt })},
+		{Name: "avatarUrl", Type: gqlStringType, Resolve: gqlFrom(func(u User) interface{} { return u.AvatarURL })},
+		{Name: "phone", Description: "E.164.", Type: gqlStringType, Resolve: gqlFrom(func(u User) interface{} { return u.Phone })},
+		{Name: "status", Type: gqlNonNull(statusType), Resolve: gqlFrom(func(u User) interface{} { return u.Status })},
+		{Name: "role", Type: gqlNonNull(roleType), Resolve: gqlFrom(func(u User) interface{} { return u.Role })},
+		{Name: "metadata", Type: gqlNonNull(gqlJSONType), Resolve: gqlFrom(func(u User) interface{} {
+			if u.Metadata == nil {
+				return Metadata{}
+			}
+			return u.Metadata
+		})},
+		{Name: "version", Description: "Incremented by every change; see updateUser's version.", Type: gqlNonNull(gqlIntType), Resolve: gqlFrom(func(u User) interface{} { return u.Version })},
+	}
+
+	connectionType := &gqlType{Kind: gqlObjectKind, Name: "UserConnection", Description: "A page of users."}
+	connectionType.Fields = []*gqlField{
+		{Name: "nodes", Type: gqlNonNull(gqlListOf(gqlNonNull(userType))), Resolve: gqlFrom(func(p *gqlUserPage) interface{} { return p.Users })},
+		{Name: "nextCursor", Description: "after for the next page; null on the last page and when sort or offset is used.", Type: gqlStringType,
+			Resolve: gqlFrom(func(p *gqlUserPage) interface{} { return p.NextCursor })},
+		{Name: "totalCount", Description: "Users matching the filter, on every page. Costs a query of its own.", Type: gqlNonNull(gqlIntType),
+			Resolve: func(ctx context.Context, source interface{}, _ map[string]interface{}) (interface{}, error) {
+				total, err := repositoriesFrom(ctx).reader.Count(ctx, source.(*gqlUserPage).Filter)
+				if err != nil {
+					return nil, internalError(ctx, "Failed to count users", err)
+				}
+				return total, nil
+			},
+		},
+	}
+
+	filterType := &gqlType{Kind: gqlInputObjectKind, Name: "UserFilter", Description: "The filters of GET /api/users."}
+	filterType.InputFields = []*gqlInputValue{
+		{Name: "name", Description: "Substring of the name, case-insensitive.", Type: gqlStringType},
+		{Name: "domain", Description: "Email domain, e.g. example.com.", Type: gqlStringType},
+		{Name: "createdAfter", Type: gqlDateTimeType},
+		{Name: "createdBefore", Type: gqlDateTimeType},
+		{Name: "includeDeleted", Type: gqlBooleanType, Default: "false"},
+		{Name: "phone", Type: gqlStringType},
+		{Name: "status", Type: statusType},
+		{Name: "role", Type: roleType},
+		{Name: "verified", Type: gqlBooleanType},
+		{Name: "metadata", Description: "An object of string values the user's metadata must contain.", Type: gqlJSONType},
+	}
+
+	createInput := &gqlType{Kind: gqlInputObjectKind, Name: "CreateUserInput", Description: "The body of POST /api/users."}
+	createInput.InputFields = []*gqlInputValue{
+		{Name: "email", Type: gqlNonNull(gqlStringType)},
+		{Name: "name", Type: gqlNonNull(gqlStringType)},
+		{Name: "phone", Type: gqlStringType},
+		{Name: "role", Description: "MEMBER when unset.", Type: roleType},
+		{Name: "metadata", Type: gqlJSONType},
+		{Name: "password", Description: "Users without one can't log in.", Type: gqlStringType},
+	}
+
+	updateInput := &gqlType{Kind: gqlInputObjectKind, Name: "UpdateUserInput", Description: "The body of PATCH /api/users/{id}: only the fields given change, and null clears phone."}
+	updateInput.InputFields = []*gqlInputValue{
+		{Name: "email", Type: gqlStringType},
+		{Name: "name", Type: gqlStringType},
+		{Name: "phone", Type: gqlStringType},
+		{Name: "role", Type: roleType},
+		{Name: "metadata", Description: "Merged into the existing metadata; keys set to null are removed.", Type: gqlJSONType},
+	}
+
+	query := &gqlType{Kind: gqlObjectKind, Name: "Query"}
+	query.Fields = []*gqlField{
+		{
+			Name:        "users",
+			Description: "Users newest first, or in sort's order. Page with after (nextCursor) or with offset.",
+			Args: []*gqlInputValue{
+				{Name: "filter", Type: filterType},
+				{Name: "first", Description: "At most 500.", Type: gqlIntType, Default: fmt.Sprint(defaultPageLimit)},
+				{Name: "after", Type: gqlStringType},
+				{Name: "offset", Type: gqlIntType, Default: "0"},
+				{Name: "sort", Description: "The sort parameter of GET /api/users, e.g. \"name,-created_at\".", Type: gqlStringType},
+			},
+			Type:  gqlNonNull(connectionType),
+			Scope: scopeUsersRead,
+			Size: func(args map[string]interface{}) int {
+				first, _ := args["first"].(int)
+				return min(max(first, 1), maxPageLimit)
+			},
+			Resolve: resolveUsers,
+		},
+		{
+			Name:        "user",
+			Description: "A user by id; null when there is none.",
+			Args: []*gqlInputValue{
+				{Name: "id", Type: gqlNonNull(gqlIDType)},
+				{Name: "includeDeleted", Type: gqlBooleanType, Default: "false"},
+			},
+			Type:    userType,
+			Scope:   scopeUsersRead,
+			Resolve: resolveUser,
+		},
+	}
+
+	mutation := &gqlType{Kind: gqlObjectKind, Name: "Mutation"}
+	mutation.Fields = []*gqlField{
+		{
+			Name:        "createUser",
+			Description: "Create a user and send the verification email.",
+			Args:        []*gqlInputValue{{Name: "input", Type: gqlNonNull(createInput)}},
+			Type:        gqlNonNull(userType),
+			Scope:       scopeUsersWrite,
+			Resolve:     resolveCreateUser,
+		},
+		{
+			Name:        "updateUser",
+			Description: "Update a user.",
+			Args: []*gqlInputValue{
+				{Name: "id", Type: gqlNonNull(gqlIDType)},
+				{Name: "input", Type: gqlNonNull(updateInput)},
+				{Name: "version", Description: "The version the change is based on, like If-Match; required when REQUIRE_IF_MATCH is on.", Type: gqlIntType},
+			},
+			Type:    gqlNonNull(userType),
+			Scope:   scopeUsersWrite,
+			Resolve: resolveUpdateUser,
+		},
+		{
+			Name:        "deleteUser",
+			Description: "Soft-delete a user.",
+			Args:        []*gqlInputValue{{Name: "id", Type: gqlNonNull(gqlIDType)}},
+			Type:        gqlNonNull(gqlBooleanType),
+			Scope:       scopeUsersAdmin,
+			Resolve:     resolveDeleteUser,
+		},
+	}
+
+	return newGQLSchema("The users API of sample-api.", query, mutation)
+}
+
+func resolveUsers(ctx context.Context, _ interface{}, args map[string]interface{}) (interface{}, error) {
+	first, offset := args["first"].(int), args["offset"].(int)
+	after, afterSet := args["after"].(string)
+	sort, _ := args["sort"].(string)
+	switch {
+	case first < 1:
+		return nil, invalidArgument(fieldError{Field: "first", Rule: "min", Message: "first must be a positive integer"})
+	case offset < 0:
+		return nil, invalidArgument(fieldError{Field: "offset", Rule: "min", Message: "offset must be a non-negative integer"})
+	case afterSet && offset > 0:
+		return nil, apiError{Code: codeInvalidRequest, Message: "after and offset cannot be combined"}
+	case afterSet && sort != "":
+		return nil, apiError{Code: codeInvalidRequest, Message: "after and sort cannot be combined"}
+	}
+	limit := min(first, maxPageLimit)
+
+	sortTerms, err := parseSort(sort)
+	if err != nil {
+		return nil, apiError{Code: codeInvalidRequest, Message: err.Error()}
+	}
+	filter, err := gqlUserFilter(args["filter"])
+	if err != nil {
+		return nil, invalidArgument(err)
+	}
+
+	// Fetch one extra row to find out whether another page exists
+	query := userListQuery{Filter: filter, Fields: userFields, Sort: sortTerms, Limit: limit + 1, Offset: offset}
+	if after != "" {
+		cursor, err := decodeCursor(after)
+		if err != nil {
+			return nil, invalidArgument(fieldError{Field: "after", Rule: "cursor", Message: "Invalid cursor"})
+		}
+		query.After = &cursor
+	}
+
+	users, err := repositoriesFrom(ctx).reader.List(ctx, query)
+	if err != nil {
+		return nil, internalError(ctx, "Failed to fetch users", err)
+	}
+	page := &gqlUserPage{Users: users, Filter: filter}
+	if len(users) > limit {
+		page.Users = users[:limit]
+		if sort == "" && offset == 0 {
+			next := encodeCursor(users[limit-1])
+			page.NextCursor = &next
+		}
+	}
+	return page, nil
+}
+
+// The userFilter for a UserFilter input, validated
+func gqlUserFilter(v interface{}) (userFilter, error) {
+	var filter userFilter
+	in, _ := v.(map[string]interface{})
+	if in == nil {
+		return filter, nil
+	}
+	name, _ := in["name"].(string)
+	filter.Name = strings.TrimSpace(name)
+	filter.Domain, _ = in["domain"].(string)
+	if t, ok := in["createdAfter"].(time.Time); ok {
+		filter.CreatedAfter = &t
+	}
+	if t, ok := in["createdBefore"].(time.Time); ok {
+		filter.CreatedBefore = &t
+	}
+	filter.IncludeDeleted, _ = in["includeDeleted"].(bool)
+	filter.Phone, _ = in["phone"].(string)
+	filter.Status, _ = in["status"].(string)
+	filter.Role, _ = in["role"].(string)
+	if verified, ok := in["verified"].(bool); ok {
+		filter.Verified = &verified
+	}
+	if metadata, ok := in["metadata"]; ok && metadata != nil {
+		entries, ok := metadata.(map[string]interface{})
+		if !ok {
+			return userFilter{}, fieldError{Field: "metadata", Rule: "object", Message: "metadata must be a JSON object"}
+		}
+		// Values are strings, as metadata.<key>=<value> parameters are
+		filter.Metadata = Metadata{}
+		for key, value := range entries {
+			s, ok := value.(string)
+			if !ok {
+				return userFilter{}, fieldError{Field: "metadata", Rule: "string", Message: fmt.Sprintf("metadata.%s must be a string", key)}
+			}
+			filter.Metadata[key] = s
+		}
+	}
+	if err := filter.validate(); err != nil {
+		return userFilter{}, err
+	}
+	return filter, nil
+}
+
+// The id argument, which must be a UUID like the :id of the REST routes
+func gqlUserID(args map[string]interface{}) (string, error) {
+	id := args["id"].(string)
+	if !uuidRegex.MatchString(id) {
+		return "", invalidArgument(fieldError{Field: "id", Rule: "uuid", Message: "Invalid user id"})
+	}
+	return id, nil
+}
+
+func resolveUser(ctx context.Context, _ interface{}, args map[string]interface{}) (interface{}, error) {
+	id, err := gqlUserID(args)
+	if err != nil {
+		return nil, err
+	}
+	user, err := repositoriesFrom(ctx).reader.GetByID(ctx, id, userFields, args["includeDeleted"].(bool))
+	if err == errUserNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, internalError(ctx, "Failed to fetch user", err)
+	}
+	return user, nil
+}
+
+// A JSON input as Metadata, checked like a request body's metadata
+func gqlMetadata(v interface{}) (Metadata, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var metadata Metadata
+	if err := metadata.UnmarshalJSON(data); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+func resolveCreateUser(ctx context.Context, _ interface{}, args map[string]interface{}) (interface{}, error) {
+	in := args["input"].(map[string]interface{})
+	input := createUserInput{Email: in["email"].(string), Name: in["name"].(string)}
+	input.Role, _ = in["role"].(string)
+	if phone, ok := in["phone"].(string); ok {
+		input.Phone = &phone
+	}
+	if password, ok := in["password"].(string); ok {
+		input.Password = &password
+	}
+	if metadata := in["metadata"]; metadata != nil {
+		var err error
+		if input.Metadata, err = gqlMetadata(metadata); err != nil {
+			return nil, invalidArgument(err)
+		}
+	}
+	if input.Role != "" && !canAssignRole(principalFrom(ctx), input.Role) {
+		return nil, roleAssignmentRefused(input.Role)
+	}
+	if err := input.validate(); err != nil {
+		return nil, invalidArgument(err)
+	}
+
+	user, err := createUserAudited(ctx, repositoriesFrom(ctx).users, input)
+	if err == errEmailTaken {
+		return nil, apiError{Code: codeEmailConflict, Message: "Email already exists"}
+	}
+	if err != nil {
+		return nil, internalError(ctx, "Failed to create user", err)
+	}
+	return user, nil
+}
+
+func resolveUpdateUser(ctx context.Context, _ interface{}, args map[string]interface{}) (interface{}, error) {
+	id, err := gqlUserID(args)
+	if err != nil {
+		return nil, err
+	}
+
+	in := args["input"].(map[string]interface{})
+	field := func(name string) optionalString {
+		v, ok := in[name]
+		if !ok {
+			return optionalString{}
+		}
+		s, _ := v.(string)
+		return optionalString{Set: true, Null: v == nil, Value: s}
+	}
+	patch := userPatch{Email: field("email"), Name: field("name"), Phone: field("phone"), Role: field("role")}
+	if metadata := in["metadata"]; metadata != nil {
+		merged, err := gqlMetadata(metadata)
+		if err != nil {
+			return nil, invalidArgument(err)
+		}
+		patch.Metadata = &merged
+	}
+	if err := patch.validate(); err != nil {
+		return nil, invalidArgument(err)
+	}
+	if patch.Role.Set && !canAssignRole(principalFrom(ctx), patch.Role.Value) {
+		return nil, roleAssignmentRefused(patch.Role.Value)
+	}
+
+	version, versionSet := args["version"].(int)
+	if !versionSet && requireIfMatch {
+		return nil, apiError{Code: codePreconditionRequired, Message: "version is required"}
+	}
+	if patch.empty() {
+		return nil, invalidArgument(fieldError{Field: "input", Rule: "required", Message: "No fields to update"})
+	}
+
+	// Like If-Match: without a version the update is unconditional
+	var versions []int64
+	if versionSet {
+		versions = []int64{int64(version)}
+	}
+
+	user, err := updateUserAudited(ctx, repositoriesFrom(ctx).users, id, patch, versions)
+	if err == errVersionMismatch {
+		return nil, apiError{Code: codePreconditionFailed, Message: "User has been modified; fetch it again and retry"}
+	}
+	if err == errUserNotFound {
+		return nil, errGraphQLUserNotFound
+	}
+	if err == errMetadataTooLarge {
+		return nil, invalidArgument(errMetadataTooLarge)
+	}
+	if err == errEmailTaken {
+		return nil, apiError{Code: codeEmailConflict, Message: "Email already exists"}
+	}
+	if err != nil {
+		return nil, internalError(ctx, "Failed to update user", err)
+	}
+	return user, nil
+}
+
+func resolveDeleteUser(ctx context.Context, _ interface{}, args map[string]interface{}) (interface{}, error) {
+	id, err := gqlUserID(args)
+	if err != nil {
+		return nil, err
+	}
+	err = deleteUserAudited(ctx, repositoriesFrom(ctx).users, id)
+	if err == errUserNotFound {
+		return nil, errGraphQLUserNotFound
+	}
+	if err != nil {
+		return nil, internalError(ctx, "Failed to delete user", err)
+	}
+	return true, nil
+}
+
+// HTTP
+
+// The body of POST /graphql, and the parameters of GET /graphql
+type graphQLRequest struct {
+	Query         string          `json:"query"`
+	OperationName string          `json:"operationName"`
+	Variables     json.RawMessage `json:"variables"`
+	// Accepted for clients that send them (e.g. persisted query hashes);
+	// none are supported
+	Extensions json.RawMessage `json:"extensions"`
+}
+
+type graphQLResponse struct {
+	Errors []*gqlError `json:"errors,omitempty"`
+	Data   gqlObject   `json:"data"`
+}
+
+// Run a GraphQL request. Documents that don't parse or validate get 400 with
+// only errors; anything that runs gets 200 with data and the errors of the
+// fields that failed. GET only runs queries.
+func graphQL(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var req graphQLRequest
+	if c.Request.Method == http.MethodGet {
+		req.Query = c.Query("query")
+		req.OperationName = c.Query("operationName")
+		req.Variables = json.RawMessage(c.Query("variables"))
+	} else if !bindJSON(c, &req) {
+		return
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		respondGraphQLErrors(c, http.StatusBadRequest, &gqlError{Message: "query is required"})
+		return
+	}
+
+	var variables map[string]interface{}
+	if len(bytes.TrimSpace(req.Variables)) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(req.Variables))
+		dec.UseNumber()
+		if err := dec.Decode(&variables); err != nil {
+			respondGraphQLErrors(c, http.StatusBadRequest, &gqlError{Message: "variables must be a JSON object"})
+			return
+		}
+	}
+
+	prepared, errs := graphQLSchema.prepare(req.Query, req.OperationName, variables)
+	if errs != nil {
+		respondGraphQLErrors(c, http.StatusBadRequest, errs...)
+		return
+	}
+	if prepared.op.Kind == "mutation" && c.Request.Method == http.MethodGet {
+		c.Header("Allow", http.MethodPost)
+		respondGraphQLErrors(c, http.StatusMethodNotAllowed, &gqlError{Message: "Mutations must be sent with POST"})
+		return
+	}
+
+	data, errs := prepared.execute(ctx, graphQLFieldError)
+	c.JSON(http.StatusOK, graphQLResponse{Errors: errs, Data: data})
+}
+
+// Respond with request errors, which have the invalid_request code
+func respondGraphQLErrors(c *gin.Context, status int, errs ...*gqlError) {
+	for _, e := range errs {
+		e.Extensions = map[string]interface{}{"code": codeInvalidRequest, "request_id": c.GetString(requestIDKey)}
+	}
+	c.AbortWithStatusJSON(status, gin.H{"errors": errs})
+}
+
+// The response error for a field's error: apiErrors keep their code and
+// details, and failures caused by the request context are reported as what
+// they are, like respondInternal does
+func graphQLFieldError(ctx context.Context, err error) *gqlError {
+	var e apiError
+	var ge *gqlError
+	switch {
+	case errors.As(err, &e):
+	case errors.As(err, &ge):
+		e = apiError{Code: codeInvalidRequest, Message: ge.Message}
+	default:
+		// The engine's own errors, such as a null for a non-null field
+		loggerFrom(ctx).Error("GraphQL error", "error", err)
+		e = apiError{Code: codeInternal, Message: err.Error()}
+	}
+	if e.Code == codeInternal && ctx.Err() == context.DeadlineExceeded {
+		e = apiError{Code: codeTimeout, Message: "Request timed out"}
+	}
+	extensions := map[string]interface{}{"code": e.Code, "request_id": requestIDFrom(ctx)}
+	if len(e.Details) > 0 {
+		extensions["details"] = e.Details
+	}
+	return &gqlError{Message: e.Message, Extensions: extensions}
+}
+
+// Serve the playground's files, index.html for /graphql/playground/ and
+// the schema in the GraphQL schema language for schema.graphql
+func getGraphQLPlayground(c *gin.Context) {
+	name := strings.TrimPrefix(c.Param("file"), "/")
+	if name == "" {
+		name = "index.html"
+	}
+	contentType := mime.TypeByExtension(path.Ext(name))
+	var data []byte
+	if name == "schema.graphql" {
+		data = []byte(graphQLSchema.sdl())
+		contentType = "text/plain; charset=utf-8"
+	} else {
+		var err error
+		if data, err = playgroundFiles.ReadFile("playground/" + name); err != nil {
+			noRoute(c)
+			return
+		}
+	}
+	// The same sources as the API explorer's
+	if !strings.EqualFold(contentSecurityPolicy, headerOff) {
+		c.Header("Content-Security-Policy", docsContentSecurityPolicy)
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, contentType, data)
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// gRPC on GRPC_PORT: unary calls over cleartext HTTP/2 (h2c), served with
+// net/http. Like ADMIN_PORT it has no TLS and is meant for a private
+// network. The services are in users.proto; calls go through interceptors
+// doing what the HTTP middleware does for /api.
+
+// gRPC status codes
+type grpcCode uint32
+
+const (
+	grpcOK                 grpcCode = 0
+	grpcCanceled           grpcCode = 1
+	grpcUnknown            grpcCode = 2
+	grpcInvalidArgument    grpcCode = 3
+	grpcDeadlineExceeded   grpcCode = 4
+	grpcNotFound           grpcCode = 5
+	grpcAlreadyExists      grpcCode = 6
+	grpcPermissionDenied   grpcCode = 7
+	grpcResourceExhausted  grpcCode = 8
+	grpcFailedPrecondition grpcCode = 9
+	grpcAborted            grpcCode = 10
+	grpcUnimplemented      grpcCode = 12
+	grpcInternal           grpcCode = 13
+	grpcUnavailable        grpcCode = 14
+	grpcUnauthenticated    grpcCode = 16
+)
+
+var grpcCodeNames = map[grpcCode]string{
+	grpcOK:                 "OK",
+	grpcCanceled:           "Canceled",
+	grpcUnknown:            "Unknown",
+	grpcInvalidArgument:    "InvalidArgument",
+	grpcDeadlineExceeded:   "DeadlineExceeded",
+	grpcNotFound:           "NotFound",
+	grpcAlreadyExists:      "AlreadyExists",
+	grpcPermissionDenied:   "PermissionDenied",
+	grpcResourceExhausted:  "ResourceExhausted",
+	grpcFailedPrecondition: "FailedPrecondition",
+	grpcAborted:            "Aborted",
+	grpcUnimplemented:      "Unimplemented",
+	grpcInternal:           "Internal",
+	grpcUnavailable:        "Unavailable",
+	grpcUnauthenticated:    "Unauthenticated",
+}
+
+func (c grpcCode) String() string {
+	if name, ok := grpcCodeNames[c]; ok {
+		return name
+	}
+	return "Code(" + strconv.Itoa(int(c)) + ")"
+}
+
+// The gRPC code for each API error code; the API code itself goes in the
+// status details. Codes missing here become Internal.
+var grpcCodes = map[string]grpcCode{
+	codeInvalidRequest:       grpcInvalidArgument,
+	codeValidationFailed:     grpcInvalidArgument,
+	codeUserNotFound:         grpcNotFound,
+	codeEmailConflict:        grpcAlreadyExists,
+	codePreconditionFailed:   grpcAborted,
+	codePreconditionRequired: grpcFailedPrecondition,
+	codePayloadTooLarge:      grpcResourceExhausted,
+	codeTimeout:              grpcDeadlineExceeded,
+	codeNotImplemented:       grpcUnimplemented,
+	codeUnauthorized:         grpcUnauthenticated,
+	codeForbidden:            grpcPermissionDenied,
+	codeMaintenance:          grpcUnavailable,
+	codeRateLimited:          grpcResourceExhausted,
+	codeQuotaExceeded:        grpcResourceExhausted,
+	codeInternal:             grpcInternal,
+}
+
+// Domain of the google.rpc.ErrorInfo in error details
+const grpcErrorDomain = "sample-api"
+
+// Failed calls answer with an apiError, so gRPC clients get the codes and
+// field errors HTTP clients do
+func (e apiError) Error() string {
+	return e.Message
+}
+
+// A validation failure as an error, like respondInvalid answers it
+func invalidArgument(err error) apiError {
+	var fe fieldError
+	if errors.As(err, &fe) {
+		return apiError{Code: codeValidationFailed, Message: fe.Message, Details: []fieldError{fe}}
+	}
+	return apiError{Code: codeValidationFailed, Message: err.Error()}
+}
+
+// A call in progress
+type grpcCall struct {
+	// Full method name, /sampleapi.users.v1.Users/GetUser
+	Method string
+	// The method's name for metrics: Method when it exists, "unmatched"
+	// otherwise, so unknown names don't create a series each
+	Route string
+	// The method's handler; nil when it doesn't exist
+	Handler *grpcMethod
+	// Request metadata (headers) and response metadata
+	Header         http.Header
+	ResponseHeader http.Header
+	RemoteAddr     string
+	Body           io.Reader
+}
+
+// A unary method: the encoded request in, the encoded response out
+type grpcMethod struct {
+	// Scope the caller needs
+	Scope string
+	// Reads only, so allowed during read-only maintenance
+	ReadOnly bool
+	Handle   func(ctx context.Context, req []byte) ([]byte, error)
+}
+
+type grpcHandler func(ctx context.Context, call *grpcCall) ([]byte, error)
+
+// Wraps the handling of a call, like gin middleware
+type grpcInterceptor func(ctx context.Context, call *grpcCall, next grpcHandler) ([]byte, error)
+
+type grpcServer struct {
+	methods  map[string]*grpcMethod
+	handler  grpcHandler
+	maxBytes int64
+	timeout  time.Duration
+	// Carried in every call's context, like newRouter's
+	repos *repositories
+}
+
+func newGRPCHandler(cfg Config, repos *repositories) *grpcServer {
+	s := &grpcServer{
+		methods:  map[string]*grpcMethod{},
+		maxBytes: cfg.MaxBodyBytes,
+		timeout:  cfg.RequestTimeout,
+		repos:    repos,
+	}
+	for name, m := range usersMethods {
+		s.methods["/"+usersService+"/"+name] = m
+	}
+	// First to last, the order of the HTTP middleware
+	s.handler = chainGRPC(s.invoke,
+		grpcRequestID, grpcLogRequests, grpcRecordMetrics, grpcRecoverPanics, grpcMaintenanceGate, grpcAuthenticate)
+	return s
+}
+
+func chainGRPC(handler grpcHandler, interceptors ...grpcInterceptor) grpcHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		next, interceptor := handler, interceptors[i]
+		handler = func(ctx context.Context, call *grpcCall) ([]byte, error) {
+			return interceptor(ctx, call, next)
+		}
+	}
+	return handler
+}
+
+// Server for GRPC_PORT; nil when gRPC is off
+func newGRPCServer(cfg Config, baseCtx context.Context, repos *repositories) *http.Server {
+	if cfg.GRPCPort == "" {
+		return nil
+	}
+	return &http.Server{
+		Addr:              ":" + cfg.GRPCPort,
+		Handler:           h2c.NewHandler(newGRPCHandler(cfg, repos), &http2.Server{}),
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
+		ReadHeaderTimeout: cfg.ServerReadHeaderTimeout,
+		IdleTimeout:       cfg.ServerIdleTimeout,
+	}
+}
+
+func (s *grpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 {
+		http.Error(w, "gRPC requires HTTP/2", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "gRPC requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/grpc" && !strings.HasPrefix(contentType, "application/grpc+proto") && !strings.HasPrefix(contentType, "application/grpc;") {
+		http.Error(w, "Content-Type must be application/grpc", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	ctx := withRepositories(r.Context(), s.repos)
+	timeout := s.timeout
+	if v := r.Header.Get("Grpc-Timeout"); v != "" {
+		if d, ok := parseGRPCTimeout(v); ok && (timeout <= 0 || d < timeout) {
+			timeout = d
+		}
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	call := &grpcCall{
+		Method:         r.URL.Path,
+		Route:          "unmatched",
+		Handler:        s.methods[r.URL.Path],
+		Header:         r.Header,
+		ResponseHeader: w.Header(),
+		RemoteAddr:     r.RemoteAddr,
+		Body:           r.Body,
+	}
+	if call.Handler != nil {
+		call.Route = call.Method
+	}
+	resp, err := s.handler(ctx, call)
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Accept-Encoding", "identity")
+	w.WriteHeader(http.StatusOK)
+	if err == nil {
+		frame := make([]byte, 5, 5+len(resp))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(resp)))
+		w.Write(append(frame, resp...))
+	}
+
+	code, message, details := grpcStatus(ctx, err)
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(int(code)))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", encodeGRPCMessage(message))
+	}
+	if details != nil {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status-Details-Bin", base64.RawStdEncoding.EncodeToString(details))
+	}
+}
+
+// Read the request message and run the method
+func (s *grpcServer) invoke(ctx context.Context, call *grpcCall) ([]byte, error) {
+	if call.Handler == nil {
+		return nil, apiError{Code: codeNotImplemented, Message: "Unknown method " + call.Method}
+	}
+	req, err := readGRPCMessage(call.Body, s.maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	return call.Handler.Handle(ctx, req)
+}
+
+// Read the single length-prefixed message of a unary call
+func readGRPCMessage(body io.Reader, maxBytes int64) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, apiError{Code: codeInvalidRequest, Message: "Missing request message"}
+	}
+	if prefix[0] != 0 {
+		return nil, apiError{Code: codeNotImplemented, Message: "Compressed messages are not supported"}
+	}
+	size := int64(binary.BigEndian.Uint32(prefix[1:]))
+	if size > maxBytes {
+		return nil, apiError{Code: codePayloadTooLarge, Message: fmt.Sprintf("Request message is larger than %d bytes", maxBytes)}
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, apiError{Code: codeInvalidRequest, Message: "Truncated request message"}
+	}
+	return msg, nil
+}
+
+// Parse a grpc-timeout value: up to 8 digits and a unit
+func parseGRPCTimeout(v string) (time.Duration, bool) {
+	if len(v) < 2 || len(v) > 9 {
+		return 0, false
+	}
+	units := map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second, 'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond}
+	unit, ok := units[v[len(v)-1]]
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if !ok || err != nil || n < 0 {
+		return 0, false
+	}
+	if n > int64(1<<63-1)/int64(unit) {
+		return 1<<63 - 1, true
+	}
+	return time.Duration(n) * unit, true
+}
+
+// Percent-encode a grpc-message value
+func encodeGRPCMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		if c := message[i]; c >= 0x20 && c <= 0x7e && c != '%' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// The code, message and encoded google.rpc.Status of a call's result.
+// Failures caused by the call's context are reported as what they are, like
+// respondInternal does.
+func grpcStatus(ctx context.Context, err error) (grpcCode, string, []byte) {
+	if err == nil {
+		return grpcOK, "", nil
+	}
+	var e apiError
+	if !errors.As(err, &e) {
+		e = apiError{Code: codeInternal, Message: "Internal server error"}
+	}
+	if e.Code == codeInternal {
+		switch ctx.Err() {
+		case context.DeadlineExceeded:
+			e = apiError{Code: codeTimeout, Message: "Request timed out"}
+		case context.Canceled:
+			return grpcCanceled, "Client canceled the call", nil
+		}
+	}
+	code, ok := grpcCodes[e.Code]
+	if !ok {
+		code = grpcInternal
+	}
+	return code, e.Message, encodeRPCStatus(code, e)
+}
+
+// google.rpc.Status{code, message, details: [ErrorInfo, BadRequest]}
+func encodeRPCStatus(code grpcCode, e apiError) []byte {
+	var info []byte
+	info = appendString(info, 1, e.Code)
+	info = appendString(info, 2, grpcErrorDomain)
+	if e.RequestID != "" {
+		var entry []byte
+		entry = appendString(entry, 1, "request_id")
+		entry = appendString(entry, 2, e.RequestID)
+		info = appendMessage(info, 3, entry)
+	}
+
+	var b []byte
+	b = appendInt64(b, 1, int64(code))
+	b = appendString(b, 2, e.Message)
+	b = appendMessage(b, 3, anyMessage("type.googleapis.com/google.rpc.ErrorInfo", info))
+	if len(e.Details) > 0 {
+		var badRequest []byte
+		for _, fe := range e.Details {
+			var violation []byte
+			violation = appendString(violation, 1, fe.Field)
+			violation = appendString(violation, 2, fe.Message)
+			violation = appendString(violation, 3, fe.Rule)
+			badRequest = appendMessage(badRequest, 1, violation)
+		}
+		b = appendMessage(b, 3, anyMessage("type.googleapis.com/google.rpc.BadRequest", badRequest))
+	}
+	return b
+}
+
+// google.protobuf.Any{type_url, value}
+func anyMessage(typeURL string, value []byte) []byte {
+	var b []byte
+	b = appendString(b, 1, typeURL)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendBytes(b, value)
+}
+
+// Interceptor assigning each call a request ID, like assignRequestID: the
+// client's x-request-id when it is a sane token, otherwise a new UUID, echoed
+// in the response metadata and the error details
+func grpcRequestID(ctx context.Context, call *grpcCall, next grpcHandler) ([]byte, error) {
+	id := call.Header.Get(requestIDHeader)
+	if !validRequestID.MatchString(id) {
+		id = newUUID()
+	}
+	call.ResponseHeader.Set(requestIDHeader, id)
+	logger := slog.Default().With("request_id", id, "rpc", call.Method)
+	resp, err := next(withLogger(withRequestID(ctx, id), logger), call)
+	var e apiError
+	if errors.As(err, &e) {
+		e.RequestID = id
+		err = e
+	}
+	return resp, err
+}
+
+// Interceptor writing an access log line per call, like logRequests
+func grpcLogRequests(ctx context.Context, call *grpcCall, next grpcHandler) ([]byte, error) {
+	start := time.Now()
+	resp, err := next(ctx, call)
+	code, _, _ := grpcStatus(ctx, err)
+	host, _, _ := net.SplitHostPort(call.RemoteAddr)
+	level := slog.LevelInfo
+	if code == grpcInternal || code == grpcUnknown || code == grpcUnavailable {
+		level = slog.LevelWarn
+	}
+	loggerFrom(ctx).LogAttrs(ctx, level, "Call", slog.String("code", code.String()), slog.Duration("duration", time.Since(start)), slog.String("client_ip", host))
+	return resp, err
+}
+
+// Interceptor counting calls by method and code and their duration
+func grpcRecordMetrics(ctx context.Context, call *grpcCall, next grpcHandler) ([]byte, error) {
+	start := time.Now()
+	resp, err := next(ctx, call)
+	code, _, _ := grpcStatus(ctx, err)
+	grpcRequestsTotal.inc(call.Route, code.String())
+	grpcRequestDuration.observe(time.Since(start).Seconds(), call.Route)
+	return resp, err
+}
+
+// Interceptor turning a panic in a method into Internal, like recoverPanics
+func grpcRecoverPanics(ctx context.Context, call *grpcCall, next grpcHandler) (resp []byte, err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			loggerFrom(ctx).Error("Panic serving call", "panic", rec, "stack", string(debug.Stack()))
+			httpPanicsTotal.inc()
+			resp, err = nil, apiError{Code: codeInternal, Message: "Internal server error"}
+		}
+	}()
+	return next(ctx, call)
+}
+
+// Interceptor answering Unavailable while maintenance mode is on, except for
+// reads in read-only maintenance
+func grpcMaintenanceGate(ctx context.Context, call *grpcCall, next grpcHandler) ([]byte, error) {
+	state := maintenance.Load()
+	if state.Enabled && !(state.ReadOnly && call.Handler != nil && call.Handler.ReadOnly) {
+		return nil, apiError{Code: codeMaintenance, Message: state.Message}
+	}
+	return next(ctx, call)
+}
+
+// Interceptor authenticating the call's metadata like requireAuth and
+// checking the method's scope like requireScope. Handlers get the caller
+// through principalFrom.
+func grpcAuthenticate(ctx context.Context, call *grpcCall, next grpcHandler) ([]byte, error) {
+	p, err := authenticateHeaders(ctx, call.Header)
+	var authErr authError
+	if errors.As(err, &authErr) {
+		return nil, apiError{Code: codeUnauthorized, Message: authErr.message}
+	}
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to authenticate call", "error", err)
+		return nil, apiError{Code: codeInternal, Message: "Failed to check credentials"}
+	}
+	if call.Handler != nil && !slices.Contains(p.Scopes, call.Handler.Scope) {
+		return nil, apiError{Code: codeForbidden, Message: "Missing scope " + call.Handler.Scope}
+	}
+	return next(withPrincipal(ctx, p), call)
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The Users service of users.proto. Messages are encoded by hand with
+// protowire rather than generated, with the field numbers of the .proto;
+// the well-known types use their Go packages.
+
+const usersService = "sampleapi.users.v1.Users"
+
+var usersMethods = map[string]*grpcMethod{
+	"ListUsers":  {Scope: scopeUsersRead, ReadOnly: true, Handle: grpcListUsers},
+	"GetUser":    {Scope: scopeUsersRead, ReadOnly: true, Handle: grpcGetUser},
+	"CreateUser": {Scope: scopeUsersWrite, Handle: grpcCreateUser},
+	"UpdateUser": {Scope: scopeUsersWrite, Handle: grpcUpdateUser},
+	"DeleteUser": {Scope: scopeUsersAdmin, Handle: grpcDeleteUser},
+}
+
+// Paths UpdateUserRequest.update_mask accepts
+var userMaskFields = []string{"email", "name", "phone", "role", "metadata"}
+
+var errGRPCUserNotFound = apiError{Code: codeUserNotFound, Message: "User not found"}
+
+func grpcListUsers(ctx context.Context, req []byte) ([]byte, error) {
+	var pageSize int64
+	var pageToken string
+	var filter userFilter
+	err := eachField(req, func(num protowire.Number, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			pageSize = int64(int32(v))
+		case 2:
+			pageToken = string(data)
+		case 3:
+			filter.Name = strings.TrimSpace(string(data))
+		case 4:
+			filter.Domain = string(data)
+		case 5:
+			filter.Status = string(data)
+		case 6:
+			filter.Role = string(data)
+		case 7:
+			filter.IncludeDeleted = v != 0
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	limit := defaultPageLimit
+	switch {
+	case pageSize < 0:
+		return nil, invalidArgument(fieldError{Field: "page_size", Rule: "min", Message: "page_size must not be negative"})
+	case pageSize > maxPageLimit:
+		limit = maxPageLimit
+	case pageSize > 0:
+		limit = int(pageSize)
+	}
+	if err := filter.validate(); err != nil {
+		return nil, invalidArgument(err)
+	}
+
+	// Fetch one extra row to find out whether another page exists
+	query := userListQuery{Filter: filter, Fields: userFields, Limit: limit + 1}
+	if pageToken != "" {
+		cursor, err := decodeCursor(pageToken)
+		if err != nil {
+			return nil, invalidArgument(fieldError{Field: "page_token", Rule: "cursor", Message: "Invalid page_token"})
+		}
+		query.After = &cursor
+	}
+
+	total, err := repositoriesFrom(ctx).reader.Count(ctx, filter)
+	if err != nil {
+		return nil, internalError(ctx, "Failed to count users", err)
+	}
+	users, err := repositoriesFrom(ctx).reader.List(ctx, query)
+	if err != nil {
+		return nil, internalError(ctx, "Failed to fetch users", err)
+	}
+
+	var b []byte
+	if len(users) > limit {
+		users = users[:limit]
+		b = appendString(b, 2, encodeCursor(users[limit-1]))
+	}
+	for _, user := range users {
+		msg, err := appendUser(nil, user)
+		if err != nil {
+			return nil, internalError(ctx, "Failed to fetch users", err)
+		}
+		b = appendMessage(b, 1, msg)
+	}
+	return appendInt64(b, 3, total), nil
+}
+
+func grpcGetUser(ctx context.Context, req []byte) ([]byte, error) {
+	id, err := decodeUserID(req)
+	if err != nil {
+		return nil, err
+	}
+	user, err := repositoriesFrom(ctx).reader.GetByID(ctx, id, userFields, false)
+	if err == errUserNotFound {
+		return nil, errGRPCUserNotFound
+	}
+	if err != nil {
+		return nil, internalError(ctx, "Failed to fetch user", err)
+	}
+	return appendUser(nil, user)
+}
+
+func grpcCreateUser(ctx context.Context, req []byte) ([]byte, error) {
+	var input createUserInput
+	err := eachField(req, func(num protowire.Number, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			input.Email = string(data)
+		case 2:
+			input.Name = string(data)
+		case 3:
+			phone := string(data)
+			input.Phone = &phone
+		case 4:
+			input.Role = string(data)
+		case 5:
+			metadata, err := decodeMetadata(data)
+			if err != nil {
+				return err
+			}
+			input.Metadata = metadata
+		case 6:
+			password := string(data)
+			input.Password = &password
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// binding:"required" on the HTTP body
+	if input.Email == "" {
+		return nil, invalidArgument(fieldError{Field: "email", Rule: "required", Message: "email is required"})
+	}
+	if input.Name == "" {
+		return nil, invalidArgument(fieldError{Field: "name", Rule: "required", Message: "name is required"})
+	}
+	if input.Role != "" && !canAssignRole(principalFrom(ctx), input.Role) {
+		return nil, roleAssignmentRefused(input.Role)
+	}
+	if err := input.validate(); err != nil {
+		return nil, invalidArgument(err)
+	}
+
+	user, err := createUserAudited(ctx, repositoriesFrom(ctx).users, input)
+	if err == errEmailTaken {
+		return nil, apiError{Code: codeEmailConflict, Message: "Email already exists"}
+	}
+	if err != nil {
+		return nil, internalError(ctx, "Failed to create user", err)
+	}
+	return appendUser(nil, user)
+}
+
+func grpcUpdateUser(ctx context.Context, req []byte) ([]byte, error) {
+	var id string
+	var user User
+	var paths []string
+	var version int64
+	err := eachField(req, func(num protowire.Number, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			var err error
+			id, user, err = decodeUser(data)
+			return err
+		case 2:
+			var mask fieldmaskpb.FieldMask
+			if err := proto.Unmarshal(data, &mask); err != nil {
+				return apiError{Code: codeInvalidRequest, Message: "Invalid update_mask"}
+			}
+			paths = append(paths, mask.Paths...)
+		case 3:
+			version = int64(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !uuidRegex.MatchString(id) {
+		return nil, invalidArgument(fieldError{Field: "user.id", Rule: "uuid", Message: "Invalid user id"})
+	}
+
+	var patch userPatch
+	for _, path := range paths {
+		switch path {
+		case "email":
+			patch.Email = optionalString{Set: true, Value: user.Email}
+		case "name":
+			patch.Name = optionalString{Set: true, Value: user.Name}
+		case "phone":
+			patch.Phone = optionalString{Set: true, Null: user.Phone == nil}
+			if user.Phone != nil {
+				patch.Phone.Value = *user.Phone
+			}
+		case "role":
+			patch.Role = optionalString{Set: true, Value: user.Role}
+		case "metadata":
+			metadata := user.Metadata
+			if metadata == nil {
+				metadata = Metadata{}
+			}
+			patch.Metadata = &metadata
+		case "status":
+			patch.Status = optionalString{Set: true, Value: user.Status}
+		default:
+			return nil, invalidArgument(fieldError{Field: "update_mask", Rule: "oneof", Message: fmt.Sprintf("update_mask path %q is not one of: %s", path, strings.Join(userMaskFields, ", "))})
+		}
+	}
+	if err := patch.validate(); err != nil {
+		return nil, invalidArgument(err)
+	}
+	if patch.Role.Set && !canAssignRole(principalFrom(ctx), patch.Role.Value) {
+		return nil, roleAssignmentRefused(patch.Role.Value)
+	}
+
+	if version == 0 && requireIfMatch {
+		return nil, apiError{Code: codePreconditionRequired, Message: "version is required"}
+	}
+	if patch.empty() {
+		return nil, invalidArgument(fieldError{Field: "update_mask", Rule: "required", Message: "No fields to update"})
+	}
+
+	// Like If-Match: 0 updates unconditionally
+	var versions []int64
+	if version != 0 {
+		versions = []int64{version}
+	}
+
+	updated, err := updateUserAudited(ctx, repositoriesFrom(ctx).users, id, patch, versions)
+	if err == errVersionMismatch {
+		return nil, apiError{Code: codePreconditionFailed, Message: "User has been modified; fetch it again and retry"}
+	}
+	if err == errUserNotFound {
+		return nil, errGRPCUserNotFound
+	}
+	if err == errMetadataTooLarge {
+		return nil, invalidArgument(errMetadataTooLarge)
+	}
+	if err == errEmailTaken {
+		return nil, apiError{Code: codeEmailConflict, Message: "Email already exists"}
+	}
+	if err != nil {
+		return nil, internalError(ctx, "Failed to update user", err)
+	}
+	return appendUser(nil, updated)
+}
+
+func grpcDeleteUser(ctx context.Context, req []byte) ([]byte, error) {
+	id, err := decodeUserID(req)
+	if err != nil {
+		return nil, err
+	}
+	err = deleteUserAudited(ctx, repositoriesFrom(ctx).users, id)
+	if err == errUserNotFound {
+		return nil, errGRPCUserNotFound
+	}
+	if err != nil {
+		return nil, internalError(ctx, "Failed to delete user", err)
+	}
+	// google.protobuf.Empty
+	return []byte{}, nil
+}
+
+// The id of GetUserRequest and DeleteUserRequest
+func decodeUserID(req []byte) (string, error) {
+	var id string
+	err := eachField(req, func(num protowire.Number, v uint64, data []byte) error {
+		if num == 1 {
+			id = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if !uuidRegex.MatchString(id) {
+		return "", invalidArgument(fieldError{Field: "id", Rule: "uuid", Message: "Invalid user id"})
+	}
+	return id, nil
+}
+
+// The fields of a User message an update can set
+func decodeUser(b []byte) (string, User, error) {
+	var id string
+	var user User
+	err := eachField(b, func(num protowire.Number, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			id = string(data)
+		case 2:
+			user.Email = string(data)
+		case 4:
+			user.Name = string(data)
+		case 9:
+			phone := string(data)
+			user.Phone = &phone
+		case 10:
+			user.Status = string(data)
+		case 11:
+			user.Role = string(data)
+		case 12:
+			metadata, err := decodeMetadata(data)
+			if err != nil {
+				return err
+			}
+			user.Metadata = metadata
+		}
+		return nil
+	})
+	return id, user, err
+}
+
+// A google.protobuf.Struct as metadata; null values stay nil
+func decodeMetadata(data []byte) (Metadata, error) {
+	var s structpb.Struct
+	if err := proto.Unmarshal(data, &s); err != nil {
+		return nil, apiError{Code: codeInvalidRequest, Message: "Invalid metadata"}
+	}
+	return Metadata(s.AsMap()), nil
+}
+
+// Append u as a User message
+func appendUser(b []byte, u User) ([]byte, error) {
+	b = appendString(b, 1, u.ID)
+	b = appendString(b, 2, u.Email)
+	b = appendBool(b, 3, u.EmailVerified)
+	b = appendString(b, 4, u.Name)
+	b = appendTimestamp(b, 5, u.CreatedAt)
+	b = appendTimestamp(b, 6, u.UpdatedAt)
+	if u.DeletedAt != nil {
+		b = appendTimestamp(b, 7, *u.DeletedAt)
+	}
+	// Optional fields are sent even when empty, since being set is what
+	// they say
+	if u.AvatarURL != nil {
+		b = protowire.AppendTag(b, 8, protowire.BytesType)
+		b = protowire.AppendString(b, *u.AvatarURL)
+	}
+	if u.Phone != nil {
+		b = protowire.AppendTag(b, 9, protowire.BytesType)
+		b = protowire.AppendString(b, *u.Phone)
+	}
+	b = appendString(b, 10, u.Status)
+	b = appendString(b, 11, u.Role)
+	if u.Metadata != nil {
+		s, err := structpb.NewStruct(u.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := proto.Marshal(s)
+		if err != nil {
+			return nil, err
+		}
+		b = appendMessage(b, 12, msg)
+	}
+	return appendInt64(b, 13, u.Version), nil
+}
+
+// Call field with each field of a message, in order: v holds varints and
+// data length-delimited values. Other wire types are skipped.
+func eachField(b []byte, field func(num protowire.Number, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return apiError{Code: codeInvalidRequest, Message: "Malformed request message"}
+		}
+		b = b[n:]
+		var v uint64
+		var data []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			data, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return apiError{Code: codeInvalidRequest, Message: "Malformed request message"}
+		}
+		b = b[n:]
+		if err := field(num, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Appenders for proto3 fields, which leave out zero values
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, 1)
+}
+
+func appendInt64(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+// Embedded messages are sent even when empty
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+func appendTimestamp(b []byte, num protowire.Number, t time.Time) []byte {
+	msg, _ := proto.Marshal(timestamppb.New(t))
+	return appendMessage(b, num, msg)
+}
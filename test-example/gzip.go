@@ -0,0 +1,256 @@
+package main
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Response compression (GZIP_ENABLED, GZIP_MIN_BYTES): bodies of at least
+// gzipMinBytes are gzipped for clients that accept it. Smaller bodies aren't
+// worth it; bodies that are flushed before reaching the threshold (the
+// export, the event stream) are compressed from the first flush on.
+var (
+	gzipEnabled  = true
+	gzipMinBytes = 1024
+)
+
+// Suffix of the strong ETags of gzipped bodies. A gzipped body is a
+// different representation, so it can't share the identity body's strong
+// ETag; the suffix is stripped before comparing (see etagMatches).
+const gzipETagSuffix = "-gzip"
+
+var gzipWriters = sync.Pool{New: func() interface{} {
+	return gzip.NewWriter(nil)
+}}
+
+// Middleware gzipping responses for clients that send Accept-Encoding: gzip
+func compressResponses() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !gzipEnabled {
+			c.Next()
+			return
+		}
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(c.Request.Header.Values("Accept-Encoding")) {
+			c.Next()
+			return
+		}
+
+		w := &gzipWriter{ResponseWriter: c.Writer, request: c.Request}
+		c.Writer = w
+		// Deferred so a panicking handler's buffered body is still written
+		// and recoverPanics writes its error to the original writer
+		defer func() {
+			w.finish()
+			c.Writer = w.ResponseWriter
+		}()
+		c.Next()
+	}
+}
+
+// Whether an Accept-Encoding header allows gzip: named with a non-zero q, or
+// covered by * when not named
+func acceptsGzip(values []string) bool {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			q := 1.0
+			if name, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					q = f
+				}
+			}
+			switch strings.ToLower(strings.TrimSpace(coding)) {
+			case "gzip", "x-gzip":
+				gzipQ = q
+			case "*":
+				anyQ = q
+			}
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return anyQ > 0
+}
+
+// Whether a body of this Content-Type is worth compressing; images, audio,
+// video and archives are already compressed
+func compressible(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	group, _, _ := strings.Cut(mediaType, "/")
+	switch {
+	case mediaType == "image/svg+xml":
+		return true
+	case group == "image", group == "audio", group == "video", group == "font":
+		return false
+	}
+	switch mediaType {
+	case "application/gzip", "application/x-gzip", "application/zip", "application/zstd", "application/octet-stream":
+		return false
+	}
+	return true
+}
+
+// The strong ETag of the gzipped form of a representation; weak ETags
+// are the same for both
+func gzipETag(etag string) string {
+	if len(etag) < 2 || etag[0] != '"' || strings.HasSuffix(etag, gzipETagSuffix+`"`) {
+		return etag
+	}
+	return etag[:len(etag)-1] + gzipETagSuffix + `"`
+}
+
+// etag without the gzip suffix
+func identityETag(etag string) string {
+	return strings.Replace(etag, gzipETagSuffix+`"`, `"`, 1)
+}
+
+// Holds the body back until gzipMinBytes have been written, the handler
+// flushes or it returns, then either gzips it or passes it through
+type gzipWriter struct {
+	gin.ResponseWriter
+	request *http.Request
+	buf     []byte
+	decided bool
+	// Set when compressing
+	gz *gzip.Writer
+}
+
+// Choose between gzip and identity; final is set when the whole body is
+// buffered, so a small one stays uncompressed
+func (w *gzipWriter) decide(final bool) {
+	w.decided = true
+	h := w.Header()
+	status := w.Status()
+	if h.Get("Content-Type") == "" && len(w.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+
+	if etag := h.Get("ETag"); status == http.StatusNotModified && etag != "" {
+		// Answer with the ETag the client has
+		if strings.Contains(w.request.Header.Get("If-None-Match"), gzipETag(etag)) {
+			h.Set("ETag", gzipETag(etag))
+		}
+		return
+	}
+	if final && (len(w.buf) < gzipMinBytes || len(w.buf) == 0) ||
+		status == http.StatusNoContent || status == http.StatusPartialContent ||
+		h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" ||
+		!compressible(h.Get("Content-Type")) {
+		if etag := h.Get("ETag"); etag != "" {
+			h.Set("ETag", identityETag(etag))
+		}
+		return
+	}
+
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	if etag := h.Get("ETag"); etag != "" {
+		h.Set("ETag", gzipETag(etag))
+	}
+	w.gz = gzipWriters.Get().(*gzip.Writer)
+	w.gz.Reset(w.ResponseWriter)
+}
+
+// Write what was buffered, through gzip when compressing
+func (w *gzipWriter) drain() error {
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if w.gz != nil {
+		_, err := w.gz.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+func (w *gzipWriter) Write(data []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, data...)
+		if len(w.buf) < gzipMinBytes {
+			return len(data), nil
+		}
+		w.decide(false)
+		if err := w.drain(); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+	if w.gz != nil {
+		return w.gz.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *gzipWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Send what has been written so far, compressed when the response will be
+func (w *gzipWriter) Flush() {
+	if !w.decided {
+		w.decide(false)
+		_ = w.drain()
+	}
+	if w.gz != nil {
+		_ = w.gz.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// Headers go out now, so the decision is made with what was written
+func (w *gzipWriter) WriteHeaderNow() {
+	if !w.decided {
+		w.decide(true)
+		_ = w.drain()
+	}
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+// A buffered body counts as written, so handlers don't append an error to it
+func (w *gzipWriter) Written() bool {
+	return len(w.buf) > 0 || w.ResponseWriter.Written()
+}
+
+// For http.ResponseController
+func (w *gzipWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Write the rest of the body and end the gzip stream
+func (w *gzipWriter) finish() {
+	if !w.decided {
+		if len(w.buf) == 0 && !w.ResponseWriter.Written() {
+			// Nothing written: a later handler (recoverPanics) may still
+			// respond, and a 304's ETag still needs adjusting
+			if w.Status() == http.StatusNotModified {
+				w.decide(true)
+			}
+			return
+		}
+		w.decide(true)
+	}
+	if err := w.drain(); err != nil && w.request.Context().Err() == nil {
+		loggerFrom(w.request.Context()).Error("Failed to write response", "error", err)
+	}
+	if w.gz == nil {
+		return
+	}
+	if err := w.gz.Close(); err != nil && w.request.Context().Err() == nil {
+		loggerFrom(w.request.Context()).Error("Failed to finish gzipped response", "error", err)
+	}
+	w.gz.Reset(nil)
+	gzipWriters.Put(w.gz)
+	w.gz = nil
+}
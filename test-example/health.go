@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How long each dependency check in /health may take (HEALTH_CHECK_TIMEOUT)
+var healthCheckTimeout = 500 * time.Millisecond
+
+// How long shutdown keeps serving after /readyz starts failing, so load
+// balancers stop routing new requests first (SHUTDOWN_DRAIN_DELAY)
+var shutdownDrainDelay = 5 * time.Second
+
+// How long shutdown waits for in-flight requests after the drain delay
+// before canceling them (SHUTDOWN_TIMEOUT)
+var shutdownTimeout = 20 * time.Second
+
+// Readiness state for /readyz. schemaReady is set once no migration is
+// pending and stays set; shuttingDown is set when shutdown begins.
+var (
+	schemaReady  atomic.Bool
+	shuttingDown atomic.Bool
+)
+
+// Outcome of checking one dependency
+type dependencyStatus struct {
+	// "up" or "down"
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Run SELECT 1 on pool within healthCheckTimeout. The query runs in its own
+// goroutine so a connection stuck in the driver can't hold the response past
+// the timeout.
+func checkDatabase(ctx context.Context, pool *sql.DB) dependencyStatus {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	result := make(chan error, 1)
+	go func() {
+		var one int
+		result <- pool.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+	}()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		err = fmt.Errorf("no response within %s", healthCheckTimeout)
+	}
+
+	status := dependencyStatus{Status: "up", LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		status.Status = "down"
+		status.Error = err.Error()
+	}
+	return status
+}
+
+// Liveness probe: the process is up and serving requests. It never checks
+// dependencies, so a database outage doesn't get the pod restarted.
+func livez(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readiness probe: 503 until every migration has been applied and while the
+// database is unreachable, and from the start of shutdown on
+func readyz(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	if shuttingDown.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "message": "Shutting down"})
+		return
+	}
+
+	database := checkDatabase(ctx, db)
+	if database.Status != "up" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "unavailable",
+			"message": "Database is unavailable",
+			"checks":  gin.H{"database": database},
+		})
+		return
+	}
+
+	// Migrations may be applied out-of-band, so this is checked until it passes
+	if !schemaReady.Load() {
+		checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		defer cancel()
+
+		pending, err := pendingMigrations(checkCtx, db)
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "message": "Cannot read schema version: " + err.Error()})
+			return
+		}
+		if len(pending) > 0 {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "message": "Migrations are pending", "pending": pending})
+			return
+		}
+		schemaReady.Store(true)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ready", "checks": gin.H{"database": database}})
+}
+
+// Stop srv once a shutdown signal arrived: fail readiness and keep serving
+// while load balancers notice, then stop accepting connections and wait up to
+// shutdownTimeout for in-flight requests. Requests still running after that
+// see their context canceled (cancelRequests cancels srv's BaseContext)
+// before their connections are closed.
+func shutdownServer(srv *http.Server, cancelRequests context.CancelFunc, logger *slog.Logger) {
+	shuttingDown.Store(true)
+	logger.Info("Shutting down: readiness failing", "drain", shutdownDrainDelay)
+	time.Sleep(shutdownDrainDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Warn("Requests still running, canceling them", "after", shutdownTimeout, "error", err)
+		cancelRequests()
+		srv.Close()
+	}
+}
+
+// Stop the servers besides the main one (admin, HTTP redirect), each within
+// shutdownTimeout; nil servers are skipped
+func shutdownSecondary(servers ...*http.Server) {
+	for _, srv := range servers {
+		if srv == nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		if err := srv.Shutdown(ctx); err != nil {
+			srv.Close()
+		}
+		cancel()
+	}
+}
+
+// Close the database pools. Waits for queries that are still running, which
+// stop early once their request context is canceled.
+func closeDatabases(logger *slog.Logger) {
+	if replica != nil {
+		if err := replica.db.Close(); err != nil {
+			logger.Error("Failed to close read replica", "error", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		logger.Error("Failed to close database", "error", err)
+	}
+	// Closing db leaves the pgx pool behind it open
+	if pgxPool != nil {
+		pgxPool.Close()
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	slog.SetDefault(newLogger(io.Discard, logFormatText))
+	os.Exit(m.Run())
+}
+
+// A router on repos, configured with what the package variables hold
+func newTestRouter(repos *repositories) *gin.Engine {
+	return newRouter(defaultConfig(), repos)
+}
+
+// A new API key with the given role, returning its plaintext
+func testAPIKey(t testing.TB, repos *repositories, role string) string {
+	t.Helper()
+	_, plaintext, err := newAPIKey(context.Background(), repos.apiKeys, apiKey{Name: "test", Role: role})
+	if err != nil {
+		t.Fatalf("create API key: %v", err)
+	}
+	return plaintext
+}
+
+// Make a request to h; body is sent as JSON unless it is nil, a string or
+// []byte, and headers are name, value pairs
+func request(h http.Handler, method, path string, body interface{}, headers ...string) *httptest.ResponseRecorder {
+	var r io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		r = bytes.NewBufferString(b)
+	case []byte:
+		r = bytes.NewReader(b)
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			panic(err)
+		}
+		r = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, r)
+	if r != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// A gin context for a request to target, for the functions that parse one
+func testContext(method, target string) (*gin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(method, target, nil)
+	return c, w
+}
+
+// Decode a JSON response body into v, failing the test when it isn't JSON
+func decode(t testing.TB, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("response is not JSON: %v\n%s", err, w.Body.String())
+	}
+}
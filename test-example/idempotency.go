@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How long a stored response is replayed for (IDEMPOTENCY_TTL)
+var idempotencyTTL = 24 * time.Hour
+
+// Response headers stored with a response and replayed with it
+var replayedHeaders = []string{"Content-Type", "Location", "ETag"}
+
+// Captures the response body while passing it through to the client
+type bodyRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *bodyRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *bodyRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Where the Idempotency-Key middleware keeps the keys it has seen and the
+// responses it stored for them
+type idempotencyStore interface {
+	// Claims key for a request with the given fingerprint until ttl has
+	// passed, dropping an earlier claim whose time is up; false when the key
+	// is still claimed
+	Claim(ctx context.Context, key, requestHash string, ttl time.Duration) (bool, error)
+	// Drops the claim on key, so the request can be retried
+	Release(ctx context.Context, key string) error
+	// Stores the response to replay for key
+	Complete(ctx context.Context, key string, response storedResponse) error
+	// The claim on key; errIdempotencyKeyNotFound when there is none
+	Lookup(ctx context.Context, key string) (idempotencyRecord, error)
+}
+
+var errIdempotencyKeyNotFound = errors.New("idempotency key not found")
+
+// A response replayed for a key
+type storedResponse struct {
+	Status  int
+	Headers map[string]string
+	Body    []byte
+}
+
+// A claimed key, with its response once the request is done
+type idempotencyRecord struct {
+	RequestHash string
+	// nil while the request is running
+	Response *storedResponse
+}
+
+// Keeps keys in the idempotency_keys table, whose primary key makes
+// concurrent requests with the same key lose the race
+type postgresIdempotencyStore struct {
+	db *sql.DB
+}
+
+func (s *postgresIdempotencyStore) Claim(ctx context.Context, key, requestHash string, ttl time.Duration) (bool, error) {
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE key = $1 AND expires_at < NOW()", key); err != nil {
+		return false, err
+	}
+	result, err := s.db.ExecContext(ctx,
+		"INSERT INTO idempotency_keys (key, request_hash, expires_at) VALUES ($1, $2, NOW() + $3 * INTERVAL '1 second') ON CONFLICT (key) DO NOTHING",
+		key, requestHash, int64(ttl/time.Second),
+	)
+	if err != nil {
+		return false, err
+	}
+	claimed, _ := result.RowsAffected()
+	return claimed > 0, nil
+}
+
+func (s *postgresIdempotencyStore) Release(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE key = $1", key)
+	return err
+}
+
+func (s *postgresIdempotencyStore) Complete(ctx context.Context, key string, response storedResponse) error {
+	headersJSON, _ := json.Marshal(response.Headers)
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE idempotency_keys SET status_code = $1, response_headers = $2, response_body = $3 WHERE key = $4",
+		response.Status, string(headersJSON), response.Body, key,
+	)
+	return err
+}
+
+func (s *postgresIdempotencyStore) Lookup(ctx context.Context, key string) (idempotencyRecord, error) {
+	var record idempotencyRecord
+	var status sql.NullInt64
+	var headersJSON sql.NullString
+	var body []byte
+	err := s.db.QueryRowContext(ctx,
+		"SELECT request_hash, status_code, response_headers, response_body FROM idempotency_keys WHERE key = $1",
+		key,
+	).Scan(&record.RequestHash, &status, &headersJSON, &body)
+	if err == sql.ErrNoRows {
+		return idempotencyRecord{}, errIdempotencyKeyNotFound
+	}
+	if err != nil {
+		return idempotencyRecord{}, err
+	}
+	if status.Valid {
+		headers := map[string]string{}
+		if headersJSON.Valid {
+			_ = json.Unmarshal([]byte(headersJSON.String), &headers)
+		}
+		record.Response = &storedResponse{Status: int(status.Int64), Headers: headers, Body: body}
+	}
+	return record, nil
+}
+
+// Middleware implementing the Idempotency-Key header
+//
+// The first request with a key claims it and stores its response. Later
+// requests with the key replay that response, get 409 while the first is
+// still running, or 422 if the key is reused for a different request. 5xx
+// responses and abandoned requests are not stored so the client can retry.
+func idempotent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		store := repositoriesFrom(ctx).idempotency
+		if store == nil {
+			respondError(c, codeNotImplemented, "Idempotency-Key requires Postgres (DB_DRIVER=postgres or pgx)")
+			return
+		}
+
+		if len(key) > 255 {
+			respondError(c, codeInvalidRequest, "Idempotency-Key cannot be longer than 255 characters")
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if isBodyTooLarge(err) {
+			bodyTooLarge(c, err)
+			return
+		}
+		if err != nil {
+			respondError(c, codeInvalidRequest, "Failed to read request body")
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		sum := sha256.Sum256(append([]byte(c.Request.Method+" "+canonicalRoute(c.FullPath())+"\n"), body...))
+		requestHash := hex.EncodeToString(sum[:])
+
+		claimed, err := store.Claim(ctx, key, requestHash, idempotencyTTL)
+		if err != nil {
+			respondInternal(c, "Failed to store idempotency key")
+			return
+		}
+		if !claimed {
+			replayIdempotentResponse(c, store, key, requestHash)
+			return
+		}
+
+		recorder := &bodyRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+
+		// The request context may have timed out or been canceled by now, but
+		// the key must still be released or stored
+		ctx = context.WithoutCancel(ctx)
+
+		// Failed, timed out and abandoned requests can be retried with the key
+		status := recorder.Status()
+		if status >= http.StatusInternalServerError || c.Request.Context().Err() != nil {
+			if err := store.Release(ctx, key); err != nil {
+				loggerFrom(ctx).Error("Failed to release idempotency key", "key", key, "error", err)
+			}
+			return
+		}
+
+		headers := map[string]string{}
+		for _, name := range replayedHeaders {
+			if v := recorder.Header().Get(name); v != "" {
+				headers[name] = v
+			}
+		}
+		err = store.Complete(ctx, key, storedResponse{Status: status, Headers: headers, Body: recorder.body.Bytes()})
+		if err != nil {
+			loggerFrom(ctx).Error("Failed to store response for idempotency key", "key", key, "error", err)
+		}
+	}
+}
+
+// Respond to a request whose key was already claimed
+func replayIdempotentResponse(c *gin.Context, store idempotencyStore, key, requestHash string) {
+	record, err := store.Lookup(c.Request.Context(), key)
+	if err == errIdempotencyKeyNotFound {
+		// Released by a failed request in the meantime
+		respondError(c, codeIdempotencyConflict, "A request with this Idempotency-Key failed; retry")
+		return
+	}
+	if err != nil {
+		respondInternal(c, "Failed to check idempotency key")
+		return
+	}
+
+	if record.RequestHash != requestHash {
+		respondError(c, codeIdempotencyKeyReused, "Idempotency-Key was already used for a different request")
+		return
+	}
+
+	if record.Response == nil {
+		respondError(c, codeIdempotencyConflict, "A request with this Idempotency-Key is still in progress")
+		return
+	}
+
+	for name, v := range record.Response.Headers {
+		c.Header(name, v)
+	}
+	c.Header("Idempotent-Replayed", "true")
+
+	c.Abort()
+	c.Status(record.Response.Status)
+	c.Writer.Write(record.Response.Body)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// POST /api/users/import creates users from a CSV upload: a header row naming
+// the columns, then a user per row. Rows are read as they arrive and
+// inserted importBatchSize at a time, so memory holds one batch, the emails
+// seen so far (for duplicates) and the failures rather than the file.
+
+// Body limit of an import
+const importBodyBytes = 64 << 20
+
+// Rows validated and inserted together
+const importBatchSize = 500
+
+// Columns an import may have; email and name are required
+var importColumns = []string{"email", "name", "phone", "role", "metadata"}
+
+// A row that wasn't imported: its line in the file and why
+type importFailure struct {
+	Line    int    `json:"line"`
+	Email   string `json:"email,omitempty"`
+	Field   string `json:"field,omitempty"`
+	Rule    string `json:"rule,omitempty"`
+	Message string `json:"message"`
+}
+
+// Response of an import. Created counts the users that would be created in
+// a dry run.
+type importResult struct {
+	DryRun   bool            `json:"dry_run"`
+	Rows     int             `json:"rows"`
+	Created  int             `json:"created"`
+	Failed   int             `json:"failed"`
+	Failures []importFailure `json:"failures"`
+}
+
+// An import in progress: the rows waiting to be inserted and the result so
+// far
+type userImport struct {
+	ctx    context.Context
+	users  postgresUserOps
+	dryRun bool
+	// Line of the first row with each email
+	seen    map[string]int
+	pending []User
+	lines   []int
+	result  importResult
+}
+
+func (imp *userImport) fail(line int, email string, err error) {
+	var fe fieldError
+	if !errors.As(err, &fe) {
+		fe = fieldError{Message: err.Error()}
+	}
+	imp.result.Failures = append(imp.result.Failures, importFailure{Line: line, Email: email, Field: fe.Field, Rule: fe.Rule, Message: fe.Message})
+	imp.result.Failed++
+}
+
+// Validate a row like createUser and queue it, inserting the queue when it
+// is full
+func (imp *userImport) add(line int, record []string, columns map[string]int) error {
+	imp.result.Rows++
+	input, err := importRow(record, columns)
+	if err == nil {
+		err = input.validate()
+	}
+	if err != nil {
+		imp.fail(line, normalizeEmail(input.Email), err)
+		return nil
+	}
+	if first, dup := imp.seen[input.Email]; dup {
+		imp.fail(line, input.Email, fieldError{Field: "email", Rule: "unique", Message: fmt.Sprintf("Duplicate of line %d", first)})
+		return nil
+	}
+	imp.seen[input.Email] = line
+
+	imp.pending = append(imp.pending, User{Email: input.Email, Name: input.Name, Phone: input.Phone, Role: input.Role, Metadata: input.Metadata})
+	imp.lines = append(imp.lines, line)
+	if len(imp.pending) < importBatchSize {
+		return nil
+	}
+	return imp.flush()
+}
+
+// Insert the queued users (in a dry run, check their emails are free); a
+// taken email fails its row
+func (imp *userImport) flush() error {
+	if len(imp.pending) == 0 {
+		return nil
+	}
+
+	var created func(email string) bool
+	if imp.dryRun {
+		emails := make([]string, len(imp.pending))
+		for i, u := range imp.pending {
+			emails[i] = u.Email
+		}
+		taken, err := imp.users.TakenEmails(imp.ctx, emails)
+		if err != nil {
+			return err
+		}
+		created = func(email string) bool { return !taken[email] }
+	} else {
+		inserted, err := imp.users.CreateMany(imp.ctx, imp.pending, false)
+		if err != nil {
+			return err
+		}
+		created = func(email string) bool { return inserted[email] != "" }
+	}
+
+	for i, u := range imp.pending {
+		if created(u.Email) {
+			imp.result.Created++
+		} else {
+			imp.fail(imp.lines[i], u.Email, errEmailExists)
+		}
+	}
+	imp.pending, imp.lines = imp.pending[:0], imp.lines[:0]
+	return nil
+}
+
+// Map the header row's column names to their positions
+func importHeader(header []string) (map[string]int, error) {
+	columns := map[string]int{}
+	for i, name := range header {
+		if i == 0 {
+			// Spreadsheets often save UTF-8 with a byte order mark
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !slices.Contains(importColumns, name) {
+			return nil, fmt.Errorf("unknown column %q; columns are %s", name, strings.Join(importColumns, ", "))
+		}
+		if _, dup := columns[name]; dup {
+			return nil, fmt.Errorf("column %q appears twice", name)
+		}
+		columns[name] = i
+	}
+	for _, name := range importColumns[:2] {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("the header must have a %s column", name)
+		}
+	}
+	return columns, nil
+}
+
+// A row as the input of createUser; empty phone, role and metadata cells are
+// absent
+func importRow(record []string, columns map[string]int) (createUserInput, error) {
+	cell := func(name string) string {
+		if i, ok := columns[name]; ok {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	input := createUserInput{Email: cell("email"), Name: cell("name"), Role: cell("role")}
+	if input.Email == "" {
+		return input, fieldError{Field: "email", Rule: "required", Message: "Email is required"}
+	}
+	if phone := cell("phone"); phone != "" {
+		input.Phone = &phone
+	}
+	if metadata := cell("metadata"); metadata != "" {
+		if err := json.Unmarshal([]byte(metadata), &input.Metadata); err != nil || input.Metadata == nil {
+			return input, fieldError{Field: "metadata", Rule: "json", Message: "metadata must be a JSON object"}
+		}
+	}
+	return input, nil
+}
+
+// Import users from CSV
+//
+// Invalid rows, duplicates within the file and taken emails are reported
+// with their line and don't stop the import; the other rows are created.
+// With ?dry_run=true every row is checked the same way but nothing is
+// written.
+func importUsers(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	dryRun, err := parseBoolParam(c, "dry_run", false)
+	if err != nil {
+		respondError(c, codeInvalidRequest, err.Error())
+		return
+	}
+
+	r := csv.NewReader(c.Request.Body)
+	r.ReuseRecord = true
+	header, err := r.Read()
+	switch {
+	case err == io.EOF:
+		respondError(c, codeInvalidRequest, "CSV is empty; the first row must name the columns")
+		return
+	case isBodyTooLarge(err):
+		respondError(c, codePayloadTooLarge, fmt.Sprintf("Import cannot be larger than %d bytes", importBodyBytes))
+		return
+	case err != nil:
+		respondError(c, codeInvalidRequest, "Invalid CSV: "+err.Error())
+		return
+	}
+	columns, err := importHeader(header)
+	if err != nil {
+		respondError(c, codeInvalidRequest, err.Error())
+		return
+	}
+	// header is overwritten by the next Read
+	width := len(header)
+
+	imp := &userImport{ctx: ctx, users: repositoriesFrom(ctx).postgres, dryRun: dryRun, seen: map[string]int{}}
+	imp.result = importResult{DryRun: dryRun, Failures: []importFailure{}}
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) && parseErr.Err == csv.ErrFieldCount {
+			imp.result.Rows++
+			imp.fail(parseErr.StartLine, "", fieldError{Rule: "columns", Message: fmt.Sprintf("Row has %d columns, the header %d", len(record), width)})
+			continue
+		}
+		if err != nil {
+			// The reader can't find the next row after other errors
+			message := "Invalid CSV: " + err.Error() + "; the rest of the file was not read"
+			line := 0
+			if errors.As(err, &parseErr) {
+				line = parseErr.StartLine
+			} else if isBodyTooLarge(err) {
+				message = fmt.Sprintf("Import is larger than %d bytes; the rest of the file was not read", importBodyBytes)
+			}
+			imp.result.Rows++
+			imp.fail(line, "", errors.New(message))
+			break
+		}
+		line, _ := r.FieldPos(0)
+		if err := imp.add(line, record, columns); err != nil {
+			loggerFrom(ctx).Error("Failed to import users", "created", imp.result.Created, "error", err)
+			respondInternal(c, fmt.Sprintf("Failed to import users; %d were created", imp.result.Created))
+			return
+		}
+	}
+	if err := imp.flush(); err != nil {
+		loggerFrom(ctx).Error("Failed to import users", "created", imp.result.Created, "error", err)
+		respondInternal(c, fmt.Sprintf("Failed to import users; %d were created", imp.result.Created))
+		return
+	}
+
+	// Taken emails are found batch by batch, after later rows' failures
+	slices.SortStableFunc(imp.result.Failures, func(a, b importFailure) int { return a.Line - b.Line })
+
+	status := http.StatusCreated
+	switch {
+	case dryRun:
+		status = http.StatusOK
+	case imp.result.Failed > 0:
+		status = http.StatusMultiStatus
+	}
+	c.JSON(status, imp.result)
+}
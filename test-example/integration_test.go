@@ -0,0 +1,649 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// The user API suite runs on every backend: the memory repositories, and the
+// database of TEST_DB_DRIVER (sqlite, the default, postgres, pgx or mysql) at
+// TEST_DATABASE_URL (a temporary SQLite file by default; the database suite is
+// skipped for the other drivers without one). The routes behind requirePostgres are
+// only covered with TEST_DB_DRIVER=postgres or pgx; elsewhere the suite
+// checks that they answer 501.
+
+// A router on some repositories, with an admin API key
+type testBackend struct {
+	api   http.Handler
+	repos *repositories
+	key   string
+}
+
+func newMemoryBackend(t testing.TB) testBackend {
+	t.Helper()
+	repos := newMemoryRepositories()
+	return testBackend{api: newTestRouter(repos), repos: repos, key: testAPIKey(t, repos, roleAdmin)}
+}
+
+// A router on the test database, migrated to the current schema. Tests share
+// a Postgres database across runs, so they make up unique emails.
+func newDatabaseBackend(t testing.TB) testBackend {
+	t.Helper()
+	driver, url := os.Getenv("TEST_DB_DRIVER"), os.Getenv("TEST_DATABASE_URL")
+	if driver == "" {
+		driver = driverSQLite
+	}
+	if url == "" {
+		if driver != driverSQLite {
+			t.Skipf("TEST_DATABASE_URL is not set for TEST_DB_DRIVER=%s", driver)
+		}
+		url = "file:" + filepath.Join(t.TempDir(), "test.db") + "?_pragma=busy_timeout(5000)"
+	}
+	url, err := validateDSN(driver, url)
+	if err != nil {
+		t.Fatalf("TEST_DATABASE_URL: %v", err)
+	}
+	conn, err := sql.Open(driver, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Ping(); err != nil {
+		t.Fatalf("test database: %v", err)
+	}
+	previousDB, previousDriver := db, dbDriver
+	db, dbDriver = conn, driver
+	t.Cleanup(func() {
+		db, dbDriver = previousDB, previousDriver
+		conn.Close()
+	})
+	if err := migrate(context.Background(), loggerFrom(context.Background())); err != nil {
+		t.Fatalf("migrate test database: %v", err)
+	}
+
+	repos := newRepositories(db)
+	return testBackend{api: newTestRouter(repos), repos: repos, key: testAPIKey(t, repos, roleAdmin)}
+}
+
+var userSuite = []struct {
+	name string
+	run  func(t *testing.T, b testBackend)
+}{
+	{"Lifecycle", testUserLifecycle},
+	{"DuplicateEmail", testCreateDuplicateEmail},
+	{"ConcurrentCreate", testConcurrentCreate},
+	{"Pagination", testPagination},
+	{"Roles", testRoles},
+	{"LookupByIDs", testLookupByIDs},
+	{"PatchSemantics", testPatchSemantics},
+	{"NameFilterIsLiteral", testNameFilterIsLiteral},
+	{"CountMatchesList", testCountMatchesList},
+	{"HeadMatchesGet", testHeadMatchesGet},
+	{"PostgresOnlyRoutes", testPostgresOnlyRoutes},
+	{"APIKeys", testAPIKeys},
+	{"Audit", testAudit},
+}
+
+func TestUsersOnMemory(t *testing.T) {
+	for _, tt := range userSuite {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.run(t, newMemoryBackend(t))
+		})
+	}
+}
+
+func TestUsersOnDatabase(t *testing.T) {
+	for _, tt := range userSuite {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.run(t, newDatabaseBackend(t))
+		})
+	}
+}
+
+// An email no other test run used
+func uniqueEmail(name string) string {
+	return name + "-" + newUUID()[:8] + "@example.com"
+}
+
+// Create a user with name, failing the test unless it is created
+func createTestUser(t *testing.T, b testBackend, name string) User {
+	t.Helper()
+	return createTestUserFrom(t, b, map[string]interface{}{"name": name, "email": uniqueEmail("user")})
+}
+
+// Create a user from a request body, failing the test unless it is created
+func createTestUserFrom(t *testing.T, b testBackend, body map[string]interface{}) User {
+	t.Helper()
+	w := request(b.api, "POST", "/api/v1/users", body, "X-API-Key", b.key)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create %v: status %d: %s", body, w.Code, w.Body)
+	}
+	var u User
+	decode(t, w, &u)
+	return u
+}
+
+func testUserLifecycle(t *testing.T, b testBackend) {
+	email := uniqueEmail("ada")
+	name := "Ada " + newUUID()[:8]
+	w := request(b.api, "POST", "/api/v1/users", map[string]string{"name": name, "email": "  " + email}, "X-API-Key", b.key)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+	var created User
+	decode(t, w, &created)
+	if created.Email != email {
+		t.Errorf("create: email %q, want %q", created.Email, email)
+	}
+	if loc := w.Header().Get("Location"); loc != "/api/v1/users/"+created.ID {
+		t.Errorf("create: Location %q", loc)
+	}
+
+	w = request(b.api, "GET", "/api/v1/users/"+created.ID, nil, "X-API-Key", b.key)
+	if w.Code != http.StatusOK {
+		t.Fatalf("get: status %d: %s", w.Code, w.Body)
+	}
+
+	w = request(b.api, "PATCH", "/api/v1/users/"+created.ID, map[string]string{"name": name + " King"}, "X-API-Key", b.key)
+	if w.Code != http.StatusOK {
+		t.Fatalf("update: status %d: %s", w.Code, w.Body)
+	}
+	var updated, fetched User
+	decode(t, w, &updated)
+	if updated.Name != name+" King" || updated.Email != created.Email || updated.Version != created.Version+1 {
+		t.Errorf("update: got %q <%s> version %d", updated.Name, updated.Email, updated.Version)
+	}
+	// PATCH answers with the user as a GET now returns it
+	decode(t, request(b.api, "GET", "/api/v1/users/"+created.ID, nil, "X-API-Key", b.key), &fetched)
+	if !reflect.DeepEqual(updated, fetched) {
+		t.Errorf("update: returned %+v, then fetched %+v", updated, fetched)
+	}
+
+	w = request(b.api, "GET", "/api/v1/users?name="+url.QueryEscape(name), nil, "X-API-Key", b.key)
+	if w.Code != http.StatusOK {
+		t.Fatalf("list: status %d: %s", w.Code, w.Body)
+	}
+	var users []User
+	decode(t, w, &users)
+	if len(users) != 1 || users[0].ID != created.ID {
+		t.Errorf("list: got %+v", users)
+	}
+
+	w = request(b.api, "DELETE", "/api/v1/users/"+created.ID, nil, "X-API-Key", b.key)
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete: status %d: %s", w.Code, w.Body)
+	}
+	w = request(b.api, "GET", "/api/v1/users/"+created.ID, nil, "X-API-Key", b.key)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("get after delete: status %d, want 404", w.Code)
+	}
+}
+
+func testCreateDuplicateEmail(t *testing.T, b testBackend) {
+	email := uniqueEmail("grace")
+	body := map[string]string{"name": "Grace Hopper", "email": email}
+	if w := request(b.api, "POST", "/api/v1/users", body, "X-API-Key", b.key); w.Code != http.StatusCreated {
+		t.Fatalf("first create: status %d: %s", w.Code, w.Body)
+	}
+	body["email"] = "GRACE" + email[len("grace"):]
+	if w := request(b.api, "POST", "/api/v1/users", body, "X-API-Key", b.key); w.Code != http.StatusConflict {
+		t.Errorf("second create: status %d, want 409: %s", w.Code, w.Body)
+	}
+}
+
+// Of concurrent creates with the same email, exactly one succeeds and the
+// others conflict
+func testConcurrentCreate(t *testing.T, b testBackend) {
+	const creates = 8
+	email := uniqueEmail("race")
+	statuses := make(chan int, creates)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < creates; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			body := map[string]string{"name": "Racer " + strconv.Itoa(i), "email": email}
+			statuses <- request(b.api, "POST", "/api/v1/users", body, "X-API-Key", b.key).Code
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	close(statuses)
+
+	counts := map[int]int{}
+	for status := range statuses {
+		counts[status]++
+	}
+	if counts[http.StatusCreated] != 1 || counts[http.StatusConflict] != creates-1 {
+		t.Errorf("statuses %v, want one 201 and %d 409", counts, creates-1)
+	}
+}
+
+func testPagination(t *testing.T, b testBackend) {
+	prefix := newUUID()[:8]
+	for i := 0; i < 3; i++ {
+		createTestUser(t, b, prefix+" Page "+strconv.Itoa(i))
+	}
+
+	var users []User
+	w := request(b.api, "GET", "/api/v1/users?limit=2&name="+prefix, nil, "X-API-Key", b.key)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if decode(t, w, &users); len(users) != 2 {
+		t.Errorf("limit=2 returned %d users", len(users))
+	}
+
+	// Past the last row the page is empty, not null
+	w = request(b.api, "GET", "/api/v1/users?offset=3&name="+prefix, nil, "X-API-Key", b.key)
+	if w.Code != http.StatusOK || w.Body.String() != "[]" {
+		t.Errorf("offset past the end: status %d, body %s", w.Code, w.Body)
+	}
+}
+
+// Created users are members unless they get another role, and ?role= lists
+// only the users with the role
+func testRoles(t *testing.T, b testBackend) {
+	prefix := newUUID()[:8]
+	member := createTestUser(t, b, prefix+" Member")
+	viewer := createTestUserFrom(t, b, map[string]interface{}{"name": prefix + " Viewer", "email": uniqueEmail("viewer"), "role": roleViewer})
+	if member.Role != roleMember || viewer.Role != roleViewer {
+		t.Errorf("created with roles %q and %q, want member and viewer", member.Role, viewer.Role)
+	}
+
+	var stored User
+	decode(t, request(b.api, "GET", "/api/v1/users/"+member.ID, nil, "X-API-Key", b.key), &stored)
+	if stored.Role != roleMember {
+		t.Errorf("stored role %q, want member", stored.Role)
+	}
+
+	listed := func(role string) map[string]bool {
+		t.Helper()
+		w := request(b.api, "GET", "/api/v1/users?name="+prefix+"&role="+role, nil, "X-API-Key", b.key)
+		if w.Code != http.StatusOK {
+			t.Fatalf("role=%s: status %d: %s", role, w.Code, w.Body)
+		}
+		var users []User
+		decode(t, w, &users)
+		ids := map[string]bool{}
+		for _, u := range users {
+			if u.Role != role {
+				t.Errorf("role=%s listed a %s", role, u.Role)
+			}
+			ids[u.ID] = true
+		}
+		return ids
+	}
+	if ids := listed(roleViewer); !ids[viewer.ID] || ids[member.ID] {
+		t.Errorf("role=viewer: %v", ids)
+	}
+
+	if w := request(b.api, "PATCH", "/api/v1/users/"+member.ID, map[string]string{"role": roleViewer}, "X-API-Key", b.key); w.Code != http.StatusOK {
+		t.Fatalf("update role: status %d: %s", w.Code, w.Body)
+	}
+	if ids := listed(roleViewer); !ids[member.ID] {
+		t.Errorf("updated user not listed as a viewer")
+	}
+}
+
+// ?ids= returns the users in the requested order, and lists the ids of
+// missing and deleted users in not_found
+func testLookupByIDs(t *testing.T, b testBackend) {
+	ada := createTestUser(t, b, "Ada")
+	bob := createTestUser(t, b, "Bob")
+	gone := createTestUser(t, b, "Gone")
+	if w := request(b.api, "DELETE", "/api/v1/users/"+gone.ID, nil, "X-API-Key", b.key); w.Code != http.StatusOK {
+		t.Fatalf("delete: status %d: %s", w.Code, w.Body)
+	}
+	missing := newUUID()
+
+	ids := []string{bob.ID, strings.ToUpper(ada.ID), missing, gone.ID, bob.ID}
+	w := request(b.api, "GET", "/api/v1/users?ids="+strings.Join(ids, ","), nil, "X-API-Key", b.key)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var body struct {
+		Items    []User   `json:"items"`
+		NotFound []string `json:"not_found"`
+	}
+	decode(t, w, &body)
+	var got []string
+	for _, u := range body.Items {
+		got = append(got, u.ID)
+	}
+	if !reflect.DeepEqual(got, []string{bob.ID, ada.ID}) {
+		t.Errorf("items %v, want bob and ada", got)
+	}
+	if !reflect.DeepEqual(body.NotFound, []string{missing, gone.ID}) {
+		t.Errorf("not_found %v, want %v", body.NotFound, []string{missing, gone.ID})
+	}
+
+	if w := request(b.api, "GET", "/api/v1/users?ids="+ada.ID+",nope", nil, "X-API-Key", b.key); w.Code != http.StatusBadRequest {
+		t.Errorf("malformed id: status %d, want 400", w.Code)
+	}
+}
+
+// Omitted fields are kept, null clears the phone and empty strings are
+// rejected
+func testPatchSemantics(t *testing.T, b testBackend) {
+	u := createTestUser(t, b, "Ada")
+	path := "/api/v1/users/" + u.ID
+
+	// The user after the patch
+	patch := func(body string, status int) User {
+		t.Helper()
+		w := request(b.api, "PATCH", path, body, "X-API-Key", b.key)
+		if w.Code != status {
+			t.Fatalf("PATCH %s: status %d, want %d: %s", body, w.Code, status, w.Body)
+		}
+		if status != http.StatusOK {
+			w = request(b.api, "GET", path, nil, "X-API-Key", b.key)
+		}
+		var got User
+		decode(t, w, &got)
+		return got
+	}
+
+	got := patch(`{"phone": "+1 415 555 2671"}`, http.StatusOK)
+	if got.Phone == nil || *got.Phone != "+14155552671" {
+		t.Errorf("phone set: %v", got.Phone)
+	}
+	got = patch(`{"name": "Ada King"}`, http.StatusOK)
+	if got.Phone == nil || *got.Phone != "+14155552671" || got.Email != u.Email {
+		t.Errorf("phone or email changed by an update omitting them: %v <%s>", got.Phone, got.Email)
+	}
+	got = patch(`{"phone": null}`, http.StatusOK)
+	if got.Phone != nil || got.Name != "Ada King" {
+		t.Errorf("phone null: phone %v, name %q", got.Phone, got.Name)
+	}
+	patch(`{"phone": ""}`, http.StatusUnprocessableEntity)
+	patch(`{"name": ""}`, http.StatusUnprocessableEntity)
+	patch(`{"email": null}`, http.StatusUnprocessableEntity)
+	patch(`{}`, http.StatusUnprocessableEntity)
+}
+
+// LIKE wildcards in ?name= match themselves
+func testNameFilterIsLiteral(t *testing.T, b testBackend) {
+	prefix := newUUID()[:8]
+	for _, suffix := range []string{"50% off", "500 off", "a_b", "axb", `c\d`, "cd"} {
+		createTestUser(t, b, prefix+" "+suffix)
+	}
+
+	for _, tt := range []struct{ filter, want string }{
+		{"50%", "50% off"},
+		{"a_b", "a_b"},
+		{`c\d`, `c\d`},
+	} {
+		w := request(b.api, "GET", "/api/v1/users?name="+url.QueryEscape(prefix+" "+tt.filter), nil, "X-API-Key", b.key)
+		if w.Code != http.StatusOK {
+			t.Fatalf("name=%q: status %d: %s", tt.filter, w.Code, w.Body)
+		}
+		var users []User
+		decode(t, w, &users)
+		if len(users) != 1 || users[0].Name != prefix+" "+tt.want {
+			var names []string
+			for _, u := range users {
+				names = append(names, u.Name)
+			}
+			t.Errorf("name=%q: got %q, want only %q", tt.filter, names, prefix+" "+tt.want)
+		}
+	}
+}
+
+// /users/count and X-Total-Count count the users the list returns, under
+// every filter
+func testCountMatchesList(t *testing.T, b testBackend) {
+	prefix := newUUID()[:8]
+	core := map[string]string{"team": "core"}
+	var ids []string
+	for _, u := range []map[string]interface{}{
+		{"name": prefix + " Ada", "email": "ada@" + prefix + "-a.test", "role": "admin", "metadata": core},
+		{"name": prefix + " Bob", "email": "bob@" + prefix + "-a.test", "role": "viewer"},
+		{"name": prefix + " Cy", "email": "cy@" + prefix + "-b.test", "metadata": core},
+		{"name": prefix + " Dee", "email": "dee@" + prefix + "-b.test"},
+	} {
+		ids = append(ids, createTestUserFrom(t, b, u).ID)
+	}
+	if w := request(b.api, "DELETE", "/api/v1/users/"+ids[3], nil, "X-API-Key", b.key); w.Code != http.StatusOK {
+		t.Fatalf("delete: status %d: %s", w.Code, w.Body)
+	}
+
+	for _, tt := range []struct {
+		filter string
+		want   int
+	}{
+		{"", 3},
+		{"&role=member", 1},
+		{"&domain=" + prefix + "-a.test", 2},
+		{"&metadata.team=core", 2},
+		{"&include_deleted=true", 4},
+		{"&include_deleted=true&domain=" + prefix + "-b.test", 2},
+		{"&role=admin&domain=" + prefix + "-b.test", 0},
+		{"&status=active", 3},
+	} {
+		query := "?name=" + prefix + tt.filter
+		w := request(b.api, "GET", "/api/v1/users"+query+"&limit=500", nil, "X-API-Key", b.key)
+		if w.Code != http.StatusOK {
+			t.Fatalf("list %s: status %d: %s", query, w.Code, w.Body)
+		}
+		var users []User
+		decode(t, w, &users)
+		total := w.Header().Get("X-Total-Count")
+
+		w = request(b.api, "GET", "/api/v1/users/count"+query, nil, "X-API-Key", b.key)
+		if w.Code != http.StatusOK {
+			t.Fatalf("count %s: status %d: %s", query, w.Code, w.Body)
+		}
+		var count struct {
+			Count int `json:"count"`
+		}
+		decode(t, w, &count)
+
+		if len(users) != tt.want || count.Count != tt.want || total != strconv.Itoa(tt.want) {
+			t.Errorf("%s: %d listed, count %d, X-Total-Count %s; want %d", query, len(users), count.Count, total, tt.want)
+		}
+	}
+}
+
+// HEAD sends GET's headers, Content-Length included, without the body
+func testHeadMatchesGet(t *testing.T, b testBackend) {
+	u := createTestUserFrom(t, b, map[string]interface{}{"name": "Zoë <Head>", "email": uniqueEmail("head"), "phone": "+15551234567"})
+	path := "/api/v1/users/" + u.ID
+
+	get := request(b.api, "GET", path, nil, "X-API-Key", b.key)
+	head := request(b.api, "HEAD", path, nil, "X-API-Key", b.key)
+	if get.Code != http.StatusOK || head.Code != http.StatusOK {
+		t.Fatalf("GET %d, HEAD %d", get.Code, head.Code)
+	}
+	if head.Body.Len() != 0 {
+		t.Errorf("HEAD has a body: %s", head.Body)
+	}
+	if want := strconv.Itoa(get.Body.Len()); head.Header().Get("Content-Length") != want {
+		t.Errorf("HEAD Content-Length %q, want %s", head.Header().Get("Content-Length"), want)
+	}
+	for _, header := range []string{"Content-Type", "ETag"} {
+		if head.Header().Get(header) != get.Header().Get(header) {
+			t.Errorf("HEAD %s %q, GET %q", header, head.Header().Get(header), get.Header().Get(header))
+		}
+	}
+
+	missing := request(b.api, "HEAD", "/api/v1/users/00000000-0000-4000-8000-000000000000", nil, "X-API-Key", b.key)
+	if missing.Code != http.StatusNotFound || missing.Body.Len() != 0 {
+		t.Errorf("HEAD of a missing user: status %d, body %q", missing.Code, missing.Body)
+	}
+}
+
+// Answered with 501 unless the backend is Postgres
+func testPostgresOnlyRoutes(t *testing.T, b testBackend) {
+	for _, tt := range []struct{ method, path string }{
+		{"GET", "/api/v1/users/search?q=ada"},
+		{"GET", "/api/v1/users/stats"},
+		{"GET", "/api/v1/users/" + newUUID() + "/avatar"},
+		{"POST", "/api/v1/users/" + newUUID() + "/suspend"},
+		{"POST", "/api/v1/users/" + newUUID() + "/restore"},
+		{"PUT", "/api/v1/users/by-email/" + uniqueEmail("upsert")},
+		{"POST", "/api/v1/users/batch"},
+		{"PATCH", "/api/v1/users/bulk"},
+		{"DELETE", "/api/v1/users"},
+	} {
+		w := request(b.api, tt.method, tt.path, nil, "X-API-Key", b.key)
+		if b.repos.postgres == nil && w.Code != http.StatusNotImplemented {
+			t.Errorf("%s %s: status %d, want 501", tt.method, tt.path, w.Code)
+		}
+		if b.repos.postgres != nil && w.Code == http.StatusNotImplemented {
+			t.Errorf("%s %s: status 501 on Postgres", tt.method, tt.path)
+		}
+	}
+
+	w := request(b.api, "POST", "/api/v1/users", map[string]string{"name": "Ada", "email": uniqueEmail("ada")}, "Idempotency-Key", newUUID(), "X-API-Key", b.key)
+	if b.repos.idempotency == nil && w.Code != http.StatusNotImplemented {
+		t.Errorf("create with Idempotency-Key: status %d, want 501", w.Code)
+	}
+	if b.repos.idempotency != nil && w.Code != http.StatusCreated {
+		t.Errorf("create with Idempotency-Key: status %d, want 201", w.Code)
+	}
+}
+
+func testAPIKeys(t *testing.T, b testBackend) {
+	for _, tt := range []struct {
+		name    string
+		headers []string
+		status  int
+	}{
+		{"no key", nil, http.StatusUnauthorized},
+		{"unknown key", []string{"X-API-Key", "sk_" + strings.Repeat("x", 43)}, http.StatusUnauthorized},
+		{"X-API-Key", []string{"X-API-Key", b.key}, http.StatusOK},
+		{"bearer token", []string{"Authorization", "Bearer " + b.key}, http.StatusOK},
+	} {
+		w := request(b.api, "GET", "/api/v1/users/count", nil, tt.headers...)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+		if w.Code == http.StatusUnauthorized && !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Bearer") {
+			t.Errorf("%s: WWW-Authenticate %q", tt.name, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	// Routes outside /api stay open
+	if w := request(b.api, "GET", "/livez", nil); w.Code != http.StatusOK {
+		t.Errorf("livez: status %d", w.Code)
+	}
+
+	w := request(b.api, "POST", "/api/v1/keys", map[string]string{"name": "ci"}, "X-API-Key", b.key)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create key: status %d: %s", w.Code, w.Body)
+	}
+	var created struct {
+		apiKey
+		Key string `json:"key"`
+	}
+	decode(t, w, &created)
+	if !strings.HasPrefix(created.Key, created.Prefix) || w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("create key: prefix %q of %q, Cache-Control %q", created.Prefix, created.Key, w.Header().Get("Cache-Control"))
+	}
+	if created.Role != roleMember {
+		t.Errorf("create key: role %q, want the default %q", created.Role, roleMember)
+	}
+	if w := request(b.api, "POST", "/api/v1/keys", map[string]string{"name": "ci", "role": "root"}, "X-API-Key", b.key); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("create key with an unknown role: status %d, want 422", w.Code)
+	}
+	if w := request(b.api, "GET", "/api/v1/users/count", nil, "X-API-Key", created.Key); w.Code != http.StatusOK {
+		t.Errorf("new key: status %d", w.Code)
+	}
+
+	// Other runs may have left keys in the database
+	var list struct{ Items []apiKey }
+	decode(t, request(b.api, "GET", "/api/v1/keys", nil, "X-API-Key", b.key), &list)
+	var listed *apiKey
+	for i := range list.Items {
+		if list.Items[i].ID == created.ID {
+			listed = &list.Items[i]
+		}
+	}
+	if listed == nil || listed.LastUsedAt == nil {
+		t.Errorf("list keys: new key %+v, want it listed with its use", listed)
+	}
+
+	if w := request(b.api, "DELETE", "/api/v1/keys/"+created.ID, nil, "X-API-Key", b.key); w.Code != http.StatusOK {
+		t.Fatalf("revoke key: status %d: %s", w.Code, w.Body)
+	}
+	if w := request(b.api, "GET", "/api/v1/users/count", nil, "X-API-Key", created.Key); w.Code != http.StatusUnauthorized {
+		t.Errorf("revoked key: status %d, want 401", w.Code)
+	}
+	if w := request(b.api, "DELETE", "/api/v1/keys/"+created.ID, nil, "X-API-Key", b.key); w.Code != http.StatusNotFound {
+		t.Errorf("revoke again: status %d, want 404", w.Code)
+	}
+}
+
+func testAudit(t *testing.T, b testBackend) {
+	w := request(b.api, "POST", "/api/v1/users", map[string]string{"name": "Ada", "email": uniqueEmail("ada")}, "X-API-Key", b.key, "X-Request-ID", "req-1")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+	var user User
+	decode(t, w, &user)
+	w = request(b.api, "PATCH", "/api/v1/users/"+user.ID, map[string]string{"name": "Ada King"}, "X-API-Key", b.key)
+	if w.Code != http.StatusOK {
+		t.Fatalf("update: status %d: %s", w.Code, w.Body)
+	}
+	w = request(b.api, "PATCH", "/api/v1/users/"+user.ID, map[string]string{"name": "Ada Lovelace"}, "X-API-Key", b.key, "If-Match", `"1"`)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("stale update: status %d, want 412: %s", w.Code, w.Body)
+	}
+	if w := request(b.api, "DELETE", "/api/v1/users/"+user.ID, nil, "X-API-Key", b.key); w.Code != http.StatusOK {
+		t.Fatalf("delete: status %d: %s", w.Code, w.Body)
+	}
+
+	var history struct{ Items []auditEntry }
+	w = request(b.api, "GET", "/api/v1/users/"+user.ID+"/audit", nil, "X-API-Key", b.key)
+	if w.Code != http.StatusOK {
+		t.Fatalf("user audit: status %d: %s", w.Code, w.Body)
+	}
+	decode(t, w, &history)
+	actions := []string{}
+	for _, e := range history.Items {
+		actions = append(actions, e.Action)
+	}
+	if want := []string{auditDelete, auditUpdate, auditCreate}; !slices.Equal(actions, want) {
+		t.Fatalf("user audit: actions %v, want %v", actions, want)
+	}
+	created, updated := history.Items[2], history.Items[1]
+	if !strings.HasPrefix(created.Actor, "api_key:") || created.RequestID != "req-1" || string(created.Changes["email"].From) != "null" {
+		t.Errorf("create entry: %+v", created)
+	}
+	if len(updated.Changes) != 1 || string(updated.Changes["name"].To) != `"Ada King"` {
+		t.Errorf("update entry: changes %v, want only the name", updated.Changes)
+	}
+	if w.Header().Get("X-Total-Count") != "3" {
+		t.Errorf("user audit: X-Total-Count %q, want 3", w.Header().Get("X-Total-Count"))
+	}
+
+	if w := request(b.api, "GET", "/api/v1/users/"+newUUID()+"/audit", nil, "X-API-Key", b.key); w.Code != http.StatusNotFound {
+		t.Errorf("audit of an unknown user: status %d, want 404", w.Code)
+	}
+
+	// Other runs may have left entries by the same key in the database
+	var all struct{ Items []auditEntry }
+	decode(t, request(b.api, "GET", "/api/v1/audit?limit=100&actor="+url.QueryEscape(created.Actor), nil, "X-API-Key", b.key), &all)
+	if len(all.Items) < 3 {
+		t.Errorf("audit by actor: %d entries, want at least 3", len(all.Items))
+	}
+	decode(t, request(b.api, "GET", "/api/v1/audit?actor=api_key:nope", nil, "X-API-Key", b.key), &all)
+	if len(all.Items) != 0 {
+		t.Errorf("audit by an unknown actor: %+v", all.Items)
+	}
+	if w := request(b.api, "GET", "/api/v1/audit?occurred_after=2024-02-01&occurred_before=2024-01-01", nil, "X-API-Key", b.key); w.Code != http.StatusBadRequest {
+		t.Errorf("inverted range: status %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bearer tokens issued by an external identity provider (AUTH_MODES=jwt),
+// verified with the public keys it publishes at JWT_JWKS_URL. Only RS256 and
+// ES256 are accepted, and every token must carry exp, sub and the configured
+// iss and aud.
+
+// Required iss and aud claims (JWT_ISSUER, JWT_AUDIENCE)
+var (
+	jwtIssuer   = ""
+	jwtAudience = ""
+)
+
+// How long fetched keys are used before the JWKS is fetched again
+// (JWT_JWKS_REFRESH)
+var jwksRefreshInterval = time.Hour
+
+// A token signed with an unknown key fetches the JWKS again, at most this
+// often, so rotated keys are picked up without forged kids hammering the
+// provider
+const jwksMinRefreshInterval = 30 * time.Second
+
+// Allowed clock difference with the identity provider for exp and nbf
+const jwtLeeway = time.Minute
+
+// Limits for fetching the JWKS
+const (
+	jwksFetchTimeout = 5 * time.Second
+	maxJWKSBytes     = 1 << 20
+)
+
+// Keys from JWT_JWKS_URL; nil unless JWTs are enabled
+var jwks *jwksCache
+
+var errUnknownSigningKey = errors.New("unknown signing key")
+
+// A verification key and the algorithm it is for
+type jwksKey struct {
+	alg string
+	key crypto.PublicKey
+}
+
+// The keys of a JWKS by kid, fetched when first needed, when older than
+// jwksRefreshInterval, and when a token names a kid it doesn't have. A fetch
+// that fails keeps the current keys.
+type jwksCache struct {
+	url    string
+	client *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]jwksKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+}
+
+func newJWKSCache(url string) *jwksCache {
+	return &jwksCache{url: url, client: &http.Client{Timeout: jwksFetchTimeout}}
+}
+
+// The key with the given kid; errUnknownSigningKey when the JWKS doesn't
+// have it. Requests wait while the JWKS is fetched.
+func (j *jwksCache) key(ctx context.Context, kid string) (jwksKey, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	key, ok := j.keys[kid]
+	stale := time.Since(j.fetchedAt) >= jwksRefreshInterval
+	if (stale || !ok) && time.Since(j.attemptedAt) >= jwksMinRefreshInterval {
+		j.attemptedAt = time.Now()
+		if err := j.fetch(ctx); err != nil {
+			if j.keys == nil {
+				return jwksKey{}, fmt.Errorf("fetch JWKS: %w", err)
+			}
+			loggerFrom(ctx).Error("Failed to refresh JWKS, keeping the current keys", "url", j.url, "error", err)
+		}
+		key, ok = j.keys[kid]
+	}
+	if !ok {
+		return jwksKey{}, errUnknownSigningKey
+	}
+	return key, nil
+}
+
+// Fetch the JWKS, replacing the keys; called with j.mu held
+func (j *jwksCache) fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.url, nil)
+	if err != nil {
+		return err
+	}
+	if id := requestIDFrom(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSBytes)).Decode(&set); err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+
+	keys := map[string]jwksKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.verificationKey()
+		if err != nil {
+			loggerFrom(ctx).Warn("Skipping JWKS key", "kid", k.Kid, "error", err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return errors.New("no usable RS256 or ES256 keys")
+	}
+
+	j.keys = keys
+	j.fetchedAt = time.Now()
+	loggerFrom(ctx).Info("Loaded JWKS", "keys", len(keys), "url", j.url)
+	return nil
+}
+
+// A JSON Web Key (RFC 7517); only the members for RSA and P-256 keys
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) verificationKey() (jwksKey, error) {
+	switch k.Kty {
+	case "RSA":
+		if k.Alg != "" && k.Alg != "RS256" {
+			return jwksKey{}, fmt.Errorf("unsupported algorithm %q", k.Alg)
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return jwksKey{}, fmt.Errorf("invalid n: %w", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return jwksKey{}, errors.New("invalid e")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if pub.N.BitLen() < 2048 {
+			return jwksKey{}, fmt.Errorf("%d-bit RSA key is too short", pub.N.BitLen())
+		}
+		return jwksKey{alg: "RS256", key: pub}, nil
+	case "EC":
+		if k.Crv != "P-256" || (k.Alg != "" && k.Alg != "ES256") {
+			return jwksKey{}, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		if errX != nil || errY != nil || len(x) != 32 || len(y) != 32 {
+			return jwksKey{}, errors.New("invalid coordinates")
+		}
+		// ecdh rejects points that are not on the curve
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return jwksKey{}, err
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		return jwksKey{alg: "ES256", key: pub}, nil
+	}
+	return jwksKey{}, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// Registered claims checked on every token
+type jwtClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+}
+
+// Principal for a bearer token in compact JWT form
+func jwtPrincipal(ctx context.Context, token string) (*principal, error) {
+	invalid := func(message string) error {
+		return authError{message: message, invalid: true}
+	}
+
+	parts := strings.Split(token, ".")
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, invalid("Malformed token")
+	}
+	if header.Alg != "RS256" && header.Alg != "ES256" {
+		return nil, invalid("Unsupported token algorithm")
+	}
+
+	key, err := jwks.key(ctx, header.Kid)
+	if err == errUnknownSigningKey {
+		return nil, invalid("Unknown token signing key")
+	}
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || key.alg != header.Alg || !verifyJWTSignature(key, parts[0]+"."+parts[1], signature) {
+		return nil, invalid("Invalid token signature")
+	}
+
+	var claims jwtClaims
+	var all map[string]interface{}
+	if decodeJWTPart(parts[1], &claims) != nil || decodeJWTPart(parts[1], &all) != nil {
+		return nil, invalid("Malformed token claims")
+	}
+	now := time.Now()
+	switch {
+	case claims.ExpiresAt == nil:
+		return nil, invalid("Token has no expiry")
+	case now.Add(-jwtLeeway).After(time.Unix(int64(*claims.ExpiresAt), 0)):
+		return nil, invalid("Token expired")
+	case claims.NotBefore != nil && now.Add(jwtLeeway).Before(time.Unix(int64(*claims.NotBefore), 0)):
+		return nil, invalid("Token not valid yet")
+	case claims.Issuer != jwtIssuer:
+		return nil, invalid("Token issuer not accepted")
+	case !audienceIncludes(claims.Audience, jwtAudience):
+		return nil, invalid("Token audience not accepted")
+	case claims.Subject == "":
+		return nil, invalid("Token has no subject")
+	}
+
+	return &principal{Mode: authModeJWT, Subject: claims.Subject, Scopes: tokenScopes(all), Claims: all}, nil
+}
+
+// Decode a base64url JSON segment of a token
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	// Keeps large numeric claims exact in principal.Claims
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func verifyJWTSignature(key jwksKey, signed string, signature []byte) bool {
+	digest := sha256.Sum256([]byte(signed))
+	switch pub := key.key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		// r and s, 32 bytes each
+		if len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(pub, digest[:], r, s)
+	}
+	return false
+}
+
+// Whether an aud claim, a string or an array of strings, includes audience
+func audienceIncludes(raw json.RawMessage, audience string) bool {
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		return one == audience
+	}
+	var many []string
+	if json.Unmarshal(raw, &many) == nil {
+		return slices.Contains(many, audience)
+	}
+	return false
+}
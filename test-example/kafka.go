@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A small Kafka producer for events: metadata for the one topic, a
+// connection to each partition leader, and one Produce request per event,
+// acknowledged by all in-sync replicas. Requests use versions without
+// tagged fields (Metadata v1, Produce v3, SASL PLAIN), which brokers from
+// 0.11 on accept. Records are keyed by user id and partitioned like the
+// Java client's default partitioner, so a user's events keep their order.
+
+// API keys of the requests used
+const (
+	kafkaProduce          = 0
+	kafkaMetadata         = 3
+	kafkaSaslHandshake    = 17
+	kafkaSaslAuthenticate = 36
+)
+
+// Error codes that mean the metadata is out of date
+var kafkaStaleMetadata = map[int16]bool{3: true, 5: true, 6: true}
+
+// Names of the error codes a producer is likely to see
+var kafkaErrorNames = map[int16]string{
+	2: "CORRUPT_MESSAGE", 3: "UNKNOWN_TOPIC_OR_PARTITION", 5: "LEADER_NOT_AVAILABLE",
+	6: "NOT_LEADER_OR_FOLLOWER", 7: "REQUEST_TIMED_OUT", 10: "MESSAGE_TOO_LARGE",
+	19: "NOT_ENOUGH_REPLICAS", 20: "NOT_ENOUGH_REPLICAS_AFTER_APPEND", 29: "TOPIC_AUTHORIZATION_FAILED",
+	33: "UNSUPPORTED_SASL_MECHANISM", 34: "ILLEGAL_SASL_STATE", 58: "SASL_AUTHENTICATION_FAILED",
+}
+
+// An error code in a Kafka response
+type kafkaError int16
+
+func (e kafkaError) Error() string {
+	if name, ok := kafkaErrorNames[int16(e)]; ok {
+		return "kafka: " + name
+	}
+	return "kafka: error code " + strconv.Itoa(int(e))
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type kafkaPublisher struct {
+	// Bootstrap brokers, host:port
+	brokers  []string
+	topic    string
+	username string
+	password string
+	tls      *tls.Config
+
+	mu sync.Mutex
+	// From the last metadata; nil until read. Leader node of each partition
+	// by partition index, and the address of each node.
+	leaders     []int32
+	addrs       map[int32]string
+	conns       map[int32]*kafkaConn
+	correlation int32
+}
+
+type kafkaConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// A publisher for a topic on host:port brokers
+func newKafkaPublisher(brokers []string, topic, username, password string, tlsConfig *tls.Config) (*kafkaPublisher, error) {
+	for _, broker := range brokers {
+		if _, _, err := net.SplitHostPort(broker); err != nil {
+			return nil, fmt.Errorf("%q is not host:port", broker)
+		}
+	}
+	return &kafkaPublisher{brokers: brokers, topic: topic, username: username, password: password, tls: tlsConfig, conns: map[int32]*kafkaConn{}}, nil
+}
+
+func (p *kafkaPublisher) Publish(ctx context.Context, msg eventMessage) error {
+	value, err := msg.encode()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+	defer cancel()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.leaders == nil {
+		if err := p.refreshMetadata(ctx); err != nil {
+			return err
+		}
+	}
+	key := []byte(msg.User.ID)
+	partition := int32(kafkaPartition(key, len(p.leaders)))
+	node := p.leaders[partition]
+	kc, err := p.conn(ctx, node)
+	if err != nil {
+		p.reset()
+		return err
+	}
+
+	headers := [][2]string{{"event", msg.Event}, {"content-type", msg.contentType()}}
+	batch := kafkaRecordBatch(key, value, headers, time.Now())
+	var body kafkaEncoder
+	body.int16(-1) // no transactional id
+	body.int16(-1) // acks from all in-sync replicas
+	body.int32(int32(publishTimeout / time.Millisecond))
+	body.int32(1)
+	body.string(p.topic)
+	body.int32(1)
+	body.int32(partition)
+	body.bytes(batch)
+
+	resp, err := p.roundTrip(ctx, kc, kafkaProduce, 3, body.b)
+	if err != nil {
+		p.reset()
+		return err
+	}
+	d := kafkaDecoder{b: resp}
+	d.arrayLen() // topics
+	d.string()
+	d.arrayLen() // partitions
+	d.int32()
+	code := d.int16()
+	if d.err != nil {
+		p.reset()
+		return d.err
+	}
+	if code != 0 {
+		if kafkaStaleMetadata[code] {
+			p.reset()
+		}
+		return kafkaError(code)
+	}
+	return nil
+}
+
+func (p *kafkaPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reset()
+	return nil
+}
+
+// Forget the metadata and close the connections, after an error that may
+// have left either out of date
+func (p *kafkaPublisher) reset() {
+	for node, kc := range p.conns {
+		kc.conn.Close()
+		delete(p.conns, node)
+	}
+	p.leaders = nil
+	p.addrs = nil
+}
+
+// Read the topic's partitions and their leaders from the first bootstrap
+// broker that answers
+func (p *kafkaPublisher) refreshMetadata(ctx context.Context) error {
+	var err error
+	for _, broker := range p.brokers {
+		var kc *kafkaConn
+		if kc, err = p.dial(ctx, broker); err != nil {
+			continue
+		}
+		err = p.readMetadata(ctx, kc)
+		kc.conn.Close()
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("kafka metadata: %w", err)
+}
+
+func (p *kafkaPublisher) readMetadata(ctx context.Context, kc *kafkaConn) error {
+	var body kafkaEncoder
+	body.int32(1)
+	body.string(p.topic)
+	resp, err := p.roundTrip(ctx, kc, kafkaMetadata, 1, body.b)
+	if err != nil {
+		return err
+	}
+
+	d := kafkaDecoder{b: resp}
+	addrs := map[int32]string{}
+	for i := d.arrayLen(); i > 0; i-- {
+		node := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string() // rack
+		addrs[node] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.int32() // controller
+	if n := d.arrayLen(); n != 1 && d.err == nil {
+		return fmt.Errorf("%d topics in metadata", n)
+	}
+	if code := d.int16(); code != 0 && d.err == nil {
+		return kafkaError(code)
+	}
+	d.string()
+	d.bool()
+	n := d.arrayLen()
+	if d.err == nil && n <= 0 {
+		return errors.New("topic has no partitions")
+	}
+	leaders := make([]int32, max(n, 0))
+	for i := 0; i < n && d.err == nil; i++ {
+		d.int16() // partition error; a missing leader shows as -1
+		index := d.int32()
+		leader := d.int32()
+		d.int32s() // replicas
+		d.int32s() // in-sync replicas
+		if index < 0 || int(index) >= n {
+			return fmt.Errorf("partition %d out of range", index)
+		}
+		leaders[index] = leader
+	}
+	if d.err != nil {
+		return d.err
+	}
+	for index, leader := range leaders {
+		if _, ok := addrs[leader]; !ok {
+			return fmt.Errorf("partition %d has no leader: %w", index, kafkaError(5))
+		}
+	}
+	p.leaders, p.addrs = leaders, addrs
+	return nil
+}
+
+// The connection to a node, dialing it the first time
+func (p *kafkaPublisher) conn(ctx context.Context, node int32) (*kafkaConn, error) {
+	if kc, ok := p.conns[node]; ok {
+		return kc, nil
+	}
+	kc, err := p.dial(ctx, p.addrs[node])
+	if err != nil {
+		return nil, err
+	}
+	p.conns[node] = kc
+	return kc, nil
+}
+
+// Connect to a broker, over TLS with EVENT_TLS, and log in with SASL PLAIN
+// when there is a username
+func (p *kafkaPublisher) dial(ctx context.Context, addr string) (*kafkaConn, error) {
+	dialer := &net.Dialer{}
+	var conn net.Conn
+	var err error
+	if p.tls != nil {
+		host, _, _ := net.SplitHostPort(addr)
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsFor(p.tls, host)}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	kc := &kafkaConn{conn: conn, r: bufio.NewReader(conn)}
+	if p.username != "" {
+		if err := p.authenticate(ctx, kc); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return kc, nil
+}
+
+func (p *kafkaPublisher) authenticate(ctx context.Context, kc *kafkaConn) error {
+	var body kafkaEncoder
+	body.string("PLAIN")
+	resp, err := p.roundTrip(ctx, kc, kafkaSaslHandshake, 1, body.b)
+	if err != nil {
+		return err
+	}
+	d := kafkaDecoder{b: resp}
+	if code := d.int16(); code != 0 {
+		return kafkaError(code)
+	}
+
+	body = kafkaEncoder{}
+	body.bytes([]byte("\x00" + p.username + "\x00" + p.password))
+	if resp, err = p.roundTrip(ctx, kc, kafkaSaslAuthenticate, 0, body.b); err != nil {
+		return err
+	}
+	d = kafkaDecoder{b: resp}
+	code := d.int16()
+	message := d.string()
+	if d.err != nil {
+		return d.err
+	}
+	if code != 0 {
+		return fmt.Errorf("%w: %s", kafkaError(code), message)
+	}
+	return nil
+}
+
+// Send a request and return the body of its response
+func (p *kafkaPublisher) roundTrip(ctx context.Context, kc *kafkaConn, apiKey, version int16, body []byte) ([]byte, error) {
+	deadline, _ := ctx.Deadline()
+	kc.conn.SetDeadline(deadline)
+
+	p.correlation++
+	var req kafkaEncoder
+	req.int32(0) // size, set below
+	req.int16(apiKey)
+	req.int16(version)
+	req.int32(p.correlation)
+	req.string("sample-api")
+	req.b = append(req.b, body...)
+	binary.BigEndian.PutUint32(req.b, uint32(len(req.b)-4))
+	if _, err := kc.conn.Write(req.b); err != nil {
+		return nil, err
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(kc.r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > 64<<20 {
+		return nil, fmt.Errorf("kafka: response of %d bytes", n)
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(kc.r, resp); err != nil {
+		return nil, err
+	}
+	if id := int32(binary.BigEndian.Uint32(resp)); id != p.correlation {
+		return nil, fmt.Errorf("kafka: response %d to request %d", id, p.correlation)
+	}
+	return resp[4:], nil
+}
+
+// A record batch (magic 2) holding one record
+func kafkaRecordBatch(key, value []byte, headers [][2]string, at time.Time) []byte {
+	var record []byte
+	record = append(record, 0)              // attributes
+	record = binary.AppendVarint(record, 0) // timestamp delta
+	record = binary.AppendVarint(record, 0) // offset delta
+	record = binary.AppendVarint(record, int64(len(key)))
+	record = append(record, key...)
+	record = binary.AppendVarint(record, int64(len(value)))
+	record = append(record, value...)
+	record = binary.AppendVarint(record, int64(len(headers)))
+	for _, h := range headers {
+		record = binary.AppendVarint(record, int64(len(h[0])))
+		record = append(record, h[0]...)
+		record = binary.AppendVarint(record, int64(len(h[1])))
+		record = append(record, h[1]...)
+	}
+
+	// Everything the CRC covers
+	var tail kafkaEncoder
+	tail.int16(0) // attributes: no compression, create time
+	tail.int32(0) // last offset delta
+	ms := at.UnixMilli()
+	tail.int64(ms)
+	tail.int64(ms)
+	tail.int64(-1) // producer id
+	tail.int16(-1) // producer epoch
+	tail.int32(-1) // base sequence
+	tail.int32(1)
+	tail.b = binary.AppendVarint(tail.b, int64(len(record)))
+	tail.b = append(tail.b, record...)
+
+	var batch kafkaEncoder
+	batch.int64(0) // base offset
+	batch.int32(int32(4 + 1 + 4 + len(tail.b)))
+	batch.int32(-1) // partition leader epoch
+	batch.b = append(batch.b, 2)
+	batch.int32(int32(crc32.Checksum(tail.b, castagnoli)))
+	batch.b = append(batch.b, tail.b...)
+	return batch.b
+}
+
+// Partition of a key among n, as the Java client's default partitioner
+// chooses it
+func kafkaPartition(key []byte, n int) int {
+	return int(murmur2(key)&0x7fffffff) % n
+}
+
+// Kafka's variant of MurmurHash2
+func murmur2(data []byte) int32 {
+	const m = 0x5bd1e995
+	length := len(data)
+	h := uint32(0x9747b28c) ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> 24
+		k *= m
+		h *= m
+		h ^= k
+	}
+	rest := data[length&^3:]
+	switch len(rest) {
+	case 3:
+		h ^= uint32(rest[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(rest[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(rest[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// Big-endian request encoding
+type kafkaEncoder struct {
+	b []byte
+}
+
+func (e *kafkaEncoder) int16(v int16) { e.b = binary.BigEndian.AppendUint16(e.b, uint16(v)) }
+func (e *kafkaEncoder) int32(v int32) { e.b = binary.BigEndian.AppendUint32(e.b, uint32(v)) }
+func (e *kafkaEncoder) int64(v int64) { e.b = binary.BigEndian.AppendUint64(e.b, uint64(v)) }
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.b = append(e.b, b...)
+}
+
+// Response decoding; after the first short read every value is zero and err
+// says why
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *kafkaDecoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b) {
+		d.err = errors.New("kafka: truncated response")
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *kafkaDecoder) bool() bool {
+	v := d.take(1)
+	return v != nil && v[0] != 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if v := d.take(2); v != nil {
+		return int16(binary.BigEndian.Uint16(v))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if v := d.take(4); v != nil {
+		return int32(binary.BigEndian.Uint32(v))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) arrayLen() int {
+	return int(d.int32())
+}
+
+func (d *kafkaDecoder) int32s() {
+	if n := d.arrayLen(); n > 0 {
+		d.take(4 * n)
+	}
+}
+
+// A string or nullable string; null reads as ""
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// LISTEN_ADDR prefix selecting a Unix domain socket
+const unixSocketPrefix = "unix://"
+
+// Address the server listens on: LISTEN_ADDR, or every interface on PORT
+func (cfg Config) listenAddr() string {
+	if cfg.ListenAddr != "" {
+		return cfg.ListenAddr
+	}
+	return ":" + cfg.Port
+}
+
+// Path of the Unix socket to listen on, or "" for TCP
+func (cfg Config) socketPath() string {
+	return socketPathOf(cfg.listenAddr())
+}
+
+func socketPathOf(addr string) string {
+	if !strings.HasPrefix(addr, unixSocketPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(addr, unixSocketPrefix)
+}
+
+// TCP port the server listens on, for the HTTPS redirect; "" on a socket
+func (cfg Config) listenPort() string {
+	if cfg.socketPath() != "" {
+		return ""
+	}
+	_, port, _ := net.SplitHostPort(cfg.listenAddr())
+	return port
+}
+
+// Check LISTEN_ADDR and SOCKET_MODE
+func (cfg *Config) validateListen(r *configReader) {
+	if strings.HasPrefix(cfg.ListenAddr, unixSocketPrefix) {
+		if !strings.HasPrefix(socketPathOf(cfg.ListenAddr), "/") {
+			r.fail("LISTEN_ADDR", "%q needs an absolute socket path (unix:///path/to.sock)", cfg.ListenAddr)
+		}
+		if _, err := strconv.ParseUint(cfg.SocketMode, 8, 32); err != nil {
+			r.fail("SOCKET_MODE", "%q is not an octal file mode", cfg.SocketMode)
+		}
+		return
+	}
+	if cfg.ListenAddr != "" {
+		_, port, err := net.SplitHostPort(cfg.ListenAddr)
+		if err != nil {
+			r.fail("LISTEN_ADDR", "%q is neither host:port nor unix:///path: %v", cfg.ListenAddr, err)
+			return
+		}
+		r.port("LISTEN_ADDR", port)
+	}
+}
+
+// Open the listener for cfg. A Unix socket gets SOCKET_MODE permissions and
+// is removed again when the listener closes, which srv.Shutdown does. A
+// socket file left behind by a crashed process is replaced; one that still
+// accepts connections is an error.
+func listen(cfg Config) (net.Listener, error) {
+	path := cfg.socketPath()
+	if path == "" {
+		return net.Listen("tcp", cfg.listenAddr())
+	}
+
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	mode, _ := strconv.ParseUint(cfg.SocketMode, 8, 32)
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	} else if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Serve srv on ln, with TLS when configureTLS set it up
+func serve(srv *http.Server, ln net.Listener) error {
+	if srv.TLSConfig != nil {
+		// The certificate comes from GetCertificate
+		return srv.ServeTLS(ln, "", "")
+	}
+	return srv.Serve(ln)
+}
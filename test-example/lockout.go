@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Brute-force protection for POST /api/auth/login. Failed logins are
+// counted per email and per client IP; after each failure that email and IP
+// must wait an exponentially growing delay before trying again (429), and
+// LOGIN_MAX_FAILURES consecutive failures lock the email for LOGIN_LOCKOUT
+// (423). A successful login clears the email's count, not the IP's, so one
+// good account doesn't let an IP go on guessing others. Unknown emails are
+// counted and locked like real ones.
+
+// Consecutive failures that lock an email (LOGIN_MAX_FAILURES)
+var loginMaxFailures int64 = 5
+
+// How long a locked email stays locked, and how long failures are
+// remembered (LOGIN_LOCKOUT)
+var loginLockout = 15 * time.Minute
+
+// Delay after the first failure, doubled with each further one up to
+// loginBackoffMax (LOGIN_BACKOFF_BASE, LOGIN_BACKOFF_MAX); 0 turns delays off
+var (
+	loginBackoffBase = time.Second
+	loginBackoffMax  = time.Minute
+)
+
+// Where failures, delays and locks are kept (LOGIN_ATTEMPT_STORE): in memory
+// for a single instance, or in Redis (REDIS_URL) to share them between
+// instances
+const (
+	loginStoreMemory = "memory"
+	loginStoreRedis  = "redis"
+)
+
+// Entries the in-memory store holds before it sweeps out expired ones
+const maxLoginAttemptEntries = 100000
+
+// Counters and expiring blocks by key
+type LoginAttemptStore interface {
+	// Add one to key's counter and return it; the counter is dropped ttl
+	// after its last increment
+	Increment(ctx context.Context, key string, ttl time.Duration) (int64, error)
+	// Block key for d
+	Block(ctx context.Context, key string, d time.Duration) error
+	// How long key stays blocked; 0 when it isn't
+	BlockedFor(ctx context.Context, key string) (time.Duration, error)
+	// Drop counters and blocks
+	Delete(ctx context.Context, keys ...string) error
+}
+
+var loginAttempts LoginAttemptStore = newMemoryLoginAttemptStore(maxLoginAttemptEntries)
+
+// Store keys for an email or client IP
+func loginFailuresKey(kind, value string) string { return "login:fail:" + kind + ":" + value }
+func loginDelayKey(kind, value string) string    { return "login:delay:" + kind + ":" + value }
+func loginLockKey(email string) string           { return "login:lock:email:" + email }
+
+// Delay after n consecutive failures
+func loginBackoff(n int64) time.Duration {
+	if loginBackoffBase <= 0 || n < 1 {
+		return 0
+	}
+	d := loginBackoffBase
+	for i := int64(1); i < n && d < loginBackoffMax; i++ {
+		d *= 2
+	}
+	return min(d, loginBackoffMax)
+}
+
+// Answer 423 or 429 with Retry-After when the email is locked or the email
+// or IP must still wait; false after answering. A failing store lets the
+// attempt through.
+func allowLoginAttempt(c *gin.Context, email, ip string) bool {
+	ctx := c.Request.Context()
+
+	locked, err := loginAttempts.BlockedFor(ctx, loginLockKey(email))
+	if err != nil {
+		loggerFrom(ctx).Error("Login attempt store failed, allowing the attempt", "error", err)
+		return true
+	}
+	if locked > 0 {
+		c.Header("Retry-After", strconv.Itoa(ceilSeconds(locked)))
+		respondError(c, codeAccountLocked, "Account locked after too many failed logins")
+		return false
+	}
+
+	var wait time.Duration
+	for _, key := range []string{loginDelayKey("email", email), loginDelayKey("ip", ip)} {
+		d, err := loginAttempts.BlockedFor(ctx, key)
+		if err != nil {
+			loggerFrom(ctx).Error("Login attempt store failed, allowing the attempt", "error", err)
+			return true
+		}
+		wait = max(wait, d)
+	}
+	if wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(ceilSeconds(wait)))
+		respondError(c, codeRateLimited, "Too many failed logins; try again later")
+		return false
+	}
+	return true
+}
+
+// Count a failed login and answer it: 401, or 423 when it locks the email.
+// userID is empty for unknown emails.
+func failLogin(c *gin.Context, email, ip, userID string) {
+	ctx := c.Request.Context()
+
+	n, err := loginAttempts.Increment(ctx, loginFailuresKey("email", email), loginLockout)
+	if err == nil {
+		var m int64
+		m, err = loginAttempts.Increment(ctx, loginFailuresKey("ip", ip), loginLockout)
+		if err == nil {
+			err = loginAttempts.Block(ctx, loginDelayKey("ip", ip), loginBackoff(m))
+		}
+	}
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to record failed login", "error", err)
+		respondError(c, codeInvalidCredentials, "Invalid email or password")
+		return
+	}
+
+	if n < loginMaxFailures {
+		if err := loginAttempts.Block(ctx, loginDelayKey("email", email), loginBackoff(n)); err != nil {
+			loggerFrom(ctx).Error("Failed to record failed login", "error", err)
+		}
+		respondError(c, codeInvalidCredentials, "Invalid email or password")
+		return
+	}
+
+	// The lock replaces the count, so the email gets a fresh series of
+	// attempts once it expires
+	err = loginAttempts.Block(ctx, loginLockKey(email), loginLockout)
+	if err == nil {
+		err = loginAttempts.Delete(ctx, loginFailuresKey("email", email), loginDelayKey("email", email))
+	}
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to lock account", "error", err)
+	}
+	loggerFrom(ctx).Warn("Locked login", "email", maskEmail(email), "for", loginLockout, "failed_attempts", n)
+	if userID != "" {
+		u := User{ID: userID}
+		if err := repositoriesFrom(ctx).users.RecordAudit(ctx, newAuditEntry(ctx, auditLockout, &u, &u)); err != nil {
+			loggerFrom(ctx).Error("Failed to record lockout", "user_id", userID, "error", err)
+		}
+	}
+	c.Header("Retry-After", strconv.Itoa(ceilSeconds(loginLockout)))
+	respondError(c, codeAccountLocked, "Account locked after too many failed logins")
+}
+
+// Forget an email's failures after a successful login
+func clearLoginFailures(ctx context.Context, email string) {
+	if err := loginAttempts.Delete(ctx, loginFailuresKey("email", email), loginDelayKey("email", email)); err != nil {
+		loggerFrom(ctx).Error("Failed to reset failed logins", "error", err)
+	}
+}
+
+// Unlock a user's email and clear its failures (admin)
+func unlockUser(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	user, err := repositoriesFrom(ctx).users.GetByID(ctx, c.Param("id"), nil, false)
+	if err == errUserNotFound {
+		respondError(c, codeUserNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		respondInternal(c, "Failed to fetch user")
+		return
+	}
+
+	email := user.Email
+	err = loginAttempts.Delete(ctx, loginLockKey(email), loginFailuresKey("email", email), loginDelayKey("email", email))
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to unlock user", "user_id", user.ID, "error", err)
+		respondInternal(c, "Failed to unlock user")
+		return
+	}
+	u := User{ID: user.ID}
+	if err := repositoriesFrom(ctx).users.RecordAudit(ctx, newAuditEntry(ctx, auditUnlock, &u, &u)); err != nil {
+		loggerFrom(ctx).Error("Failed to record unlock", "user_id", user.ID, "error", err)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// Counters and blocks in memory, for a single instance
+type memoryLoginAttemptStore struct {
+	max int
+
+	mu      sync.Mutex
+	entries map[string]loginAttemptEntry
+}
+
+type loginAttemptEntry struct {
+	count   int64
+	expires time.Time
+}
+
+func newMemoryLoginAttemptStore(max int) *memoryLoginAttemptStore {
+	return &memoryLoginAttemptStore{max: max, entries: map[string]loginAttemptEntry{}}
+}
+
+// Make room for an entry; callers hold s.mu. Expired entries go first, and
+// when every entry is live the store is cleared, which only forgets failures.
+func (s *memoryLoginAttemptStore) reserve(now time.Time) {
+	if len(s.entries) < s.max {
+		return
+	}
+	for key, e := range s.entries {
+		if !now.Before(e.expires) {
+			delete(s.entries, key)
+		}
+	}
+	if len(s.entries) >= s.max {
+		s.entries = map[string]loginAttemptEntry{}
+	}
+}
+
+func (s *memoryLoginAttemptStore) Increment(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok || !now.Before(e.expires) {
+		s.reserve(now)
+		e = loginAttemptEntry{}
+	}
+	e.count++
+	e.expires = now.Add(ttl)
+	s.entries[key] = e
+	return e.count, nil
+}
+
+func (s *memoryLoginAttemptStore) Block(ctx context.Context, key string, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.entries[key]; !ok {
+		s.reserve(now)
+	}
+	s.entries[key] = loginAttemptEntry{expires: now.Add(d)}
+	return nil
+}
+
+func (s *memoryLoginAttemptStore) BlockedFor(ctx context.Context, key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[key]; ok {
+		return max(time.Until(e.expires), 0), nil
+	}
+	return 0, nil
+}
+
+func (s *memoryLoginAttemptStore) Delete(ctx context.Context, keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		delete(s.entries, key)
+	}
+	return nil
+}
+
+// Counters and blocks in Redis, shared by every instance using it. Counters
+// are INCR with PEXPIRE, blocks are keys set with PX.
+type redisLoginAttemptStore struct {
+	client *redisClient
+}
+
+func (s *redisLoginAttemptStore) Increment(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	replies, err := s.client.do(ctx,
+		[]string{"INCR", key},
+		[]string{"PEXPIRE", key, strconv.FormatInt(ttl.Milliseconds(), 10)},
+	)
+	if err != nil {
+		return 0, err
+	}
+	for _, reply := range replies {
+		if e, ok := reply.(redisError); ok {
+			return 0, e
+		}
+	}
+	n, ok := replies[0].(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: INCR returned %T", replies[0])
+	}
+	return n, nil
+}
+
+func (s *redisLoginAttemptStore) Block(ctx context.Context, key string, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	_, err := s.client.command(ctx, "SET", key, "1", "PX", strconv.FormatInt(max(d.Milliseconds(), 1), 10))
+	return err
+}
+
+func (s *redisLoginAttemptStore) BlockedFor(ctx context.Context, key string) (time.Duration, error) {
+	reply, err := s.client.command(ctx, "PTTL", key)
+	if err != nil {
+		return 0, err
+	}
+	// -2 for a missing key, -1 for one without expiry
+	ms, _ := reply.(int64)
+	if ms <= 0 {
+		return 0, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+func (s *redisLoginAttemptStore) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := s.client.command(ctx, append([]string{"DEL"}, keys...)...)
+	return err
+}
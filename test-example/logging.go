@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Logging goes through log/slog: JSON lines (LOG_FORMAT=json, the default
+// outside development) or logfmt-style text. Each request carries a logger
+// in its context with its ID, method, path and, once authenticated, its
+// principal; handlers log through loggerFrom. Components that run outside
+// requests (the database pools, the outbox, webhook deliveries) are given
+// their logger when they are set up.
+
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+)
+
+// Minimum level logged (LOG_LEVEL); POST /admin/log-level changes it while
+// running
+var logLevel = new(slog.LevelVar)
+
+// A logger writing to w in format at logLevel
+func newLogger(w io.Writer, format string) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: logLevel}
+	if format == logFormatJSON {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// Make the configured logger the default, which the standard log package
+// (and libraries using it) write through as well
+func setupLogging(cfg Config) *slog.Logger {
+	logger := newLogger(os.Stderr, cfg.LogFormat)
+	slog.SetDefault(logger)
+	return logger
+}
+
+// Log to logger at error level and exit, for failures at startup
+func fatal(logger *slog.Logger, msg string, args ...interface{}) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Parse a LOG_LEVEL value: debug, info, warn or error
+func parseLogLevel(value string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(strings.TrimSpace(value)))
+	return level, err
+}
+
+type loggerContextKey struct{}
+
+// A context carrying logger, for the code below it
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+// The logger of ctx's request, or fallback outside requests
+func contextLogger(ctx context.Context, fallback *slog.Logger) *slog.Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return fallback
+}
+
+// The logger of ctx's request; the default logger outside requests
+func loggerFrom(ctx context.Context) *slog.Logger {
+	return contextLogger(ctx, slog.Default())
+}
+
+// Middleware writing an access log line per request, at warn level for
+// 5xx responses
+func logRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelWarn
+		}
+		attrs := []slog.Attr{
+			slog.Int("status", status),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("client_ip", c.ClientIP()),
+			slog.Int("bytes", max(c.Writer.Size(), 0)),
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.String("errors", c.Errors.String()))
+		}
+		ctx := c.Request.Context()
+		loggerFrom(ctx).LogAttrs(ctx, level, "Request", attrs...)
+	}
+}
+
+// Get the minimum log level
+func getLogLevel(c *gin.Context) {
+	c.JSON(http.StatusOK, logLevelState{Level: strings.ToLower(logLevel.Level().String())})
+}
+
+type logLevelState struct {
+	Level string `json:"level"`
+}
+
+// Change the minimum log level of this process until it restarts
+//
+// Body: {"level": "debug"}; one of debug, info, warn and error.
+func updateLogLevel(c *gin.Context) {
+	var input logLevelState
+	if !bindJSON(c, &input) {
+		return
+	}
+	level, err := parseLogLevel(input.Level)
+	if err != nil {
+		respondInvalid(c, fieldError{Field: "level", Rule: "oneof", Message: "level must be debug, info, warn or error"})
+		return
+	}
+
+	if previous := logLevel.Level(); previous != level {
+		logLevel.Set(level)
+		// At a level the new setting still logs
+		ctx := c.Request.Context()
+		loggerFrom(ctx).Log(ctx, max(level, slog.LevelInfo), "Log level changed", "from", previous, "to", level)
+	}
+	getLogLevel(c)
+}
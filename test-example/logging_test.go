@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateLogging(t *testing.T) {
+	for _, tt := range []struct {
+		env        map[string]string
+		wantFormat string
+		wantError  string
+	}{
+		{map[string]string{"ENV": envDevelopment}, logFormatText, ""},
+		{map[string]string{"ENV": "production", "LOG_LEVEL": "warn"}, logFormatJSON, ""},
+		{map[string]string{"LOG_FORMAT": logFormatJSON, "LOG_LEVEL": "DEBUG"}, logFormatJSON, ""},
+		{map[string]string{"LOG_LEVEL": "verbose"}, "", "LOG_LEVEL"},
+		{map[string]string{"LOG_FORMAT": "xml"}, "", "LOG_FORMAT"},
+	} {
+		t.Run(strings.Join(sortedKeys(tt.env), ","), func(t *testing.T) {
+			t.Setenv("ENV", envDevelopment)
+			t.Setenv("DB_DRIVER", driverSQLite)
+			t.Setenv("DATABASE_URL", "file::memory:")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := loadConfig("", nil)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Errorf("error %v, want one about %s", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.LogFormat != tt.wantFormat {
+				t.Errorf("LogFormat %q, want %q", cfg.LogFormat, tt.wantFormat)
+			}
+		})
+	}
+}
+
+// An apiKeyRepository whose usage writes fail
+type failingUsageRepository struct {
+	apiKeyRepository
+}
+
+var errUsageWrite = errors.New("usage write failed")
+
+func (failingUsageRepository) SetLastUsed(ctx context.Context, id string, at time.Time) error {
+	return errUsageWrite
+}
+
+func (failingUsageRepository) AddUsage(ctx context.Context, id, day string, n int64) error {
+	return errUsageWrite
+}
+
+func (failingUsageRepository) Usage(ctx context.Context, day string) (map[string]int64, error) {
+	return nil, errUsageWrite
+}
+
+// Background flushes log to the logger they were started with, not the
+// default one
+func TestFlushesLogThroughContext(t *testing.T) {
+	defaultLogs := &bytes.Buffer{}
+	defer func(logger *slog.Logger) { slog.SetDefault(logger) }(slog.Default())
+	slog.SetDefault(newLogger(defaultLogs, logFormatJSON))
+
+	logs := &bytes.Buffer{}
+	ctx := withLogger(context.Background(), newLogger(logs, logFormatJSON).With("component", "api_keys"))
+	keys := failingUsageRepository{}
+
+	usage := &apiKeyUsage{lastUsed: map[string]time.Time{"key-1": time.Now()}}
+	usage.flush(ctx, keys)
+	quotas := &apiKeyQuotaCounter{pending: map[quotaCounterKey]int64{{"key-1", quotaDay(time.Now())}: 3}}
+	quotas.flush(ctx, keys)
+
+	for _, msg := range []string{"Failed to record use of API key", "Failed to count requests of API key", "Failed to read API key request counts"} {
+		lines := logLines(t, logs, msg)
+		if len(lines) != 1 || lines[0]["component"] != "api_keys" || lines[0]["error"] != errUsageWrite.Error() {
+			t.Errorf("%q: logged %v", msg, lines)
+		}
+	}
+	if defaultLogs.Len() > 0 {
+		t.Errorf("logged to the default logger: %s", defaultLogs)
+	}
+}
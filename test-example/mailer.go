@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// How outgoing email is sent (MAILER): logged with its content, through an
+// SMTP server, or not at all. Unset, it is log with ENV=development and
+// none otherwise, so links with tokens never reach production logs by
+// default.
+const (
+	mailerLog  = "log"
+	mailerSMTP = "smtp"
+	mailerNone = "none"
+)
+
+// Time allowed for connecting to the SMTP server and sending one message
+const smtpTimeout = 10 * time.Second
+
+// A plain text email to one recipient
+type mailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sends email; implement it to send through a provider's API instead of SMTP
+type Mailer interface {
+	Send(ctx context.Context, msg mailMessage) error
+}
+
+var mailer Mailer = logMailer{}
+
+// Writes messages to the log, for development
+type logMailer struct{}
+
+func (logMailer) Send(ctx context.Context, msg mailMessage) error {
+	loggerFrom(ctx).Info("Mail", "to", msg.To, "subject", msg.Subject, "body", msg.Body)
+	return nil
+}
+
+// Drops messages, logging only that it did
+type discardMailer struct{}
+
+func (discardMailer) Send(ctx context.Context, msg mailMessage) error {
+	loggerFrom(ctx).Warn("No MAILER configured, not sending mail", "subject", msg.Subject, "to", maskEmail(msg.To))
+	return nil
+}
+
+// Sends through an SMTP server (SMTP_ADDR), upgrading to TLS when the server
+// offers STARTTLS and logging in when SMTP_USERNAME is set
+type smtpMailer struct {
+	addr     string
+	username string
+	password string
+	// MAIL_FROM, e.g. "Sample API <noreply@example.com>"
+	from *mail.Address
+}
+
+func (m smtpMailer) Send(ctx context.Context, msg mailMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", m.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	host, _, _ := net.SplitHostPort(m.addr)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if m.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.username, m.password, host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(m.from.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(m.format(msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// The message with its headers. Recipients are validated addresses and
+// subjects come from the code, so neither can inject headers.
+func (m smtpMailer) format(msg mailMessage) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", m.from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Maintenance mode, toggled with POST /admin/maintenance or at startup with
+// MAINTENANCE_MODE. Kept in memory only, so a restart goes back to the
+// configured state.
+type maintenanceState struct {
+	Enabled bool `json:"enabled"`
+	// Let GET, HEAD and OPTIONS through and refuse only writes
+	ReadOnly bool       `json:"read_only"`
+	Message  string     `json:"message,omitempty"`
+	Since    *time.Time `json:"since,omitempty"`
+}
+
+var maintenance atomic.Pointer[maintenanceState]
+
+// Message when maintenance mode is enabled without one
+const defaultMaintenanceMessage = "The API is down for maintenance"
+
+// Retry-After sent while in maintenance mode (MAINTENANCE_RETRY_AFTER)
+var maintenanceRetryAfter = 2 * time.Minute
+
+// Shared secret for the /admin endpoints (ADMIN_TOKEN), sent as a bearer
+// token; the endpoints are not registered without it
+var adminToken = ""
+
+func init() {
+	maintenance.Store(&maintenanceState{})
+}
+
+// Paths that keep working in maintenance mode: probes, metrics, pprof and
+// the admin API
+func maintenanceExempt(path string) bool {
+	switch path {
+	case "/health", "/livez", "/readyz", "/metrics":
+		return true
+	}
+	return strings.HasPrefix(path, "/admin/") || strings.HasPrefix(path, "/debug/pprof/")
+}
+
+// Middleware answering 503 with Retry-After while maintenance mode is on
+func maintenanceGate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		state := maintenance.Load()
+		if !state.Enabled || maintenanceExempt(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+		if state.ReadOnly {
+			switch c.Request.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				c.Next()
+				return
+			}
+		}
+
+		c.Header("Retry-After", strconv.Itoa(int(maintenanceRetryAfter.Seconds())))
+		respondError(c, codeMaintenance, state.Message)
+	}
+}
+
+// Replace the maintenance state, returning the new one
+func setMaintenance(enabled, readOnly bool, message string) *maintenanceState {
+	state := &maintenanceState{}
+	if enabled {
+		if message == "" {
+			message = defaultMaintenanceMessage
+		}
+		now := time.Now().UTC()
+		state = &maintenanceState{Enabled: true, ReadOnly: readOnly, Message: message, Since: &now}
+	}
+	maintenance.Store(state)
+	return state
+}
+
+// Middleware requiring "Authorization: Bearer <ADMIN_TOKEN>"
+func requireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			c.Header("WWW-Authenticate", `Bearer realm="admin"`)
+			respondError(c, codeUnauthorized, "Admin token required")
+			return
+		}
+		c.Next()
+	}
+}
+
+// Get the maintenance mode state
+func getMaintenance(c *gin.Context) {
+	c.JSON(http.StatusOK, maintenance.Load())
+}
+
+type maintenanceInput struct {
+	Enabled  *bool  `json:"enabled"`
+	ReadOnly bool   `json:"read_only"`
+	Message  string `json:"message"`
+}
+
+// Turn maintenance mode on or off
+//
+// Body: {"enabled": true, "read_only": false, "message": "..."}; the message
+// defaults to a generic one.
+func updateMaintenance(c *gin.Context) {
+	var input maintenanceInput
+	if !bindJSON(c, &input) {
+		return
+	}
+	if input.Enabled == nil {
+		respondInvalid(c, fieldError{Field: "enabled", Rule: "required", Message: "enabled is required"})
+		return
+	}
+
+	c.JSON(http.StatusOK, setMaintenance(*input.Enabled, input.ReadOnly, input.Message))
+}
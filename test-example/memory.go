@@ -0,0 +1,767 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In-memory UserRepository for handler tests and local experiments without
+// Postgres. It mirrors the Postgres behavior the handlers rely on (soft
+// delete, unique active emails, versions, filters and ordering) but always
+// returns every field; handlers restrict the output themselves.
+type memoryUserRepository struct {
+	mu    sync.Mutex
+	users map[string]User
+	// Password hashes and when they were set, by user id
+	passwords map[string]memoryPassword
+	// Email verification and password reset tokens by hash
+	verificationTokens map[string]memoryToken
+	resetTokens        map[string]memoryToken
+	// Held for the length of a WithTx call, one transaction at a time
+	txMu sync.Mutex
+	// Deleted users keep their email reserved (the opposite of
+	// ALLOW_DELETED_EMAIL_REUSE)
+	reserveDeletedEmails bool
+	// Recorded audit entries, oldest first
+	audit []auditEntry
+}
+
+func newMemoryUserRepository(reserveDeletedEmails bool) *memoryUserRepository {
+	return &memoryUserRepository{
+		users:                map[string]User{},
+		passwords:            map[string]memoryPassword{},
+		verificationTokens:   map[string]memoryToken{},
+		resetTokens:          map[string]memoryToken{},
+		reserveDeletedEmails: reserveDeletedEmails,
+	}
+}
+
+type memoryPassword struct {
+	hash      string
+	changedAt time.Time
+}
+
+type memoryToken struct {
+	userID  string
+	expires time.Time
+	// Password reset tokens only
+	used bool
+}
+
+func (r *memoryUserRepository) List(ctx context.Context, q userListQuery) ([]User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	users := []User{}
+	for _, u := range r.users {
+		if !q.Filter.matches(u) {
+			continue
+		}
+		if q.After != nil && !userBefore(q.After.CreatedAt, q.After.ID, u) {
+			continue
+		}
+		users = append(users, copyUser(u))
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return compareUsers(users[i], users[j], q.Sort) < 0
+	})
+
+	if q.Offset >= len(users) {
+		return []User{}, nil
+	}
+	users = users[q.Offset:]
+	if q.Limit < len(users) {
+		users = users[:q.Limit]
+	}
+	return users, nil
+}
+
+// Reads a snapshot under the lock, so fn can call back into the repository
+func (r *memoryUserRepository) Each(ctx context.Context, q userListQuery, fn func(User) error) error {
+	q.Limit, q.Offset = math.MaxInt, 0
+	users, err := r.List(ctx, q)
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *memoryUserRepository) Count(ctx context.Context, filter userFilter) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var total int64
+	for _, u := range r.users {
+		if filter.matches(u) {
+			total++
+		}
+	}
+	return total, nil
+}
+
+func (r *memoryUserRepository) GetByID(ctx context.Context, id string, fields []userField, includeDeleted bool) (User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.users[id]
+	if !ok || (u.DeletedAt != nil && !includeDeleted) {
+		return User{}, errUserNotFound
+	}
+	return copyUser(u), nil
+}
+
+func (r *memoryUserRepository) GetByEmail(ctx context.Context, email string) (User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, u := range r.users {
+		if u.Email == email && u.DeletedAt == nil {
+			return copyUser(u), nil
+		}
+	}
+	return User{}, errUserNotFound
+}
+
+func (r *memoryUserRepository) Create(ctx context.Context, u User) (User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.emailTaken(u.Email, "", r.reserveDeletedEmails) {
+		return User{}, errEmailTaken
+	}
+
+	now := time.Now().UTC()
+	u.ID = newUUID()
+	u.CreatedAt = now
+	u.UpdatedAt = now
+	u.DeletedAt = nil
+	u.AvatarURL = nil
+	u.EmailVerified = false
+	u.Status = statusActive
+	u.Version = 1
+	if u.Role == "" {
+		u.Role = defaultRole
+	}
+	if u.Metadata == nil {
+		u.Metadata = Metadata{}
+	}
+
+	r.users[u.ID] = copyUser(u)
+	return u, nil
+}
+
+func (r *memoryUserRepository) Update(ctx context.Context, id string, patch userPatch, versions []int64) (User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.users[id]
+	if !ok || u.DeletedAt != nil {
+		return User{}, errUserNotFound
+	}
+	if versions != nil && !containsVersion(versions, u.Version) {
+		return User{}, errVersionMismatch
+	}
+
+	u = copyUser(u)
+	if patch.Name.Set {
+		u.Name = patch.Name.Value
+	}
+	if patch.Email.Set {
+		if r.emailTaken(patch.Email.Value, id, false) {
+			return User{}, errEmailTaken
+		}
+		if patch.Email.Value != u.Email {
+			u.EmailVerified = false
+		}
+		u.Email = patch.Email.Value
+	}
+	if patch.EmailVerified != nil {
+		u.EmailVerified = *patch.EmailVerified
+	}
+	if patch.Phone.Set {
+		u.Phone = nil
+		if !patch.Phone.Null {
+			phone := patch.Phone.Value
+			u.Phone = &phone
+		}
+	}
+	if patch.Role.Set {
+		u.Role = patch.Role.Value
+	}
+	if patch.Metadata != nil {
+		set, remove := patch.Metadata.mergePatch()
+		for k, v := range set {
+			u.Metadata[k] = v
+		}
+		for _, k := range remove {
+			delete(u.Metadata, k)
+		}
+		if err := u.Metadata.validate(); err != nil {
+			return User{}, err
+		}
+	}
+
+	u.UpdatedAt = time.Now().UTC()
+	u.Version++
+	r.users[id] = u
+	return copyUser(u), nil
+}
+
+func (r *memoryUserRepository) Delete(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.users[id]
+	if !ok || u.DeletedAt != nil {
+		return errUserNotFound
+	}
+
+	now := time.Now().UTC()
+	u.DeletedAt = &now
+	u.UpdatedAt = now
+	u.Version++
+	r.users[id] = u
+	return nil
+}
+
+func (r *memoryUserRepository) RecordAudit(ctx context.Context, entries ...auditEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, e := range entries {
+		e.ID = int64(len(r.audit) + 1)
+		e.user = nil
+		r.audit = append(r.audit, e)
+	}
+	return nil
+}
+
+func (r *memoryUserRepository) CountAudit(ctx context.Context, q auditQuery) (int64, error) {
+	entries, err := r.ListAudit(ctx, auditQuery{UserID: q.UserID, Actor: q.Actor, After: q.After, Before: q.Before, Limit: math.MaxInt})
+	return int64(len(entries)), err
+}
+
+func (r *memoryUserRepository) ListAudit(ctx context.Context, q auditQuery) ([]auditEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries := []auditEntry{}
+	for i := len(r.audit) - 1; i >= 0; i-- {
+		e := r.audit[i]
+		switch {
+		case q.UserID != "" && e.UserID != strings.ToLower(q.UserID),
+			q.Actor != "" && e.Actor != q.Actor,
+			q.After != nil && e.OccurredAt.Before(*q.After),
+			q.Before != nil && !e.OccurredAt.Before(*q.Before):
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	if q.Offset >= len(entries) {
+		return []auditEntry{}, nil
+	}
+	entries = entries[q.Offset:]
+	if q.Limit < len(entries) {
+		entries = entries[:q.Limit]
+	}
+	return entries, nil
+}
+
+func (r *memoryUserRepository) GetCredentials(ctx context.Context, id string) (userCredentials, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.users[strings.ToLower(id)]
+	if !ok || u.DeletedAt != nil {
+		return userCredentials{}, errUserNotFound
+	}
+	return r.credentials(u), nil
+}
+
+func (r *memoryUserRepository) GetCredentialsByEmail(ctx context.Context, email string) (userCredentials, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, u := range r.users {
+		if u.Email == email && u.DeletedAt == nil {
+			return r.credentials(u), nil
+		}
+	}
+	return userCredentials{}, errUserNotFound
+}
+
+// Callers hold r.mu
+func (r *memoryUserRepository) credentials(u User) userCredentials {
+	creds := userCredentials{UserID: u.ID, Email: u.Email, Role: u.Role, Status: u.Status}
+	if p, ok := r.passwords[u.ID]; ok {
+		changedAt := p.changedAt
+		creds.PasswordHash = p.hash
+		creds.PasswordChangedAt = &changedAt
+	}
+	return creds
+}
+
+func (r *memoryUserRepository) SetPasswordHash(ctx context.Context, id, hash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id = strings.ToLower(id)
+	if u, ok := r.users[id]; !ok || u.DeletedAt != nil {
+		return errUserNotFound
+	}
+	r.passwords[id] = memoryPassword{hash: hash, changedAt: time.Now().UTC()}
+	return nil
+}
+
+func (r *memoryUserRepository) StoreVerificationToken(ctx context.Context, userID, hash string, expires time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for h, t := range r.verificationTokens {
+		if t.userID == userID {
+			delete(r.verificationTokens, h)
+		}
+	}
+	r.verificationTokens[hash] = memoryToken{userID: userID, expires: expires}
+	return nil
+}
+
+func (r *memoryUserRepository) TakeVerificationToken(ctx context.Context, hash string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.verificationTokens[hash]
+	if !ok || !time.Now().Before(t.expires) {
+		return "", errInvalidToken
+	}
+	delete(r.verificationTokens, hash)
+	return t.userID, nil
+}
+
+func (r *memoryUserRepository) StorePasswordResetToken(ctx context.Context, userID, hash string, expires time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for h, t := range r.resetTokens {
+		if t.userID == userID && !now.Before(t.expires) {
+			delete(r.resetTokens, h)
+		}
+	}
+	r.resetTokens[hash] = memoryToken{userID: userID, expires: expires}
+	return nil
+}
+
+func (r *memoryUserRepository) TakePasswordResetToken(ctx context.Context, hash string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.resetTokens[hash]
+	switch {
+	case !ok:
+		return "", errInvalidToken
+	case t.used:
+		return "", errTokenUsed
+	case !time.Now().Before(t.expires):
+		return "", errTokenExpired
+	}
+	for h, other := range r.resetTokens {
+		if other.userID == t.userID && !other.used {
+			delete(r.resetTokens, h)
+		}
+	}
+	t.used = true
+	r.resetTokens[hash] = t
+	return t.userID, nil
+}
+
+// Transactions run one at a time and undo their changes by restoring a
+// snapshot. Operations outside WithTx are not isolated from them.
+func (r *memoryUserRepository) WithTx(ctx context.Context, fn func(tx UserRepository) error) error {
+	r.txMu.Lock()
+	defer r.txMu.Unlock()
+
+	r.mu.Lock()
+	snapshot := make(map[string]User, len(r.users))
+	for id, u := range r.users {
+		snapshot[id] = copyUser(u)
+	}
+	audit := len(r.audit)
+	passwords := make(map[string]memoryPassword, len(r.passwords))
+	for id, p := range r.passwords {
+		passwords[id] = p
+	}
+	tokens := make(map[string]memoryToken, len(r.verificationTokens))
+	for hash, t := range r.verificationTokens {
+		tokens[hash] = t
+	}
+	resetTokens := make(map[string]memoryToken, len(r.resetTokens))
+	for hash, t := range r.resetTokens {
+		resetTokens[hash] = t
+	}
+	r.mu.Unlock()
+
+	restore := func() {
+		r.mu.Lock()
+		r.users = snapshot
+		r.audit = r.audit[:audit]
+		r.passwords = passwords
+		r.verificationTokens = tokens
+		r.resetTokens = resetTokens
+		r.mu.Unlock()
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			restore()
+			panic(p)
+		}
+	}()
+
+	if err := fn(&memoryTx{r}); err != nil {
+		restore()
+		return err
+	}
+	return nil
+}
+
+// The repository inside WithTx, where a nested WithTx joins the transaction
+// instead of waiting for it
+type memoryTx struct {
+	*memoryUserRepository
+}
+
+func (t *memoryTx) WithTx(ctx context.Context, fn func(tx UserRepository) error) error {
+	return fn(t)
+}
+
+// Whether another user than exceptID has the email, counting deleted users
+// when includeDeleted is set. Callers hold r.mu.
+func (r *memoryUserRepository) emailTaken(email, exceptID string, includeDeleted bool) bool {
+	for _, u := range r.users {
+		if u.ID != exceptID && u.Email == email && (u.DeletedAt == nil || includeDeleted) {
+			return true
+		}
+	}
+	return false
+}
+
+// Copy a user so callers can't modify the stored metadata map
+func copyUser(u User) User {
+	metadata := Metadata{}
+	for k, v := range u.Metadata {
+		metadata[k] = v
+	}
+	u.Metadata = metadata
+	return u
+}
+
+func containsVersion(versions []int64, version int64) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether u comes after the (createdAt, id) position in the default order,
+// i.e. (u.created_at, u.id) < (createdAt, id)
+func userBefore(createdAt time.Time, id string, u User) bool {
+	if !u.CreatedAt.Equal(createdAt) {
+		return u.CreatedAt.Before(createdAt)
+	}
+	return u.ID < id
+}
+
+// Compare two users by sort terms, with the same id tiebreaker buildOrderBy
+// adds; nil terms sort newest first
+func compareUsers(a, b User, terms []sortTerm) int {
+	if len(terms) == 0 {
+		terms = []sortTerm{{Field: "created_at", Desc: true}}
+	}
+
+	desc := false
+	for _, term := range terms {
+		desc = term.Desc
+		var cmp int
+		switch term.Field {
+		case "name":
+			cmp = strings.Compare(a.Name, b.Name)
+		case "email":
+			cmp = strings.Compare(a.Email, b.Email)
+		case "created_at":
+			cmp = a.CreatedAt.Compare(b.CreatedAt)
+		}
+		if cmp != 0 {
+			if desc {
+				return -cmp
+			}
+			return cmp
+		}
+	}
+
+	cmp := strings.Compare(a.ID, b.ID)
+	if desc {
+		return -cmp
+	}
+	return cmp
+}
+
+// Go equivalent of apply, for repositories that filter in memory
+func (f userFilter) matches(u User) bool {
+	if !f.IncludeDeleted && u.DeletedAt != nil {
+		return false
+	}
+	if f.Name != "" && !strings.Contains(strings.ToLower(u.Name), strings.ToLower(f.Name)) {
+		return false
+	}
+	if f.Domain != "" && !strings.HasSuffix(strings.ToLower(u.Email), "@"+strings.ToLower(f.Domain)) {
+		return false
+	}
+	if f.CreatedAfter != nil && u.CreatedAt.Before(*f.CreatedAfter) {
+		return false
+	}
+	if f.CreatedBefore != nil && !u.CreatedAt.Before(*f.CreatedBefore) {
+		return false
+	}
+	if f.UpdatedSince != nil && u.UpdatedAt.Before(*f.UpdatedSince) {
+		return false
+	}
+	if f.Phone != "" && (u.Phone == nil || *u.Phone != f.Phone) {
+		return false
+	}
+	if f.Status != "" && u.Status != f.Status {
+		return false
+	}
+	if f.Role != "" && u.Role != f.Role {
+		return false
+	}
+	if f.Verified != nil && u.EmailVerified != *f.Verified {
+		return false
+	}
+	for k, v := range f.Metadata {
+		if u.Metadata[k] != v {
+			return false
+		}
+	}
+	if f.IDs != nil && !slices.Contains(f.IDs, u.ID) {
+		return false
+	}
+	return true
+}
+
+// Generate a random (version 4) UUID
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// Repositories keeping users and API keys in memory, for handler tests.
+// They have no avatar store, so only the user routes work on them.
+func newMemoryRepositories() *repositories {
+	users := newMemoryUserRepository(!allowDeletedEmailReuse)
+	return &repositories{
+		users:    users,
+		reader:   users,
+		apiKeys:  &memoryAPIKeyRepository{keys: map[string]memoryAPIKey{}, usage: map[quotaCounterKey]int64{}},
+		webhooks: &memoryWebhookRepository{hooks: map[string]webhook{}},
+	}
+}
+
+// In-memory apiKeyRepository
+type memoryAPIKeyRepository struct {
+	mu    sync.Mutex
+	keys  map[string]memoryAPIKey
+	usage map[quotaCounterKey]int64
+}
+
+type memoryAPIKey struct {
+	key     apiKey
+	hash    string
+	revoked bool
+}
+
+func (r *memoryAPIKeyRepository) Create(ctx context.Context, key apiKey, hash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys[key.ID] = memoryAPIKey{key: key, hash: hash}
+	return nil
+}
+
+func (r *memoryAPIKeyRepository) FindByHash(ctx context.Context, hash string) (apiKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, k := range r.keys {
+		if k.hash == hash && !k.revoked {
+			return k.key, nil
+		}
+	}
+	return apiKey{}, errAPIKeyNotFound
+}
+
+func (r *memoryAPIKeyRepository) Get(ctx context.Context, id string) (apiKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k, ok := r.keys[id]
+	if !ok || k.revoked {
+		return apiKey{}, errAPIKeyNotFound
+	}
+	return k.key, nil
+}
+
+func (r *memoryAPIKeyRepository) List(ctx context.Context) ([]apiKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys := []apiKey{}
+	for _, k := range r.keys {
+		if !k.revoked {
+			keys = append(keys, k.key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys, nil
+}
+
+func (r *memoryAPIKeyRepository) Revoke(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k, ok := r.keys[id]
+	if !ok || k.revoked {
+		return errAPIKeyNotFound
+	}
+	k.revoked = true
+	r.keys[id] = k
+	return nil
+}
+
+func (r *memoryAPIKeyRepository) SetLastUsed(ctx context.Context, id string, t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if k, ok := r.keys[id]; ok {
+		k.key.LastUsedAt = &t
+		r.keys[id] = k
+	}
+	return nil
+}
+
+func (r *memoryAPIKeyRepository) AddUsage(ctx context.Context, id, day string, n int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.usage[quotaCounterKey{id, day}] += n
+	return nil
+}
+
+func (r *memoryAPIKeyRepository) Usage(ctx context.Context, day string) (map[string]int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counts := map[string]int64{}
+	for k, n := range r.usage {
+		if k.day == day {
+			counts[k.id] = n
+		}
+	}
+	return counts, nil
+}
+
+// In-memory webhookRepository. Deliveries are made by the outbox, which
+// needs a database, so there are never any.
+type memoryWebhookRepository struct {
+	mu    sync.Mutex
+	hooks map[string]webhook
+}
+
+func (r *memoryWebhookRepository) Get(ctx context.Context, id string) (webhook, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w, ok := r.hooks[strings.ToLower(id)]
+	if !ok {
+		return webhook{}, errWebhookNotFound
+	}
+	return w, nil
+}
+
+func (r *memoryWebhookRepository) List(ctx context.Context, activeOnly bool) ([]webhook, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hooks := []webhook{}
+	for _, w := range r.hooks {
+		if w.Active || !activeOnly {
+			hooks = append(hooks, w)
+		}
+	}
+	sort.Slice(hooks, func(i, j int) bool {
+		if !hooks[i].CreatedAt.Equal(hooks[j].CreatedAt) {
+			return hooks[i].CreatedAt.Before(hooks[j].CreatedAt)
+		}
+		return hooks[i].ID < hooks[j].ID
+	})
+	return hooks, nil
+}
+
+func (r *memoryWebhookRepository) Create(ctx context.Context, w webhook, secret string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hooks[w.ID] = w
+	return nil
+}
+
+func (r *memoryWebhookRepository) Update(ctx context.Context, id string, input webhookInput) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w, ok := r.hooks[strings.ToLower(id)]
+	if !ok {
+		return errWebhookNotFound
+	}
+	if input.URL != nil {
+		w.URL = *input.URL
+	}
+	if input.Events != nil {
+		w.Events = *input.Events
+	}
+	if input.Active != nil {
+		w.Active = *input.Active
+	}
+	w.UpdatedAt = time.Now().UTC()
+	r.hooks[w.ID] = w
+	return nil
+}
+
+func (r *memoryWebhookRepository) Delete(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.hooks[strings.ToLower(id)]; !ok {
+		return errWebhookNotFound
+	}
+	delete(r.hooks, strings.ToLower(id))
+	return nil
+}
+
+func (r *memoryWebhookRepository) CountDeliveries(ctx context.Context, q webhookDeliveryQuery) (int64, error) {
+	return 0, nil
+}
+
+func (r *memoryWebhookRepository) ListDeliveries(ctx context.Context, q webhookDeliveryQuery) ([]webhookDelivery, error) {
+	return []webhookDelivery{}, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+)
+
+// Maximum serialized size of a user's metadata
+const maxMetadataSize = 8 << 10
+
+// Free-form key/value data attached to a user, stored as a JSONB object
+type Metadata map[string]interface{}
+
+// UnmarshalJSON rejects anything but a JSON object (or null)
+func (m *Metadata) UnmarshalJSON(data []byte) error {
+	trimmed := bytes.TrimSpace(data)
+	if bytes.Equal(trimmed, []byte("null")) {
+		*m = nil
+		return nil
+	}
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return fieldError{Field: "metadata", Rule: "object", Message: "metadata must be a JSON object"}
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(trimmed, &v); err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
+// MarshalXML writes an <entry key="…"> per key, in key order; values other
+// than strings are written as JSON
+func (m Metadata) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(m) {
+		value, ok := m[key].(string)
+		if !ok {
+			data, err := json.Marshal(m[key])
+			if err != nil {
+				return err
+			}
+			value = string(data)
+		}
+		entry := xml.StartElement{Name: xml.Name{Local: "entry"}, Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: key}}}
+		if err := e.EncodeElement(value, entry); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// Value implements driver.Valuer. The JSON is returned as a string because
+// lib/pq would encode a []byte as bytea.
+func (m Metadata) Value() (driver.Value, error) {
+	if m == nil {
+		return "{}", nil
+	}
+	data, err := json.Marshal(map[string]interface{}(m))
+	return string(data), err
+}
+
+// Scan implements sql.Scanner
+func (m *Metadata) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*m = Metadata{}
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into Metadata", src)
+	}
+	return json.Unmarshal(data, (*map[string]interface{})(m))
+}
+
+var errMetadataTooLarge = fieldError{
+	Field:   "metadata",
+	Rule:    "max_size",
+	Message: fmt.Sprintf("metadata cannot exceed %d bytes when serialized", maxMetadataSize),
+}
+
+// Check the serialized size limit
+func (m Metadata) validate() error {
+	data, err := json.Marshal(map[string]interface{}(m))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxMetadataSize {
+		return errMetadataTooLarge
+	}
+	return nil
+}
+
+// Split a metadata patch into values to merge and keys to remove (null values)
+func (m Metadata) mergePatch() (set Metadata, remove []string) {
+	set = Metadata{}
+	remove = []string{}
+	for k, v := range m {
+		if v == nil {
+			remove = append(remove, k)
+		} else {
+			set[k] = v
+		}
+	}
+	return set, remove
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Metrics in the Prometheus text format. There are few enough that a client
+// library isn't worth the dependency: labeled counters and histograms, plus
+// values read when scraped.
+
+// Default histogram buckets, in seconds
+var durationBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.mu.Lock()
+	c.values[labelKey(labelValues)]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// An unlabeled counter exists from the start
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, "", ""), formatFloat(c.values[key]))
+	}
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	// counts[i] counts observations <= buckets[i], not cumulative
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, "", ""), s.count)
+	}
+}
+
+// A metric whose value is read when scraped
+type valueFunc struct {
+	name string
+	help string
+	// "counter" or "gauge"
+	kind  string
+	value func() float64
+}
+
+func (f valueFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", f.name, f.help, f.name, f.kind, f.name, formatFloat(f.value()))
+}
+
+// Label values joined into a map key
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// {name="value",...} for the label names and a labelKey, plus an extra label
+// (histogram le) when extraName is set
+func formatLabels(names []string, key, extraName, extraValue string) string {
+	pairs := []string{}
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, names[i]+"="+strconv.Quote(v))
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+"="+strconv.Quote(extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	httpRequestsTotal = newCounterVec("http_requests_total",
+		"HTTP requests by method, route and status.", "method", "route", "status")
+	httpRequestDuration = newHistogramVec("http_request_duration_seconds",
+		"HTTP request duration by method and route.", durationBuckets, "method", "route")
+	httpPanicsTotal = newCounterVec("http_panics_total",
+		"Panics recovered in handlers.")
+	grpcRequestsTotal = newCounterVec("grpc_requests_total",
+		"gRPC calls by method and status code.", "method", "code")
+	grpcRequestDuration = newHistogramVec("grpc_request_duration_seconds",
+		"gRPC call duration by method.", durationBuckets, "method")
+	dbQueryDuration = newHistogramVec("db_query_duration_seconds",
+		"Database query duration by query name (operation and table).", durationBuckets, "query")
+	dbQueryErrorsTotal = newCounterVec("db_query_errors_total",
+		"Failed database queries by query name.", "query")
+)
+
+// Scrape-time metrics
+func valueMetrics() []valueFunc {
+	metrics := []valueFunc{
+		{"db_connections_open", "Open connections to the primary database.", "gauge", func() float64 { return float64(db.Stats().OpenConnections) }},
+		{"db_connections_in_use", "Primary database connections in use.", "gauge", func() float64 { return float64(db.Stats().InUse) }},
+		{"db_connections_idle", "Idle primary database connections.", "gauge", func() float64 { return float64(db.Stats().Idle) }},
+		{"db_connection_waits_total", "Waits for a free primary database connection.", "counter", func() float64 { return float64(db.Stats().WaitCount) }},
+		{"user_event_streams_open", "Open streams of user events.", "gauge", func() float64 { return float64(userEventStreams.count()) }},
+		{"maintenance_enabled", "1 while maintenance mode is on.", "gauge", func() float64 {
+			if maintenance.Load().Enabled {
+				return 1
+			}
+			return 0
+		}},
+	}
+	if replica != nil {
+		metrics = append(metrics, valueFunc{"db_replica_fallbacks_total", "Reads served by the primary because the replica was down.", "counter",
+			func() float64 { return float64(replica.fallbacks.Load()) }})
+	}
+	return metrics
+}
+
+// Prometheus scrape endpoint
+func metricsHandler(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	w := c.Writer
+	httpRequestsTotal.write(w)
+	httpRequestDuration.write(w)
+	httpPanicsTotal.write(w)
+	grpcRequestsTotal.write(w)
+	grpcRequestDuration.write(w)
+	dbQueryDuration.write(w)
+	dbQueryErrorsTotal.write(w)
+	for _, m := range valueMetrics() {
+		m.write(w)
+	}
+}
+
+// Middleware counting requests and their duration by route pattern, so ids
+// in the path don't create a series each
+func recordMetrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequestsTotal.inc(c.Request.Method, route, strconv.Itoa(c.Writer.Status()))
+		httpRequestDuration.observe(time.Since(start).Seconds(), c.Request.Method, route)
+	}
+}
+
+// Name a query by its operation and main table ("select users"), which
+// keeps the number of series small
+func queryName(query string) string {
+	fields := strings.Fields(strings.ToLower(query))
+	if len(fields) == 0 {
+		return "other"
+	}
+
+	op := fields[0]
+	var after string
+	switch op {
+	case "select", "delete":
+		after = "from"
+	case "insert":
+		after = "into"
+	case "update":
+		if len(fields) > 1 {
+			return op + " " + tableName(fields[1])
+		}
+		return op
+	default:
+		return "other"
+	}
+	for i, f := range fields[:len(fields)-1] {
+		if f == after {
+			return op + " " + tableName(fields[i+1])
+		}
+	}
+	return op
+}
+
+// A table name token without quotes; subqueries and functions give "expr"
+func tableName(token string) string {
+	token = strings.Trim(token, "\"`;,")
+	for _, r := range token {
+		if !(r >= 'a' && r <= 'z' || r == '_' || r >= '0' && r <= '9') {
+			return "expr"
+		}
+	}
+	return token
+}
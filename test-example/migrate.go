@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"strings"
+)
+
+// Schema migrations, one directory per DB_DRIVER, applied in filename order.
+// Each file runs once in its own transaction and is recorded in
+// schema_migrations; never edit a file that has been released, add a new one
+// instead.
+//
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+// Apply pending migrations at startup (AUTO_MIGRATE); off for deployments
+// that migrate out-of-band with -migrate-only
+var autoMigrate = false
+
+// Advisory lock held while migrating (a key on Postgres, a name on MySQL), so
+// replicas starting at the same time apply each migration once
+const (
+	migrationLockKey  = 7262011
+	migrationLockName = "sample-api-migrations"
+)
+
+// Apply every migration for the current driver not yet recorded in
+// schema_migrations, logging each to logger
+func migrate(ctx context.Context, logger *slog.Logger) error {
+	// Advisory locks belong to a session, so everything runs on one connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// SQLite serializes writers on its own
+	switch dbDialect() {
+	case driverPostgres:
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey); err != nil {
+			return fmt.Errorf("acquire migration lock: %w", err)
+		}
+		defer func() {
+			if _, err := conn.ExecContext(context.WithoutCancel(ctx), "SELECT pg_advisory_unlock($1)", migrationLockKey); err != nil {
+				logger.Error("Failed to release migration lock", "error", err)
+			}
+		}()
+	case driverMySQL:
+		// Waits up to a minute; 0 means another session still holds it
+		var locked sql.NullInt64
+		if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 60)", migrationLockName).Scan(&locked); err != nil {
+			return fmt.Errorf("acquire migration lock: %w", err)
+		}
+		if locked.Int64 != 1 {
+			return fmt.Errorf("acquire migration lock: timed out")
+		}
+		defer func() {
+			if _, err := conn.ExecContext(context.WithoutCancel(ctx), "SELECT RELEASE_LOCK(?)", migrationLockName); err != nil {
+				logger.Error("Failed to release migration lock", "error", err)
+			}
+		}()
+	}
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version VARCHAR(255) PRIMARY KEY,
+			applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`)
+	if err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	pending, err := pendingMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	dir := "migrations/" + dbDialect()
+	for _, version := range pending {
+		script, err := fs.ReadFile(migrationFiles, dir+"/"+version+".sql")
+		if err != nil {
+			return err
+		}
+
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		// MySQL runs one statement per call and commits DDL implicitly, so
+		// there a failed migration can be left half applied
+		statements := []string{string(script)}
+		record := "INSERT INTO schema_migrations (version) VALUES ($1)"
+		if dbDialect() == driverMySQL {
+			statements = splitStatements(string(script))
+			record, _ = rebindMySQL(record, []interface{}{version})
+		}
+		for _, statement := range statements {
+			if _, err := tx.ExecContext(ctx, statement); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %s: %w", version, err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, record, version); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("record migration %s: %w", version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %s: %w", version, err)
+		}
+
+		logger.Info("Applied migration", "version", version)
+	}
+
+	if len(pending) == 0 {
+		logger.Info("Database schema is up to date")
+	}
+	return nil
+}
+
+// Versions of the current driver's migrations not yet recorded in
+// schema_migrations, in the order they apply; all of them on a database that
+// was never migrated
+func pendingMigrations(ctx context.Context, q dbtx) ([]string, error) {
+	applied := map[string]bool{}
+	rows, err := q.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if isUndefinedTable(err) {
+		return migrationVersions(applied)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version string
+		if err := rows.Scan(&version); err != nil {
+			return nil, fmt.Errorf("read schema_migrations: %w", err)
+		}
+		applied[version] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("read schema_migrations: %w", err)
+	}
+	return migrationVersions(applied)
+}
+
+// Versions of the current driver's migrations missing from applied
+func migrationVersions(applied map[string]bool) ([]string, error) {
+	// ReadDir returns entries sorted by filename
+	entries, err := fs.ReadDir(migrationFiles, "migrations/"+dbDialect())
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []string{}
+	for _, entry := range entries {
+		if version := strings.TrimSuffix(entry.Name(), ".sql"); !applied[version] {
+			pending = append(pending, version)
+		}
+	}
+	return pending, nil
+}
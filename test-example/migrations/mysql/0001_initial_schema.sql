@@ -0,0 +1,29 @@
+-- Initial schema: users (MySQL)
+--
+-- ids are generated by the API. MySQL has no partial indexes, so email
+-- uniqueness among non-deleted users is enforced through a generated column
+-- that is NULL for deleted users.
+
+CREATE TABLE IF NOT EXISTS users (
+    id CHAR(36) NOT NULL PRIMARY KEY,
+    email VARCHAR(255) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    created_at DATETIME(6) NOT NULL,
+    updated_at DATETIME(6) NOT NULL,
+    deleted_at DATETIME(6) NULL,
+    avatar_updated_at DATETIME(6) NULL,
+    phone VARCHAR(16) NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'active',
+    role VARCHAR(20) NOT NULL DEFAULT 'member',
+    metadata JSON NOT NULL,
+    version BIGINT NOT NULL DEFAULT 1,
+    active_email VARCHAR(255) AS (IF(deleted_at IS NULL, email, NULL)) STORED,
+    CONSTRAINT users_status_check CHECK (status IN ('active', 'suspended', 'deactivated')),
+    CONSTRAINT users_role_check CHECK (role IN ('admin', 'member', 'viewer')),
+    UNIQUE KEY users_email_active_key (active_email),
+    KEY idx_users_email (email),
+    KEY idx_users_created_at (created_at),
+    KEY idx_users_phone (phone),
+    KEY idx_users_status (status),
+    KEY idx_users_role (role)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
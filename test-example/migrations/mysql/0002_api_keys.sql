@@ -0,0 +1,11 @@
+-- API keys: only the SHA-256 of a key is stored, plus its first characters
+-- to tell keys apart (MySQL)
+
+CREATE TABLE IF NOT EXISTS api_keys (
+    id CHAR(36) NOT NULL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    prefix VARCHAR(16) NOT NULL,
+    key_hash CHAR(64) NOT NULL,
+    created_at DATETIME(6) NOT NULL,
+    UNIQUE KEY api_keys_key_hash_key (key_hash)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
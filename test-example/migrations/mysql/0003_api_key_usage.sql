@@ -0,0 +1,7 @@
+-- When each API key was last used (updated in batches, so it can lag by a
+-- minute) and when it was revoked; revoked keys are kept for auditing
+-- (MySQL)
+
+ALTER TABLE api_keys
+    ADD COLUMN last_used_at DATETIME(6) NULL,
+    ADD COLUMN revoked_at DATETIME(6) NULL;
@@ -0,0 +1,14 @@
+-- Per-key rate limits and daily quotas, and the requests counted against
+-- the quotas per UTC day (MySQL)
+
+ALTER TABLE api_keys
+    ADD COLUMN rate_limit DOUBLE NULL,
+    ADD COLUMN daily_quota BIGINT NULL;
+
+CREATE TABLE IF NOT EXISTS api_key_daily_usage (
+    api_key_id CHAR(36) NOT NULL,
+    day DATE NOT NULL,
+    requests BIGINT NOT NULL,
+    PRIMARY KEY (api_key_id, day),
+    CONSTRAINT api_key_daily_usage_api_key_id_fkey FOREIGN KEY (api_key_id) REFERENCES api_keys (id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,15 @@
+-- Changes to users with who made them (MySQL)
+
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    occurred_at DATETIME(6) NOT NULL,
+    actor VARCHAR(255) NOT NULL,
+    action VARCHAR(20) NOT NULL,
+    user_id CHAR(36) NOT NULL,
+    changes JSON NOT NULL,
+    request_id VARCHAR(128) NOT NULL DEFAULT '',
+    PRIMARY KEY (id),
+    KEY idx_audit_log_user_id (user_id, id),
+    KEY idx_audit_log_actor (actor, id),
+    KEY idx_audit_log_occurred_at (occurred_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
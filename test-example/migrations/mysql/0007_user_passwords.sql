@@ -0,0 +1,6 @@
+-- Bcrypt password hashes for logging in, and when each was set; sessions
+-- issued before then are rejected (MySQL)
+
+ALTER TABLE users
+    ADD COLUMN password_hash VARCHAR(72) NULL,
+    ADD COLUMN password_changed_at DATETIME(6) NULL;
@@ -0,0 +1,16 @@
+-- Whether each user confirmed their email, and the single-use tokens mailed
+-- to confirm it; only a token's SHA-256 is stored. Users from before
+-- verification existed count as verified (MySQL)
+
+ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE users ALTER COLUMN email_verified SET DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS email_verification_tokens (
+    token_hash CHAR(64) NOT NULL,
+    user_id CHAR(36) NOT NULL,
+    expires_at DATETIME(6) NOT NULL,
+    created_at DATETIME(6) NOT NULL,
+    PRIMARY KEY (token_hash),
+    KEY idx_email_verification_tokens_user_id (user_id),
+    CONSTRAINT email_verification_tokens_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
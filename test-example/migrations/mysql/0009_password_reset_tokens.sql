@@ -0,0 +1,14 @@
+-- Single-use password reset tokens; only a token's SHA-256 is stored, and
+-- used ones are kept until they expire to tell reuse from a wrong token
+-- (MySQL)
+
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+    token_hash CHAR(64) NOT NULL,
+    user_id CHAR(36) NOT NULL,
+    expires_at DATETIME(6) NOT NULL,
+    created_at DATETIME(6) NOT NULL,
+    used_at DATETIME(6) NULL,
+    PRIMARY KEY (token_hash),
+    KEY idx_password_reset_tokens_user_id (user_id),
+    CONSTRAINT password_reset_tokens_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
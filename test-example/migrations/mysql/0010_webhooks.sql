@@ -0,0 +1,30 @@
+-- Webhooks and their deliveries; the secret is kept in plaintext, as it is
+-- needed to sign every delivery (MySQL)
+
+CREATE TABLE IF NOT EXISTS webhooks (
+    id CHAR(36) NOT NULL PRIMARY KEY,
+    url VARCHAR(2048) NOT NULL,
+    secret VARCHAR(255) NOT NULL,
+    -- Comma-separated; empty for every event
+    events VARCHAR(255) NOT NULL DEFAULT '',
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at DATETIME(6) NOT NULL,
+    updated_at DATETIME(6) NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id CHAR(36) NOT NULL,
+    webhook_id CHAR(36) NOT NULL,
+    event VARCHAR(50) NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    response_status INT NULL,
+    error TEXT NOT NULL,
+    payload MEDIUMTEXT NOT NULL,
+    created_at DATETIME(6) NOT NULL,
+    last_attempt_at DATETIME(6) NULL,
+    next_attempt_at DATETIME(6) NULL,
+    PRIMARY KEY (id),
+    KEY idx_webhook_deliveries_webhook_id (webhook_id, created_at),
+    CONSTRAINT webhook_deliveries_webhook_id_fkey FOREIGN KEY (webhook_id) REFERENCES webhooks (id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,19 @@
+-- Events of committed changes to users, written in the same transaction and
+-- relayed to webhooks by the outbox dispatcher (MySQL)
+
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    event VARCHAR(50) NOT NULL,
+    user_id CHAR(36) NOT NULL,
+    payload MEDIUMTEXT NOT NULL,
+    occurred_at DATETIME(6) NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL,
+    next_attempt_at DATETIME(6) NOT NULL,
+    delivered_at DATETIME(6) NULL,
+    PRIMARY KEY (id),
+    -- No partial indexes; undelivered rows are the NULL ones
+    KEY idx_outbox_delivered_at (delivered_at, id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE INDEX idx_webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at);
@@ -0,0 +1,78 @@
+-- Initial schema: users, avatars and idempotency keys (Postgres)
+
+-- Enable UUID extension
+CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+
+-- Enable trigram matching for /api/users/search
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+-- Users table
+CREATE TABLE IF NOT EXISTS users (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    email VARCHAR(255) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW(),
+    updated_at TIMESTAMP DEFAULT NOW(),
+    deleted_at TIMESTAMP
+);
+
+-- Soft delete (for databases created before deleted_at existed)
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+
+-- Emails are unique among non-deleted users only, so a deleted user's email
+-- can be reused when ALLOW_DELETED_EMAIL_REUSE is enabled
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_email_key;
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_active_key ON users(email) WHERE deleted_at IS NULL;
+
+-- Avatars: the image lives in user_avatars, users.avatar_updated_at marks
+-- that one exists and versions its URL
+ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar_updated_at TIMESTAMP;
+
+-- Phone number in E.164 format (nullable)
+ALTER TABLE users ADD COLUMN IF NOT EXISTS phone VARCHAR(16);
+CREATE INDEX IF NOT EXISTS idx_users_phone ON users(phone);
+
+-- Account status; changed only through the suspend/activate/deactivate endpoints
+ALTER TABLE users ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'active'
+    CHECK (status IN ('active', 'suspended', 'deactivated'));
+CREATE INDEX IF NOT EXISTS idx_users_status ON users(status);
+
+-- Role used for authorization
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'member'
+    CHECK (role IN ('admin', 'member', 'viewer'));
+CREATE INDEX IF NOT EXISTS idx_users_role ON users(role);
+
+-- Arbitrary client key/value data, capped at 8KB serialized
+ALTER TABLE users ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}'::jsonb;
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_metadata_size;
+ALTER TABLE users ADD CONSTRAINT users_metadata_size CHECK (jsonb_typeof(metadata) = 'object' AND octet_length(metadata::text) <= 8192);
+CREATE INDEX IF NOT EXISTS idx_users_metadata ON users USING gin (metadata);
+
+-- Row version for optimistic concurrency (ETag / If-Match); every write
+-- increments it
+ALTER TABLE users ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+
+CREATE TABLE IF NOT EXISTS user_avatars (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    content_type VARCHAR(50) NOT NULL,
+    data BYTEA NOT NULL,
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- Create indexes for performance
+CREATE INDEX IF NOT EXISTS idx_users_email ON users(email);
+CREATE INDEX IF NOT EXISTS idx_users_created_at ON users(created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_users_name_trgm ON users USING gin (name gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_users_email_trgm ON users USING gin (email gin_trgm_ops);
+
+-- Stored responses for Idempotency-Key replay
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key VARCHAR(255) PRIMARY KEY,
+    request_hash CHAR(64) NOT NULL,
+    status_code INTEGER,
+    response_headers JSONB,
+    response_body BYTEA,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
@@ -0,0 +1,6 @@
+-- Role of each API key, mapped to scopes by ROLE_SCOPES (Postgres)
+
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS role VARCHAR(50) NOT NULL DEFAULT 'member';
+
+-- Keys created before roles keep the full access they had
+UPDATE api_keys SET role = 'admin';
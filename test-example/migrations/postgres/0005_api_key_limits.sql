@@ -0,0 +1,12 @@
+-- Per-key rate limits and daily quotas, and the requests counted against
+-- the quotas per UTC day (Postgres)
+
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS rate_limit DOUBLE PRECISION;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS daily_quota BIGINT;
+
+CREATE TABLE IF NOT EXISTS api_key_daily_usage (
+    api_key_id UUID NOT NULL REFERENCES api_keys(id),
+    day DATE NOT NULL,
+    requests BIGINT NOT NULL,
+    PRIMARY KEY (api_key_id, day)
+);
@@ -0,0 +1,18 @@
+-- Changes to users with who made them (Postgres)
+
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    occurred_at TIMESTAMP NOT NULL,
+    -- "api_key:<id>", "jwt:<subject>" or "system"
+    actor VARCHAR(255) NOT NULL,
+    action VARCHAR(20) NOT NULL,
+    -- No foreign key: entries outlive the users they describe
+    user_id UUID NOT NULL,
+    -- Changed fields' old and new values
+    changes JSONB NOT NULL,
+    request_id VARCHAR(128) NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_user_id ON audit_log(user_id, id);
+CREATE INDEX IF NOT EXISTS idx_audit_log_actor ON audit_log(actor, id);
+CREATE INDEX IF NOT EXISTS idx_audit_log_occurred_at ON audit_log(occurred_at);
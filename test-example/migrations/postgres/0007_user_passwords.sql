@@ -0,0 +1,5 @@
+-- Bcrypt password hashes for logging in, and when each was set; sessions
+-- issued before then are rejected (Postgres)
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_hash VARCHAR(72);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_changed_at TIMESTAMP;
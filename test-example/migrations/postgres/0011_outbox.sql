@@ -0,0 +1,24 @@
+-- Events of committed changes to users, written in the same transaction and
+-- relayed to webhooks by the outbox dispatcher (Postgres)
+
+CREATE TABLE IF NOT EXISTS outbox (
+    -- Increasing, so events are relayed in the order they were written
+    id BIGSERIAL PRIMARY KEY,
+    event VARCHAR(50) NOT NULL,
+    user_id UUID NOT NULL,
+    -- The event as sent to webhooks
+    payload TEXT NOT NULL,
+    occurred_at TIMESTAMP NOT NULL,
+    -- Failed relays, and the last one's error
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMP NOT NULL,
+    -- Set once relayed; such rows are deleted after OUTBOX_RETENTION
+    delivered_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_outbox_pending ON outbox(id) WHERE delivered_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_outbox_delivered_at ON outbox(delivered_at);
+
+-- Deliveries are now found by when they are due
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at);
@@ -0,0 +1,10 @@
+-- API keys: only the SHA-256 of a key is stored, plus its first characters
+-- to tell keys apart (SQLite)
+
+CREATE TABLE IF NOT EXISTS api_keys (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    prefix TEXT NOT NULL,
+    key_hash TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL
+);
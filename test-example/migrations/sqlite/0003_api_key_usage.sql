@@ -0,0 +1,6 @@
+-- When each API key was last used (updated in batches, so it can lag by a
+-- minute) and when it was revoked; revoked keys are kept for auditing
+-- (SQLite)
+
+ALTER TABLE api_keys ADD COLUMN last_used_at TIMESTAMP;
+ALTER TABLE api_keys ADD COLUMN revoked_at TIMESTAMP;
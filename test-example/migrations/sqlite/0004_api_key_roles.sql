@@ -0,0 +1,6 @@
+-- Role of each API key, mapped to scopes by ROLE_SCOPES (SQLite)
+
+ALTER TABLE api_keys ADD COLUMN role TEXT NOT NULL DEFAULT 'member';
+
+-- Keys created before roles keep the full access they had
+UPDATE api_keys SET role = 'admin';
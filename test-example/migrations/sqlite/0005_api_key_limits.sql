@@ -0,0 +1,12 @@
+-- Per-key rate limits and daily quotas, and the requests counted against
+-- the quotas per UTC day (SQLite)
+
+ALTER TABLE api_keys ADD COLUMN rate_limit REAL;
+ALTER TABLE api_keys ADD COLUMN daily_quota INTEGER;
+
+CREATE TABLE IF NOT EXISTS api_key_daily_usage (
+    api_key_id TEXT NOT NULL REFERENCES api_keys(id),
+    day TEXT NOT NULL,
+    requests INTEGER NOT NULL,
+    PRIMARY KEY (api_key_id, day)
+);
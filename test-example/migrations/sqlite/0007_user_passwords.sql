@@ -0,0 +1,5 @@
+-- Bcrypt password hashes for logging in, and when each was set; sessions
+-- issued before then are rejected (SQLite)
+
+ALTER TABLE users ADD COLUMN password_hash TEXT;
+ALTER TABLE users ADD COLUMN password_changed_at TIMESTAMP;
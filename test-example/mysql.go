@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Column expressions that differ from the Postgres ones in userFields. The
+// MySQL schema never had NULL names or update times to paper over, and
+// avatars are Postgres-only, so there is never an avatar URL.
+var mysqlColumnOverrides = map[string]string{
+	"name":       "name",
+	"updated_at": "updated_at",
+	"avatar_url": "NULL",
+}
+
+// Comma-separated MySQL column list for the given fields
+func mysqlSelectColumns(fields []userField) string {
+	columns := make([]string, len(fields))
+	for i, f := range fields {
+		columns[i] = f.column
+		if column, ok := mysqlColumnOverrides[f.name]; ok {
+			columns[i] = column
+		}
+	}
+	return strings.Join(columns, ", ")
+}
+
+var placeholderRegex = regexp.MustCompile(`\$(\d+)`)
+
+// Rewrite $n placeholders to MySQL's positional ?, reordering (and repeating)
+// the arguments to match, so queries can be built with whereBuilder
+func rebindMySQL(query string, args []interface{}) (string, []interface{}) {
+	bound := []interface{}{}
+	query = placeholderRegex.ReplaceAllStringFunc(query, func(p string) string {
+		n, _ := strconv.Atoi(p[1:])
+		bound = append(bound, args[n-1])
+		return "?"
+	})
+	return query, bound
+}
+
+// Check a MySQL DSN and force the options the repository relies on:
+// DATETIME columns scanned as time.Time, in UTC
+func normalizeMySQLDSN(dsn string) (string, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+	if cfg.DBName == "" {
+		return "", fmt.Errorf("no database name")
+	}
+	cfg.ParseTime = true
+	cfg.Loc = time.UTC
+	return cfg.FormatDSN(), nil
+}
+
+// Split a migration script into statements, since the driver runs one
+// statement per call. Statements end with a semicolon at the end of a line.
+func splitStatements(script string) []string {
+	statements := []string{}
+	current := []string{}
+	for _, line := range strings.Split(script, "\n") {
+		current = append(current, line)
+		if strings.HasSuffix(strings.TrimSpace(line), ";") {
+			statements = append(statements, strings.Join(current, "\n"))
+			current = nil
+		}
+	}
+	if rest := strings.TrimSpace(strings.Join(current, "\n")); rest != "" && !isSQLComment(rest) {
+		statements = append(statements, rest)
+	}
+	return statements
+}
+
+// Whether every line of s is a -- comment or blank
+func isSQLComment(s string) bool {
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "--") {
+			return false
+		}
+	}
+	return true
+}
+
+// Stores users in MySQL 8 (DB_DRIVER=mysql). Queries are written with $n
+// placeholders like the other backends and rewritten by rebindMySQL.
+type mysqlUserRepository struct {
+	db *sql.DB
+	// Deleted users keep their email reserved (the opposite of
+	// ALLOW_DELETED_EMAIL_REUSE)
+	reserveDeletedEmails bool
+	// Set on the repository passed to a WithTx function
+	tx *sql.Tx
+}
+
+// The transaction when there is one, otherwise the pool
+func (r *mysqlUserRepository) conn() dbtx {
+	if r.tx != nil {
+		return r.tx
+	}
+	return r.db
+}
+
+// MySQL equivalent of userFilter.apply. The default utf8mb4 collation makes
+// LIKE case-insensitive, and || means OR, hence CONCAT.
+func (r *mysqlUserRepository) applyFilter(f userFilter, w *whereBuilder) {
+	if !f.IncludeDeleted {
+		w.add("deleted_at IS NULL")
+	}
+	if f.Name != "" {
+		w.add(fmt.Sprintf("name LIKE CONCAT('%%', %s, '%%')", w.arg(escapeLike(f.Name))))
+	}
+	if f.Domain != "" {
+		w.add(fmt.Sprintf("email LIKE CONCAT('%%@', %s)", w.arg(escapeLike(f.Domain))))
+	}
+	if f.CreatedAfter != nil {
+		w.add("created_at >= " + w.arg(f.CreatedAfter.UTC()))
+	}
+	if f.CreatedBefore != nil {
+		w.add("created_at < " + w.arg(f.CreatedBefore.UTC()))
+	}
+	if f.UpdatedSince != nil {
+		w.add("COALESCE(updated_at, created_at) >= " + w.arg(f.UpdatedSince.UTC()))
+	}
+	if f.Phone != "" {
+		w.add("phone = " + w.arg(f.Phone))
+	}
+	if f.Status != "" {
+		w.add("status = " + w.arg(f.Status))
+	}
+	if f.Role != "" {
+		w.add("role = " + w.arg(f.Role))
+	}
+	if f.Verified != nil {
+		w.add("email_verified = " + w.arg(*f.Verified))
+	}
+	if len(f.Metadata) > 0 {
+		w.add(fmt.Sprintf("JSON_CONTAINS(metadata, CAST(%s AS JSON))", w.arg(f.Metadata)))
+	}
+	if f.IDs != nil {
+		placeholders := make([]string, len(f.IDs))
+		for i, id := range f.IDs {
+			placeholders[i] = w.arg(id)
+		}
+		w.add("id IN (" + strings.Join(placeholders, ", ") + ")")
+	}
+}
+
+// A *sql.DB or *sql.Tx
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// QueryRowContext with $n placeholders
+func (r *mysqlUserRepository) queryRow(ctx context.Context, q rowQuerier, query string, args ...interface{}) *sql.Row {
+	query, args = rebindMySQL(query, args)
+	return q.QueryRowContext(ctx, query, args...)
+}
+
+func (r *mysqlUserRepository) List(ctx context.Context, q userListQuery) ([]User, error) {
+	return collectUsers(r.selectUsers(ctx, q, true))
+}
+
+func (r *mysqlUserRepository) Each(ctx context.Context, q userListQuery, fn func(User) error) error {
+	rows, fields, err := r.selectUsers(ctx, q, false)
+	if err != nil {
+		return err
+	}
+	return scanUsers(rows, fields, fn)
+}
+
+func (r *mysqlUserRepository) selectUsers(ctx context.Context, q userListQuery, paged bool) (*sql.Rows, []userField, error) {
+	fields := q.Fields
+	if fields == nil {
+		fields = userFields
+	}
+
+	where := &whereBuilder{}
+	r.applyFilter(q.Filter, where)
+	if q.After != nil {
+		where.add(fmt.Sprintf("(created_at, id) < (%s, %s)", where.arg(q.After.CreatedAt.UTC()), where.arg(q.After.ID)))
+	}
+
+	query := "SELECT " + mysqlSelectColumns(fields) + " FROM users" + where.sql() + " ORDER BY " + buildOrderBy(q.Sort)
+	if paged {
+		query += fmt.Sprintf(" LIMIT %s OFFSET %s", where.arg(q.Limit), where.arg(q.Offset))
+	}
+
+	query, args := rebindMySQL(query, where.args)
+	rows, err := r.conn().QueryContext(ctx, query, args...)
+	return rows, fields, err
+}
+
+func (r *mysqlUserRepository) Count(ctx context.Context, filter userFilter) (int64, error) {
+	where := &whereBuilder{}
+	r.applyFilter(filter, where)
+
+	var total int64
+	err := r.queryRow(ctx, r.conn(), "SELECT count(*) FROM users"+where.sql(), where.args...).Scan(&total)
+	return total, err
+}
+
+func (r *mysqlUserRepository) GetByID(ctx context.Context, id string, fields []userField, includeDeleted bool) (User, error) {
+	if fields == nil {
+		fields = userFields
+	}
+
+	query := "SELECT " + mysqlSelectColumns(fields) + " FROM users WHERE id = $1"
+	if !includeDeleted {
+		query += " AND deleted_at IS NULL"
+	}
+
+	var user User
+	err := r.queryRow(ctx, r.conn(), query, strings.ToLower(id)).Scan(scanDest(&user, fields)...)
+	if err == sql.ErrNoRows {
+		return User{}, errUserNotFound
+	}
+	return user, err
+}
+
+func (r *mysqlUserRepository) GetByEmail(ctx context.Context, email string) (User, error) {
+	var user User
+	err := r.queryRow(ctx, r.conn(), "SELECT "+mysqlSelectColumns(userFields)+" FROM users WHERE email = $1 AND deleted_at IS NULL", email).
+		Scan(scanDest(&user, userFields)...)
+	if err == sql.ErrNoRows {
+		return User{}, errUserNotFound
+	}
+	return user, err
+}
+
+func (r *mysqlUserRepository) Create(ctx context.Context, u User) (User, error) {
+	if r.reserveDeletedEmails {
+		var reserved bool
+		err := r.queryRow(ctx, r.conn(), "SELECT EXISTS(SELECT 1 FROM users WHERE email = $1 AND deleted_at IS NOT NULL)", u.Email).Scan(&reserved)
+		if err != nil {
+			return User{}, err
+		}
+		if reserved {
+			return User{}, errEmailTaken
+		}
+	}
+
+	// There is no RETURNING, so the id is generated here and the row read
+	// back by it
+	id := newUUID()
+	now := time.Now().UTC()
+	query, args := rebindMySQL(
+		"INSERT INTO users (id, email, name, phone, role, metadata, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $7)",
+		[]interface{}{id, u.Email, u.Name, u.Phone, u.Role, u.Metadata, now},
+	)
+	if _, err := r.conn().ExecContext(ctx, query, args...); err != nil {
+		if isUniqueViolation(err) {
+			return User{}, errEmailTaken
+		}
+		return User{}, err
+	}
+
+	return r.GetByID(ctx, id, nil, false)
+}
+
+// Metadata is merged in Go, like the SQLite repository, because JSON_MERGE_PATCH
+// merges nested objects recursively where the Postgres || operator replaces them
+func (r *mysqlUserRepository) Update(ctx context.Context, id string, patch userPatch, versions []int64) (User, error) {
+	var user User
+	err := inTx(ctx, r.db, r.tx, func(tx *sql.Tx) error {
+		var err error
+		user, err = r.update(ctx, tx, id, patch, versions)
+		return err
+	})
+	return user, err
+}
+
+func (r *mysqlUserRepository) update(ctx context.Context, tx *sql.Tx, id string, patch userPatch, versions []int64) (User, error) {
+	id = strings.ToLower(id)
+
+	var version int64
+	var metadata Metadata
+	err := r.queryRow(ctx, tx, "SELECT version, metadata FROM users WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", id).
+		Scan(&version, &metadata)
+	if err == sql.ErrNoRows {
+		return User{}, errUserNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if versions != nil && !containsVersion(versions, version) {
+		return User{}, errVersionMismatch
+	}
+
+	s := &setBuilder{}
+	if err := patch.setColumnsMerged(s, metadata); err != nil {
+		return User{}, err
+	}
+	s.set("updated_at", time.Now().UTC())
+	s.setExpr("version", "version + 1")
+	s.add("id = " + s.arg(id))
+
+	query, err := s.update("users")
+	if err != nil {
+		return User{}, err
+	}
+	query, args := rebindMySQL(query, s.args)
+
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		if isUniqueViolation(err) {
+			return User{}, errEmailTaken
+		}
+		return User{}, err
+	}
+	// No RETURNING either; the row is still locked, so this reads what was written
+	var user User
+	err = r.queryRow(ctx, tx, "SELECT "+mysqlSelectColumns(userFields)+" FROM users WHERE id = $1", id).
+		Scan(scanDest(&user, userFields)...)
+	return user, err
+}
+
+func (r *mysqlUserRepository) Delete(ctx context.Context, id string) error {
+	query, args := rebindMySQL(
+		"UPDATE users SET deleted_at = $1, updated_at = $1, version = version + 1 WHERE id = $2 AND deleted_at IS NULL",
+		[]interface{}{time.Now().UTC(), strings.ToLower(id)},
+	)
+	result, err := r.conn().ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func (r *mysqlUserRepository) RecordAudit(ctx context.Context, entries ...auditEntry) error {
+	return insertAuditEntries(ctx, r.conn(), entries...)
+}
+
+func (r *mysqlUserRepository) CountAudit(ctx context.Context, q auditQuery) (int64, error) {
+	return countAuditEntries(ctx, r.conn(), q)
+}
+
+func (r *mysqlUserRepository) ListAudit(ctx context.Context, q auditQuery) ([]auditEntry, error) {
+	return listAuditEntries(ctx, r.conn(), q)
+}
+
+func (r *mysqlUserRepository) GetCredentials(ctx context.Context, id string) (userCredentials, error) {
+	return queryCredentials(ctx, r.conn(), "id", strings.ToLower(id))
+}
+
+func (r *mysqlUserRepository) GetCredentialsByEmail(ctx context.Context, email string) (userCredentials, error) {
+	return queryCredentials(ctx, r.conn(), "email", email)
+}
+
+func (r *mysqlUserRepository) SetPasswordHash(ctx context.Context, id, hash string) error {
+	return storePasswordHash(ctx, r.conn(), id, hash)
+}
+
+func (r *mysqlUserRepository) StoreVerificationToken(ctx context.Context, userID, hash string, expires time.Time) error {
+	return storeVerificationToken(ctx, r.conn(), userID, hash, expires)
+}
+
+func (r *mysqlUserRepository) TakeVerificationToken(ctx context.Context, hash string) (string, error) {
+	return takeVerificationToken(ctx, r.conn(), hash)
+}
+
+func (r *mysqlUserRepository) StorePasswordResetToken(ctx context.Context, userID, hash string, expires time.Time) error {
+	return storePasswordResetToken(ctx, r.conn(), userID, hash, expires)
+}
+
+func (r *mysqlUserRepository) TakePasswordResetToken(ctx context.Context, hash string) (string, error) {
+	return takePasswordResetToken(ctx, r.conn(), hash)
+}
+
+func (r *mysqlUserRepository) WithTx(ctx context.Context, fn func(tx UserRepository) error) error {
+	return inTx(ctx, r.db, r.tx, func(tx *sql.Tx) error {
+		txRepo := *r
+		txRepo.tx = tx
+		return fn(&txRepo)
+	})
+}
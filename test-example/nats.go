@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// A small NATS client for publishing events: one connection, the text
+// protocol, and a PING after each message so a publish only succeeds once
+// the server has taken it. Core NATS only; subjects bound to a JetStream
+// stream are stored by the server as usual.
+
+type natsPublisher struct {
+	// host:port of each server, tried in turn
+	servers []string
+	// <prefix>.<event>, e.g. user-events.user.created
+	prefix   string
+	username string
+	password string
+	tls      *tls.Config
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+	next int
+}
+
+// The server's greeting; only what the client needs
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+}
+
+// A publisher for nats://host[:port] (or tls://) servers. A password without
+// a username is sent as a token.
+func newNATSPublisher(servers []string, prefix, username, password string, tlsConfig *tls.Config) (*natsPublisher, error) {
+	p := &natsPublisher{prefix: prefix, username: username, password: password, tls: tlsConfig}
+	for _, server := range servers {
+		u, err := url.Parse(server)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "nats" && u.Scheme != "tls" {
+			return nil, fmt.Errorf("%q is not a nats:// or tls:// URL", server)
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("%q has no host", server)
+		}
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "4222")
+		}
+		if u.Scheme == "tls" && p.tls == nil {
+			p.tls = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		p.servers = append(p.servers, addr)
+	}
+	return p, nil
+}
+
+func (p *natsPublisher) Publish(ctx context.Context, msg eventMessage) error {
+	payload, err := msg.encode()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+	defer cancel()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		if err := p.connect(ctx); err != nil {
+			return fmt.Errorf("nats: %w", err)
+		}
+	}
+	deadline, _ := ctx.Deadline()
+	p.conn.SetDeadline(deadline)
+
+	subject := p.prefix + "." + msg.Event
+	_, err = fmt.Fprintf(p.conn, "PUB %s %d\r\n%s\r\nPING\r\n", subject, len(payload), payload)
+	if err == nil {
+		err = p.awaitPong()
+	}
+	if err != nil {
+		p.closeConn()
+		return fmt.Errorf("nats: %w", err)
+	}
+	return nil
+}
+
+func (p *natsPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closeConn()
+	return nil
+}
+
+func (p *natsPublisher) closeConn() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+// Connect to the next server that answers, upgrading to TLS when either side
+// asks for it, and log in
+func (p *natsPublisher) connect(ctx context.Context) error {
+	var err error
+	for range p.servers {
+		addr := p.servers[p.next]
+		p.next = (p.next + 1) % len(p.servers)
+		if err = p.dial(ctx, addr); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (p *natsPublisher) dial(ctx context.Context, addr string) error {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	r := bufio.NewReader(conn)
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	var info natsInfo
+	if !strings.HasPrefix(line, "INFO ") || json.Unmarshal([]byte(line[5:]), &info) != nil {
+		conn.Close()
+		return errors.New("no INFO from server")
+	}
+	if info.TLSRequired && p.tls == nil {
+		conn.Close()
+		return errors.New("server requires TLS; set EVENT_TLS")
+	}
+	if p.tls != nil {
+		host, _, _ := net.SplitHostPort(addr)
+		tlsConn := tls.Client(conn, tlsFor(p.tls, host))
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tlsConn
+		r = bufio.NewReader(conn)
+	}
+
+	connect := map[string]interface{}{
+		"verbose": false, "pedantic": false, "tls_required": p.tls != nil,
+		"name": "sample-api", "lang": "go", "version": "1.0", "protocol": 1,
+	}
+	if p.username != "" {
+		connect["user"] = p.username
+		connect["pass"] = p.password
+	} else if p.password != "" {
+		connect["auth_token"] = p.password
+	}
+	options, _ := json.Marshal(connect)
+	p.conn, p.r = conn, r
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", options); err != nil {
+		p.closeConn()
+		return err
+	}
+	if err := p.awaitPong(); err != nil {
+		p.closeConn()
+		return err
+	}
+	return nil
+}
+
+// Read until the server answers our PING, answering its own; an -ERR before
+// that fails the message or the login
+func (p *natsPublisher) awaitPong() error {
+	for {
+		line, err := p.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := p.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New(strings.Trim(strings.TrimSpace(line[4:]), "'"))
+		// +OK, INFO updates
+		default:
+		}
+	}
+}
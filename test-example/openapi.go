@@ -0,0 +1,978 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OpenAPI: the document at /openapi.json is built when the router is, from
+// the routes it registered, the operations below and the Go types the
+// handlers bind and answer with, so a field added to a type shows up without
+// touching this file. A route without an operation here stops the server
+// from starting.
+
+// An OpenAPI object, marshaled as is
+type openAPIObject = map[string]interface{}
+
+// A parameter of an operation; path parameters come from the route
+type apiParam struct {
+	Name string
+	// "query" or "header"
+	In          string
+	Description string
+	// A value of the parameter's type
+	Type     interface{}
+	Required bool
+}
+
+// One route as documented
+type apiOperation struct {
+	// operationId; the handler's name when empty
+	ID      string
+	Summary string
+	// Scope the caller needs; "" for routes without /api authentication
+	Scope string
+	// Authenticated like /api routes without needing one scope, for
+	// /graphql, whose fields check their own
+	Authenticated bool
+	// Authenticated with ADMIN_TOKEN
+	Admin bool
+	// Answers not_implemented unless DB_DRIVER is postgres or pgx
+	Postgres bool
+	Params   []apiParam
+	// A value of the request body's type; nil without a body
+	Body interface{}
+	// Media type of Body when it isn't JSON
+	BodyType     string
+	BodyOptional bool
+	// Success statuses; 200 when empty
+	Statuses []int
+	// A value of the response body's type; nil without a body
+	Response interface{}
+	// Media type of Response when it isn't JSON
+	ResponseType string
+	// Other media types Accept can ask for: XML has Response's schema, CSV
+	// is text
+	Formats []string
+	// Response headers, from apiHeaders
+	Headers []string
+	// Error codes besides those every route of its kind can answer with
+	Errors []string
+}
+
+// A JSON object the handler builds with gin.H: its keys and a value of the
+// type of each
+type jsonObject map[string]interface{}
+
+// A key of a jsonObject that is not always present
+type jsonOptional struct{ value interface{} }
+
+// A body that is one of several shapes
+type jsonOneOf []interface{}
+
+var messageBody = jsonObject{"message": ""}
+
+// data is absent when the document didn't run, errors when nothing failed
+var graphQLResponseBody = jsonObject{"data": jsonOptional{json.RawMessage(nil)}, "errors": jsonOptional{[]gqlError{}}}
+
+// Response headers operations refer to by name
+var apiHeaders = map[string]string{
+	"X-Total-Count":       "Number of items matching the filters, ignoring pagination",
+	"X-Next-Cursor":       "next_cursor of a CSV response in cursor mode",
+	"ETag":                "Version of the user, for If-None-Match and If-Match",
+	"Location":            "URL of the created resource",
+	"Idempotent-Replayed": "true when the response is a replay of an earlier request with the same Idempotency-Key",
+}
+
+var paginationParams = []apiParam{
+	{Name: "limit", In: "query", Type: 0, Description: fmt.Sprintf("Page size, 1 to %d (default %d)", maxPageLimit, defaultPageLimit)},
+	{Name: "offset", In: "query", Type: 0, Description: "Items to skip"},
+}
+
+var userFilterParams = []apiParam{
+	{Name: "name", In: "query", Type: "", Description: "Substring of the name, case-insensitive"},
+	{Name: "domain", In: "query", Type: "", Description: "Email domain"},
+	{Name: "created_after", In: "query", Type: "", Description: "RFC 3339 timestamp or YYYY-MM-DD, inclusive"},
+	{Name: "created_before", In: "query", Type: "", Description: "RFC 3339 timestamp or YYYY-MM-DD, exclusive"},
+	{Name: "include_deleted", In: "query", Type: false, Description: "Include soft-deleted users"},
+	{Name: "status", In: "query", Type: "", Description: "One of: " + strings.Join(userStatuses, ", ")},
+	{Name: "role", In: "query", Type: "", Description: "One of: " + strings.Join(userRoles, ", ")},
+	{Name: "verified", In: "query", Type: false, Description: "Whether the email is verified"},
+	{Name: "phone", In: "query", Type: "", Description: "Phone number, normalized before matching"},
+}
+
+var fieldsParam = apiParam{Name: "fields", In: "query", Type: "", Description: "Comma-separated user fields to return; every field by default"}
+
+// Every route, keyed by method and gin path
+var apiOperations = map[string]apiOperation{
+	"GET /openapi.json": {Summary: "This document", Response: openAPIObject{}},
+	"GET /docs/*file": {
+		Summary:      "API explorer; the page without a file",
+		Response:     "",
+		ResponseType: "text/html",
+		Errors:       []string{codeRouteNotFound},
+	},
+	"GET /graphql": {
+		ID:      "getGraphQL",
+		Summary: "Run a GraphQL query; mutations need POST",
+		Params: []apiParam{
+			{Name: "query", In: "query", Type: "", Required: true, Description: "The GraphQL document"},
+			{Name: "operationName", In: "query", Type: "", Description: "The operation to run when the document has several"},
+			{Name: "variables", In: "query", Type: "", Description: "A JSON object"},
+		},
+		Authenticated: true,
+		Statuses:      []int{http.StatusOK, http.StatusBadRequest, http.StatusMethodNotAllowed},
+		Response:      graphQLResponseBody,
+	},
+	"POST /graphql": {
+		ID:            "postGraphQL",
+		Summary:       "Run a GraphQL query or mutation",
+		Authenticated: true,
+		Body:          graphQLRequest{},
+		Statuses:      []int{http.StatusOK, http.StatusBadRequest},
+		Response:      graphQLResponseBody,
+	},
+	"GET /graphql/playground/*file": {
+		Summary:      "GraphQL playground; the page without a file, the schema for schema.graphql",
+		Response:     "",
+		ResponseType: "text/html",
+		Errors:       []string{codeRouteNotFound},
+	},
+	"GET /health": {
+		Summary: "Health check; 503 when the database is down",
+		Params: []apiParam{
+			{Name: "live", In: "query", Type: false, Description: "Skip the dependency checks"},
+			{Name: "verbose", In: "query", Type: false, Description: "Add connection pool statistics"},
+		},
+		Statuses: []int{http.StatusOK, http.StatusServiceUnavailable},
+		Response: jsonObject{
+			"status": "", "message": "", "maintenance": (*maintenanceState)(nil),
+			"checks":   jsonOptional{map[string]dependencyStatus{}},
+			"db_pool":  jsonOptional{map[string]interface{}{}},
+			"replica":  jsonOptional{map[string]interface{}{}},
+			"pgx_pool": jsonOptional{map[string]interface{}{}},
+		},
+		Errors: []string{codeInvalidRequest},
+	},
+	"POST /api/v1/auth/login": {
+		Summary:  "Exchange an email and password for a session token",
+		Body:     loginInput{},
+		Response: jsonObject{"token": "", "token_type": "", "expires_at": time.Time{}, "user_id": ""},
+		Errors:   []string{codeInvalidCredentials, codeAccountLocked, codeForbidden, codeNotImplemented},
+	},
+	"POST /api/v1/auth/password-reset": {
+		Summary:  "Mail a password reset token; answered the same whether the email is known or not",
+		Body:     passwordResetInput{},
+		Statuses: []int{http.StatusAccepted},
+		Errors:   []string{codeValidationFailed, codeNotImplemented},
+	},
+	"POST /api/v1/auth/password-reset/confirm": {
+		Summary:  "Set a new password with a reset token",
+		Body:     passwordResetConfirmInput{},
+		Statuses: []int{http.StatusNoContent},
+		Errors:   []string{codeValidationFailed, codeInvalidToken, codeTokenExpired, codeTokenUsed, codeNotImplemented},
+	},
+	"GET /api/v1/verify": {
+		Summary:  "Verify an email with the token mailed to it",
+		Params:   []apiParam{{Name: "token", In: "query", Type: "", Required: true}},
+		Response: jsonObject{"user_id": "", "email_verified": true},
+		Errors:   []string{codeInvalidRequest, codeInvalidToken},
+	},
+
+	"GET /api/v1/users": {
+		Summary: "List users, by page (offset or cursor) or by id",
+		Scope:   scopeUsersRead,
+		Params: append(append([]apiParam{
+			{Name: "ids", In: "query", Type: "", Description: "Comma-separated ids; answers {items, not_found} and ignores the other parameters (Postgres only)"},
+			{Name: "cursor", In: "query", Type: "", Description: "Keyset pagination: empty for the first page, then next_cursor; answers {items, next_cursor}"},
+			{Name: "sort", In: "query", Type: "", Description: "Comma-separated fields, - prefix for descending; not with cursor"},
+			fieldsParam,
+			{Name: "count", In: "query", Type: true, Description: "Set X-Total-Count (default true)"},
+		}, paginationParams...), userFilterParams...),
+		Response: jsonOneOf{[]User{}, jsonObject{"items": []User{}, "next_cursor": (*string)(nil)}, jsonObject{"items": []User{}, "not_found": []string{}}},
+		Formats:  userMediaTypes[1:],
+		Headers:  []string{"X-Total-Count", "X-Next-Cursor"},
+		Errors:   []string{codeInvalidRequest, codeNotImplemented, codeNotAcceptable},
+	},
+	"GET /api/v1/users/search": {
+		Summary:  "Search users by name and email, best match first",
+		Scope:    scopeUsersRead,
+		Postgres: true,
+		Params: []apiParam{
+			{Name: "q", In: "query", Type: "", Required: true, Description: "At least 2 characters"},
+			{Name: "limit", In: "query", Type: 0, Description: "At most this many results"},
+		},
+		Response: []userSearchResult{},
+		Errors:   []string{codeInvalidRequest},
+	},
+	"GET /api/v1/users/events": {
+		Summary: "Stream user events as Server-Sent Events",
+		Scope:   scopeUsersRead,
+		Params: []apiParam{
+			{Name: "Last-Event-ID", In: "header", Type: "", Description: "Replay the events after this one"},
+			{Name: "last_event_id", In: "query", Type: "", Description: "Last-Event-ID for clients that can't set headers"},
+		},
+		Response:     "",
+		ResponseType: "text/event-stream",
+		Errors:       []string{codeInvalidRequest},
+	},
+	"GET /api/v1/users/export": {
+		Summary: "Export users as newline-delimited JSON, a user per line",
+		Scope:   scopeUsersRead,
+		Params: append([]apiParam{
+			{Name: "since", In: "query", Type: "", Description: "Only users updated or deleted at or after this RFC 3339 timestamp or YYYY-MM-DD date"},
+			fieldsParam,
+		}, userFilterParams...),
+		Response:     User{},
+		ResponseType: mediaNDJSON,
+		Errors:       []string{codeInvalidRequest},
+	},
+	"GET /api/v1/users/count": {
+		Summary:  "Count users matching the filters",
+		Scope:    scopeUsersRead,
+		Params:   userFilterParams,
+		Response: jsonObject{"count": int64(0)},
+		Errors:   []string{codeInvalidRequest},
+	},
+	"GET /api/v1/users/stats": {
+		Summary:  "Signup statistics, with a per-day series",
+		Scope:    scopeUsersRead,
+		Postgres: true,
+		Params: []apiParam{
+			{Name: "from", In: "query", Type: "", Description: "YYYY-MM-DD; 30 days before to by default"},
+			{Name: "to", In: "query", Type: "", Description: "YYYY-MM-DD; today by default"},
+		},
+		Response: jsonObject{"total": int64(0), "created_24h": int64(0), "created_7d": int64(0), "created_30d": int64(0), "daily": []dailySignups{}},
+		Errors:   []string{codeInvalidRequest},
+	},
+	"GET /api/v1/users/:id": {
+		Summary: "Get a user",
+		Scope:   scopeUsersRead,
+		Params: []apiParam{
+			fieldsParam,
+			{Name: "include_deleted", In: "query", Type: false, Description: "Find soft-deleted users too"},
+			{Name: "If-None-Match", In: "header", Type: "", Description: "Answer 304 when the ETag matches"},
+		},
+		Statuses: []int{http.StatusOK, http.StatusNotModified},
+		Response: User{},
+		Formats:  userMediaTypes[1:],
+		Headers:  []string{"ETag"},
+		Errors:   []string{codeInvalidRequest, codeUserNotFound, codeNotAcceptable},
+	},
+	"HEAD /api/v1/users/:id": {
+		Summary: "Check that a user exists",
+		Scope:   scopeUsersRead,
+		Headers: []string{"ETag"},
+		Errors:  []string{codeUserNotFound},
+	},
+	"GET /api/v1/users/by-email/:email": {
+		Summary:  "Get a user by email",
+		Scope:    scopeUsersRead,
+		Response: User{},
+		Errors:   []string{codeValidationFailed, codeUserNotFound},
+	},
+	"GET /api/v1/users/:id/avatar": {
+		Summary:      "Get a user's avatar",
+		Scope:        scopeUsersRead,
+		Postgres:     true,
+		Response:     []byte{},
+		ResponseType: "image/*",
+		Errors:       []string{codeUserNotFound, codeAvatarNotFound},
+	},
+	"GET /api/v1/users/:id/audit": {
+		Summary:  "Changes to a user, newest first",
+		Scope:    scopeUsersRead,
+		Params:   paginationParams,
+		Response: jsonObject{"items": []auditEntry{}},
+		Headers:  []string{"X-Total-Count"},
+		Errors:   []string{codeInvalidRequest, codeUserNotFound},
+	},
+
+	"POST /api/v1/users": {
+		Summary:  "Create a user",
+		Scope:    scopeUsersWrite,
+		Params:   []apiParam{{Name: "Idempotency-Key", In: "header", Type: "", Description: "Replay the first response to a retried request"}},
+		Body:     createUserInput{},
+		Statuses: []int{http.StatusCreated},
+		Response: User{},
+		Headers:  []string{"Location", "ETag", "Idempotent-Replayed"},
+		Errors:   []string{codeValidationFailed, codeEmailConflict, codeIdempotencyConflict, codeIdempotencyKeyReused, codeNotImplemented},
+	},
+	"PUT /api/v1/users/:id": {
+		ID:       "putUser",
+		Summary:  "Update a user; the same as PATCH",
+		Scope:    scopeUsersWrite,
+		Params:   []apiParam{{Name: "If-Match", In: "header", Type: "", Description: "Only update when the ETag matches"}},
+		Body:     userPatch{},
+		Response: User{},
+		Headers:  []string{"ETag"},
+		Errors:   []string{codeValidationFailed, codeUserNotFound, codeEmailConflict, codePreconditionFailed, codePreconditionRequired},
+	},
+	"PATCH /api/v1/users/:id": {
+		Summary:  "Update a user; omitted fields are left as they are and null clears the phone",
+		Scope:    scopeUsersWrite,
+		Params:   []apiParam{{Name: "If-Match", In: "header", Type: "", Description: "Only update when the ETag matches"}},
+		Body:     userPatch{},
+		Response: User{},
+		Headers:  []string{"ETag"},
+		Errors:   []string{codeValidationFailed, codeUserNotFound, codeEmailConflict, codePreconditionFailed, codePreconditionRequired},
+	},
+	"PUT /api/v1/users/by-email/:email": {
+		Summary:  "Create or update a user by email",
+		Scope:    scopeUsersWrite,
+		Postgres: true,
+		Body:     upsertUserInput{},
+		Statuses: []int{http.StatusOK, http.StatusCreated},
+		Response: User{},
+		Errors:   []string{codeValidationFailed, codeEmailConflict},
+	},
+	"POST /api/v1/users/:id/suspend": {
+		ID: "suspendUser", Summary: "Suspend a user", Scope: scopeUsersWrite, Postgres: true,
+		Body: statusTransitionInput{}, BodyOptional: true, Response: User{},
+		Errors: []string{codeUserNotFound, codeInvalidTransition},
+	},
+	"POST /api/v1/users/:id/activate": {
+		ID: "activateUser", Summary: "Activate a user", Scope: scopeUsersWrite, Postgres: true,
+		Body: statusTransitionInput{}, BodyOptional: true, Response: User{},
+		Errors: []string{codeUserNotFound, codeInvalidTransition},
+	},
+	"POST /api/v1/users/:id/deactivate": {
+		ID: "deactivateUser", Summary: "Deactivate a user", Scope: scopeUsersWrite, Postgres: true,
+		Body: statusTransitionInput{}, BodyOptional: true, Response: User{},
+		Errors: []string{codeUserNotFound, codeInvalidTransition},
+	},
+	"POST /api/v1/users/:id/avatar": {
+		Summary:  "Upload a user's avatar",
+		Scope:    scopeUsersWrite,
+		Postgres: true,
+		Body:     jsonObject{"avatar": []byte{}},
+		BodyType: "multipart/form-data",
+		Response: User{},
+		Errors:   []string{codeInvalidRequest, codeValidationFailed, codePayloadTooLarge, codeUserNotFound},
+	},
+	"DELETE /api/v1/users/:id/avatar": {
+		Summary:  "Delete a user's avatar",
+		Scope:    scopeUsersWrite,
+		Postgres: true,
+		Response: messageBody,
+		Errors:   []string{codeUserNotFound, codeAvatarNotFound},
+	},
+	"POST /api/v1/users/:id/password": {
+		Summary:  "Change a user's password given the current one",
+		Scope:    scopeUsersWrite,
+		Body:     passwordChangeInput{},
+		Statuses: []int{http.StatusNoContent},
+		Errors:   []string{codeValidationFailed, codeUserNotFound},
+	},
+	"POST /api/v1/users/:id/verification/resend": {
+		Summary:  "Mail a new verification link",
+		Scope:    scopeUsersWrite,
+		Statuses: []int{http.StatusNoContent},
+		Errors:   []string{codeUserNotFound, codeAlreadyVerified},
+	},
+
+	"DELETE /api/v1/users/:id": {
+		Summary:  "Soft delete a user",
+		Scope:    scopeUsersAdmin,
+		Response: messageBody,
+		Errors:   []string{codeUserNotFound},
+	},
+	"POST /api/v1/users/:id/restore": {
+		Summary:  "Restore a soft-deleted user",
+		Scope:    scopeUsersAdmin,
+		Postgres: true,
+		Response: User{},
+		Errors:   []string{codeUserNotFound, codeEmailConflict},
+	},
+	"POST /api/v1/users/:id/unlock": {
+		Summary:  "Lift a login lockout",
+		Scope:    scopeUsersAdmin,
+		Statuses: []int{http.StatusNoContent},
+		Errors:   []string{codeUserNotFound, codeNotImplemented},
+	},
+	"POST /api/v1/users/batch": {
+		Summary:  "Create many users in one transaction; 207 with partial=true when some fail",
+		Scope:    scopeUsersAdmin,
+		Postgres: true,
+		Params:   []apiParam{{Name: "partial", In: "query", Type: false, Description: "Insert the valid items and report failures per item"}},
+		Body:     []batchUserInput{},
+		Statuses: []int{http.StatusCreated, http.StatusMultiStatus},
+		Response: jsonObject{"created": 0, "failed": 0, "skipped": 0, "invalid": 0, "results": []batchItemResult{}},
+		Errors:   []string{codeValidationFailed, codeEmailConflict},
+	},
+	"POST /api/v1/users/import": {
+		Summary:  "Create users from CSV, reporting failed rows by line; 207 when some fail",
+		Scope:    scopeUsersAdmin,
+		Postgres: true,
+		Params:   []apiParam{{Name: "dry_run", In: "query", Type: false, Description: "Check every row without creating users"}},
+		Body:     "",
+		BodyType: mediaCSV,
+		Statuses: []int{http.StatusOK, http.StatusCreated, http.StatusMultiStatus},
+		Response: importResult{},
+		Errors:   []string{codeInvalidRequest, codePayloadTooLarge, codeUnsupportedMedia},
+	},
+	"PATCH /api/v1/users/bulk": {
+		Summary:  "Apply the same change to many users",
+		Scope:    scopeUsersAdmin,
+		Postgres: true,
+		Params:   []apiParam{{Name: "dry_run", In: "query", Type: false, Description: "Report what would change without changing it"}},
+		Body:     bulkUpdateInput{},
+		Response: jsonObject{"updated": 0, "not_found": []string{}, "dry_run": false},
+		Errors:   []string{codeValidationFailed, codeEmailConflict},
+	},
+	"DELETE /api/v1/users": {
+		Summary:  "Soft delete many users",
+		Scope:    scopeUsersAdmin,
+		Postgres: true,
+		Body:     bulkDeleteInput{},
+		Response: jsonObject{"deleted": 0, "not_found": []string{}},
+	},
+	"GET /api/v1/audit": {
+		Summary: "Changes to any user, newest first",
+		Scope:   scopeUsersAdmin,
+		Params: append([]apiParam{
+			{Name: "actor", In: "query", Type: "", Description: `e.g. "api_key:<id>"`},
+			{Name: "occurred_after", In: "query", Type: "", Description: "RFC 3339 timestamp or YYYY-MM-DD, inclusive"},
+			{Name: "occurred_before", In: "query", Type: "", Description: "RFC 3339 timestamp or YYYY-MM-DD, exclusive"},
+		}, paginationParams...),
+		Response: jsonObject{"items": []auditEntry{}},
+		Headers:  []string{"X-Total-Count"},
+		Errors:   []string{codeInvalidRequest},
+	},
+
+	"POST /api/v1/keys": {
+		Summary:  "Create an API key; the response has the key, which is not shown again",
+		Scope:    scopeKeysAdmin,
+		Body:     apiKeyInput{},
+		Statuses: []int{http.StatusCreated},
+		Response: createdAPIKey{},
+		Errors:   []string{codeValidationFailed},
+	},
+	"GET /api/v1/keys": {
+		Summary:  "List the API keys",
+		Scope:    scopeKeysAdmin,
+		Response: jsonObject{"items": []apiKey{}},
+	},
+	"DELETE /api/v1/keys/:id": {
+		Summary:  "Revoke an API key",
+		Scope:    scopeKeysAdmin,
+		Response: messageBody,
+		Errors:   []string{codeAPIKeyNotFound},
+	},
+	"GET /api/v1/keys/:id/usage": {
+		Summary:  "An API key's requests today and its limits",
+		Scope:    scopeKeysAdmin,
+		Response: apiKeyUsageReport{},
+		Errors:   []string{codeAPIKeyNotFound},
+	},
+
+	"POST /api/v1/webhooks": {
+		Summary:  "Register a webhook; the response has the secret, which is not shown again",
+		Scope:    scopeWebhooksAdmin,
+		Body:     webhookInput{},
+		Statuses: []int{http.StatusCreated},
+		Response: createdWebhook{},
+		Headers:  []string{"Location"},
+		Errors:   []string{codeValidationFailed},
+	},
+	"GET /api/v1/webhooks": {
+		Summary:  "List the webhooks",
+		Scope:    scopeWebhooksAdmin,
+		Response: jsonObject{"items": []webhook{}},
+	},
+	"GET /api/v1/webhooks/:id": {
+		Summary:  "Get a webhook",
+		Scope:    scopeWebhooksAdmin,
+		Response: webhook{},
+		Errors:   []string{codeWebhookNotFound},
+	},
+	"PATCH /api/v1/webhooks/:id": {
+		Summary:  "Change a webhook",
+		Scope:    scopeWebhooksAdmin,
+		Body:     webhookInput{},
+		Response: webhook{},
+		Errors:   []string{codeValidationFailed, codeWebhookNotFound},
+	},
+	"DELETE /api/v1/webhooks/:id": {
+		Summary:  "Delete a webhook",
+		Scope:    scopeWebhooksAdmin,
+		Response: messageBody,
+		Errors:   []string{codeWebhookNotFound},
+	},
+	"GET /api/v1/webhooks/:id/deliveries": {
+		Summary: "A webhook's deliveries, newest first",
+		Scope:   scopeWebhooksAdmin,
+		Params: append([]apiParam{
+			{Name: "status", In: "query", Type: "", Description: fmt.Sprintf("%s, %s or %s", deliveryPending, deliverySucceeded, deliveryFailed)},
+		}, paginationParams...),
+		Response: jsonObject{"items": []webhookDelivery{}},
+		Headers:  []string{"X-Total-Count"},
+		Errors:   []string{codeInvalidRequest, codeWebhookNotFound},
+	},
+
+	"GET /metrics": {
+		ID:           "getMetrics",
+		Summary:      "Prometheus metrics",
+		Response:     "",
+		ResponseType: "text/plain",
+	},
+	"GET /livez": {
+		Summary:  "Liveness probe",
+		Response: jsonObject{"status": ""},
+	},
+	"GET /readyz": {
+		Summary:  "Readiness probe; 503 until the migrations are applied, while the database is down and during shutdown",
+		Statuses: []int{http.StatusOK, http.StatusServiceUnavailable},
+		Response: jsonObject{
+			"status":  "",
+			"checks":  jsonOptional{map[string]dependencyStatus{}},
+			"message": jsonOptional{""},
+			"pending": jsonOptional{[]string{}},
+		},
+	},
+	"GET /debug/pprof/*name": {
+		ID:           "getProfile",
+		Summary:      "Go runtime profiles; the index without a name",
+		Admin:        true,
+		Response:     []byte{},
+		ResponseType: "*/*",
+	},
+	"GET /admin/maintenance": {
+		Summary:  "Maintenance mode",
+		Admin:    true,
+		Response: maintenanceState{},
+	},
+	"POST /admin/maintenance": {
+		Summary:  "Turn maintenance mode on or off",
+		Admin:    true,
+		Body:     maintenanceInput{},
+		Response: maintenanceState{},
+		Errors:   []string{codeValidationFailed},
+	},
+	"GET /admin/log-level": {
+		Summary:  "Minimum log level",
+		Admin:    true,
+		Response: logLevelState{},
+	},
+	"POST /admin/log-level": {
+		Summary:  "Change the minimum log level until the process restarts",
+		Admin:    true,
+		Body:     logLevelState{},
+		Response: logLevelState{},
+		Errors:   []string{codeValidationFailed},
+	},
+}
+
+// The document for the routes of r; an error names the routes missing from
+// apiOperations
+func buildOpenAPI(routes gin.RoutesInfo) ([]byte, error) {
+	b := &schemaBuilder{schemas: openAPIObject{}}
+	paths := map[string]openAPIObject{}
+	ids := map[string]string{}
+	var missing []string
+	for _, route := range routes {
+		if canonicalRoute(route.Path) != route.Path {
+			// The deprecated aliases are described once, in info
+			continue
+		}
+		key := route.Method + " " + route.Path
+		op, ok := apiOperations[key]
+		if !ok {
+			missing = append(missing, key)
+			continue
+		}
+		if op.ID == "" {
+			op.ID = strings.TrimPrefix(route.Handler, "main.")
+		}
+		if other, ok := ids[op.ID]; ok {
+			return nil, fmt.Errorf("%s and %s have the same operationId %q", other, key, op.ID)
+		}
+		ids[op.ID] = key
+
+		path := openAPIPath(route.Path)
+		if paths[path] == nil {
+			paths[path] = openAPIObject{}
+		}
+		paths[path][strings.ToLower(route.Method)] = b.operation(route, op)
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("routes missing from the OpenAPI document: %s", strings.Join(missing, ", "))
+	}
+
+	// Every code clients may see, from the table they come from
+	codes := make([]string, 0, len(codeStatus))
+	for code := range codeStatus {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	b.schemas["ApiError"].(openAPIObject)["properties"].(openAPIObject)["code"].(openAPIObject)["enum"] = codes
+
+	bearer := []string{}
+	if authModes[authModeAPIKey] {
+		bearer = append(bearer, "an API key")
+	}
+	if authModes[authModeJWT] {
+		bearer = append(bearer, "a JWT")
+	}
+	if authModes[authModeSession] {
+		bearer = append(bearer, "a session token from POST "+apiV1Prefix+"/auth/login")
+	}
+	schemes := openAPIObject{
+		"BearerAuth": openAPIObject{"type": "http", "scheme": "bearer", "description": "Authorization: Bearer with " + strings.Join(bearer, ", or ")},
+		"AdminToken": openAPIObject{"type": "http", "scheme": "bearer", "description": "ADMIN_TOKEN"},
+	}
+	if authModes[authModeAPIKey] {
+		schemes["ApiKey"] = openAPIObject{"type": "apiKey", "in": "header", "name": "X-API-Key"}
+	}
+
+	versions := "The " + apiV1Prefix + " paths are also served without the version (" + legacyAPIPrefix + "/users and so on); " +
+		"those are deprecated and go away on " + apiSunset.Format(time.DateOnly) + "."
+
+	return json.Marshal(openAPIObject{
+		"openapi": "3.0.3",
+		"info": openAPIObject{
+			"title":       "sample-api",
+			"version":     "1.0.0",
+			"description": "Errors are answered as {\"error\": {\"code\", \"message\", \"details\", \"request_id\"}}; clients should match on code. " + versions,
+		},
+		"paths": paths,
+		"components": openAPIObject{
+			"schemas":         b.schemas,
+			"securitySchemes": schemes,
+		},
+	})
+}
+
+// /users/:id as /users/{id}
+func openAPIPath(path string) string {
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		if strings.HasPrefix(part, ":") || strings.HasPrefix(part, "*") {
+			parts[i] = "{" + part[1:] + "}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// Group of an operation: the first segment after /api and its version, or
+// ops
+func openAPITag(path string) string {
+	rest, ok := strings.CutPrefix(path, "/api/")
+	if strings.HasPrefix(path, "/graphql") {
+		return "graphql"
+	}
+	if !ok {
+		return "ops"
+	}
+	tag, after, _ := strings.Cut(rest, "/")
+	if apiVersionSegment.MatchString(tag) {
+		tag, _, _ = strings.Cut(after, "/")
+	}
+	if tag == "verify" {
+		return "auth"
+	}
+	return tag
+}
+
+func (b *schemaBuilder) operation(route gin.RouteInfo, op apiOperation) openAPIObject {
+	o := openAPIObject{
+		"operationId": op.ID,
+		"summary":     op.Summary,
+		"tags":        []string{openAPITag(route.Path)},
+	}
+
+	params := []interface{}{}
+	for _, part := range strings.Split(route.Path, "/") {
+		if part == "" || (part[0] != ':' && part[0] != '*') {
+			continue
+		}
+		schema := openAPIObject{"type": "string"}
+		switch part[1:] {
+		case "id":
+			schema["format"] = "uuid"
+		case "email":
+			schema["format"] = "email"
+		}
+		params = append(params, openAPIObject{"name": part[1:], "in": "path", "required": true, "schema": schema})
+	}
+	for _, p := range op.Params {
+		param := openAPIObject{"name": p.Name, "in": p.In, "schema": b.schema(p.Type, false)}
+		if p.Description != "" {
+			param["description"] = p.Description
+		}
+		if p.Required {
+			param["required"] = true
+		}
+		params = append(params, param)
+	}
+	if len(params) > 0 {
+		o["parameters"] = params
+	}
+
+	if op.Body != nil {
+		bodyType := op.BodyType
+		if bodyType == "" {
+			bodyType = "application/json"
+		}
+		o["requestBody"] = openAPIObject{
+			"required": !op.BodyOptional,
+			"content":  openAPIObject{bodyType: openAPIObject{"schema": b.schema(op.Body, true)}},
+		}
+	}
+
+	var description []string
+	errors := slices.Clone(op.Errors)
+	errors = append(errors, codeRateLimited, codeTimeout, codeInternal)
+	if strings.HasPrefix(route.Path, "/api/") || strings.HasPrefix(route.Path, "/graphql") {
+		errors = append(errors, codeMaintenance)
+	}
+	switch {
+	case op.Scope != "" || op.Authenticated:
+		o["security"] = []interface{}{openAPIObject{"ApiKey": []string{}}, openAPIObject{"BearerAuth": []string{}}}
+		if !authModes[authModeAPIKey] {
+			o["security"] = []interface{}{openAPIObject{"BearerAuth": []string{}}}
+		}
+		if op.Scope != "" {
+			o["x-required-scope"] = op.Scope
+			description = append(description, "Requires the "+op.Scope+" scope.")
+		} else {
+			description = append(description, "Each field requires the scope of its REST route.")
+		}
+		errors = append(errors, codeUnauthorized, codeForbidden, codeQuotaExceeded)
+	case op.Admin:
+		o["security"] = []interface{}{openAPIObject{"AdminToken": []string{}}}
+		errors = append(errors, codeUnauthorized)
+	default:
+		o["security"] = []interface{}{}
+	}
+	if op.Postgres {
+		description = append(description, "Requires Postgres (DB_DRIVER=postgres or pgx).")
+		errors = append(errors, codeNotImplemented)
+	}
+	if op.Body != nil {
+		errors = append(errors, codeInvalidRequest, codeUnsupportedMedia, codePayloadTooLarge)
+	}
+	if strings.Contains(route.Path, "/:id") {
+		errors = append(errors, codeInvalidRequest)
+	}
+	if len(description) > 0 {
+		o["description"] = strings.Join(description, " ")
+	}
+
+	responses := openAPIObject{}
+	statuses := op.Statuses
+	if len(statuses) == 0 {
+		statuses = []int{http.StatusOK}
+	}
+	for _, status := range statuses {
+		r := openAPIObject{"description": http.StatusText(status), "headers": b.headers(op.Headers)}
+		if op.Response != nil && status != http.StatusNoContent && status != http.StatusNotModified && route.Method != http.MethodHead {
+			responseType := op.ResponseType
+			if responseType == "" {
+				responseType = "application/json"
+			}
+			content := openAPIObject{responseType: openAPIObject{"schema": b.schema(op.Response, false)}}
+			for _, format := range op.Formats {
+				schema := content[responseType]
+				if format == mediaCSV {
+					schema = openAPIObject{"schema": openAPIObject{"type": "string"}}
+				}
+				content[format] = schema
+			}
+			r["content"] = content
+		}
+		responses[strconv.Itoa(status)] = r
+	}
+
+	// One response per status, naming its codes
+	byStatus := map[int][]string{}
+	for _, code := range errors {
+		status := codeStatus[code]
+		if !slices.Contains(byStatus[status], code) {
+			byStatus[status] = append(byStatus[status], code)
+		}
+	}
+	for status, codes := range byStatus {
+		sort.Strings(codes)
+		r := openAPIObject{"description": http.StatusText(status) + ": " + strings.Join(codes, ", "), "headers": b.headers(nil)}
+		if route.Method != http.MethodHead {
+			r["content"] = openAPIObject{
+				"application/json": openAPIObject{"schema": b.schema(errorResponse{}, false)},
+				mediaProblem:       openAPIObject{"schema": b.schema(problemDetails{}, false)},
+			}
+		}
+		responses[strconv.Itoa(status)] = r
+	}
+	o["responses"] = responses
+	return o
+}
+
+// The named headers, and X-Request-ID, which every response has
+func (b *schemaBuilder) headers(names []string) openAPIObject {
+	headers := openAPIObject{
+		requestIDHeader: openAPIObject{"description": "The request's ID, from the request or generated", "schema": openAPIObject{"type": "string"}},
+	}
+	for _, name := range names {
+		headers[name] = openAPIObject{"description": apiHeaders[name], "schema": openAPIObject{"type": "string"}}
+	}
+	return headers
+}
+
+// Builds schemas from Go types, keeping named structs in components
+type schemaBuilder struct {
+	schemas openAPIObject
+}
+
+var (
+	timeType           = reflect.TypeOf(time.Time{})
+	rawMessageType     = reflect.TypeOf(json.RawMessage{})
+	optionalStringType = reflect.TypeOf(optionalString{})
+)
+
+// The schema of v's type; request types require the fields binding requires,
+// and the others every field without omitempty
+func (b *schemaBuilder) schema(v interface{}, request bool) openAPIObject {
+	switch v := v.(type) {
+	case jsonObject:
+		properties := openAPIObject{}
+		required := []string{}
+		for name, value := range v {
+			if optional, ok := value.(jsonOptional); ok {
+				value = optional.value
+			} else {
+				required = append(required, name)
+			}
+			properties[name] = b.schema(value, request)
+		}
+		sort.Strings(required)
+		s := openAPIObject{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			s["required"] = required
+		}
+		return s
+	case jsonOneOf:
+		schemas := []interface{}{}
+		for _, value := range v {
+			schemas = append(schemas, b.schema(value, request))
+		}
+		return openAPIObject{"oneOf": schemas}
+	}
+	return b.typeSchema(reflect.TypeOf(v), request)
+}
+
+func (b *schemaBuilder) typeSchema(t reflect.Type, request bool) openAPIObject {
+	switch t {
+	case timeType:
+		return openAPIObject{"type": "string", "format": "date-time"}
+	case rawMessageType:
+		// Any JSON value
+		return openAPIObject{}
+	case optionalStringType:
+		return openAPIObject{"type": "string", "nullable": true}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := b.typeSchema(t.Elem(), request)
+		if _, ok := s["$ref"]; ok {
+			return openAPIObject{"allOf": []interface{}{s}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+	case reflect.Bool:
+		return openAPIObject{"type": "boolean"}
+	case reflect.Int64:
+		return openAPIObject{"type": "integer", "format": "int64"}
+	case reflect.Int, reflect.Int32:
+		return openAPIObject{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return openAPIObject{"type": "number"}
+	case reflect.String:
+		return openAPIObject{"type": "string"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return openAPIObject{"type": "string", "format": "binary"}
+		}
+		return openAPIObject{"type": "array", "items": b.typeSchema(t.Elem(), request)}
+	case reflect.Map:
+		return openAPIObject{"type": "object", "additionalProperties": b.typeSchema(t.Elem(), request)}
+	case reflect.Interface:
+		return openAPIObject{}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t, request)
+		}
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := b.schemas[name]; !ok {
+			// Reserved first, for types that refer to themselves
+			b.schemas[name] = openAPIObject{}
+			b.schemas[name] = b.structSchema(t, request)
+		}
+		return openAPIObject{"$ref": "#/components/schemas/" + name}
+	}
+	panic(fmt.Sprintf("openapi: no schema for %s", t))
+}
+
+func (b *schemaBuilder) structSchema(t reflect.Type, request bool) openAPIObject {
+	properties := openAPIObject{}
+	required := []string{}
+	b.addFields(t, request, properties, &required)
+	s := openAPIObject{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	// bindJSON rejects unknown fields
+	if request {
+		s["additionalProperties"] = false
+	}
+	return s
+}
+
+// Add the JSON fields of t, including those of embedded structs
+func (b *schemaBuilder) addFields(t reflect.Type, request bool, properties openAPIObject, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, options, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			b.addFields(f.Type, request, properties, required)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		s := b.typeSchema(f.Type, request)
+		rules := strings.Split(f.Tag.Get("binding"), ",")
+		for _, rule := range rules {
+			if values, ok := strings.CutPrefix(rule, "oneof="); ok {
+				s["enum"] = strings.Fields(values)
+			}
+		}
+		properties[name] = s
+		if request && slices.Contains(rules, "required") || !request && !strings.Contains(options, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// The document, built by newRouter
+var openAPIDocument []byte
+
+func getOpenAPI(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json; charset=utf-8", openAPIDocument)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The paths of the served document: path, then lowercase method
+func servedOpenAPIPaths(t *testing.T, r http.Handler) map[string]map[string]interface{} {
+	t.Helper()
+	w := request(r, "GET", "/openapi.json", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /openapi.json: status %d", w.Code)
+	}
+	var doc struct {
+		Paths map[string]map[string]interface{} `json:"paths"`
+	}
+	decode(t, w, &doc)
+	return doc.Paths
+}
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	withAdmin := defaultConfig()
+	withAdmin.AdminToken = strings.Repeat("a", 32)
+	for _, tt := range []struct {
+		name string
+		cfg  Config
+	}{
+		{"defaults", defaultConfig()},
+		{"admin routes", withAdmin},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRouter(tt.cfg, newMemoryRepositories())
+			paths := servedOpenAPIPaths(t, r)
+
+			served := map[string]bool{}
+			for _, route := range r.Routes() {
+				path, method := openAPIPath(route.Path), strings.ToLower(route.Method)
+				if canonicalRoute(route.Path) != route.Path {
+					if paths[path] != nil {
+						t.Errorf("deprecated alias %s is documented", path)
+					}
+					continue
+				}
+				served[method+" "+path] = true
+				if paths[path][method] == nil {
+					t.Errorf("%s %s is not in the document", route.Method, route.Path)
+				}
+			}
+			for path, operations := range paths {
+				for method := range operations {
+					if !served[method+" "+path] {
+						t.Errorf("%s %s is documented but not served", strings.ToUpper(method), path)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestBuildOpenAPIRejectsUndocumentedRoutes(t *testing.T) {
+	routes := gin.RoutesInfo{
+		{Method: "GET", Path: "/livez", Handler: "main.livez"},
+		{Method: "GET", Path: apiV1Prefix + "/undocumented", Handler: "main.undocumented"},
+	}
+	_, err := buildOpenAPI(routes)
+	if err == nil || !strings.Contains(err.Error(), "GET "+apiV1Prefix+"/undocumented") {
+		t.Errorf("error %v, want it to name the undocumented route", err)
+	}
+	if _, err := buildOpenAPI(routes[:1]); err != nil {
+		t.Errorf("documented routes: %v", err)
+	}
+}
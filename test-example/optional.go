@@ -0,0 +1,36 @@
+package main
+
+import "encoding/json"
+
+// A JSON string field that records whether it was present in the request.
+// Omitted keys leave Set false; an explicit null sets Set and Null.
+type optionalString struct {
+	Set   bool
+	Null  bool
+	Value string
+}
+
+// UnmarshalJSON is only called for keys present in the body, including null
+func (o *optionalString) UnmarshalJSON(data []byte) error {
+	o.Set = true
+	if string(data) == "null" {
+		o.Null = true
+		o.Value = ""
+		return nil
+	}
+	o.Null = false
+	return json.Unmarshal(data, &o.Value)
+}
+
+// Whether the field was present and is null or an empty string
+func (o optionalString) Empty() bool {
+	return o.Set && (o.Null || o.Value == "")
+}
+
+// Column value for a nullable field: nil for an explicit null
+func (o optionalString) sqlValue() interface{} {
+	if o.Null {
+		return nil
+	}
+	return o.Value
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transactional outbox: the events of a change to a user are written to the
+// outbox table in the transaction that makes the change, so an event exists
+// exactly when its change was committed. A dispatcher in every instance
+// polls the table, turns each event into webhook deliveries, and makes the
+// deliveries that are due. Rows are claimed with FOR UPDATE SKIP LOCKED, so
+// replicas share the work without sending anything twice, and whatever an
+// instance leaves undone when it stops is picked up by the next poll.
+
+// Events of changes to users, one per audit action that changes one
+const (
+	eventUserCreated  = "user.created"
+	eventUserUpdated  = "user.updated"
+	eventUserDeleted  = "user.deleted"
+	eventUserRestored = "user.restored"
+)
+
+// Event of each audited action; the others (password changes, lockouts)
+// don't change the user and have none
+var auditActionEvents = map[string]string{
+	auditCreate:  eventUserCreated,
+	auditUpdate:  eventUserUpdated,
+	auditDelete:  eventUserDeleted,
+	auditRestore: eventUserRestored,
+}
+
+// How often the outbox is polled when nothing wakes the dispatcher
+// (OUTBOX_POLL_INTERVAL)
+var outboxPollInterval = time.Second
+
+// How long relayed events are kept before they are deleted
+// (OUTBOX_RETENTION)
+var outboxRetention = 24 * time.Hour
+
+const (
+	// Events relayed per poll before polling again
+	outboxBatchSize = 100
+	// Longest delay before relaying an event again after a failure
+	outboxRetryMax = 5 * time.Minute
+	// How often relayed events past outboxRetention are deleted
+	outboxCleanupInterval = time.Minute
+)
+
+// An event as stored in the outbox and sent to webhooks
+type userEvent struct {
+	Event string `json:"event"`
+	// The user after the change; before it for user.deleted
+	User      User      `json:"user"`
+	Timestamp time.Time `json:"timestamp"`
+	// Of the request that made the change
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Events of the entries that change a user
+func userEvents(entries []auditEntry) []userEvent {
+	events := []userEvent{}
+	for _, e := range entries {
+		event, ok := auditActionEvents[e.Action]
+		if !ok || e.user == nil {
+			continue
+		}
+		events = append(events, userEvent{Event: event, User: *e.user, Timestamp: e.OccurredAt, RequestID: e.RequestID})
+	}
+	return events
+}
+
+// The INSERT for events, with Postgres placeholders
+func outboxInsertSQL(events []userEvent) (string, []interface{}) {
+	now := time.Now().UTC()
+	values := []string{}
+	args := []interface{}{}
+	for _, e := range events {
+		payload, _ := json.Marshal(e)
+		n := len(args)
+		values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5))
+		args = append(args, e.Event, e.User.ID, string(payload), e.Timestamp, now)
+	}
+	return "INSERT INTO outbox (event, user_id, payload, occurred_at, next_attempt_at) VALUES " + strings.Join(values, ", "), args
+}
+
+// Write the events of entries to the outbox through tx, and wake the
+// dispatcher once tx commits
+func insertOutboxEvents(ctx context.Context, tx execer, entries []auditEntry) error {
+	events := userEvents(entries)
+	if len(events) == 0 {
+		return nil
+	}
+	query, args := outboxInsertSQL(events)
+	query, args = bindQuery(query, args...)
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return err
+	}
+	afterCommit(tx, outbox.wake)
+	return nil
+}
+
+// Locking clause for rows claimed by one instance; SQLite has one writer
+// at a time and no row locks
+func skipLocked() string {
+	if dbDialect() == driverSQLite {
+		return ""
+	}
+	return " FOR UPDATE SKIP LOCKED"
+}
+
+// base doubled for each failure after the first, up to max
+func doublingDelay(base, max time.Duration, failures int) time.Duration {
+	delay := base
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	return min(delay, max)
+}
+
+// Polls the outbox and runs the webhook workers
+type outboxDispatcher struct {
+	logger     *slog.Logger
+	wakeup     chan struct{}
+	done       chan struct{}
+	deliveries chan string
+	wg         sync.WaitGroup
+	// Set by start
+	webhooks webhookRepository
+
+	// Only touched by run
+	lastCleanup time.Time
+}
+
+var outbox = &outboxDispatcher{
+	wakeup:     make(chan struct{}, 1),
+	done:       make(chan struct{}),
+	deliveries: make(chan string, webhookWorkers),
+}
+
+// Poll now rather than at the next tick; never blocks
+func (d *outboxDispatcher) wake() {
+	select {
+	case d.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Start polling and the webhook workers, which log to logger and relay
+// events to the webhooks of hooks
+func (d *outboxDispatcher) start(logger *slog.Logger, hooks webhookRepository) {
+	d.logger, d.webhooks = logger, hooks
+	for i := 0; i < webhookWorkers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+	d.wg.Add(1)
+	go d.run()
+}
+
+// Stop polling and wait up to timeout for the running deliveries. Events
+// and deliveries not done yet stay in the database for the next start.
+func (d *outboxDispatcher) stop(timeout time.Duration) {
+	close(d.done)
+	finished := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(timeout):
+		d.logger.Warn("Webhook deliveries still running", "after", timeout)
+	}
+}
+
+func (d *outboxDispatcher) run() {
+	defer d.wg.Done()
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+	for {
+		d.poll()
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+		case <-d.wakeup:
+		}
+	}
+}
+
+// Pass new events to the event streams, relay the due events, hand due
+// deliveries to idle workers, and delete old events now and then
+func (d *outboxDispatcher) poll() {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	ctx = withLogger(ctx, d.logger)
+
+	userEventStreams.tail(ctx)
+
+	hooks, err := d.webhooks.List(ctx, true)
+	if err != nil {
+		d.logger.Error("Failed to look up webhooks", "error", err)
+		return
+	}
+	relayed := 0
+	for ; relayed < outboxBatchSize; relayed++ {
+		ok, err := relayOutboxEvent(ctx, hooks)
+		if err != nil {
+			d.logger.Error("Failed to relay outbox event", "error", err)
+			break
+		}
+		if !ok {
+			break
+		}
+	}
+	if relayed == outboxBatchSize {
+		d.wake()
+	}
+
+	if idle := cap(d.deliveries) - len(d.deliveries); idle > 0 {
+		ids, err := claimWebhookDeliveries(ctx, idle)
+		if err != nil {
+			d.logger.Error("Failed to claim webhook deliveries", "error", err)
+		}
+		for _, id := range ids {
+			d.deliveries <- id
+		}
+	}
+
+	if time.Since(d.lastCleanup) >= outboxCleanupInterval {
+		d.lastCleanup = time.Now()
+		query, args := bindQuery("DELETE FROM outbox WHERE delivered_at < $1", time.Now().UTC().Add(-outboxRetention))
+		if _, err := db.ExecContext(ctx, query, args...); err != nil {
+			d.logger.Error("Failed to delete relayed outbox events", "error", err)
+		}
+	}
+}
+
+// Make claimed deliveries; each finished one may free a slot for the next
+func (d *outboxDispatcher) work() {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-d.done:
+			return
+		case id := <-d.deliveries:
+			attemptWebhookDelivery(id, d.logger)
+			d.wake()
+		}
+	}
+}
+
+// Publish the oldest due event, turn it into deliveries to hooks and mark
+// it relayed, in one transaction; false when no event is due. An event
+// that fails is tried again later, with a doubling delay, however often it
+// fails.
+func relayOutboxEvent(ctx context.Context, hooks []webhook) (bool, error) {
+	var id int64
+	var event, payload string
+	var attempts int
+	err := runInTx(ctx, db, func(tx *sql.Tx) error {
+		query, args := bindQuery("SELECT id, event, payload, attempts FROM outbox WHERE delivered_at IS NULL AND next_attempt_at <= $1 ORDER BY id LIMIT 1"+skipLocked(),
+			time.Now().UTC())
+		if err := tx.QueryRowContext(ctx, query, args...).Scan(&id, &event, &payload, &attempts); err != nil {
+			return err
+		}
+		// Before the writes, which SQLite would hold its lock for
+		if err := publishOutboxEvent(ctx, id, payload); err != nil {
+			return fmt.Errorf("publish: %w", err)
+		}
+		body, err := webhookPayload(id, payload)
+		if err != nil {
+			return err
+		}
+		if err := insertWebhookDeliveries(ctx, tx, hooks, event, body); err != nil {
+			return err
+		}
+		query, args = bindQuery("UPDATE outbox SET delivered_at = $1 WHERE id = $2", time.Now().UTC(), id)
+		_, err = tx.ExecContext(ctx, query, args...)
+		return err
+	})
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err == nil {
+		return true, nil
+	}
+	if id == 0 {
+		return false, err
+	}
+
+	message := err.Error()
+	if len(message) > 500 {
+		message = message[:500]
+	}
+	attempts++
+	query, args := bindQuery("UPDATE outbox SET attempts = $1, last_error = $2, next_attempt_at = $3 WHERE id = $4",
+		attempts, message, time.Now().UTC().Add(doublingDelay(outboxPollInterval, outboxRetryMax, attempts)), id)
+	if _, updateErr := db.ExecContext(ctx, query, args...); updateErr != nil {
+		loggerFrom(ctx).Error("Failed to record failure of outbox event", "event_id", id, "error", updateErr)
+	}
+	return false, fmt.Errorf("outbox event %d: %w", id, err)
+}
+
+// Publish an outbox event to the message bus
+func publishOutboxEvent(ctx context.Context, id int64, payload string) error {
+	var e userEvent
+	if err := json.Unmarshal([]byte(payload), &e); err != nil {
+		return err
+	}
+	return publisher.Publish(ctx, eventMessage{ID: id, Event: e.Event, User: e.User, OccurredAt: e.Timestamp, RequestID: e.RequestID})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Password reset: POST /api/auth/password-reset mails a single-use token to
+// the address, and POST /api/auth/password-reset/confirm exchanges it for a
+// new password. Only the token's SHA-256 is stored. Used tokens are kept
+// until they expire so reusing one can be told apart from an unknown token.
+
+// How long a reset token works (PASSWORD_RESET_TTL)
+var passwordResetTTL = time.Hour
+
+// Page of the client app that asks for the new password, given the token as
+// ?token= (PASSWORD_RESET_URL); empty mails the token alone
+var passwordResetURL string
+
+// Requests for one email within this interval of the last don't send mail,
+// so the endpoint can't be used to flood an inbox
+const passwordResetInterval = time.Minute
+
+// Returned for reset tokens past their expiry or already used
+var (
+	errTokenExpired = errors.New("token expired")
+	errTokenUsed    = errors.New("token already used")
+)
+
+type passwordResetInput struct {
+	Email string `json:"email" binding:"required"`
+}
+
+type passwordResetConfirmInput struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required"`
+}
+
+// Mail a reset token to the user with the email, if there is one. Always
+// 202, answered before any lookup, so neither the answer nor its timing
+// tells whether the email belongs to a user.
+func requestPasswordReset(c *gin.Context) {
+	var input passwordResetInput
+	if !bindJSON(c, &input) {
+		return
+	}
+	email := normalizeEmail(input.Email)
+	if !isValidEmail(email) {
+		respondInvalid(c, errInvalidEmail)
+		return
+	}
+
+	c.Status(http.StatusAccepted)
+
+	// The request's context ends with the response; keep its request ID
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(c.Request.Context()), requestTimeout+smtpTimeout)
+	go func() {
+		defer cancel()
+		sendPasswordReset(ctx, email)
+	}()
+}
+
+func sendPasswordReset(ctx context.Context, email string) {
+	spacing := "login:reset:email:" + email
+	if wait, err := loginAttempts.BlockedFor(ctx, spacing); err == nil && wait > 0 {
+		loggerFrom(ctx).Info("Password reset requested again too soon, not sending", "email", maskEmail(email), "within", passwordResetInterval)
+		return
+	}
+
+	creds, err := repositoriesFrom(ctx).users.GetCredentialsByEmail(ctx, email)
+	if err == errUserNotFound {
+		return
+	}
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to look up user for password reset", "error", err)
+		return
+	}
+
+	token, hash, err := newLinkToken()
+	if err == nil {
+		err = repositoriesFrom(ctx).users.StorePasswordResetToken(ctx, creds.UserID, hash, time.Now().Add(passwordResetTTL))
+	}
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to create password reset token", "user_id", creds.UserID, "error", err)
+		return
+	}
+	if err := loginAttempts.Block(ctx, spacing, passwordResetInterval); err != nil {
+		loggerFrom(ctx).Error("Failed to record password reset request", "error", err)
+	}
+
+	body := "Someone asked to reset the password for this address. If it wasn't you, ignore this email.\n\n"
+	if passwordResetURL != "" {
+		link, _ := url.Parse(passwordResetURL)
+		query := link.Query()
+		query.Set("token", token)
+		link.RawQuery = query.Encode()
+		body += "Choose a new password here:\n\n" + link.String() + "\n\n"
+	} else {
+		body += "Your reset token:\n\n" + token + "\n\n"
+	}
+	body += "It works once and expires in " + passwordResetTTL.String() + ".\n"
+
+	if err := mailer.Send(ctx, mailMessage{To: email, Subject: "Reset your password", Body: body}); err != nil {
+		loggerFrom(ctx).Error("Failed to send password reset email", "email", maskEmail(email), "error", err)
+	}
+}
+
+// Set a new password with a reset token. The user's other reset tokens and
+// sessions stop working, and a login lockout is lifted: the token proves
+// control of the address.
+func confirmPasswordReset(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var input passwordResetConfirmInput
+	if !bindJSON(c, &input) {
+		return
+	}
+	// Checked against the email below, once the token names the user
+	if err := validatePassword("new_password", input.NewPassword, ""); err != nil {
+		respondInvalid(c, err)
+		return
+	}
+	// Hashed before the transaction, which shouldn't wait on bcrypt
+	hash, err := hashPassword(input.NewPassword)
+	if err != nil {
+		respondInternal(c, "Failed to reset password")
+		return
+	}
+
+	var email string
+	err = repositoriesFrom(ctx).users.WithTx(ctx, func(tx UserRepository) error {
+		id, err := tx.TakePasswordResetToken(ctx, hashToken(input.Token))
+		if err != nil {
+			return err
+		}
+		creds, err := tx.GetCredentials(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err := validatePassword("new_password", input.NewPassword, creds.Email); err != nil {
+			return err
+		}
+		if err := tx.SetPasswordHash(ctx, id, hash); err != nil {
+			return err
+		}
+		email = creds.Email
+		u := User{ID: id}
+		return tx.RecordAudit(ctx, newAuditEntry(ctx, auditPasswordReset, &u, &u))
+	})
+	var invalid fieldError
+	switch {
+	case errors.As(err, &invalid):
+		respondInvalid(c, invalid)
+		return
+	// Tokens of deleted users are as good as none
+	case err == errInvalidToken || err == errUserNotFound:
+		respondError(c, codeInvalidToken, "Password reset token is invalid")
+		return
+	case err == errTokenExpired:
+		respondError(c, codeTokenExpired, "Password reset token has expired")
+		return
+	case err == errTokenUsed:
+		respondError(c, codeTokenUsed, "Password reset token has already been used")
+		return
+	case err != nil:
+		respondInternal(c, "Failed to reset password")
+		return
+	}
+
+	if err := loginAttempts.Delete(ctx, loginLockKey(email), loginFailuresKey("email", email), loginDelayKey("email", email)); err != nil {
+		loggerFrom(ctx).Error("Failed to unlock login after password reset", "error", err)
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// Store a password reset token, dropping the user's expired ones; the same
+// SQL for every dialect
+func storePasswordResetToken(ctx context.Context, q dbtx, userID, hash string, expires time.Time) error {
+	now := time.Now().UTC()
+	query, args := bindQuery("DELETE FROM password_reset_tokens WHERE user_id = $1 AND expires_at <= $2", userID, now)
+	if _, err := q.ExecContext(ctx, query, args...); err != nil {
+		return err
+	}
+	query, args = bindQuery("INSERT INTO password_reset_tokens (token_hash, user_id, expires_at, created_at) VALUES ($1, $2, $3, $4)",
+		hash, userID, expires.UTC(), now)
+	_, err := q.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Mark a password reset token used, delete the user's other unused ones and
+// return the user's id. Two requests with the same token can't both succeed:
+// only one UPDATE finds it unused.
+func takePasswordResetToken(ctx context.Context, q dbtx, hash string) (string, error) {
+	var userID string
+	var expires time.Time
+	var usedAt *time.Time
+	query, args := bindQuery("SELECT user_id, expires_at, used_at FROM password_reset_tokens WHERE token_hash = $1", hash)
+	err := q.QueryRowContext(ctx, query, args...).Scan(&userID, &expires, &usedAt)
+	if err == sql.ErrNoRows {
+		return "", errInvalidToken
+	}
+	if err != nil {
+		return "", err
+	}
+	if usedAt != nil {
+		return "", errTokenUsed
+	}
+	now := time.Now().UTC()
+	if !now.Before(expires) {
+		return "", errTokenExpired
+	}
+
+	query, args = bindQuery("UPDATE password_reset_tokens SET used_at = $1 WHERE token_hash = $2 AND used_at IS NULL", now, hash)
+	result, err := q.ExecContext(ctx, query, args...)
+	if err != nil {
+		return "", err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return "", errTokenUsed
+	}
+
+	query, args = bindQuery("DELETE FROM password_reset_tokens WHERE user_id = $1 AND used_at IS NULL", userID)
+	if _, err := q.ExecContext(ctx, query, args...); err != nil {
+		return "", err
+	}
+	return userID, nil
+}
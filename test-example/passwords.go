@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Work factor of new password hashes (BCRYPT_COST); existing hashes keep
+// the cost they were made with
+var bcryptCost = 12
+
+// Shortest accepted password, in characters (PASSWORD_MIN_LENGTH)
+var passwordMinLength = 8
+
+// bcrypt ignores everything after 72 bytes, so longer passwords are refused
+// rather than silently cut
+const maxPasswordBytes = 72
+
+// What a login or password change needs to know about a user
+type userCredentials struct {
+	UserID string
+	Email  string
+	Role   string
+	Status string
+	// Empty for users without a password, who can't log in
+	PasswordHash      string
+	PasswordChangedAt *time.Time
+}
+
+// Check a new password: at least PASSWORD_MIN_LENGTH characters, at most 72
+// bytes, and not the user's email. field names it in errors.
+func validatePassword(field, password, email string) error {
+	if n := utf8.RuneCountInString(password); n < passwordMinLength {
+		return fieldError{Field: field, Rule: "min_length", Message: fmt.Sprintf("%s must be at least %d characters", field, passwordMinLength)}
+	}
+	if len(password) > maxPasswordBytes {
+		return fieldError{Field: field, Rule: "max_length", Message: fmt.Sprintf("%s cannot be longer than %d bytes", field, maxPasswordBytes)}
+	}
+	if strings.EqualFold(strings.TrimSpace(password), email) {
+		return fieldError{Field: field, Rule: "not_email", Message: field + " cannot be the email address"}
+	}
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	return string(hash), err
+}
+
+// Hash compared against when there is no real one, so a login for an
+// unknown email or a user without a password takes as long as a wrong
+// password and doesn't reveal which it was
+var (
+	dummyPasswordHashOnce sync.Once
+	dummyPasswordHash     []byte
+)
+
+// Make the dummy hash; done at startup with sessions enabled, so the first
+// failed login doesn't take longer than the rest
+func prepareDummyPasswordHash() {
+	dummyPasswordHashOnce.Do(func() {
+		dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte(newUUID()), bcryptCost)
+	})
+}
+
+// Whether password matches hash; an empty hash never matches but costs the
+// same bcrypt comparison
+func checkPassword(hash, password string) bool {
+	if hash == "" {
+		prepareDummyPasswordHash()
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// Credentials of the non-deleted user whose column equals value; the same
+// SQL for every dialect
+func queryCredentials(ctx context.Context, q dbtx, column, value string) (userCredentials, error) {
+	query, args := bindQuery("SELECT id, email, role, status, password_hash, password_changed_at FROM users WHERE "+column+" = $1 AND deleted_at IS NULL", value)
+	var creds userCredentials
+	var hash sql.NullString
+	err := q.QueryRowContext(ctx, query, args...).Scan(&creds.UserID, &creds.Email, &creds.Role, &creds.Status, &hash, &creds.PasswordChangedAt)
+	if err == sql.ErrNoRows {
+		return userCredentials{}, errUserNotFound
+	}
+	creds.PasswordHash = hash.String
+	return creds, err
+}
+
+// Replace a non-deleted user's password hash. The version and updated_at
+// stay: the password is not part of the user representation.
+func storePasswordHash(ctx context.Context, q dbtx, id, hash string) error {
+	query, args := bindQuery("UPDATE users SET password_hash = $1, password_changed_at = $2 WHERE id = $3 AND deleted_at IS NULL",
+		hash, time.Now().UTC(), strings.ToLower(id))
+	result, err := q.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+type passwordChangeInput struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+// Change a user's password given the current one. Sessions issued before
+// the change stop working, including the caller's.
+func changePassword(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var input passwordChangeInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	creds, err := repositoriesFrom(ctx).users.GetCredentials(ctx, c.Param("id"))
+	if err == errUserNotFound {
+		respondError(c, codeUserNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		respondInternal(c, "Failed to change password")
+		return
+	}
+
+	if err := validatePassword("new_password", input.NewPassword, creds.Email); err != nil {
+		respondInvalid(c, err)
+		return
+	}
+	if !checkPassword(creds.PasswordHash, input.CurrentPassword) {
+		respondInvalid(c, fieldError{Field: "current_password", Rule: "match", Message: "current_password is incorrect"})
+		return
+	}
+
+	hash, err := hashPassword(input.NewPassword)
+	if err != nil {
+		respondInternal(c, "Failed to change password")
+		return
+	}
+	err = repositoriesFrom(ctx).users.WithTx(ctx, func(tx UserRepository) error {
+		if err := tx.SetPasswordHash(ctx, creds.UserID, hash); err != nil {
+			return err
+		}
+		// No values: the entry only says the password changed
+		u := User{ID: creds.UserID}
+		return tx.RecordAudit(ctx, newAuditEntry(ctx, auditPasswordChange, &u, &u))
+	})
+	if err == errUserNotFound {
+		respondError(c, codeUserNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		respondInternal(c, "Failed to change password")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
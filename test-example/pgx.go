@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// Native pgx pool behind db when DB_DRIVER=pgx, nil otherwise
+var pgxPool *pgxpool.Pool
+
+// Open Postgres through pgx. The pgxpool pool is exposed as a *sql.DB, so
+// handlers and the Postgres repository run unchanged on either driver.
+func openPgx(dsn string, logger *slog.Logger) (*sql.DB, *pgxpool.Pool, error) {
+	cfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if dbMaxOpenConns > 0 {
+		cfg.MaxConns = int32(dbMaxOpenConns)
+	}
+	cfg.MaxConnLifetime = dbConnMaxLifetime
+	cfg.MaxConnIdleTime = dbConnMaxIdleTime
+
+	// Connects lazily; initDB's ping waits for the database
+	pool, err := pgxpool.NewWithConfig(context.Background(), cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sql.OpenDB(loggingConnector{stdlib.GetPoolConnector(pool), logger}), pool, nil
+}
@@ -0,0 +1,96 @@
+// GraphQL playground: sends the query to ../../graphql with the credentials
+// typed into the header. No inline scripts or styles, so the page works
+// under the docs Content-Security-Policy.
+"use strict";
+
+const endpoint = "../../graphql";
+const sample = `query Users($first: Int) {
+  users(first: $first) {
+    totalCount
+    nextCursor
+    nodes { id email name role status createdAt }
+  }
+}`;
+
+function credentials() {
+  const headers = {};
+  const key = document.getElementById("api-key").value.trim();
+  const bearer = document.getElementById("bearer").value.trim();
+  if (key) headers["X-API-Key"] = key;
+  if (bearer) headers["Authorization"] = "Bearer " + bearer;
+  return headers;
+}
+
+async function run() {
+  const status = document.getElementById("status");
+  const response = document.getElementById("response");
+  const body = { query: document.getElementById("query").value };
+  const operation = document.getElementById("operation").value.trim();
+  if (operation) body.operationName = operation;
+  const variables = document.getElementById("variables").value.trim();
+  if (variables) {
+    try {
+      body.variables = JSON.parse(variables);
+    } catch (err) {
+      status.className = "failed";
+      status.textContent = "Variables are not valid JSON: " + err.message;
+      return;
+    }
+  }
+  sessionStorage.setItem("query", body.query);
+  sessionStorage.setItem("variables", variables);
+
+  status.className = "";
+  status.textContent = "Running…";
+  try {
+    const resp = await fetch(endpoint, {
+      method: "POST",
+      headers: { ...credentials(), "Content-Type": "application/json" },
+      body: JSON.stringify(body),
+    });
+    const text = await resp.text();
+    let shown = text;
+    try {
+      shown = JSON.stringify(JSON.parse(text), null, 2);
+    } catch (err) {
+      // Not JSON; show it as it is
+    }
+    status.className = resp.ok && !shown.includes('"errors"') ? "ok" : "failed";
+    status.textContent = resp.status + " " + resp.statusText;
+    response.textContent = shown;
+  } catch (err) {
+    status.className = "failed";
+    status.textContent = String(err);
+  }
+}
+
+async function loadSchema() {
+  const schema = document.getElementById("schema");
+  try {
+    const resp = await fetch("schema.graphql");
+    schema.textContent = await resp.text();
+  } catch (err) {
+    schema.textContent = "Failed to load schema.graphql: " + err;
+  }
+}
+
+function main() {
+  for (const id of ["api-key", "bearer"]) {
+    const input = document.getElementById(id);
+    input.value = sessionStorage.getItem(id) || "";
+    input.addEventListener("change", () => sessionStorage.setItem(id, input.value));
+  }
+  document.getElementById("query").value = sessionStorage.getItem("query") || sample;
+  document.getElementById("variables").value = sessionStorage.getItem("variables") || '{"first": 10}';
+
+  document.getElementById("run").addEventListener("click", run);
+  document.addEventListener("keydown", (e) => {
+    if (e.key === "Enter" && (e.ctrlKey || e.metaKey)) {
+      e.preventDefault();
+      run();
+    }
+  });
+  loadSchema();
+}
+
+main();
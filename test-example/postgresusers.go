@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// A status change that the user's current status doesn't allow
+var errStatusNotAllowed = errors.New("status transition not allowed")
+
+// User operations built on Postgres features (trigram similarity,
+// generate_series, COPY, arrays, FOR UPDATE, upserts reporting xmax) that only
+// postgresUserRepository implements. The routes using them are behind
+// requirePostgres.
+type postgresUserOps interface {
+	// Non-deleted users whose name or email is similar to q, best match first
+	Search(ctx context.Context, q string, limit int) ([]userSearchResult, error)
+	// Signup counts of non-deleted users, with a zero-filled entry for every
+	// UTC day from start to end
+	Stats(ctx context.Context, start, end time.Time) (userStats, error)
+	// Sets the status of a non-deleted user whose status is one of from and
+	// records it; errStatusNotAllowed, with the user as it is, for another
+	// status
+	SetStatus(ctx context.Context, id, status string, from []string) (User, error)
+	// Records that the user's avatar changed at t, or with nil that it was
+	// removed; errAvatarNotFound when removing an avatar the user doesn't
+	// have
+	SetAvatarUpdatedAt(ctx context.Context, id string, t *time.Time) (User, error)
+	// Undeletes a user and records it; errUserNotFound when there is no such
+	// deleted user, errEmailTaken when its email was taken again meanwhile
+	Restore(ctx context.Context, id string) (User, error)
+	// Creates a user with email and name, or renames the non-deleted one that
+	// has the email, reporting whether it was created; errEmailTaken when
+	// the email is reserved by a deleted user
+	UpsertByEmail(ctx context.Context, email, name string) (User, bool, error)
+	// Inserts many validated users with distinct emails and records them,
+	// returning the ids of the inserted ones by email; the others were
+	// skipped because their email is taken. With allOrNothing a skipped
+	// email rolls everything back and errRollback is returned along with
+	// what would have been inserted.
+	CreateMany(ctx context.Context, users []User, allOrNothing bool) (map[string]string, error)
+	// The emails CreateMany would skip as taken
+	TakenEmails(ctx context.Context, emails []string) (map[string]bool, error)
+	// Soft-deletes the non-deleted users of ids and records it, returning the
+	// ids deleted, in lowercase
+	DeleteMany(ctx context.Context, ids []string) (map[string]bool, error)
+	// Applies a validated, non-empty patch to the non-deleted users of ids
+	// and records it, returning the ids updated, in lowercase; with dryRun
+	// the changes are rolled back. errEmailTaken or errMetadataTooLarge when
+	// the patch can't be applied.
+	UpdateMany(ctx context.Context, ids []string, patch userPatch, dryRun bool) (map[string]bool, error)
+}
+
+// Signup statistics of non-deleted users
+type userStats struct {
+	Created24h int64          `json:"created_24h"`
+	Created30d int64          `json:"created_30d"`
+	Created7d  int64          `json:"created_7d"`
+	Daily      []dailySignups `json:"daily"`
+	Total      int64          `json:"total"`
+}
+
+// The users with the given ids matching condition, locked until tx ends so
+// their state can't change before the audited write
+func lockUsers(ctx context.Context, tx *sql.Tx, ids []string, condition string) (map[string]User, error) {
+	rows, err := tx.QueryContext(ctx,
+		"SELECT "+selectColumns(userFields)+" FROM users WHERE id = ANY($1) AND "+condition+" FOR UPDATE",
+		pq.Array(ids),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := map[string]User{}
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(scanDest(&u, userFields)...); err != nil {
+			return nil, err
+		}
+		users[u.ID] = u
+	}
+	return users, rows.Err()
+}
+
+func (r *postgresUserRepository) Search(ctx context.Context, q string, limit int) ([]userSearchResult, error) {
+	rows, err := r.conn().QueryContext(ctx, `
+		SELECT `+selectColumns(userFields)+`,
+		       GREATEST(similarity(name, $1), similarity(email, $1)) AS score
+		FROM users
+		WHERE (name % $1 OR email % $1) AND deleted_at IS NULL
+		ORDER BY score DESC, id
+		LIMIT $2`,
+		q, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []userSearchResult{}
+	for rows.Next() {
+		var res userSearchResult
+		if err := rows.Scan(append(scanDest(&res.User, userFields), &res.Score)...); err != nil {
+			return nil, fmt.Errorf("scan search result row %d: %w", len(results), err)
+		}
+		results = append(results, res)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("read search results after %d rows: %w", len(results), err)
+	}
+	return results, nil
+}
+
+func (r *postgresUserRepository) Stats(ctx context.Context, start, end time.Time) (userStats, error) {
+	var stats userStats
+	err := r.conn().QueryRowContext(ctx, `
+		SELECT count(*),
+		       count(*) FILTER (WHERE created_at >= NOW() - INTERVAL '24 hours'),
+		       count(*) FILTER (WHERE created_at >= NOW() - INTERVAL '7 days'),
+		       count(*) FILTER (WHERE created_at >= NOW() - INTERVAL '30 days')
+		FROM users
+		WHERE deleted_at IS NULL`,
+	).Scan(&stats.Total, &stats.Created24h, &stats.Created7d, &stats.Created30d)
+	if err != nil {
+		return userStats{}, err
+	}
+
+	// generate_series supplies the days without signups. created_at holds the
+	// session time zone's wall clock (DEFAULT NOW()), so it is converted to
+	// UTC before bucketing: the days are UTC whatever the server's TimeZone.
+	// The raw range, a day wider than any offset, keeps the created_at index.
+	rows, err := r.conn().QueryContext(ctx, `
+		SELECT to_char(d.day, 'YYYY-MM-DD'), COALESCE(s.count, 0)
+		FROM generate_series($1::timestamp, $2::timestamp, INTERVAL '1 day') AS d(day)
+		LEFT JOIN (
+			SELECT date_trunc('day', created_utc) AS day, count(*) AS count
+			FROM (
+				SELECT created_at AT TIME ZONE current_setting('TimeZone') AT TIME ZONE 'UTC' AS created_utc
+				FROM users
+				WHERE deleted_at IS NULL AND created_at >= $1::date - 1 AND created_at < $2::date + 2
+			) u
+			WHERE created_utc >= $1::date AND created_utc < $2::date + 1
+			GROUP BY 1
+		) s ON s.day = d.day
+		ORDER BY d.day`,
+		start.Format("2006-01-02"), end.Format("2006-01-02"),
+	)
+	if err != nil {
+		return userStats{}, err
+	}
+	defer rows.Close()
+
+	stats.Daily = []dailySignups{}
+	for rows.Next() {
+		var day dailySignups
+		if err := rows.Scan(&day.Date, &day.Count); err != nil {
+			return userStats{}, err
+		}
+		stats.Daily = append(stats.Daily, day)
+	}
+	return stats, rows.Err()
+}
+
+// The transition is applied with a conditional UPDATE on the locked row, so
+// concurrent changes can't skip the status check
+func (r *postgresUserRepository) SetStatus(ctx context.Context, id, status string, from []string) (User, error) {
+	id = strings.ToLower(id)
+	var user User
+	err := inTx(ctx, r.db, r.tx, func(tx *sql.Tx) error {
+		before, err := lockUsers(ctx, tx, []string{id}, "deleted_at IS NULL")
+		if err != nil {
+			return err
+		}
+		old, ok := before[id]
+		if !ok {
+			return errUserNotFound
+		}
+
+		err = tx.QueryRowContext(ctx,
+			"UPDATE users SET status = $1, updated_at = NOW(), version = version + 1 WHERE id = $2 AND deleted_at IS NULL AND status = ANY($3) RETURNING "+selectColumns(userFields),
+			status, id, pq.Array(from),
+		).Scan(scanDest(&user, userFields)...)
+		if err == sql.ErrNoRows {
+			user = old
+			return errStatusNotAllowed
+		}
+		if err != nil {
+			return err
+		}
+		return insertAuditEntries(ctx, tx, newAuditEntry(ctx, auditUpdate, &old, &user))
+	})
+	if err != nil && err != errStatusNotAllowed {
+		return User{}, err
+	}
+	return user, err
+}
+
+func (r *postgresUserRepository) SetAvatarUpdatedAt(ctx context.Context, id string, t *time.Time) (User, error) {
+	id = strings.ToLower(id)
+	condition := "deleted_at IS NULL"
+	if t == nil {
+		condition += " AND avatar_updated_at IS NOT NULL"
+	}
+
+	var user User
+	err := inTx(ctx, r.db, r.tx, func(tx *sql.Tx) error {
+		before, err := lockUsers(ctx, tx, []string{id}, condition)
+		if err != nil {
+			return err
+		}
+		old, ok := before[id]
+		if !ok {
+			if t == nil {
+				// Tell a user without an avatar from a missing one
+				var exists bool
+				if err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE id = $1 AND deleted_at IS NULL)", id).Scan(&exists); err != nil {
+					return err
+				}
+				if exists {
+					return errAvatarNotFound
+				}
+			}
+			return errUserNotFound
+		}
+
+		if t != nil {
+			err = tx.QueryRowContext(ctx,
+				"UPDATE users SET avatar_updated_at = $1, updated_at = $1, version = version + 1 WHERE id = $2 RETURNING "+selectColumns(userFields),
+				*t, id,
+			).Scan(scanDest(&user, userFields)...)
+		} else {
+			err = tx.QueryRowContext(ctx,
+				"UPDATE users SET avatar_updated_at = NULL, updated_at = NOW(), version = version + 1 WHERE id = $1 RETURNING "+selectColumns(userFields),
+				id,
+			).Scan(scanDest(&user, userFields)...)
+		}
+		if err != nil {
+			return err
+		}
+		return insertAuditEntries(ctx, tx, newAuditEntry(ctx, auditUpdate, &old, &user))
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (r *postgresUserRepository) Restore(ctx context.Context, id string) (User, error) {
+	id = strings.ToLower(id)
+	var user User
+	err := inTx(ctx, r.db, r.tx, func(tx *sql.Tx) error {
+		before, err := lockUsers(ctx, tx, []string{id}, "deleted_at IS NOT NULL")
+		if err != nil {
+			return err
+		}
+		old, ok := before[id]
+		if !ok {
+			return errUserNotFound
+		}
+
+		err = tx.QueryRowContext(ctx,
+			"UPDATE users SET deleted_at = NULL, updated_at = NOW(), version = version + 1 WHERE id = $1 AND deleted_at IS NOT NULL RETURNING "+selectColumns(userFields),
+			id,
+		).Scan(scanDest(&user, userFields)...)
+		if err != nil {
+			return err
+		}
+		return insertAuditEntries(ctx, tx, newAuditEntry(ctx, auditRestore, &old, &user))
+	})
+	// Only possible when reuse is allowed, once the email was taken again
+	if isUniqueViolation(err) {
+		return User{}, errEmailTaken
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (r *postgresUserRepository) UpsertByEmail(ctx context.Context, email, name string) (User, bool, error) {
+	if r.reserveDeletedEmails {
+		var reserved bool
+		err := r.conn().QueryRowContext(ctx,
+			"SELECT EXISTS(SELECT 1 FROM users WHERE email = $1 AND deleted_at IS NOT NULL) AND NOT EXISTS(SELECT 1 FROM users WHERE email = $1 AND deleted_at IS NULL)",
+			email,
+		).Scan(&reserved)
+		if err != nil {
+			return User{}, false, err
+		}
+		if reserved {
+			return User{}, false, errEmailTaken
+		}
+	}
+
+	var user User
+	var created bool
+	err := inTx(ctx, r.db, r.tx, func(tx *sql.Tx) error {
+		var before User
+		err := tx.QueryRowContext(ctx,
+			"SELECT "+selectColumns(userFields)+" FROM users WHERE email = $1 AND deleted_at IS NULL FOR UPDATE",
+			email,
+		).Scan(scanDest(&before, userFields)...)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		err = tx.QueryRowContext(ctx, `
+			INSERT INTO users (email, name) VALUES ($1, $2)
+			ON CONFLICT (email) WHERE deleted_at IS NULL
+			DO UPDATE SET name = EXCLUDED.name, updated_at = NOW(), version = users.version + 1
+			RETURNING `+selectColumns(userFields)+`, (xmax = 0) AS created`,
+			email, name,
+		).Scan(append(scanDest(&user, userFields), &created)...)
+		if err != nil {
+			return err
+		}
+
+		if created {
+			return insertAuditEntries(ctx, tx, newAuditEntry(ctx, auditCreate, nil, &user))
+		}
+		return insertAuditEntries(ctx, tx, newAuditEntry(ctx, auditUpdate, &before, &user))
+	})
+	if err != nil {
+		return User{}, false, err
+	}
+	return user, created, nil
+}
+
+func (r *postgresUserRepository) TakenEmails(ctx context.Context, emails []string) (map[string]bool, error) {
+	query := "SELECT email FROM users WHERE email = ANY($1)"
+	if !r.reserveDeletedEmails {
+		query += " AND deleted_at IS NULL"
+	}
+
+	rows, err := r.conn().QueryContext(ctx, query, pq.Array(emails))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	taken := map[string]bool{}
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, err
+		}
+		taken[email] = true
+	}
+	return taken, rows.Err()
+}
+
+func (r *postgresUserRepository) DeleteMany(ctx context.Context, ids []string) (map[string]bool, error) {
+	var deleted map[string]bool
+	err := inTx(ctx, r.db, r.tx, func(tx *sql.Tx) error {
+		deleted = map[string]bool{}
+
+		before, err := lockUsers(ctx, tx, ids, "deleted_at IS NULL")
+		if err != nil {
+			return err
+		}
+
+		rows, err := tx.QueryContext(ctx,
+			"UPDATE users SET deleted_at = NOW(), updated_at = NOW(), version = version + 1 WHERE id = ANY($1) AND deleted_at IS NULL RETURNING id",
+			pq.Array(ids),
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		entries := []auditEntry{}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			deleted[id] = true
+			old := before[id]
+			entries = append(entries, newAuditEntry(ctx, auditDelete, &old, nil))
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return insertAuditEntries(ctx, tx, entries...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+func (r *postgresUserRepository) UpdateMany(ctx context.Context, ids []string, patch userPatch, dryRun bool) (map[string]bool, error) {
+	s := &setBuilder{}
+	patch.setColumns(s)
+	s.setExpr("updated_at", "NOW()")
+	s.setExpr("version", "version + 1")
+	s.add(fmt.Sprintf("id = ANY(%s)", s.arg(pq.Array(ids))))
+	s.add("deleted_at IS NULL")
+
+	query, err := s.update("users")
+	if err != nil {
+		return nil, err
+	}
+	query += " RETURNING " + selectColumns(userFields)
+
+	var updated map[string]bool
+	err = inTx(ctx, r.db, r.tx, func(tx *sql.Tx) error {
+		updated = map[string]bool{}
+
+		if patch.Email.Set {
+			existsQuery := "SELECT EXISTS(SELECT 1 FROM users WHERE email = $1 AND id <> ALL($2))"
+			if !r.reserveDeletedEmails {
+				existsQuery = "SELECT EXISTS(SELECT 1 FROM users WHERE email = $1 AND id <> ALL($2) AND deleted_at IS NULL)"
+			}
+
+			var exists bool
+			if err := tx.QueryRowContext(ctx, existsQuery, patch.Email.Value, pq.Array(ids)).Scan(&exists); err != nil {
+				return err
+			}
+			if exists {
+				return errEmailTaken
+			}
+		}
+
+		before, err := lockUsers(ctx, tx, ids, "deleted_at IS NULL")
+		if err != nil {
+			return err
+		}
+
+		rows, err := tx.QueryContext(ctx, query, s.args...)
+		if err != nil {
+			if isCheckViolation(err, "users_metadata_size") {
+				return errMetadataTooLarge
+			}
+			if isUniqueViolation(err) {
+				return errEmailTaken
+			}
+			return err
+		}
+		defer rows.Close()
+
+		entries := []auditEntry{}
+		for rows.Next() {
+			var user User
+			if err := rows.Scan(scanDest(&user, userFields)...); err != nil {
+				return err
+			}
+			updated[user.ID] = true
+			old := before[user.ID]
+			entries = append(entries, newAuditEntry(ctx, auditUpdate, &old, &user))
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+		if err := insertAuditEntries(ctx, tx, entries...); err != nil {
+			return err
+		}
+
+		// A dry run reports what the update did, then undoes it
+		if dryRun {
+			return errRollback
+		}
+		return nil
+	})
+	if err != nil && err != errRollback {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// Serves searches from the replica, falling back to the primary; the other
+// operations write and go to the embedded primary
+type replicaPostgresOps struct {
+	postgresUserOps
+	replicaOps postgresUserOps
+}
+
+func (r *replicaPostgresOps) Search(ctx context.Context, q string, limit int) ([]userSearchResult, error) {
+	var results []userSearchResult
+	err := replica.read(ctx, func(conn *sql.DB) error {
+		ops := r.postgresUserOps
+		if conn == replica.db {
+			ops = r.replicaOps
+		}
+		var err error
+		results, err = ops.Search(ctx, q, limit)
+		return err
+	})
+	return results, err
+}
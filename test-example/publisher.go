@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Where user events are published besides the webhooks (EVENT_PUBLISHER):
+// nowhere, a NATS subject per event, or a Kafka topic. The outbox
+// dispatcher publishes each event before marking it relayed, so a failed
+// publish is tried again with the outbox's backoff and never holds up a
+// request. Delivery is at least once: consumers drop repeats by id.
+const (
+	publisherNone  = "none"
+	publisherNATS  = "nats"
+	publisherKafka = "kafka"
+)
+
+// Time allowed for connecting and for publishing one event
+const publishTimeout = 5 * time.Second
+
+// A user event as published, the same on every bus
+type eventMessage struct {
+	// The event's outbox id; a message published again has the same one
+	ID    int64  `json:"id"`
+	Event string `json:"event"`
+	// The user after the change; before it for user.deleted
+	User       User      `json:"user"`
+	OccurredAt time.Time `json:"occurred_at"`
+	// Of the request that made the change
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Publishes user events; implement it for another message bus
+type EventPublisher interface {
+	Publish(ctx context.Context, msg eventMessage) error
+	Close() error
+}
+
+var publisher EventPublisher = noopPublisher{}
+
+// Publishes nothing
+type noopPublisher struct{}
+
+func (noopPublisher) Publish(context.Context, eventMessage) error { return nil }
+func (noopPublisher) Close() error                                { return nil }
+
+// The publisher cfg selects; nothing connects until the first event
+func newEventPublisher(cfg Config) (EventPublisher, error) {
+	if cfg.EventPublisher == publisherNone {
+		return noopPublisher{}, nil
+	}
+	brokers := commaList(cfg.EventBrokers)
+	if len(brokers) == 0 {
+		return nil, errors.New("no brokers")
+	}
+	tlsConfig, err := eventTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.EventPublisher {
+	case publisherNATS:
+		return newNATSPublisher(brokers, cfg.EventTopic, cfg.EventUsername, cfg.EventPassword, tlsConfig)
+	case publisherKafka:
+		return newKafkaPublisher(brokers, cfg.EventTopic, cfg.EventUsername, cfg.EventPassword, tlsConfig)
+	}
+	return nil, fmt.Errorf("unknown publisher %q", cfg.EventPublisher)
+}
+
+// TLS for the brokers with EVENT_TLS, trusting EVENT_TLS_CA_FILE when set
+// and the system roots otherwise; nil without
+func eventTLSConfig(cfg Config) (*tls.Config, error) {
+	if !cfg.EventTLS {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.EventTLSCAFile != "" {
+		pem, err := os.ReadFile(cfg.EventTLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", cfg.EventTLSCAFile)
+		}
+	}
+	return config, nil
+}
+
+// A copy of config for a connection to host; nil stays nil
+func tlsFor(config *tls.Config, host string) *tls.Config {
+	if config == nil {
+		return nil
+	}
+	config = config.Clone()
+	config.ServerName = host
+	return config
+}
+
+// Topic names both buses accept
+func validTopic(topic string) bool {
+	if topic == "" || len(topic) > 200 || strings.Trim(topic, ".") != topic || strings.Contains(topic, "..") {
+		return false
+	}
+	for _, r := range topic {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Columns that may appear in ORDER BY, keyed by the public sort field name.
+// Only values from this map are ever written into the SQL string.
+var sortableColumns = map[string]string{
+	"name":       "name",
+	"email":      "email",
+	"created_at": "created_at",
+}
+
+const defaultOrderBy = "created_at DESC, id DESC"
+
+// One field of a sort parameter
+type sortTerm struct {
+	Field string
+	Desc  bool
+}
+
+// Parse a sort parameter such as "created_at,-name". A leading "-" sorts
+// descending. An empty parameter returns nil, meaning the default order
+// (newest first).
+func parseSort(sort string) ([]sortTerm, error) {
+	if sort == "" {
+		return nil, nil
+	}
+
+	seen := map[string]bool{}
+	terms := []sortTerm{}
+
+	for _, field := range strings.Split(sort, ",") {
+		field = strings.TrimSpace(field)
+		term := sortTerm{Field: field}
+		if strings.HasPrefix(field, "-") {
+			term = sortTerm{Field: field[1:], Desc: true}
+		}
+
+		if _, ok := sortableColumns[term.Field]; !ok {
+			return nil, fmt.Errorf("unknown sort field %q", term.Field)
+		}
+		if seen[term.Field] {
+			return nil, fmt.Errorf("duplicate sort field %q", term.Field)
+		}
+		seen[term.Field] = true
+
+		terms = append(terms, term)
+	}
+
+	return terms, nil
+}
+
+// Build an ORDER BY expression from parsed sort terms. The id column is always
+// appended, in the direction of the last term, as a tiebreaker so pages are
+// stable.
+func buildOrderBy(terms []sortTerm) string {
+	if len(terms) == 0 {
+		return defaultOrderBy
+	}
+
+	parts := []string{}
+	direction := "ASC"
+	for _, term := range terms {
+		direction = "ASC"
+		if term.Desc {
+			direction = "DESC"
+		}
+		parts = append(parts, sortableColumns[term.Field]+" "+direction)
+	}
+
+	parts = append(parts, "id "+direction)
+	return strings.Join(parts, ", ")
+}
+
+// Accumulates WHERE conditions and their positional arguments so list and
+// count queries can share the same filters
+type whereBuilder struct {
+	conditions []string
+	args       []interface{}
+}
+
+// Register an argument and return its placeholder ($1, $2, ...)
+func (w *whereBuilder) arg(value interface{}) string {
+	w.args = append(w.args, value)
+	return fmt.Sprintf("$%d", len(w.args))
+}
+
+// Add a condition; conditions are joined with AND
+func (w *whereBuilder) add(condition string) {
+	w.conditions = append(w.conditions, condition)
+}
+
+// Render the WHERE clause, or an empty string when there are no conditions
+func (w *whereBuilder) sql() string {
+	if len(w.conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(w.conditions, " AND ")
+}
+
+// Returned when an UPDATE would have nothing to set
+var errEmptySet = errors.New("no columns to update")
+
+// Accumulates an UPDATE's SET assignments, sharing placeholder numbering with
+// its WHERE conditions. Column names and expressions come from the code;
+// values only ever become placeholders.
+type setBuilder struct {
+	whereBuilder
+	assignments []string
+}
+
+// Assign a value to a column
+func (s *setBuilder) set(column string, value interface{}) {
+	s.assignments = append(s.assignments, column+" = "+s.arg(value))
+}
+
+// Assign an SQL expression to a column; values in it go through arg
+func (s *setBuilder) setExpr(column, expr string) {
+	s.assignments = append(s.assignments, column+" = "+expr)
+}
+
+// Whether nothing has been assigned yet
+func (s *setBuilder) empty() bool {
+	return len(s.assignments) == 0
+}
+
+// Render the UPDATE statement for table, or errEmptySet without assignments
+func (s *setBuilder) update(table string) (string, error) {
+	if s.empty() {
+		return "", errEmptySet
+	}
+	return "UPDATE " + table + " SET " + strings.Join(s.assignments, ", ") + s.whereBuilder.sql(), nil
+}
+
+// Escape LIKE/ILIKE wildcards so user input is matched literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// Filters accepted by the users list
+type userFilter struct {
+	Name          string
+	Domain        string
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	// Users updated (or deleted) at or after this time
+	UpdatedSince   *time.Time
+	IncludeDeleted bool
+	Phone          string
+	Status         string
+	Role           string
+	// nil matches verified and unverified users
+	Verified *bool
+	// From metadata.<key>=<value> parameters, matched by JSONB containment
+	Metadata Metadata
+	// Only the users with these ids (lowercase); nil for any id
+	IDs []string
+}
+
+// Parse a boolean query parameter, returning def when it is absent
+func parseBoolParam(c *gin.Context, name string, def bool) (bool, error) {
+	v := c.Query(name)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false", name)
+	}
+	return b, nil
+}
+
+// Parse a timestamp query parameter as RFC3339 or a bare date (2024-01-01,
+// meaning midnight UTC). Returns nil when the parameter is absent.
+func parseTimeParam(c *gin.Context, name string) (*time.Time, error) {
+	v := c.Query(name)
+	if v == "" {
+		return nil, nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("%s must be an RFC3339 timestamp or a YYYY-MM-DD date", name)
+}
+
+// Parse list filters from the query string; empty values are treated as absent
+func parseUserFilter(c *gin.Context) (userFilter, error) {
+	filter := userFilter{
+		Name:   strings.TrimSpace(c.Query("name")),
+		Domain: c.Query("domain"),
+		Status: c.Query("status"),
+		Role:   c.Query("role"),
+		Phone:  c.Query("phone"),
+	}
+
+	var err error
+	if filter.CreatedAfter, err = parseTimeParam(c, "created_after"); err != nil {
+		return userFilter{}, err
+	}
+	if filter.CreatedBefore, err = parseTimeParam(c, "created_before"); err != nil {
+		return userFilter{}, err
+	}
+	if filter.IncludeDeleted, err = parseBoolParam(c, "include_deleted", false); err != nil {
+		return userFilter{}, err
+	}
+	if c.Query("verified") != "" {
+		verified, err := parseBoolParam(c, "verified", false)
+		if err != nil {
+			return userFilter{}, err
+		}
+		filter.Verified = &verified
+	}
+	for key, values := range c.Request.URL.Query() {
+		name, ok := strings.CutPrefix(key, "metadata.")
+		if !ok || values[0] == "" {
+			continue
+		}
+		if name == "" {
+			return userFilter{}, fmt.Errorf("metadata filter must name a key, e.g. metadata.team=platform")
+		}
+		if filter.Metadata == nil {
+			filter.Metadata = Metadata{}
+		}
+		filter.Metadata[name] = values[0]
+	}
+
+	if err := filter.validate(); err != nil {
+		return userFilter{}, err
+	}
+	return filter, nil
+}
+
+// Validate the filter's values and normalize the phone, returning the first
+// failing field
+func (f *userFilter) validate() error {
+	if strings.ContainsAny(f.Domain, "@ \t\r\n") {
+		return fieldError{Field: "domain", Rule: "domain", Message: "domain must not contain '@' or whitespace"}
+	}
+	if f.CreatedAfter != nil && f.CreatedBefore != nil && f.CreatedAfter.After(*f.CreatedBefore) {
+		return fieldError{Field: "created_after", Rule: "range", Message: "created_after must not be later than created_before"}
+	}
+	if f.Status != "" && !isValidStatus(f.Status) {
+		return fieldError{Field: "status", Rule: "oneof", Message: "status must be one of: " + strings.Join(userStatuses, ", ")}
+	}
+	if f.Role != "" && !isValidRole(f.Role) {
+		return fieldError{Field: "role", Rule: "oneof", Message: "role must be one of: " + strings.Join(userRoles, ", ")}
+	}
+	if f.Phone != "" {
+		phone, err := normalizePhone(f.Phone)
+		if err != nil {
+			return err
+		}
+		f.Phone = phone
+	}
+	return nil
+}
+
+// Add the filter's conditions to a where builder
+func (f userFilter) apply(w *whereBuilder) {
+	if !f.IncludeDeleted {
+		w.add("deleted_at IS NULL")
+	}
+	if f.Name != "" {
+		w.add(fmt.Sprintf("name ILIKE '%%' || %s || '%%'", w.arg(escapeLike(f.Name))))
+	}
+	if f.Domain != "" {
+		w.add(fmt.Sprintf("email ILIKE '%%@' || %s", w.arg(escapeLike(f.Domain))))
+	}
+	if f.CreatedAfter != nil {
+		w.add("created_at >= " + w.arg(*f.CreatedAfter))
+	}
+	if f.CreatedBefore != nil {
+		w.add("created_at < " + w.arg(*f.CreatedBefore))
+	}
+	if f.UpdatedSince != nil {
+		w.add("COALESCE(updated_at, created_at) >= " + w.arg(*f.UpdatedSince))
+	}
+	if f.Phone != "" {
+		w.add("phone = " + w.arg(f.Phone))
+	}
+	if f.Status != "" {
+		w.add("status = " + w.arg(f.Status))
+	}
+	if f.Role != "" {
+		w.add("role = " + w.arg(f.Role))
+	}
+	if f.Verified != nil {
+		w.add("email_verified = " + w.arg(*f.Verified))
+	}
+	if len(f.Metadata) > 0 {
+		w.add("metadata @> " + w.arg(f.Metadata) + "::jsonb")
+	}
+	if f.IDs != nil {
+		w.add("id = ANY(" + w.arg(pq.Array(f.IDs)) + ")")
+	}
+}
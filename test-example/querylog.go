@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Log every query (LOG_QUERIES), for debugging
+var logQueries = false
+
+// Queries slower than this are always logged (SLOW_QUERY_THRESHOLD); 0 turns
+// slow query logging off
+var slowQueryThreshold = 200 * time.Millisecond
+
+// Logged SQL is cut off after this many bytes, for bulk statements
+const maxLoggedQueryLen = 500
+
+// Open a database/sql pool whose connections log their queries to logger,
+// or to the request's logger for queries run by a request. Parameters are
+// never logged, only their count, since they include emails.
+func openDB(driverName, dsn string, logger *slog.Logger) (*sql.DB, error) {
+	// sql.Open only looks up the driver; nothing connects until first use
+	base, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	drv := base.Driver()
+	base.Close()
+
+	var connector driver.Connector = dsnConnector{dsn: dsn, driver: drv}
+	if dc, ok := drv.(driver.DriverContext); ok {
+		if connector, err = dc.OpenConnector(dsn); err != nil {
+			return nil, err
+		}
+	}
+	return sql.OpenDB(loggingConnector{connector, logger}), nil
+}
+
+// Connector for drivers that only implement driver.Driver
+type dsnConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+type loggingConnector struct {
+	driver.Connector
+	logger *slog.Logger
+}
+
+func (c loggingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &loggingConn{conn, c.logger}, nil
+}
+
+// Logs the queries run on a driver connection. The optional driver
+// interfaces are passed through, or reported as unsupported (driver.ErrSkip)
+// so database/sql falls back as it would without the wrapper.
+type loggingConn struct {
+	driver.Conn
+	logger *slog.Logger
+}
+
+func (c *loggingConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *loggingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = p.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &loggingStmt{Stmt: stmt, conn: c.Conn, logger: c.logger, query: query}, nil
+}
+
+func (c *loggingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *loggingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := q.QueryContext(ctx, query, args)
+	if err != nil {
+		if err != driver.ErrSkip {
+			logQuery(ctx, c.logger, query, len(args), start, 0, err)
+		}
+		return nil, err
+	}
+	return &loggingRows{Rows: rows, ctx: ctx, logger: c.logger, query: query, args: len(args), start: start}, nil
+}
+
+func (c *loggingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	result, err := e.ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		logQuery(ctx, c.logger, query, len(args), start, rowsAffected(result), err)
+	}
+	return result, err
+}
+
+func (c *loggingConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *loggingConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *loggingConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *loggingConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+type loggingStmt struct {
+	driver.Stmt
+	conn   driver.Conn
+	logger *slog.Logger
+	query  string
+}
+
+func (s *loggingStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	var rows driver.Rows
+	var err error
+	if q, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = q.QueryContext(ctx, args)
+	} else {
+		rows, err = s.Stmt.Query(namedValues(args))
+	}
+	if err != nil {
+		logQuery(ctx, s.logger, s.query, len(args), start, 0, err)
+		return nil, err
+	}
+	return &loggingRows{Rows: rows, ctx: ctx, logger: s.logger, query: s.query, args: len(args), start: start}, nil
+}
+
+func (s *loggingStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	var result driver.Result
+	var err error
+	if e, ok := s.Stmt.(driver.StmtExecContext); ok {
+		result, err = e.ExecContext(ctx, args)
+	} else {
+		result, err = s.Stmt.Exec(namedValues(args))
+	}
+	logQuery(ctx, s.logger, s.query, len(args), start, rowsAffected(result), err)
+	return result, err
+}
+
+// database/sql asks the statement before the connection, so both are tried
+func (s *loggingStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	if checker, ok := s.conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// Counts rows as they are read and logs the query when the rows are closed,
+// so the duration covers streaming the whole result
+type loggingRows struct {
+	driver.Rows
+	// The query's context, for the request's logger
+	ctx    context.Context
+	logger *slog.Logger
+	query  string
+	args   int
+	start  time.Time
+	count  int64
+	err    error
+}
+
+func (r *loggingRows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	if err == nil {
+		r.count++
+	} else if err != io.EOF {
+		r.err = err
+	}
+	return err
+}
+
+func (r *loggingRows) Close() error {
+	logQuery(r.ctx, r.logger, r.query, r.args, r.start, r.count, r.err)
+	return r.Rows.Close()
+}
+
+func namedValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	return values
+}
+
+func rowsAffected(result driver.Result) int64 {
+	if result == nil {
+		return 0
+	}
+	n, _ := result.RowsAffected()
+	return n
+}
+
+// Record a finished query's duration, and log it when query logging is on or
+// it was slow: at debug level, or warn level when it was slow or failed
+func logQuery(ctx context.Context, logger *slog.Logger, query string, args int, start time.Time, rows int64, err error) {
+	duration := time.Since(start)
+	name := queryName(query)
+	dbQueryDuration.observe(duration.Seconds(), name)
+	if err != nil {
+		dbQueryErrorsTotal.inc(name)
+	}
+
+	slow := slowQueryThreshold > 0 && duration >= slowQueryThreshold
+	if !slow && !logQueries {
+		return
+	}
+
+	message, level := "Query", slog.LevelDebug
+	if err != nil {
+		level = slog.LevelWarn
+	}
+	if slow {
+		message, level = "Slow query", slog.LevelWarn
+	}
+	attrs := []slog.Attr{
+		slog.Duration("duration", duration),
+		slog.Int64("rows", rows),
+		slog.Int("args", args),
+		slog.String("sql", normalizeSQL(query)),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	contextLogger(ctx, logger).LogAttrs(ctx, level, message, attrs...)
+}
+
+// Collapse whitespace so multi-line queries log on one line, and cut off
+// long statements
+func normalizeSQL(query string) string {
+	query = strings.Join(strings.Fields(query), " ")
+	if len(query) > maxLoggedQueryLen {
+		query = query[:maxLoggedQueryLen] + "..."
+	}
+	return query
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A driver whose queries take as long as their first argument says and
+// return no rows, to exercise the query log without a database
+type stubDriver struct{}
+
+func (stubDriver) Open(string) (driver.Conn, error) { return stubConn{}, nil }
+
+type stubConn struct{}
+
+func (stubConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (stubConn) Close() error                        { return nil }
+func (stubConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (stubConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := stubWait(ctx, args); err != nil {
+		return nil, err
+	}
+	return stubRows{}, nil
+}
+
+func (stubConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := stubWait(ctx, args); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func stubWait(ctx context.Context, args []driver.NamedValue) error {
+	d, _ := time.ParseDuration(args[0].Value.(string))
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type stubRows struct{}
+
+func (stubRows) Columns() []string              { return []string{"x"} }
+func (stubRows) Close() error                   { return nil }
+func (stubRows) Next(dest []driver.Value) error { return io.EOF }
+
+func init() {
+	sql.Register("stub", stubDriver{})
+}
+
+// A pool on the stub driver logging as JSON at debug level to the returned
+// buffer, with slow queries at threshold
+func newStubDB(t *testing.T, threshold time.Duration, all bool) (*sql.DB, *bytes.Buffer) {
+	t.Helper()
+	defer func(threshold time.Duration, all bool) {
+		t.Cleanup(func() { slowQueryThreshold, logQueries = threshold, all })
+	}(slowQueryThreshold, logQueries)
+	slowQueryThreshold, logQueries = threshold, all
+	defer func(level slog.Level) { t.Cleanup(func() { logLevel.Set(level) }) }(logLevel.Level())
+	logLevel.Set(slog.LevelDebug)
+
+	logs := &bytes.Buffer{}
+	pool, err := openDB("stub", "", newLogger(logs, logFormatJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pool.Close() })
+	return pool, logs
+}
+
+// The log lines with msg, decoded
+func logLines(t *testing.T, logs *bytes.Buffer, msg string) []map[string]interface{} {
+	t.Helper()
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line is not JSON: %q", line)
+		}
+		if entry["msg"] == msg {
+			lines = append(lines, entry)
+		}
+	}
+	return lines
+}
+
+func TestSlowQueryLog(t *testing.T) {
+	pool, logs := newStubDB(t, 20*time.Millisecond, false)
+	ctx := context.Background()
+
+	rows, err := pool.QueryContext(ctx, "SELECT  id\n\tFROM users WHERE name = $1", "1ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+	if logs.Len() != 0 {
+		t.Errorf("fast query logged: %s", logs)
+	}
+
+	rows, err = pool.QueryContext(ctx, "SELECT  id\n\tFROM users WHERE name = $1", "30ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+	if _, err := pool.ExecContext(ctx, "UPDATE users SET name = $1", "30ms"); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := logLines(t, logs, "Slow query")
+	if len(lines) != 2 {
+		t.Fatalf("%d slow query lines, want 2:\n%s", len(lines), logs)
+	}
+	if l := lines[0]; l["level"] != "WARN" || l["sql"] != "SELECT id FROM users WHERE name = $1" || l["args"] != float64(1) || l["rows"] != float64(0) {
+		t.Errorf("slow query line %v", l)
+	}
+	if l := lines[1]; l["sql"] != "UPDATE users SET name = $1" || l["rows"] != float64(1) {
+		t.Errorf("slow exec line %v", l)
+	}
+	if strings.Contains(logs.String(), "30ms\"") {
+		t.Errorf("query parameters logged:\n%s", logs)
+	}
+}
+
+func TestSlowQueryLogOff(t *testing.T) {
+	pool, logs := newStubDB(t, 0, false)
+	if _, err := pool.ExecContext(context.Background(), "UPDATE users SET name = $1", "30ms"); err != nil {
+		t.Fatal(err)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("logged with SLOW_QUERY_THRESHOLD=0: %s", logs)
+	}
+}
+
+func TestQueryLogOfFailedQueries(t *testing.T) {
+	pool, logs := newStubDB(t, time.Hour, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := pool.ExecContext(ctx, "UPDATE users SET name = $1", "1s"); err == nil {
+		t.Fatal("query outlived its context")
+	}
+
+	lines := logLines(t, logs, "Query")
+	if len(lines) != 1 || lines[0]["level"] != "WARN" || lines[0]["error"] != context.DeadlineExceeded.Error() {
+		t.Errorf("query log lines %v", lines)
+	}
+}
+
+// With LOG_QUERIES each query is logged at debug level, so only once
+// LOG_LEVEL is debug
+func TestQueryLogLevel(t *testing.T) {
+	pool, logs := newStubDB(t, time.Hour, true)
+	if _, err := pool.ExecContext(context.Background(), "UPDATE users SET name = $1", "1ms"); err != nil {
+		t.Fatal(err)
+	}
+	lines := logLines(t, logs, "Query")
+	if len(lines) != 1 || lines[0]["level"] != "DEBUG" || lines[0]["sql"] != "UPDATE users SET name = $1" || lines[0]["error"] != nil {
+		t.Errorf("query log lines %v", lines)
+	}
+
+	logs.Reset()
+	logLevel.Set(slog.LevelInfo)
+	if _, err := pool.ExecContext(context.Background(), "UPDATE users SET name = $1", "1ms"); err != nil {
+		t.Fatal(err)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("logged at info level: %s", logs)
+	}
+}
+
+func TestNormalizeSQL(t *testing.T) {
+	if got := normalizeSQL("  SELECT *\n\t  FROM users  "); got != "SELECT * FROM users" {
+		t.Errorf("normalizeSQL: %q", got)
+	}
+	long := normalizeSQL("INSERT INTO users VALUES " + strings.Repeat("($1), ", 200))
+	if len(long) != maxLoggedQueryLen+len("...") || !strings.HasSuffix(long, "...") {
+		t.Errorf("long statement logged as %d bytes", len(long))
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Daily request quotas of API keys (api_keys.daily_quota). Requests are
+// counted per key and UTC day in api_key_daily_usage. Like last_used_at, the
+// counts are kept in memory and added to the table at every usage flush,
+// which also reads back every key's count for the day, so with several
+// instances a key can go over its quota by what the others counted since
+// their last flush.
+
+// A UTC day, as stored in api_key_daily_usage.day
+func quotaDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// When the quota of the day t falls in starts over: the next UTC midnight
+func quotaReset(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+type quotaCounterKey struct {
+	id  string
+	day string
+}
+
+// Requests per key and day
+type apiKeyQuotaCounter struct {
+	mu sync.Mutex
+	// Counted since the last flush
+	pending map[quotaCounterKey]int64
+	// Stored for the day of the last flush, as read back then
+	stored    map[string]int64
+	storedDay string
+}
+
+var keyQuotas = &apiKeyQuotaCounter{pending: map[quotaCounterKey]int64{}, stored: map[string]int64{}}
+
+func (q *apiKeyQuotaCounter) record(id string) {
+	q.mu.Lock()
+	q.pending[quotaCounterKey{id, quotaDay(time.Now())}]++
+	q.mu.Unlock()
+}
+
+// Requests made with a key today, as far as this instance knows
+func (q *apiKeyQuotaCounter) used(id string) int64 {
+	day := quotaDay(time.Now())
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := q.pending[quotaCounterKey{id, day}]
+	if q.storedDay == day {
+		n += q.stored[id]
+	}
+	return n
+}
+
+// Add the pending counts to api_key_daily_usage and read back today's. Failed
+// writes are logged and the counts dropped, so a key can go over its quota by
+// as much.
+func (q *apiKeyQuotaCounter) flush(ctx context.Context, keys apiKeyRepository) {
+	q.mu.Lock()
+	pending := q.pending
+	q.pending = map[quotaCounterKey]int64{}
+	q.mu.Unlock()
+
+	for k, n := range pending {
+		if err := keys.AddUsage(ctx, k.id, k.day, n); err != nil {
+			loggerFrom(ctx).Error("Failed to count requests of API key", "api_key_id", k.id, "error", err)
+		}
+	}
+
+	day := quotaDay(time.Now())
+	stored, err := keys.Usage(ctx, day)
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to read API key request counts", "error", err)
+		return
+	}
+	q.mu.Lock()
+	q.stored, q.storedDay = stored, day
+	q.mu.Unlock()
+}
+
+// Flush now and then every interval, forever; main flushes once more at
+// shutdown
+func (q *apiKeyQuotaCounter) flushEvery(ctx context.Context, keys apiKeyRepository, interval time.Duration) {
+	q.flush(ctx, keys)
+	for range time.Tick(interval) {
+		q.flush(ctx, keys)
+	}
+}
+
+func (r *sqlAPIKeyRepository) AddUsage(ctx context.Context, id, day string, n int64) error {
+	query := `INSERT INTO api_key_daily_usage (api_key_id, day, requests) VALUES ($1, $2, $3)
+		ON CONFLICT (api_key_id, day) DO UPDATE SET requests = api_key_daily_usage.requests + EXCLUDED.requests`
+	if dbDialect() == driverMySQL {
+		query = `INSERT INTO api_key_daily_usage (api_key_id, day, requests) VALUES ($1, $2, $3)
+		ON DUPLICATE KEY UPDATE requests = requests + VALUES(requests)`
+	}
+	query, args := bindQuery(query, id, day, n)
+	_, err := r.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+func (r *sqlAPIKeyRepository) Usage(ctx context.Context, day string) (map[string]int64, error) {
+	query, args := bindQuery("SELECT api_key_id, requests FROM api_key_daily_usage WHERE day = $1", day)
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int64{}
+	for rows.Next() {
+		var id string
+		var n int64
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		counts[id] = n
+	}
+	return counts, rows.Err()
+}
+
+// Count a request made with key against its daily quota. Keys with a quota
+// get the X-Quota-Limit, X-Quota-Remaining and X-Quota-Reset headers; false
+// after answering 429 once the quota is used up, and those requests are not
+// counted.
+func takeQuota(c *gin.Context, key *apiKey) bool {
+	if key.DailyQuota == nil {
+		keyQuotas.record(key.ID)
+		return true
+	}
+
+	now := time.Now()
+	reset := quotaReset(now)
+	remaining := *key.DailyQuota - keyQuotas.used(key.ID)
+	c.Header("X-Quota-Limit", strconv.FormatInt(*key.DailyQuota, 10))
+	c.Header("X-Quota-Reset", reset.Format(time.RFC3339))
+	if remaining <= 0 {
+		c.Header("X-Quota-Remaining", "0")
+		c.Header("Retry-After", strconv.Itoa(ceilSeconds(reset.Sub(now))))
+		respondError(c, codeQuotaExceeded, fmt.Sprintf("Daily quota of %d requests exceeded; it resets at %s", *key.DailyQuota, reset.Format(time.RFC3339)))
+		return false
+	}
+	c.Header("X-Quota-Remaining", strconv.FormatInt(remaining-1, 10))
+	keyQuotas.record(key.ID)
+	return true
+}
+
+// Usage of an API key today and its limits
+type apiKeyUsageReport struct {
+	ID  string `json:"id"`
+	Day string `json:"day"`
+	// Requests made today; lags by up to apiKeyUsageFlushInterval for
+	// requests served by other instances
+	Requests   int64     `json:"requests"`
+	DailyQuota *int64    `json:"daily_quota"`
+	Remaining  *int64    `json:"remaining"`
+	ResetsAt   time.Time `json:"resets_at"`
+	// The limit applied to the key: its own or RATE_LIMIT, 0 when off
+	RateLimit      float64    `json:"rate_limit"`
+	RateLimitBurst int        `json:"rate_limit_burst"`
+	LastUsedAt     *time.Time `json:"last_used_at"`
+}
+
+// Show an API key's requests today against its quota and its rate limit
+func getKeyUsage(c *gin.Context) {
+	ctx := c.Request.Context()
+	key, err := getAPIKey(ctx, repositoriesFrom(ctx).apiKeys, c.Param("id"))
+	if err == errAPIKeyNotFound {
+		respondError(c, codeAPIKeyNotFound, "API key not found")
+		return
+	}
+	if err != nil {
+		respondInternal(c, "Failed to get API key usage")
+		return
+	}
+
+	now := time.Now()
+	limit := keyRateLimit(&key)
+	report := apiKeyUsageReport{
+		ID:             key.ID,
+		Day:            quotaDay(now),
+		Requests:       keyQuotas.used(key.ID),
+		DailyQuota:     key.DailyQuota,
+		ResetsAt:       quotaReset(now),
+		RateLimit:      limit.Rate,
+		RateLimitBurst: limit.Burst,
+		LastUsedAt:     key.LastUsedAt,
+	}
+	if key.DailyQuota != nil {
+		remaining := max(*key.DailyQuota-report.Requests, 0)
+		report.Remaining = &remaining
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Requests per second each client IP, and each API key without a limit of
+// its own, may make on average (RATE_LIMIT); 0 turns these limits off
+var rateLimitRate = 0.0
+
+// Requests a client may make at once after being idle (RATE_LIMIT_BURST)
+var rateLimitBurst = 20
+
+// Buckets kept by the in-memory store; the least recently used are dropped
+// beyond this, which only gives those clients a full bucket again
+const maxRateLimitBuckets = 100000
+
+// Token bucket parameters
+type rateLimit struct {
+	// Tokens added per second
+	Rate float64
+	// Bucket size
+	Burst int
+}
+
+// Outcome of taking a token
+type rateLimitResult struct {
+	Allowed bool
+	// Whole tokens left in the bucket
+	Remaining int
+	// Until the next token, when not allowed
+	RetryAfter time.Duration
+	// Until the bucket is full again
+	Reset time.Duration
+}
+
+// Where the buckets live. The in-memory store limits each instance on its
+// own; a shared store (e.g. Redis) would enforce one limit across replicas.
+type RateLimitStore interface {
+	// Take a token from key's bucket, creating a full bucket for a new key
+	Take(ctx context.Context, key string, limit rateLimit) (rateLimitResult, error)
+}
+
+var rateLimitStore RateLimitStore = newMemoryRateLimitStore(maxRateLimitBuckets)
+
+// Token buckets in memory, in least recently used order
+type memoryRateLimitStore struct {
+	max int
+
+	mu      sync.Mutex
+	lru     *list.List
+	buckets map[string]*list.Element
+}
+
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+func newMemoryRateLimitStore(max int) *memoryRateLimitStore {
+	return &memoryRateLimitStore{max: max, lru: list.New(), buckets: map[string]*list.Element{}}
+}
+
+func (s *memoryRateLimitStore) Take(ctx context.Context, key string, limit rateLimit) (rateLimitResult, error) {
+	now := time.Now()
+	burst := float64(limit.Burst)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var b *tokenBucket
+	if el, ok := s.buckets[key]; ok {
+		s.lru.MoveToFront(el)
+		b = el.Value.(*tokenBucket)
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+		b.last = now
+	} else {
+		if s.lru.Len() >= s.max {
+			oldest := s.lru.Back()
+			s.lru.Remove(oldest)
+			delete(s.buckets, oldest.Value.(*tokenBucket).key)
+		}
+		b = &tokenBucket{key: key, tokens: burst, last: now}
+		s.buckets[key] = s.lru.PushFront(b)
+	}
+
+	result := rateLimitResult{}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsDuration((1 - b.tokens) / limit.Rate)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = secondsDuration((burst - b.tokens) / limit.Rate)
+	return result, nil
+}
+
+func secondsDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// Paths never rate limited: health checks and probes
+func rateLimitExempt(path string) bool {
+	switch path {
+	case "/health", "/livez", "/readyz", "/metrics":
+		return true
+	}
+	return false
+}
+
+// Middleware limiting requests without credentials by client IP, to
+// RATE_LIMIT requests per second with bursts of RATE_LIMIT_BURST. Requests
+// with credentials are limited by limitCaller once authenticated, or by
+// client IP when the credentials are rejected. The client IP comes from
+// X-Forwarded-For only for requests from TRUSTED_PROXIES.
+func limitRate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if rateLimitExempt(c.Request.URL.Path) || hasCredentials(c) {
+			c.Next()
+			return
+		}
+		if limitByIP(c) {
+			c.Next()
+		}
+	}
+}
+
+// Middleware limiting authenticated requests: those with an API key by the
+// key, to its own rate limit or RATE_LIMIT and then its daily quota, and
+// those with a token by the token's subject, to RATE_LIMIT
+func limitCaller() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p := currentPrincipal(c)
+		if p.APIKey != nil {
+			if !allowRequest(c, "key:"+p.APIKey.ID, keyRateLimit(p.APIKey)) || !takeQuota(c, p.APIKey) {
+				return
+			}
+		} else if !allowRequest(c, "sub:"+p.Subject, rateLimit{Rate: rateLimitRate, Burst: rateLimitBurst}) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// Take a token from the client IP's bucket; false after answering 429
+func limitByIP(c *gin.Context) bool {
+	return allowRequest(c, "ip:"+c.ClientIP(), rateLimit{Rate: rateLimitRate, Burst: rateLimitBurst})
+}
+
+// The limit of an API key: its own rate with a burst of at least one second's
+// worth of requests, or RATE_LIMIT
+func keyRateLimit(key *apiKey) rateLimit {
+	if key.RateLimit == nil {
+		return rateLimit{Rate: rateLimitRate, Burst: rateLimitBurst}
+	}
+	return rateLimit{Rate: *key.RateLimit, Burst: max(rateLimitBurst, int(math.Ceil(*key.RateLimit)))}
+}
+
+// Whether the request carries an API key or bearer token
+func hasCredentials(c *gin.Context) bool {
+	return c.GetHeader("X-API-Key") != "" || c.GetHeader("Authorization") != ""
+}
+
+// Take a token from a bucket, setting the RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers; false after answering 429
+// with Retry-After once the bucket is empty. A zero rate is no limit, and a
+// failing store lets requests through.
+func allowRequest(c *gin.Context, bucket string, limit rateLimit) bool {
+	if limit.Rate <= 0 {
+		return true
+	}
+
+	result, err := rateLimitStore.Take(c.Request.Context(), bucket, limit)
+	if err != nil {
+		loggerFrom(c.Request.Context()).Error("Rate limit store failed, allowing the request", "error", err)
+		return true
+	}
+
+	c.Header("RateLimit-Limit", strconv.Itoa(limit.Burst))
+	c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+	if !result.Allowed {
+		c.Header("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+		respondError(c, codeRateLimited, "Too many requests")
+		return false
+	}
+	return true
+}
+
+// Whole seconds, rounded up, for the headers
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
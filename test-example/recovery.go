@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Middleware turning a panic in a later handler into a structured 500
+//
+// The panic value and stack are logged together with a request ID; the
+// client only gets the generic internal error and that ID to quote in bug
+// reports. The ID is assigned by assignRequestID, which runs first.
+func recoverPanics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			// A handler ending its response early (exportUsers); net/http
+			// closes the connection without logging it
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
+			loggerFrom(c.Request.Context()).Error("Panic serving request", "panic", rec, "stack", string(debug.Stack()))
+			httpPanicsTotal.inc()
+
+			// Too late for a new status once the response has started
+			if c.Writer.Written() {
+				c.Abort()
+				return
+			}
+			// Not respondInternal: withTimeout canceled the request's context
+			// as the panic went through it, which would read as the client
+			// going away
+			respondError(c, codeInternal, "Internal server error")
+		}()
+		c.Next()
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A router with routes that panic, logging as JSON to the returned buffer
+func newPanickingRouter(t *testing.T) (*gin.Engine, *bytes.Buffer) {
+	t.Helper()
+	logs := &bytes.Buffer{}
+	defer func(logger *slog.Logger) { t.Cleanup(func() { slog.SetDefault(logger) }) }(slog.Default())
+	slog.SetDefault(newLogger(logs, logFormatJSON))
+
+	// As in main, with withTimeout between the recovery and the handlers
+	r := gin.New()
+	r.Use(assignRequestID(), recoverPanics(), withTimeout(time.Minute))
+	r.GET("/panic", func(c *gin.Context) {
+		panic("boom")
+	})
+	r.GET("/panic-after-write", func(c *gin.Context) {
+		c.String(http.StatusOK, "partial")
+		c.Writer.Flush()
+		panic("late boom")
+	})
+	r.GET("/abort", func(c *gin.Context) {
+		panic(http.ErrAbortHandler)
+	})
+	return r, logs
+}
+
+func TestRecoverPanics(t *testing.T) {
+	r, logs := newPanickingRouter(t)
+
+	w := request(r, "GET", "/panic", nil, "X-Request-ID", "req-42")
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status %d, want 500", w.Code)
+	}
+	var body struct{ Error apiError }
+	decode(t, w, &body)
+	if body.Error.Code != codeInternal || strings.Contains(w.Body.String(), "boom") {
+		t.Errorf("body %s, want an internal error without the panic value", w.Body)
+	}
+	if body.Error.RequestID != "req-42" {
+		t.Errorf("request_id %q, want the X-Request-ID", body.Error.RequestID)
+	}
+
+	lines := logLines(t, logs, "Panic serving request")
+	if len(lines) != 1 {
+		t.Fatalf("%d panic log lines, want 1:\n%s", len(lines), logs)
+	}
+	line := lines[0]
+	if line["level"] != "ERROR" || line["panic"] != "boom" || line["request_id"] != "req-42" || line["path"] != "/panic" {
+		t.Errorf("log line %v", line)
+	}
+	if stack, _ := line["stack"].(string); !strings.Contains(stack, "recovery_test.go") {
+		t.Errorf("stack does not reach the panicking handler:\n%s", stack)
+	}
+
+	// Without X-Request-ID one is generated for the client to quote
+	w = request(r, "GET", "/panic", nil)
+	decode(t, w, &body)
+	if !uuidRegex.MatchString(body.Error.RequestID) || !strings.Contains(logs.String(), body.Error.RequestID) {
+		t.Errorf("generated request_id %q is not in the log", body.Error.RequestID)
+	}
+}
+
+// A response already under way keeps its status; the panic is still logged
+func TestRecoverPanicsAfterWrite(t *testing.T) {
+	r, logs := newPanickingRouter(t)
+
+	w := request(r, "GET", "/panic-after-write", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "partial" {
+		t.Errorf("status %d body %q, want the partial response", w.Code, w.Body)
+	}
+	if lines := logLines(t, logs, "Panic serving request"); len(lines) != 1 || lines[0]["panic"] != "late boom" {
+		t.Errorf("panic log lines %v", lines)
+	}
+}
+
+// http.ErrAbortHandler goes on to net/http, which drops the connection
+func TestRecoverPanicsPassesAbortHandlerOn(t *testing.T) {
+	r, logs := newPanickingRouter(t)
+
+	defer func() {
+		if rec := recover(); rec != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", rec)
+		}
+		if lines := logLines(t, logs, "Panic serving request"); len(lines) != 0 {
+			t.Errorf("aborted request logged as a panic: %v", lines)
+		}
+	}()
+	request(r, "GET", "/abort", nil)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// How long reads stay on the primary after the replica fails
+const replicaRetryAfter = 5 * time.Second
+
+// Read replica (DATABASE_READ_URL); nil when every query goes to the primary
+var replica *readReplica
+
+type readReplica struct {
+	db     *sql.DB
+	logger *slog.Logger
+	// Unix nanoseconds until which reads skip the replica
+	downUntil atomic.Int64
+	// Reads served by the primary because the replica was down
+	fallbacks atomic.Int64
+}
+
+// Open the replica named by DATABASE_READ_URL, if any. Unlike the primary it
+// isn't waited for: while it is unreachable reads fall back to the primary.
+func initReadReplica(cfg Config, logger *slog.Logger) {
+	if cfg.DatabaseReadURL == "" {
+		return
+	}
+
+	var readDB *sql.DB
+	var err error
+	if cfg.DBDriver == driverPgx {
+		readDB, _, err = openPgx(cfg.DatabaseReadURL, logger)
+	} else {
+		readDB, err = openDB(cfg.DBDriver, cfg.DatabaseReadURL, logger)
+	}
+	if err != nil {
+		fatal(logger, "Failed to open read replica", "error", err)
+	}
+	configurePool(readDB)
+	replica = &readReplica{db: readDB, logger: logger}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := readDB.PingContext(ctx); err != nil {
+		replica.markDown(err)
+		return
+	}
+	logger.Info("Read replica connected successfully")
+}
+
+// Whether reads currently skip the replica
+func (r *readReplica) down() bool {
+	return time.Now().UnixNano() < r.downUntil.Load()
+}
+
+func (r *readReplica) markDown(err error) {
+	r.downUntil.Store(time.Now().Add(replicaRetryAfter).UnixNano())
+	r.logger.Warn("Read replica unavailable, reading from the primary", "for", replicaRetryAfter, "error", err)
+}
+
+// Run a read on the replica, or on the primary while the replica is down. A
+// replica failure marks it down and runs the read again on the primary.
+func (r *readReplica) read(ctx context.Context, fn func(conn *sql.DB) error) error {
+	if r.down() {
+		r.fallbacks.Add(1)
+		return fn(db)
+	}
+
+	err := fn(r.db)
+	if !isReplicaFailure(ctx, err) {
+		return err
+	}
+	r.markDown(err)
+	r.fallbacks.Add(1)
+	return fn(db)
+}
+
+// Whether a read failed because of the replica rather than the request:
+// not a missing row, a canceled request or a constraint error
+func isReplicaFailure(ctx context.Context, err error) bool {
+	if err == nil || err == sql.ErrNoRows || err == errUserNotFound || ctx.Err() != nil {
+		return false
+	}
+	class, _ := classifyDBError(err)
+	return class == dbErrOther
+}
+
+// Serves reads from the replica, falling back to the primary. Everything
+// else goes to the embedded primary repository.
+type replicaUserRepository struct {
+	UserRepository
+	replicaRepo UserRepository
+}
+
+func (r *replicaUserRepository) read(ctx context.Context, fn func(repo UserRepository) error) error {
+	return replica.read(ctx, func(conn *sql.DB) error {
+		if conn == replica.db {
+			return fn(r.replicaRepo)
+		}
+		return fn(r.UserRepository)
+	})
+}
+
+func (r *replicaUserRepository) List(ctx context.Context, q userListQuery) ([]User, error) {
+	var users []User
+	err := r.read(ctx, func(repo UserRepository) error {
+		var err error
+		users, err = repo.List(ctx, q)
+		return err
+	})
+	return users, err
+}
+
+// Falls back to the primary only while nothing has been passed to fn, as the
+// rows would be repeated otherwise
+func (r *replicaUserRepository) Each(ctx context.Context, q userListQuery, fn func(User) error) error {
+	var started bool
+	var err error
+	return r.read(ctx, func(repo UserRepository) error {
+		if started {
+			return err
+		}
+		err = repo.Each(ctx, q, func(u User) error {
+			started = true
+			return fn(u)
+		})
+		return err
+	})
+}
+
+func (r *replicaUserRepository) Count(ctx context.Context, filter userFilter) (int64, error) {
+	var total int64
+	err := r.read(ctx, func(repo UserRepository) error {
+		var err error
+		total, err = repo.Count(ctx, filter)
+		return err
+	})
+	return total, err
+}
+
+func (r *replicaUserRepository) GetByID(ctx context.Context, id string, fields []userField, includeDeleted bool) (User, error) {
+	var user User
+	err := r.read(ctx, func(repo UserRepository) error {
+		var err error
+		user, err = repo.GetByID(ctx, id, fields, includeDeleted)
+		return err
+	})
+	return user, err
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/lib/pq"
+)
+
+// Errors returned by UserRepository implementations
+var (
+	errUserNotFound    = errors.New("user not found")
+	errEmailTaken      = errors.New("email already exists")
+	errVersionMismatch = errors.New("user has been modified")
+)
+
+// Options for UserRepository.List
+type userListQuery struct {
+	Filter userFilter
+	// Fields to read; nil reads every field
+	Fields []userField
+	// nil sorts newest first
+	Sort   []sortTerm
+	Limit  int
+	Offset int
+	// Keyset pagination: only users after this position in the default order
+	After *userCursor
+}
+
+// Storage for users, so the CRUD handlers don't depend on Postgres directly
+type UserRepository interface {
+	List(ctx context.Context, q userListQuery) ([]User, error)
+	// Passes the users List would return, ignoring Limit and Offset, to fn
+	// as the rows are read, so memory doesn't grow with the result. An
+	// error from fn stops the query and is returned.
+	Each(ctx context.Context, q userListQuery, fn func(User) error) error
+	Count(ctx context.Context, filter userFilter) (int64, error)
+	// fields nil reads every field; errUserNotFound when there is no such user
+	GetByID(ctx context.Context, id string, fields []userField, includeDeleted bool) (User, error)
+	// Looks up a non-deleted user by normalized email
+	GetByEmail(ctx context.Context, email string) (User, error)
+	// Inserts u's email, name, phone, role and metadata, returning the stored
+	// user; errEmailTaken when the email is in use
+	Create(ctx context.Context, u User) (User, error)
+	// Applies a validated, non-empty patch and returns the updated user. With
+	// versions non-nil the update only applies when the current version is one
+	// of them, otherwise errVersionMismatch.
+	Update(ctx context.Context, id string, patch userPatch, versions []int64) (User, error)
+	// Soft-deletes a user
+	Delete(ctx context.Context, id string) error
+	// Runs fn in a transaction: the operations fn makes through tx commit
+	// together when it returns nil and roll back when it returns an error or
+	// panics. fn is run again after a lost serialization conflict, and WithTx
+	// on tx joins the transaction.
+	WithTx(ctx context.Context, fn func(tx UserRepository) error) error
+	// Inserts audit entries; called on the tx of WithTx so they commit with
+	// the change they record
+	RecordAudit(ctx context.Context, entries ...auditEntry) error
+	// Count and read a page of audit_log, newest first
+	CountAudit(ctx context.Context, q auditQuery) (int64, error)
+	ListAudit(ctx context.Context, q auditQuery) ([]auditEntry, error)
+	// Look up the credentials of a non-deleted user by id or by normalized
+	// email; errUserNotFound when there is no such user
+	GetCredentials(ctx context.Context, id string) (userCredentials, error)
+	GetCredentialsByEmail(ctx context.Context, email string) (userCredentials, error)
+	// Replaces the password hash of a non-deleted user
+	SetPasswordHash(ctx context.Context, id, hash string) error
+	// Stores an email verification token hash, replacing the user's earlier
+	// ones
+	StoreVerificationToken(ctx context.Context, userID, hash string, expires time.Time) error
+	// Deletes a verification token and returns its user id; errInvalidToken
+	// when it doesn't exist or has expired. Call it on the tx of WithTx.
+	TakeVerificationToken(ctx context.Context, hash string) (string, error)
+	// Stores a password reset token hash
+	StorePasswordResetToken(ctx context.Context, userID, hash string, expires time.Time) error
+	// Marks a password reset token used, deletes the user's other unused
+	// ones and returns the user id; errInvalidToken, errTokenExpired or
+	// errTokenUsed when it can't be used. Call it on the tx of WithTx.
+	TakePasswordResetToken(ctx context.Context, hash string) (string, error)
+}
+
+// The storage the handlers use. newRouter carries it in every request's
+// context, where handlers find it with repositoriesFrom.
+type repositories struct {
+	users UserRepository
+	// For the read-only endpoints (list, count, get by ID): users unless a
+	// read replica is configured
+	reader UserRepository
+	// The Postgres-only user operations, and the same with searches on the
+	// read replica; nil on other databases, where requirePostgres answers
+	// the routes using them with 501
+	postgres       postgresUserOps
+	postgresReader postgresUserOps
+	// nil unless the database is Postgres
+	idempotency idempotencyStore
+	avatars     AvatarStore
+	apiKeys     apiKeyRepository
+	webhooks    webhookRepository
+}
+
+// The repositories on db, a pool of the DB_DRIVER database, reading from the
+// replica when one is configured
+func newRepositories(db *sql.DB) *repositories {
+	users := newUserRepository(db)
+	repos := &repositories{users: users, reader: users, apiKeys: &sqlAPIKeyRepository{db: db}, webhooks: &sqlWebhookRepository{db: db}}
+	if pg, ok := users.(*postgresUserRepository); ok {
+		pg.pool = pgxPool
+		repos.postgres, repos.postgresReader = pg, pg
+		repos.idempotency = &postgresIdempotencyStore{db: db}
+		repos.avatars = &postgresAvatarStore{db: db}
+	}
+	if replica != nil {
+		replicaUsers := newUserRepository(replica.db)
+		repos.reader = &replicaUserRepository{UserRepository: users, replicaRepo: replicaUsers}
+		if repos.postgres != nil {
+			repos.postgresReader = &replicaPostgresOps{postgresUserOps: repos.postgres, replicaOps: replicaUsers.(postgresUserOps)}
+		}
+	}
+	return repos
+}
+
+type repositoriesContextKey struct{}
+
+// A context carrying repos, for the handlers below it
+func withRepositories(ctx context.Context, repos *repositories) context.Context {
+	return context.WithValue(ctx, repositoriesContextKey{}, repos)
+}
+
+// The repositories of ctx's request. Every route runs below
+// provideRepositories, so they are always there.
+func repositoriesFrom(ctx context.Context) *repositories {
+	return ctx.Value(repositoriesContextKey{}).(*repositories)
+}
+
+// Middleware making repos available to the handlers
+func provideRepositories(repos *repositories) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request = c.Request.WithContext(withRepositories(c.Request.Context(), repos))
+		c.Next()
+	}
+}
+
+// UserRepository for the current dialect on the given pool
+func newUserRepository(db *sql.DB) UserRepository {
+	switch dbDialect() {
+	case driverSQLite:
+		return &sqliteUserRepository{db: db, reserveDeletedEmails: !allowDeletedEmailReuse}
+	case driverMySQL:
+		return &mysqlUserRepository{db: db, reserveDeletedEmails: !allowDeletedEmailReuse}
+	default:
+		return newPostgresUserRepository(db, !allowDeletedEmailReuse)
+	}
+}
+
+// Adapt a query written for Postgres ($n placeholders) and its arguments to
+// the current dialect: ? placeholders on MySQL, text timestamps on SQLite.
+// For the simple queries outside the user repositories.
+func bindQuery(query string, args ...interface{}) (string, []interface{}) {
+	switch dbDialect() {
+	case driverMySQL:
+		return rebindMySQL(query, args)
+	case driverSQLite:
+		for i, arg := range args {
+			if t, ok := arg.(time.Time); ok {
+				args[i] = sqliteTime(t)
+			}
+		}
+	}
+	return query, args
+}
+
+// Stores users in the users table
+type postgresUserRepository struct {
+	db *sql.DB
+	// Deleted users keep their email reserved (the opposite of
+	// ALLOW_DELETED_EMAIL_REUSE)
+	reserveDeletedEmails bool
+	// Prepared hot queries (GetByID, GetByEmail, Create); nil runs them
+	// unprepared. The dynamic queries are never prepared.
+	stmts *statementCache
+	// With DB_DRIVER=pgx, the native pool CreateMany copies through
+	pool *pgxpool.Pool
+	// Set on the repository passed to a WithTx function
+	tx *sql.Tx
+}
+
+// The transaction when there is one, otherwise the pool
+func (r *postgresUserRepository) conn() dbtx {
+	if r.tx != nil {
+		return r.tx
+	}
+	return r.db
+}
+
+func newPostgresUserRepository(db *sql.DB, reserveDeletedEmails bool) *postgresUserRepository {
+	r := &postgresUserRepository{db: db, reserveDeletedEmails: reserveDeletedEmails}
+	if dbPrepareStatements {
+		r.stmts = newStatementCache(db)
+	}
+	return r
+}
+
+// Run a hot single-row query, through its prepared statement when statements
+// are enabled, and scan the row into dest
+func (r *postgresUserRepository) scanRow(ctx context.Context, query string, args []interface{}, dest ...interface{}) error {
+	if r.stmts == nil {
+		return r.conn().QueryRowContext(ctx, query, args...).Scan(dest...)
+	}
+
+	stmt, err := r.stmts.get(ctx, query)
+	if err != nil {
+		return err
+	}
+	run := stmt
+	if r.tx != nil {
+		run = r.tx.StmtContext(ctx, stmt)
+	}
+	err = run.QueryRowContext(ctx, args...).Scan(dest...)
+	if isStalePlan(err) {
+		// Inside a transaction the failure has already aborted it, so only
+		// later calls benefit
+		r.stmts.forget(query, stmt)
+		return r.conn().QueryRowContext(ctx, query, args...).Scan(dest...)
+	}
+	return err
+}
+
+func (r *postgresUserRepository) List(ctx context.Context, q userListQuery) ([]User, error) {
+	return collectUsers(r.selectUsers(ctx, q, true))
+}
+
+func (r *postgresUserRepository) Each(ctx context.Context, q userListQuery, fn func(User) error) error {
+	rows, fields, err := r.selectUsers(ctx, q, false)
+	if err != nil {
+		return err
+	}
+	return scanUsers(rows, fields, fn)
+}
+
+// Run the query of List, with its Limit and Offset when paged
+func (r *postgresUserRepository) selectUsers(ctx context.Context, q userListQuery, paged bool) (*sql.Rows, []userField, error) {
+	fields := q.Fields
+	if fields == nil {
+		fields = userFields
+	}
+
+	where := &whereBuilder{}
+	q.Filter.apply(where)
+	if q.After != nil {
+		where.add(fmt.Sprintf("(created_at, id) < (%s, %s)", where.arg(q.After.CreatedAt), where.arg(q.After.ID)))
+	}
+
+	query := "SELECT " + selectColumns(fields) + " FROM users" + where.sql() + " ORDER BY " + buildOrderBy(q.Sort)
+	if paged {
+		query += fmt.Sprintf(" LIMIT %s OFFSET %s", where.arg(q.Limit), where.arg(q.Offset))
+	}
+
+	rows, err := r.conn().QueryContext(ctx, query, where.args...)
+	return rows, fields, err
+}
+
+// Scan each row into a user restricted to fields and pass it to fn, closing
+// rows when done
+func scanUsers(rows *sql.Rows, fields []userField, fn func(User) error) error {
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(scanDest(&user, fields)...); err != nil {
+			return fmt.Errorf("scan user row %d: %w", n, err)
+		}
+		if err := fn(user); err != nil {
+			return err
+		}
+		n++
+	}
+	// A connection failure mid-stream ends the loop early without a Scan error
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("read user rows after %d rows: %w", n, err)
+	}
+	return nil
+}
+
+// The users of a selectUsers query as a slice
+func collectUsers(rows *sql.Rows, fields []userField, err error) ([]User, error) {
+	if err != nil {
+		return nil, err
+	}
+	users := []User{}
+	err = scanUsers(rows, fields, func(u User) error {
+		users = append(users, u)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (r *postgresUserRepository) Count(ctx context.Context, filter userFilter) (int64, error) {
+	where := &whereBuilder{}
+	filter.apply(where)
+
+	var total int64
+	err := r.conn().QueryRowContext(ctx, "SELECT count(*) FROM users"+where.sql(), where.args...).Scan(&total)
+	return total, err
+}
+
+func (r *postgresUserRepository) GetByID(ctx context.Context, id string, fields []userField, includeDeleted bool) (User, error) {
+	if fields == nil {
+		fields = userFields
+	}
+
+	query := "SELECT " + selectColumns(fields) + " FROM users WHERE id = $1"
+	if !includeDeleted {
+		query += " AND deleted_at IS NULL"
+	}
+
+	var user User
+	var err error
+	if len(fields) == len(userFields) {
+		// The full-row lookups are the hot ones; field selections would grow
+		// the cache with every combination
+		err = r.scanRow(ctx, query, []interface{}{id}, scanDest(&user, fields)...)
+	} else {
+		err = r.conn().QueryRowContext(ctx, query, id).Scan(scanDest(&user, fields)...)
+	}
+	if err == sql.ErrNoRows {
+		return User{}, errUserNotFound
+	}
+	return user, err
+}
+
+func (r *postgresUserRepository) GetByEmail(ctx context.Context, email string) (User, error) {
+	var user User
+	err := r.scanRow(ctx, "SELECT "+selectColumns(userFields)+" FROM users WHERE email = $1 AND deleted_at IS NULL", []interface{}{email},
+		scanDest(&user, userFields)...)
+	if err == sql.ErrNoRows {
+		return User{}, errUserNotFound
+	}
+	return user, err
+}
+
+func (r *postgresUserRepository) Create(ctx context.Context, u User) (User, error) {
+	// The unique index only covers active users, so reserved emails of
+	// deleted users need their own check
+	if r.reserveDeletedEmails {
+		var reserved bool
+		err := r.scanRow(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE email = $1 AND deleted_at IS NOT NULL)", []interface{}{u.Email}, &reserved)
+		if err != nil {
+			return User{}, err
+		}
+		if reserved {
+			return User{}, errEmailTaken
+		}
+	}
+
+	// Taken emails are caught by the unique index rather than a pre-check, so
+	// two concurrent creates can't both succeed
+	var user User
+	err := r.scanRow(ctx,
+		"INSERT INTO users (email, name, phone, role, metadata) VALUES ($1, $2, $3, $4, $5) RETURNING "+selectColumns(userFields),
+		[]interface{}{u.Email, u.Name, u.Phone, u.Role, u.Metadata},
+		scanDest(&user, userFields)...,
+	)
+	if isUniqueViolation(err) {
+		return User{}, errEmailTaken
+	}
+	return user, err
+}
+
+// Assign the patched columns, merging metadata with the JSONB operators.
+// Used by single and bulk updates.
+func (p userPatch) setColumns(s *setBuilder) {
+	if p.Name.Set {
+		s.set("name", p.Name.Value)
+	}
+	if p.Email.Set {
+		// A new address has to be verified again. Assigned before email, as
+		// MySQL reads columns assigned earlier in the same UPDATE.
+		s.setExpr("email_verified", "email_verified AND email = "+s.arg(p.Email.Value))
+		s.set("email", p.Email.Value)
+	}
+	if p.EmailVerified != nil {
+		s.set("email_verified", *p.EmailVerified)
+	}
+	if p.Phone.Set {
+		s.set("phone", p.Phone.sqlValue())
+	}
+	if p.Role.Set {
+		s.set("role", p.Role.Value)
+	}
+	if p.Metadata != nil {
+		set, remove := p.Metadata.mergePatch()
+		s.setExpr("metadata", fmt.Sprintf("(metadata || %s::jsonb) - %s::text[]", s.arg(set), s.arg(pq.Array(remove))))
+	}
+}
+
+// Assign the patched columns for backends that merge metadata in Go (SQLite,
+// MySQL): current is the stored metadata, merged in place
+func (p userPatch) setColumnsMerged(s *setBuilder, current Metadata) error {
+	if p.Name.Set {
+		s.set("name", p.Name.Value)
+	}
+	if p.Email.Set {
+		// A new address has to be verified again. Assigned before email, as
+		// MySQL reads columns assigned earlier in the same UPDATE.
+		s.setExpr("email_verified", "email_verified AND email = "+s.arg(p.Email.Value))
+		s.set("email", p.Email.Value)
+	}
+	if p.EmailVerified != nil {
+		s.set("email_verified", *p.EmailVerified)
+	}
+	if p.Phone.Set {
+		s.set("phone", p.Phone.sqlValue())
+	}
+	if p.Role.Set {
+		s.set("role", p.Role.Value)
+	}
+	if p.Metadata != nil {
+		merge, remove := p.Metadata.mergePatch()
+		for k, v := range merge {
+			current[k] = v
+		}
+		for _, k := range remove {
+			delete(current, k)
+		}
+		if err := current.validate(); err != nil {
+			return err
+		}
+		s.set("metadata", current)
+	}
+	return nil
+}
+
+func (r *postgresUserRepository) Update(ctx context.Context, id string, patch userPatch, versions []int64) (User, error) {
+	s := &setBuilder{}
+	patch.setColumns(s)
+	s.setExpr("updated_at", "NOW()")
+	s.setExpr("version", "version + 1")
+	s.add("id = " + s.arg(id))
+	s.add("deleted_at IS NULL")
+	if versions != nil {
+		s.add(fmt.Sprintf("version = ANY(%s)", s.arg(pq.Array(versions))))
+	}
+
+	query, err := s.update("users")
+	if err != nil {
+		return User{}, err
+	}
+	// The new state comes back with the update, so there is no read after it
+	query += " RETURNING " + selectColumns(userFields)
+
+	var user User
+	err = r.conn().QueryRowContext(ctx, query, s.args...).Scan(scanDest(&user, userFields)...)
+	if err == sql.ErrNoRows {
+		var exists bool
+		err := r.conn().QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE id = $1 AND deleted_at IS NULL)", id).Scan(&exists)
+		if err != nil {
+			return User{}, err
+		}
+		if exists {
+			return User{}, errVersionMismatch
+		}
+		return User{}, errUserNotFound
+	}
+	if isCheckViolation(err, "users_metadata_size") {
+		return User{}, errMetadataTooLarge
+	}
+	if isUniqueViolation(err) {
+		return User{}, errEmailTaken
+	}
+	return user, err
+}
+
+func (r *postgresUserRepository) Delete(ctx context.Context, id string) error {
+	result, err := r.conn().ExecContext(ctx, "UPDATE users SET deleted_at = NOW(), updated_at = NOW(), version = version + 1 WHERE id = $1 AND deleted_at IS NULL", id)
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func (r *postgresUserRepository) RecordAudit(ctx context.Context, entries ...auditEntry) error {
+	return insertAuditEntries(ctx, r.conn(), entries...)
+}
+
+func (r *postgresUserRepository) CountAudit(ctx context.Context, q auditQuery) (int64, error) {
+	return countAuditEntries(ctx, r.conn(), q)
+}
+
+func (r *postgresUserRepository) ListAudit(ctx context.Context, q auditQuery) ([]auditEntry, error) {
+	return listAuditEntries(ctx, r.conn(), q)
+}
+
+func (r *postgresUserRepository) GetCredentials(ctx context.Context, id string) (userCredentials, error) {
+	return queryCredentials(ctx, r.conn(), "id", strings.ToLower(id))
+}
+
+func (r *postgresUserRepository) GetCredentialsByEmail(ctx context.Context, email string) (userCredentials, error) {
+	return queryCredentials(ctx, r.conn(), "email", email)
+}
+
+func (r *postgresUserRepository) SetPasswordHash(ctx context.Context, id, hash string) error {
+	return storePasswordHash(ctx, r.conn(), id, hash)
+}
+
+func (r *postgresUserRepository) StoreVerificationToken(ctx context.Context, userID, hash string, expires time.Time) error {
+	return storeVerificationToken(ctx, r.conn(), userID, hash, expires)
+}
+
+func (r *postgresUserRepository) TakeVerificationToken(ctx context.Context, hash string) (string, error) {
+	return takeVerificationToken(ctx, r.conn(), hash)
+}
+
+func (r *postgresUserRepository) StorePasswordResetToken(ctx context.Context, userID, hash string, expires time.Time) error {
+	return storePasswordResetToken(ctx, r.conn(), userID, hash, expires)
+}
+
+func (r *postgresUserRepository) TakePasswordResetToken(ctx context.Context, hash string) (string, error) {
+	return takePasswordResetToken(ctx, r.conn(), hash)
+}
+
+func (r *postgresUserRepository) WithTx(ctx context.Context, fn func(tx UserRepository) error) error {
+	return inTx(ctx, r.db, r.tx, func(tx *sql.Tx) error {
+		txRepo := *r
+		txRepo.tx = tx
+		return fn(&txRepo)
+	})
+}
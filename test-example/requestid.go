@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Header carrying the request ID, in both directions and on outgoing calls
+const requestIDHeader = "X-Request-ID"
+
+// Request IDs taken from clients: a token short enough for log lines and
+// free of anything that could forge one
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestIDContextKey struct{}
+
+// A context carrying a request ID, for code that only gets the context
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, id)
+}
+
+// The request ID of ctx; empty outside requests
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// Middleware assigning each request an ID: the client's X-Request-ID when it
+// is a sane token, otherwise a new UUID. The ID is echoed in the response
+// header and included in error bodies and, through the request's logger
+// (loggerFrom), in log lines; handlers read it with c.GetString(requestIDKey)
+// or requestIDFrom(ctx), and pass it on in the X-Request-ID header of calls
+// they make.
+func assignRequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newUUID()
+		}
+		c.Set(requestIDKey, id)
+		logger := slog.Default().With("request_id", id, "method", c.Request.Method, "path", c.Request.URL.Path)
+		c.Request = c.Request.WithContext(withLogger(withRequestID(c.Request.Context(), id), logger))
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
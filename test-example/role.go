@@ -0,0 +1,23 @@
+package main
+
+// User roles; also the basis for authorization
+const (
+	roleAdmin  = "admin"
+	roleMember = "member"
+	roleViewer = "viewer"
+)
+
+var userRoles = []string{roleAdmin, roleMember, roleViewer}
+
+// Role assigned when createUser doesn't specify one
+const defaultRole = roleMember
+
+// Check whether r is a known role
+func isValidRole(r string) bool {
+	for _, role := range userRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
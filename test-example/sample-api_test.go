@@ -0,0 +1,304 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+func TestParsePagination(t *testing.T) {
+	for _, tt := range []struct {
+		query         string
+		limit, offset int
+		wantErr       bool
+	}{
+		{"", defaultPageLimit, 0, false},
+		{"?limit=10", 10, 0, false},
+		{"?limit=1", 1, 0, false},
+		{"?limit=500", maxPageLimit, 0, false},
+		{"?limit=501", maxPageLimit, 0, false},
+		{"?limit=1000000", maxPageLimit, 0, false},
+		{"?offset=0", defaultPageLimit, 0, false},
+		{"?limit=20&offset=40", 20, 40, false},
+		{"?offset=100000", defaultPageLimit, 100000, false},
+		{"?limit=0", 0, 0, true},
+		{"?limit=-5", 0, 0, true},
+		{"?limit=ten", 0, 0, true},
+		{"?limit=1.5", 0, 0, true},
+		{"?offset=-1", 0, 0, true},
+		{"?offset=x", 0, 0, true},
+		{"?limit=99999999999999999999", 0, 0, true},
+		{"?offset=99999999999999999999", 0, 0, true},
+	} {
+		c, _ := testContext("GET", "/api/users"+tt.query)
+		limit, offset, err := parsePagination(c)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error %v, want error %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		if limit != tt.limit || offset != tt.offset {
+			t.Errorf("%q: limit %d offset %d, want %d and %d", tt.query, limit, offset, tt.limit, tt.offset)
+		}
+	}
+}
+
+// Invalid pagination is answered with the structured 400 before the query
+// runs; a limit or offset too large for an int is invalid, not clamped
+func TestGetUsersRejectsInvalidPagination(t *testing.T) {
+	b := newMemoryBackend(t)
+	for _, tt := range []struct{ query, param string }{
+		{"?limit=-1", "limit"},
+		{"?limit=abc", "limit"},
+		{"?limit=99999999999999999999", "limit"},
+		{"?offset=-10", "offset"},
+		{"?offset=1e3", "offset"},
+		{"?offset=99999999999999999999", "offset"},
+	} {
+		w := request(b.api, "GET", "/api/v1/users"+tt.query, nil, "X-API-Key", b.key)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", tt.query, w.Code)
+			continue
+		}
+		var body struct{ Error apiError }
+		decode(t, w, &body)
+		if body.Error.Code != codeInvalidRequest || !strings.HasPrefix(body.Error.Message, tt.param+" must be") || body.Error.RequestID == "" {
+			t.Errorf("%s: error %+v", tt.query, body.Error)
+		}
+	}
+}
+
+// An offset past the last user, however large, is an empty page
+func TestGetUsersOffsetPastTheEnd(t *testing.T) {
+	b := newMemoryBackend(t)
+	createTestUser(t, b, "Ada")
+	createTestUser(t, b, "Grace")
+
+	for _, offset := range []string{"2", "500", strconv.Itoa(math.MaxInt)} {
+		w := request(b.api, "GET", "/api/v1/users?offset="+offset, nil, "X-API-Key", b.key)
+		if w.Code != http.StatusOK || w.Body.String() != "[]" {
+			t.Errorf("offset=%s: status %d, body %s, want []", offset, w.Code, w.Body)
+		}
+	}
+	var users []User
+	if decode(t, request(b.api, "GET", "/api/v1/users?offset=1", nil, "X-API-Key", b.key), &users); len(users) != 1 {
+		t.Errorf("offset=1 returned %d users, want 1", len(users))
+	}
+}
+
+func TestOptionalStringDecoding(t *testing.T) {
+	for _, tt := range []struct {
+		body      string
+		set, null bool
+		value     string
+		empty     bool
+	}{
+		{`{}`, false, false, "", false},
+		{`{"email": "ada@example.com"}`, false, false, "", false},
+		{`{"name": null}`, true, true, "", true},
+		{`{"name": ""}`, true, false, "", true},
+		{`{"name": "Ada"}`, true, false, "Ada", false},
+	} {
+		var p struct {
+			Name optionalString `json:"name"`
+		}
+		if err := json.Unmarshal([]byte(tt.body), &p); err != nil {
+			t.Errorf("%s: %v", tt.body, err)
+			continue
+		}
+		if p.Name.Set != tt.set || p.Name.Null != tt.null || p.Name.Value != tt.value {
+			t.Errorf("%s: name %+v", tt.body, p.Name)
+		}
+		if p.Name.Empty() != tt.empty {
+			t.Errorf("%s: Empty() = %v", tt.body, p.Name.Empty())
+		}
+	}
+	var p struct {
+		Name optionalString `json:"name"`
+	}
+	if err := json.Unmarshal([]byte(`{"name": 5}`), &p); err == nil {
+		t.Errorf("a number decoded as %+v", p.Name)
+	}
+}
+
+// Patches that change nothing or clear the email are answered with 422
+// before the update runs
+func TestUpdateUserRejectsInvalidPatches(t *testing.T) {
+	r := gin.New()
+	r.PUT("/api/users/:id", updateUser)
+	for _, body := range []string{
+		`{}`,
+		`{"email": ""}`,
+		`{"email": null}`,
+		`{"email": "not an email"}`,
+	} {
+		if w := request(r, "PUT", "/api/users/6f1c2a4e-8b3d-4c5e-9f7a-1b2c3d4e5f60", body); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: status %d, want 422", body, w.Code)
+		}
+	}
+}
+
+// Unknown roles are rejected on create, update and the list filter before
+// any query runs
+func TestUnknownRolesAreRejected(t *testing.T) {
+	r := gin.New()
+	r.GET("/api/users", getUsers)
+	r.POST("/api/users", createUser)
+	r.PATCH("/api/users/:id", updateUser)
+	id := "6f1c2a4e-8b3d-4c5e-9f7a-1b2c3d4e5f60"
+	for _, tt := range []struct {
+		method, path string
+		body         interface{}
+		status       int
+	}{
+		{"POST", "/api/users", map[string]string{"email": "ada@example.com", "name": "Ada", "role": "root"}, http.StatusUnprocessableEntity},
+		{"POST", "/api/users", map[string]string{"email": "ada@example.com", "name": "Ada", "role": "Admin"}, http.StatusUnprocessableEntity},
+		{"PATCH", "/api/users/" + id, map[string]string{"role": "superuser"}, http.StatusUnprocessableEntity},
+		{"PATCH", "/api/users/" + id, map[string]interface{}{"role": nil}, http.StatusUnprocessableEntity},
+		{"PATCH", "/api/users/" + id, map[string]string{"role": ""}, http.StatusUnprocessableEntity},
+		{"GET", "/api/users?role=root", nil, http.StatusBadRequest},
+	} {
+		if w := request(r, tt.method, tt.path, tt.body); w.Code != tt.status {
+			t.Errorf("%s %s %v: status %d, want %d", tt.method, tt.path, tt.body, w.Code, tt.status)
+		}
+	}
+}
+
+func TestUserPatchValidatesRole(t *testing.T) {
+	for _, tt := range []struct {
+		body  string
+		valid bool
+	}{
+		{`{}`, true},
+		{`{"role": "admin"}`, true},
+		{`{"role": "member"}`, true},
+		{`{"role": "viewer"}`, true},
+		{`{"role": "root"}`, false},
+		{`{"role": "VIEWER"}`, false},
+		{`{"role": ""}`, false},
+	} {
+		var p userPatch
+		if err := json.Unmarshal([]byte(tt.body), &p); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: validate() = %v, want valid %v", tt.body, err, tt.valid)
+		}
+	}
+}
+
+// The count validates its filters like the list
+func TestGetUserCountRejectsInvalidFilters(t *testing.T) {
+	r := gin.New()
+	r.GET("/api/users/count", getUserCount)
+	for _, query := range []string{"?role=root", "?status=gone", "?include_deleted=maybe", "?created_after=yesterday"} {
+		if w := request(r, "GET", "/api/users/count"+query, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestUUIDRegex(t *testing.T) {
+	for _, tt := range []struct {
+		id   string
+		want bool
+	}{
+		{"6f1c2a4e-8b3d-4c5e-9f7a-1b2c3d4e5f60", true},
+		{"6F1C2A4E-8B3D-4C5E-9F7A-1B2C3D4E5F60", true},
+		{"00000000-0000-0000-0000-000000000000", true},
+		{"", false},
+		{"1", false},
+		{"6f1c2a4e8b3d4c5e9f7a1b2c3d4e5f60", false},
+		{"{6f1c2a4e-8b3d-4c5e-9f7a-1b2c3d4e5f60}", false},
+		{"6f1c2a4e-8b3d-4c5e-9f7a-1b2c3d4e5f6", false},
+		{"6f1c2a4e-8b3d-4c5e-9f7a-1b2c3d4e5f600", false},
+		{"6g1c2a4e-8b3d-4c5e-9f7a-1b2c3d4e5f60", false},
+		{" 6f1c2a4e-8b3d-4c5e-9f7a-1b2c3d4e5f60", false},
+		{"6f1c2a4e-8b3d-4c5e-9f7a-1b2c3d4e5f60\n", false},
+		{"6f1c2a4e-8b3d-4c5e-9f7a-1b2c3d4e5f60' OR '1'='1", false},
+		{"' OR 1=1 --", false},
+		{"1; DROP TABLE users", false},
+	} {
+		if got := uuidRegex.MatchString(tt.id); got != tt.want {
+			t.Errorf("uuidRegex.MatchString(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+// Malformed ids are answered with 400 before the handler runs, on every route
+// with an :id; routes without one pass through
+func TestValidateUserIDRejectsMalformedIDs(t *testing.T) {
+	r := gin.New()
+	r.Use(validateUserID())
+	reached := 0
+	handler := func(c *gin.Context) {
+		reached++
+		c.Status(http.StatusNoContent)
+	}
+	r.GET("/api/users/search", handler)
+	r.GET("/api/users/:id", handler)
+	r.PATCH("/api/users/:id", handler)
+	r.DELETE("/api/users/:id", handler)
+	r.POST("/api/users/:id/restore", handler)
+
+	for _, id := range []string{
+		"1",
+		"abc",
+		"6f1c2a4e8b3d4c5e9f7a1b2c3d4e5f60",
+		url.PathEscape("' OR 1=1 --"),
+		url.PathEscape("1; DROP TABLE users"),
+		url.PathEscape("6f1c2a4e-8b3d-4c5e-9f7a-1b2c3d4e5f60' OR '1'='1"),
+		"%20",
+		"%00",
+	} {
+		for _, route := range []struct{ method, path string }{
+			{"GET", "/api/users/" + id},
+			{"PATCH", "/api/users/" + id},
+			{"DELETE", "/api/users/" + id},
+			{"POST", "/api/users/" + id + "/restore"},
+		} {
+			w := request(r, route.method, route.path, nil)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s %s: status %d, want 400", route.method, route.path, w.Code)
+			}
+		}
+	}
+	if reached > 0 {
+		t.Errorf("%d malformed ids reached the handler", reached)
+	}
+
+	for _, path := range []string{"/api/users/550E8400-E29B-41D4-A716-446655440000", "/api/users/search"} {
+		if w := request(r, "GET", path, nil); w.Code != http.StatusNoContent {
+			t.Errorf("%s: status %d, want it passed through", path, w.Code)
+		}
+	}
+}
+
+func TestIsUniqueViolation(t *testing.T) {
+	unique := &pq.Error{Code: "23505", Constraint: "users_email_active_key"}
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{unique, true},
+		{fmt.Errorf("insert user: %w", unique), true},
+		{&pq.Error{Code: "23514", Constraint: "users_status_check"}, false},
+		{&pq.Error{Code: "23503"}, false},
+		{sql.ErrNoRows, false},
+		{errors.New("duplicate key value violates unique constraint"), false},
+	} {
+		if got := isUniqueViolation(tt.err); got != tt.want {
+			t.Errorf("isUniqueViolation(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -1,4 +1,7 @@
 -- Database Schema for Sample API
+--
+-- For setting up a database by hand. The API applies the same schema from
+-- migrations/ (-migrate-only or AUTO_MIGRATE=true); keep the two in sync.
 
 -- Create database (run as postgres superuser)
 -- CREATE DATABASE testdb;
@@ -9,25 +12,214 @@
 -- Enable UUID extension
 CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
 
+-- Enable trigram matching for /api/users/search
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
 -- Users table
 CREATE TABLE IF NOT EXISTS users (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
-    email VARCHAR(255) UNIQUE NOT NULL,
+    email VARCHAR(255) NOT NULL,
     name VARCHAR(255) NOT NULL,
     created_at TIMESTAMP DEFAULT NOW(),
-    updated_at TIMESTAMP DEFAULT NOW()
+    updated_at TIMESTAMP DEFAULT NOW(),
+    deleted_at TIMESTAMP
+);
+
+-- Soft delete (for databases created before deleted_at existed)
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+
+-- Emails are unique among non-deleted users only, so a deleted user's email
+-- can be reused when ALLOW_DELETED_EMAIL_REUSE is enabled
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_email_key;
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_active_key ON users(email) WHERE deleted_at IS NULL;
+
+-- Avatars: the image lives in user_avatars, users.avatar_updated_at marks
+-- that one exists and versions its URL
+ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar_updated_at TIMESTAMP;
+
+-- Phone number in E.164 format (nullable)
+ALTER TABLE users ADD COLUMN IF NOT EXISTS phone VARCHAR(16);
+CREATE INDEX IF NOT EXISTS idx_users_phone ON users(phone);
+
+-- Account status; changed only through the suspend/activate/deactivate endpoints
+ALTER TABLE users ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'active'
+    CHECK (status IN ('active', 'suspended', 'deactivated'));
+CREATE INDEX IF NOT EXISTS idx_users_status ON users(status);
+
+-- Role used for authorization
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'member'
+    CHECK (role IN ('admin', 'member', 'viewer'));
+CREATE INDEX IF NOT EXISTS idx_users_role ON users(role);
+
+-- Arbitrary client key/value data, capped at 8KB serialized
+ALTER TABLE users ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}'::jsonb;
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_metadata_size;
+ALTER TABLE users ADD CONSTRAINT users_metadata_size CHECK (jsonb_typeof(metadata) = 'object' AND octet_length(metadata::text) <= 8192);
+CREATE INDEX IF NOT EXISTS idx_users_metadata ON users USING gin (metadata);
+
+-- Row version for optimistic concurrency (ETag / If-Match); every write
+-- increments it
+ALTER TABLE users ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+
+-- Bcrypt password hashes for logging in, and when each was set; sessions
+-- issued before then are rejected
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_hash VARCHAR(72);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_changed_at TIMESTAMP;
+
+-- Whether each user confirmed their email. Users from before verification
+-- existed count as verified: the column is added with TRUE, then new users
+-- default to FALSE.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE users ALTER COLUMN email_verified SET DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS user_avatars (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    content_type VARCHAR(50) NOT NULL,
+    data BYTEA NOT NULL,
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
 );
 
 -- Create indexes for performance
 CREATE INDEX IF NOT EXISTS idx_users_email ON users(email);
 CREATE INDEX IF NOT EXISTS idx_users_created_at ON users(created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_users_name_trgm ON users USING gin (name gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_users_email_trgm ON users USING gin (email gin_trgm_ops);
+
+-- Stored responses for Idempotency-Key replay
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key VARCHAR(255) PRIMARY KEY,
+    request_hash CHAR(64) NOT NULL,
+    status_code INTEGER,
+    response_headers JSONB,
+    response_body BYTEA,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
+
+-- API keys: only the SHA-256 of a key is stored, plus its first characters
+-- to tell keys apart
+CREATE TABLE IF NOT EXISTS api_keys (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    name VARCHAR(100) NOT NULL,
+    prefix VARCHAR(16) NOT NULL,
+    key_hash CHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    -- Updated in batches, so it can lag by a minute
+    last_used_at TIMESTAMP,
+    -- Revoked keys are kept for auditing
+    revoked_at TIMESTAMP,
+    -- Mapped to scopes by ROLE_SCOPES
+    role VARCHAR(50) NOT NULL DEFAULT 'member',
+    -- Requests per second; NULL applies RATE_LIMIT
+    rate_limit DOUBLE PRECISION,
+    -- Requests per UTC day; NULL is unlimited
+    daily_quota BIGINT
+);
+
+-- Requests made with each API key per UTC day, counted in batches
+CREATE TABLE IF NOT EXISTS api_key_daily_usage (
+    api_key_id UUID NOT NULL REFERENCES api_keys(id),
+    day DATE NOT NULL,
+    requests BIGINT NOT NULL,
+    PRIMARY KEY (api_key_id, day)
+);
+
+-- Changes to users with who made them
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    occurred_at TIMESTAMP NOT NULL,
+    -- "api_key:<id>", "jwt:<subject>" or "system"
+    actor VARCHAR(255) NOT NULL,
+    action VARCHAR(20) NOT NULL,
+    -- No foreign key: entries outlive the users they describe
+    user_id UUID NOT NULL,
+    -- Changed fields' old and new values
+    changes JSONB NOT NULL,
+    request_id VARCHAR(128) NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_user_id ON audit_log(user_id, id);
+CREATE INDEX IF NOT EXISTS idx_audit_log_actor ON audit_log(actor, id);
+CREATE INDEX IF NOT EXISTS idx_audit_log_occurred_at ON audit_log(occurred_at);
+
+-- Single-use email verification tokens; only a token's SHA-256 is stored
+CREATE TABLE IF NOT EXISTS email_verification_tokens (
+    token_hash CHAR(64) PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_email_verification_tokens_user_id ON email_verification_tokens(user_id);
+
+-- Single-use password reset tokens; used ones are kept until they expire to
+-- tell reuse from a wrong token
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+    token_hash CHAR(64) PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_password_reset_tokens_user_id ON password_reset_tokens(user_id);
+
+-- Webhooks and their deliveries; the secret is kept in plaintext, as it is
+-- needed to sign every delivery
+CREATE TABLE IF NOT EXISTS webhooks (
+    id UUID PRIMARY KEY,
+    url VARCHAR(2048) NOT NULL,
+    secret VARCHAR(255) NOT NULL,
+    -- Comma-separated; empty for every event
+    events VARCHAR(255) NOT NULL DEFAULT '',
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id UUID PRIMARY KEY,
+    webhook_id UUID NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    event VARCHAR(50) NOT NULL,
+    -- pending, succeeded or failed
+    status VARCHAR(20) NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    response_status INTEGER,
+    error TEXT NOT NULL DEFAULT '',
+    -- The exact body sent, which the signature covers
+    payload TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    last_attempt_at TIMESTAMP,
+    next_attempt_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook_id ON webhook_deliveries(webhook_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at);
+
+-- Events of committed changes to users, written in the same transaction and
+-- relayed to webhooks by the outbox dispatcher
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGSERIAL PRIMARY KEY,
+    event VARCHAR(50) NOT NULL,
+    user_id UUID NOT NULL,
+    payload TEXT NOT NULL,
+    occurred_at TIMESTAMP NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMP NOT NULL,
+    delivered_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_outbox_pending ON outbox(id) WHERE delivered_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_outbox_delivered_at ON outbox(delivered_at);
 
 -- Sample data for testing
 INSERT INTO users (email, name) VALUES
     ('john.doe@example.com', 'John Doe'),
     ('jane.smith@example.com', 'Jane Smith'),
     ('bob.wilson@example.com', 'Bob Wilson')
-ON CONFLICT (email) DO NOTHING;
+ON CONFLICT (email) WHERE deleted_at IS NULL DO NOTHING;
 
 -- Helper function to cleanup test data
 CREATE OR REPLACE FUNCTION cleanup_test_data()
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Session tokens issued by POST /api/auth/login (AUTH_MODES=session): "st_",
+// base64url JSON claims, ".", and their HMAC-SHA256 with SESSION_SECRET.
+// Each request looks the user up, so tokens of deleted or inactive users and
+// tokens issued before the last password change are rejected, and scopes
+// follow the user's current role.
+const sessionTokenPrefix = "st_"
+
+// Key signing session tokens (SESSION_SECRET); changing it ends every session
+var sessionSecret []byte
+
+// How long a session token is valid (SESSION_TTL)
+var sessionTTL = 24 * time.Hour
+
+type sessionClaims struct {
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// A token for the user with the given id, valid for sessionTTL from now
+func issueSessionToken(userID string, now time.Time) (string, time.Time) {
+	expires := now.Add(sessionTTL)
+	claims, _ := json.Marshal(sessionClaims{Subject: userID, IssuedAt: now.Unix(), ExpiresAt: expires.Unix()})
+	signed := sessionTokenPrefix + base64.RawURLEncoding.EncodeToString(claims)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sessionSignature(signed)), expires
+}
+
+func sessionSignature(signed string) []byte {
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+// Principal for a session token
+func sessionPrincipal(ctx context.Context, token string) (*principal, error) {
+	invalid := func(message string) error {
+		return authError{message: message, invalid: true}
+	}
+
+	signed, sig, ok := strings.Cut(token, ".")
+	signature, err := base64.RawURLEncoding.DecodeString(sig)
+	if !ok || err != nil || !hmac.Equal(signature, sessionSignature(signed)) {
+		return nil, invalid("Invalid session token")
+	}
+	var claims sessionClaims
+	if decodeJWTPart(strings.TrimPrefix(signed, sessionTokenPrefix), &claims) != nil || claims.Subject == "" {
+		return nil, invalid("Malformed session token")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, invalid("Session expired")
+	}
+
+	creds, err := repositoriesFrom(ctx).users.GetCredentials(ctx, claims.Subject)
+	if err == errUserNotFound {
+		return nil, invalid("Session user no longer exists")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if creds.PasswordChangedAt != nil && claims.IssuedAt < creds.PasswordChangedAt.Unix() {
+		return nil, invalid("Session ended by a password change")
+	}
+	if creds.Status != statusActive {
+		return nil, invalid("User is " + creds.Status)
+	}
+
+	return &principal{Mode: authModeSession, Subject: creds.UserID, Scopes: grantedScopes([]string{creds.Role}, nil)}, nil
+}
+
+// Middleware answering 501 unless mode is in AUTH_MODES
+func requireAuthMode(mode string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authModes[mode] {
+			respondError(c, codeNotImplemented, c.Request.Method+" "+c.FullPath()+" requires AUTH_MODES to include "+mode)
+			return
+		}
+		c.Next()
+	}
+}
+
+type loginInput struct {
+	Email    string `json:"email" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// Exchange an email and password for a session token
+//
+// Every failure, whether the email is unknown, the user has no password or
+// the password is wrong, gets the same answer after the same bcrypt work.
+// Failures are throttled and lock the email after LOGIN_MAX_FAILURES.
+func login(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var input loginInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	email, ip := normalizeEmail(input.Email), c.ClientIP()
+	if !allowLoginAttempt(c, email, ip) {
+		return
+	}
+
+	creds, err := repositoriesFrom(ctx).users.GetCredentialsByEmail(ctx, email)
+	if err != nil && err != errUserNotFound {
+		respondInternal(c, "Failed to check credentials")
+		return
+	}
+	if !checkPassword(creds.PasswordHash, input.Password) {
+		failLogin(c, email, ip, creds.UserID)
+		return
+	}
+	clearLoginFailures(ctx, email)
+	// Only someone who knows the password learns the status
+	if creds.Status != statusActive {
+		respondError(c, codeForbidden, "User is "+creds.Status)
+		return
+	}
+
+	token, expires := issueSessionToken(creds.UserID, time.Now())
+	c.JSON(http.StatusOK, gin.H{
+		"token":      token,
+		"token_type": "Bearer",
+		"expires_at": expires.UTC(),
+		"user_id":    creds.UserID,
+	})
+}
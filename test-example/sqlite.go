@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	// Registers the "sqlite" database/sql driver
+	_ "modernc.org/sqlite"
+)
+
+// Timestamps are stored as text with a fixed-width fraction so that string
+// comparison (ORDER BY, cursors, created_after) matches time order
+const sqliteTimeLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeLayout)
+}
+
+// Column expressions that differ from the Postgres ones in userFields. The
+// driver only converts plain TIMESTAMP columns to time.Time, not expressions,
+// and the SQLite schema never had NULL names or update times to paper over.
+// Avatars are Postgres-only, so there is never an avatar URL.
+var sqliteColumnOverrides = map[string]string{
+	"name":       "name",
+	"updated_at": "updated_at",
+	"avatar_url": "NULL",
+}
+
+// Begin transactions with BEGIN IMMEDIATE unless the DSN says otherwise. A
+// deferred transaction that reads before it writes can't wait for another
+// writer with busy_timeout: SQLite fails its write with SQLITE_BUSY at once.
+func normalizeSQLiteDSN(dsn string) string {
+	if strings.Contains(dsn, "_txlock=") {
+		return dsn
+	}
+	if strings.Contains(dsn, "?") {
+		return dsn + "&_txlock=immediate"
+	}
+	return dsn + "?_txlock=immediate"
+}
+
+// Comma-separated SQLite column list for the given fields
+func sqliteSelectColumns(fields []userField) string {
+	columns := make([]string, len(fields))
+	for i, f := range fields {
+		columns[i] = f.column
+		if column, ok := sqliteColumnOverrides[f.name]; ok {
+			columns[i] = column
+		}
+	}
+	return strings.Join(columns, ", ")
+}
+
+// Stores users in a SQLite database (DB_DRIVER=sqlite) for local development
+// and tests. The driver binds $n placeholders by number, so queries share
+// whereBuilder with Postgres; only the Postgres-specific SQL (ILIKE, JSONB,
+// NOW(), ANY) is rewritten.
+type sqliteUserRepository struct {
+	db *sql.DB
+	// Deleted users keep their email reserved (the opposite of
+	// ALLOW_DELETED_EMAIL_REUSE)
+	reserveDeletedEmails bool
+	// Set on the repository passed to a WithTx function
+	tx *sql.Tx
+}
+
+// The transaction when there is one, otherwise the pool
+func (r *sqliteUserRepository) conn() dbtx {
+	if r.tx != nil {
+		return r.tx
+	}
+	return r.db
+}
+
+// SQLite equivalent of userFilter.apply. LIKE is case-insensitive for ASCII.
+func (r *sqliteUserRepository) applyFilter(f userFilter, w *whereBuilder) {
+	if !f.IncludeDeleted {
+		w.add("deleted_at IS NULL")
+	}
+	if f.Name != "" {
+		w.add(fmt.Sprintf(`name LIKE '%%' || %s || '%%' ESCAPE '\'`, w.arg(escapeLike(f.Name))))
+	}
+	if f.Domain != "" {
+		w.add(fmt.Sprintf(`email LIKE '%%@' || %s ESCAPE '\'`, w.arg(escapeLike(f.Domain))))
+	}
+	if f.CreatedAfter != nil {
+		w.add("created_at >= " + w.arg(sqliteTime(*f.CreatedAfter)))
+	}
+	if f.CreatedBefore != nil {
+		w.add("created_at < " + w.arg(sqliteTime(*f.CreatedBefore)))
+	}
+	if f.UpdatedSince != nil {
+		w.add("COALESCE(updated_at, created_at) >= " + w.arg(sqliteTime(*f.UpdatedSince)))
+	}
+	if f.Phone != "" {
+		w.add("phone = " + w.arg(f.Phone))
+	}
+	if f.Status != "" {
+		w.add("status = " + w.arg(f.Status))
+	}
+	if f.Role != "" {
+		w.add("role = " + w.arg(f.Role))
+	}
+	if f.Verified != nil {
+		w.add("email_verified = " + w.arg(*f.Verified))
+	}
+	for k, v := range f.Metadata {
+		path := `$."` + strings.ReplaceAll(k, `"`, `\"`) + `"`
+		w.add(fmt.Sprintf("json_extract(metadata, %s) = %s", w.arg(path), w.arg(v)))
+	}
+	if f.IDs != nil {
+		placeholders := make([]string, len(f.IDs))
+		for i, id := range f.IDs {
+			placeholders[i] = w.arg(id)
+		}
+		w.add("id IN (" + strings.Join(placeholders, ", ") + ")")
+	}
+}
+
+func (r *sqliteUserRepository) List(ctx context.Context, q userListQuery) ([]User, error) {
+	return collectUsers(r.selectUsers(ctx, q, true))
+}
+
+func (r *sqliteUserRepository) Each(ctx context.Context, q userListQuery, fn func(User) error) error {
+	rows, fields, err := r.selectUsers(ctx, q, false)
+	if err != nil {
+		return err
+	}
+	return scanUsers(rows, fields, fn)
+}
+
+func (r *sqliteUserRepository) selectUsers(ctx context.Context, q userListQuery, paged bool) (*sql.Rows, []userField, error) {
+	fields := q.Fields
+	if fields == nil {
+		fields = userFields
+	}
+
+	where := &whereBuilder{}
+	r.applyFilter(q.Filter, where)
+	if q.After != nil {
+		where.add(fmt.Sprintf("(created_at, id) < (%s, %s)", where.arg(sqliteTime(q.After.CreatedAt)), where.arg(q.After.ID)))
+	}
+
+	query := "SELECT " + sqliteSelectColumns(fields) + " FROM users" + where.sql() + " ORDER BY " + buildOrderBy(q.Sort)
+	if paged {
+		query += fmt.Sprintf(" LIMIT %s OFFSET %s", where.arg(q.Limit), where.arg(q.Offset))
+	}
+
+	rows, err := r.conn().QueryContext(ctx, query, where.args...)
+	return rows, fields, err
+}
+
+func (r *sqliteUserRepository) Count(ctx context.Context, filter userFilter) (int64, error) {
+	where := &whereBuilder{}
+	r.applyFilter(filter, where)
+
+	var total int64
+	err := r.conn().QueryRowContext(ctx, "SELECT count(*) FROM users"+where.sql(), where.args...).Scan(&total)
+	return total, err
+}
+
+func (r *sqliteUserRepository) GetByID(ctx context.Context, id string, fields []userField, includeDeleted bool) (User, error) {
+	if fields == nil {
+		fields = userFields
+	}
+
+	query := "SELECT " + sqliteSelectColumns(fields) + " FROM users WHERE id = $1"
+	if !includeDeleted {
+		query += " AND deleted_at IS NULL"
+	}
+
+	var user User
+	err := r.conn().QueryRowContext(ctx, query, strings.ToLower(id)).Scan(scanDest(&user, fields)...)
+	if err == sql.ErrNoRows {
+		return User{}, errUserNotFound
+	}
+	return user, err
+}
+
+func (r *sqliteUserRepository) GetByEmail(ctx context.Context, email string) (User, error) {
+	var user User
+	err := r.conn().QueryRowContext(ctx, "SELECT "+sqliteSelectColumns(userFields)+" FROM users WHERE email = $1 AND deleted_at IS NULL", email).
+		Scan(scanDest(&user, userFields)...)
+	if err == sql.ErrNoRows {
+		return User{}, errUserNotFound
+	}
+	return user, err
+}
+
+func (r *sqliteUserRepository) Create(ctx context.Context, u User) (User, error) {
+	if r.reserveDeletedEmails {
+		var reserved bool
+		err := r.conn().QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE email = $1 AND deleted_at IS NOT NULL)", u.Email).Scan(&reserved)
+		if err != nil {
+			return User{}, err
+		}
+		if reserved {
+			return User{}, errEmailTaken
+		}
+	}
+
+	// SQLite has no UUID generator, so ids are made here
+	now := sqliteTime(time.Now())
+	var user User
+	err := r.conn().QueryRowContext(ctx,
+		"INSERT INTO users (id, email, name, phone, role, metadata, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $7) RETURNING "+sqliteSelectColumns(userFields),
+		newUUID(), u.Email, u.Name, u.Phone, u.Role, u.Metadata, now,
+	).Scan(scanDest(&user, userFields)...)
+	if isUniqueViolation(err) {
+		return User{}, errEmailTaken
+	}
+	return user, err
+}
+
+// Metadata is merged in Go rather than with json_patch, which merges nested
+// objects recursively where the Postgres || operator replaces them
+func (r *sqliteUserRepository) Update(ctx context.Context, id string, patch userPatch, versions []int64) (User, error) {
+	var user User
+	err := inTx(ctx, r.db, r.tx, func(tx *sql.Tx) error {
+		var err error
+		user, err = r.update(ctx, tx, id, patch, versions)
+		return err
+	})
+	return user, err
+}
+
+func (r *sqliteUserRepository) update(ctx context.Context, tx *sql.Tx, id string, patch userPatch, versions []int64) (User, error) {
+	var version int64
+	var metadata Metadata
+	err := tx.QueryRowContext(ctx, "SELECT version, metadata FROM users WHERE id = $1 AND deleted_at IS NULL", strings.ToLower(id)).
+		Scan(&version, &metadata)
+	if err == sql.ErrNoRows {
+		return User{}, errUserNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if versions != nil && !containsVersion(versions, version) {
+		return User{}, errVersionMismatch
+	}
+
+	s := &setBuilder{}
+	if err := patch.setColumnsMerged(s, metadata); err != nil {
+		return User{}, err
+	}
+	s.set("updated_at", sqliteTime(time.Now()))
+	s.setExpr("version", "version + 1")
+	s.add("id = " + s.arg(strings.ToLower(id)))
+
+	query, err := s.update("users")
+	if err != nil {
+		return User{}, err
+	}
+	query += " RETURNING " + sqliteSelectColumns(userFields)
+
+	var user User
+	if err := tx.QueryRowContext(ctx, query, s.args...).Scan(scanDest(&user, userFields)...); err != nil {
+		if isUniqueViolation(err) {
+			return User{}, errEmailTaken
+		}
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (r *sqliteUserRepository) Delete(ctx context.Context, id string) error {
+	now := sqliteTime(time.Now())
+	result, err := r.conn().ExecContext(ctx, "UPDATE users SET deleted_at = $1, updated_at = $1, version = version + 1 WHERE id = $2 AND deleted_at IS NULL", now, strings.ToLower(id))
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func (r *sqliteUserRepository) RecordAudit(ctx context.Context, entries ...auditEntry) error {
+	return insertAuditEntries(ctx, r.conn(), entries...)
+}
+
+func (r *sqliteUserRepository) CountAudit(ctx context.Context, q auditQuery) (int64, error) {
+	return countAuditEntries(ctx, r.conn(), q)
+}
+
+func (r *sqliteUserRepository) ListAudit(ctx context.Context, q auditQuery) ([]auditEntry, error) {
+	return listAuditEntries(ctx, r.conn(), q)
+}
+
+func (r *sqliteUserRepository) GetCredentials(ctx context.Context, id string) (userCredentials, error) {
+	return queryCredentials(ctx, r.conn(), "id", strings.ToLower(id))
+}
+
+func (r *sqliteUserRepository) GetCredentialsByEmail(ctx context.Context, email string) (userCredentials, error) {
+	return queryCredentials(ctx, r.conn(), "email", email)
+}
+
+func (r *sqliteUserRepository) SetPasswordHash(ctx context.Context, id, hash string) error {
+	return storePasswordHash(ctx, r.conn(), id, hash)
+}
+
+func (r *sqliteUserRepository) StoreVerificationToken(ctx context.Context, userID, hash string, expires time.Time) error {
+	return storeVerificationToken(ctx, r.conn(), userID, hash, expires)
+}
+
+func (r *sqliteUserRepository) TakeVerificationToken(ctx context.Context, hash string) (string, error) {
+	return takeVerificationToken(ctx, r.conn(), hash)
+}
+
+func (r *sqliteUserRepository) StorePasswordResetToken(ctx context.Context, userID, hash string, expires time.Time) error {
+	return storePasswordResetToken(ctx, r.conn(), userID, hash, expires)
+}
+
+func (r *sqliteUserRepository) TakePasswordResetToken(ctx context.Context, hash string) (string, error) {
+	return takePasswordResetToken(ctx, r.conn(), hash)
+}
+
+func (r *sqliteUserRepository) WithTx(ctx context.Context, fn func(tx UserRepository) error) error {
+	return inTx(ctx, r.db, r.tx, func(tx *sql.Tx) error {
+		txRepo := *r
+		txRepo.tx = tx
+		return fn(&txRepo)
+	})
+}
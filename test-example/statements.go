@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// Whether the Postgres repository prepares its hot queries
+// (DB_PREPARE_STATEMENTS). Off sends every query as plain text, which is what
+// the benchmark in TEST_SCENARIOS.md compares against.
+var dbPrepareStatements = true
+
+// Statements prepared on first use and reused for the life of the pool.
+// database/sql prepares a *sql.Stmt again on every connection it runs on, so a
+// dropped or recycled connection costs one re-prepare rather than an error. A
+// failed prepare is not cached and is retried by the next caller.
+type statementCache struct {
+	db    *sql.DB
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+func newStatementCache(db *sql.DB) *statementCache {
+	return &statementCache{db: db, stmts: map[string]*sql.Stmt{}}
+}
+
+// Prepared statement for query, preparing it if needed
+func (c *statementCache) get(ctx context.Context, query string) (*sql.Stmt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if stmt, ok := c.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := c.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	c.stmts[query] = stmt
+	return stmt, nil
+}
+
+// Drop a statement the server no longer accepts so the next get prepares it
+// again. It isn't closed, as other requests may be running it; the
+// server-side statements go away as the pool recycles its connections.
+func (c *statementCache) forget(query string, stmt *sql.Stmt) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stmts[query] == stmt {
+		delete(c.stmts, query)
+	}
+}
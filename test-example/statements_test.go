@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// Lookups by id through the statement cache and as plain queries, on the
+// test database (TEST_DB_DRIVER; the statements only matter on Postgres):
+//
+//	TEST_DB_DRIVER=postgres TEST_DATABASE_URL=... go test -run '^$' -bench Statements -cpu 1,16,64
+func BenchmarkStatements(b *testing.B) {
+	backend := newDatabaseBackend(b)
+	ctx := context.Background()
+	user, err := backend.repos.users.Create(ctx, User{Email: uniqueEmail("bench"), Name: "Bench User", Role: "member", Metadata: Metadata{}})
+	if err != nil {
+		b.Fatal(err)
+	}
+	query, args := "SELECT id, email, name, created_at FROM users WHERE id = $1 AND deleted_at IS NULL", []interface{}{user.ID}
+	if dbDialect() == driverMySQL {
+		query, args = rebindMySQL(query, args)
+	}
+
+	for _, mode := range []struct {
+		name  string
+		stmts *statementCache
+	}{
+		{"prepared", newStatementCache(db)},
+		{"unprepared", nil},
+	} {
+		r := &postgresUserRepository{db: db, stmts: mode.stmts}
+		b.Run(mode.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				var u User
+				for pb.Next() {
+					if err := r.scanRow(ctx, query, args, &u.ID, &u.Email, &u.Name, &u.CreatedAt); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// A statement is prepared once and prepared again after it is forgotten
+func TestStatementCache(t *testing.T) {
+	newDatabaseBackend(t)
+	cache := newStatementCache(db)
+	ctx := context.Background()
+
+	first, err := cache.get(ctx, "SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := cache.get(ctx, "SELECT 1"); again != first {
+		t.Error("statement prepared twice")
+	}
+	cache.forget("SELECT 1", first)
+	if again, _ := cache.get(ctx, "SELECT 1"); again == first {
+		t.Error("forgotten statement reused")
+	}
+	// A statement of the wrong query is left alone
+	cache.forget("SELECT 2", first)
+	if len(cache.stmts) != 1 {
+		t.Errorf("%d statements cached, want 1", len(cache.stmts))
+	}
+}
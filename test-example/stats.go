@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Longest range accepted for the per-day signup series
+const maxStatsDays = 90
+
+// Signups on one day
+type dailySignups struct {
+	Date  string `json:"date"`
+	Count int64  `json:"count"`
+}
+
+// Aggregate signup statistics for non-deleted users
+//
+// The series covers ?from= to ?to= inclusive (YYYY-MM-DD, default the last
+// 30 days, at most 90 days) with one entry per day, zero-filled. Days are UTC.
+func getUserStats(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	from, err := parseTimeParam(c, "from")
+	if err != nil {
+		respondError(c, codeInvalidRequest, err.Error())
+		return
+	}
+	to, err := parseTimeParam(c, "to")
+	if err != nil {
+		respondError(c, codeInvalidRequest, err.Error())
+		return
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	end := today
+	if to != nil {
+		end = to.UTC().Truncate(24 * time.Hour)
+	}
+	start := end.AddDate(0, 0, -29)
+	if from != nil {
+		start = from.UTC().Truncate(24 * time.Hour)
+	}
+
+	if start.After(end) {
+		respondError(c, codeInvalidRequest, "from must not be after to")
+		return
+	}
+	if days := int(end.Sub(start)/(24*time.Hour)) + 1; days > maxStatsDays {
+		respondError(c, codeInvalidRequest, "range cannot be longer than 90 days")
+		return
+	}
+
+	stats, err := repositoriesFrom(ctx).postgres.Stats(ctx, start, end)
+	if err != nil {
+		respondInternal(c, "Failed to compute user stats")
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// User account states
+const (
+	statusActive      = "active"
+	statusSuspended   = "suspended"
+	statusDeactivated = "deactivated"
+)
+
+var userStatuses = []string{statusActive, statusSuspended, statusDeactivated}
+
+// Check whether s is a known status
+func isValidStatus(s string) bool {
+	for _, status := range userStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// A status change and the states it may be applied from
+type statusTransition struct {
+	to   string
+	from []string
+	// States that are only left when the request includes a reason
+	fromWithReason []string
+}
+
+var statusTransitions = map[string]statusTransition{
+	"suspend":    {to: statusSuspended, from: []string{statusActive}},
+	"activate":   {to: statusActive, from: []string{statusSuspended}, fromWithReason: []string{statusDeactivated}},
+	"deactivate": {to: statusDeactivated, from: []string{statusActive, statusSuspended}},
+}
+
+// Optional body of a status transition
+type statusTransitionInput struct {
+	Reason string `json:"reason"`
+}
+
+// Handler for POST /api/users/:id/{suspend,activate,deactivate}
+//
+// Illegal transitions return 422.
+func transitionUserStatus(action string) gin.HandlerFunc {
+	t := statusTransitions[action]
+
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		id := c.Param("id")
+
+		var input statusTransitionInput
+		if c.Request.ContentLength != 0 {
+			if !bindJSON(c, &input) {
+				return
+			}
+		}
+		input.Reason = strings.TrimSpace(input.Reason)
+
+		allowed := t.from
+		if input.Reason != "" {
+			allowed = append(append([]string{}, t.from...), t.fromWithReason...)
+		}
+
+		user, err := repositoriesFrom(ctx).postgres.SetStatus(ctx, id, t.to, allowed)
+		if err == errUserNotFound {
+			respondError(c, codeUserNotFound, "User not found")
+			return
+		}
+		if err == errStatusNotAllowed {
+			msg := fmt.Sprintf("Cannot %s a user that is %s", action, user.Status)
+			for _, s := range t.fromWithReason {
+				if s == user.Status {
+					msg += " without a reason"
+				}
+			}
+			respondError(c, codeInvalidTransition, msg)
+			return
+		}
+		if err != nil {
+			respondInternal(c, "Failed to update user status")
+			return
+		}
+
+		if input.Reason != "" {
+			loggerFrom(c.Request.Context()).Info("User status changed", "user_id", id, "status", t.to, "reason", input.Reason)
+		}
+
+		c.JSON(http.StatusOK, user)
+	}
+}
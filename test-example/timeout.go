@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How long a request may take before its database calls are canceled
+// (REQUEST_TIMEOUT)
+var requestTimeout = 5 * time.Second
+
+// http.Server limits (SERVER_READ_HEADER_TIMEOUT, SERVER_READ_TIMEOUT,
+// SERVER_WRITE_TIMEOUT, SERVER_IDLE_TIMEOUT, SERVER_MAX_HEADER_BYTES); 0
+// turns a timeout off. ReadHeaderTimeout is what stops slowloris clients.
+// WriteTimeout runs from the end of the request headers to the end of the
+// response, so streaming routes replace it with writeTimeout.
+var (
+	serverReadHeaderTimeout = 5 * time.Second
+	serverReadTimeout       = 30 * time.Second
+	serverWriteTimeout      = 30 * time.Second
+	serverIdleTimeout       = 2 * time.Minute
+	serverMaxHeaderBytes    = 1 << 20
+)
+
+// Routes whose responses stream until the client leaves, or whose uploads
+// are processed as they arrive; withTimeout leaves them alone
+var streamingRoutes = map[string]bool{
+	"/api/v1/users/events": true,
+	"/api/v1/users/export": true,
+	"/api/v1/users/import": true,
+}
+
+// Middleware bounding the request context by d. Handlers pass the context to
+// every query, so a slow query is canceled at the deadline and a client that
+// disconnects cancels its queries too.
+func withTimeout(d time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if streamingRoutes[canonicalRoute(c.FullPath())] {
+			c.Next()
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), d)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// Middleware replacing the server's WriteTimeout for one route. d 0 removes
+// the deadline, for streaming responses that are bounded by their request
+// context instead.
+func writeTimeout(d time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var deadline time.Time
+		if d > 0 {
+			deadline = time.Now().Add(d)
+		}
+		if err := http.NewResponseController(c.Writer).SetWriteDeadline(deadline); err != nil {
+			loggerFrom(c.Request.Context()).Error("Failed to set write deadline", "route", c.FullPath(), "error", err)
+		}
+		c.Next()
+	}
+}
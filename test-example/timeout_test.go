@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A handler like one whose query is still running at the deadline: it waits
+// for the request context to end and reports the failure
+func slowQuery(c *gin.Context) {
+	<-c.Request.Context().Done()
+	respondInternal(c, "Failed to fetch users")
+}
+
+func TestRequestTimeoutAnswers504(t *testing.T) {
+	r := gin.New()
+	r.Use(withTimeout(50 * time.Millisecond))
+	r.GET("/api/users", slowQuery)
+
+	start := time.Now()
+	w := request(r, "GET", "/api/users", nil)
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status %d, want 504: %s", w.Code, w.Body)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("answered after %s, want about the timeout", elapsed)
+	}
+	var body struct{ Error apiError }
+	decode(t, w, &body)
+	if body.Error.Code != codeTimeout || body.Error.Message == "" {
+		t.Errorf("error %+v, want code %q", body.Error, codeTimeout)
+	}
+}
+
+// A client that goes away is logged as such, not as a failed request, and
+// gets no error body
+func TestClientCancelIsNotAnError(t *testing.T) {
+	logs := &bytes.Buffer{}
+	defer func(logger *slog.Logger) { t.Cleanup(func() { slog.SetDefault(logger) }) }(slog.Default())
+	slog.SetDefault(newLogger(logs, logFormatJSON))
+
+	r := gin.New()
+	r.Use(assignRequestID(), withTimeout(time.Minute))
+	r.GET("/api/users", slowQuery)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/api/users", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	time.AfterFunc(10*time.Millisecond, cancel)
+	r.ServeHTTP(w, req)
+
+	if w.Code != statusClientClosed || w.Body.Len() != 0 {
+		t.Errorf("status %d body %q, want %d without a body", w.Code, w.Body, statusClientClosed)
+	}
+	if lines := logLines(t, logs, "Client aborted the request"); len(lines) != 1 || lines[0]["path"] != "/api/users" || strings.Contains(logs.String(), "Failed") {
+		t.Errorf("log %q, want only the client abort", logs)
+	}
+}
+
+// Serve handler on a loopback port the way main does, returning the server,
+// its URL and the function canceling its requests
+func startServer(t *testing.T, handler http.Handler) (*http.Server, string, context.CancelFunc) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen on loopback: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := &http.Server{Handler: handler, BaseContext: func(net.Listener) context.Context { return ctx }}
+	go srv.Serve(ln)
+	t.Cleanup(func() {
+		cancel()
+		srv.Close()
+	})
+	return srv, "http://" + ln.Addr().String(), cancel
+}
+
+// Set the shutdown delays for one test, undoing what shutdownServer changes
+func shutdownTimings(t *testing.T, drain, timeout time.Duration) {
+	defer func(drain, timeout time.Duration) {
+		t.Cleanup(func() {
+			shutdownDrainDelay, shutdownTimeout = drain, timeout
+			shuttingDown.Store(false)
+		})
+	}(shutdownDrainDelay, shutdownTimeout)
+	shutdownDrainDelay, shutdownTimeout = drain, timeout
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	shutdownTimings(t, 0, 5*time.Second)
+	started := make(chan struct{})
+	srv, url, cancel := startServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			time.Sleep(200 * time.Millisecond)
+		}
+		io.WriteString(w, "done")
+	}))
+	// Listeners are closed by the time shutdown hooks run
+	closed := make(chan struct{})
+	srv.RegisterOnShutdown(func() { close(closed) })
+
+	result := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(url + "/slow")
+		if err == nil {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "done" {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		result <- err
+	}()
+	<-started
+	stopped := make(chan struct{})
+	go func() {
+		shutdownServer(srv, cancel, loggerFrom(context.Background()))
+		close(stopped)
+	}()
+	<-closed
+
+	// A new connection is refused while the in-flight request finishes
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: time.Second}
+	if resp, err := client.Get(url + "/late"); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable || !resp.Close {
+			t.Errorf("request after shutdown began: status %d, want refused or 503 with Connection: close", resp.StatusCode)
+		}
+	}
+
+	if err := <-result; err != nil {
+		t.Errorf("in-flight request failed: %v", err)
+	}
+	<-stopped
+	if !shuttingDown.Load() {
+		t.Error("readiness not failing during shutdown")
+	}
+}
+
+func TestShutdownCancelsRequestsAfterTimeout(t *testing.T) {
+	shutdownTimings(t, 0, 50*time.Millisecond)
+	started := make(chan struct{})
+	canceled := make(chan struct{})
+	srv, url, cancel := startServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		close(canceled)
+	}))
+
+	go func() {
+		if resp, err := http.Get(url); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+	shutdownServer(srv, cancel, loggerFrom(context.Background()))
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("request context not canceled after shutdownTimeout")
+	}
+}
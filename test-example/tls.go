@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How often GetCertificate looks at the certificate files for changes
+const certCheckInterval = 10 * time.Second
+
+// Serves the certificate from TLS_CERT_FILE/TLS_KEY_FILE, loading it again
+// when either file's modification time changes or on SIGHUP, so renewed
+// certificates are picked up without a restart. A reload that fails keeps
+// the current certificate.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	logger   *slog.Logger
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	certMod   time.Time
+	keyMod    time.Time
+	checkedAt time.Time
+}
+
+// Load the certificate; an error means the files are missing or don't form
+// a key pair. Reloads are logged to logger.
+func newCertReloader(certFile, keyFile string, logger *slog.Logger) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, logger: logger}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) reload() error {
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.certMod = certMod
+	r.keyMod = keyMod
+	r.checkedAt = time.Now()
+	return nil
+}
+
+func (r *certReloader) modTimes() (certMod, keyMod time.Time, err error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// tls.Config.GetCertificate
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	check := time.Since(r.checkedAt) >= certCheckInterval
+	if check {
+		r.checkedAt = time.Now()
+	}
+	cert, certMod, keyMod := r.cert, r.certMod, r.keyMod
+	r.mu.Unlock()
+
+	if check {
+		newCertMod, newKeyMod, err := r.modTimes()
+		if err == nil && (!newCertMod.Equal(certMod) || !newKeyMod.Equal(keyMod)) {
+			cert = r.reloadLogged("files changed")
+		}
+	}
+	return cert, nil
+}
+
+// Reload, logging the outcome, and return the certificate now in use
+func (r *certReloader) reloadLogged(reason string) *tls.Certificate {
+	if err := r.reload(); err != nil {
+		r.logger.Error("Failed to reload TLS certificate, keeping the current one", "reason", reason, "error", err)
+	} else {
+		r.logger.Info("Reloaded TLS certificate", "reason", reason)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert
+}
+
+// Reload on every SIGHUP
+func (r *certReloader) watchSIGHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			r.reloadLogged("SIGHUP")
+		}
+	}()
+}
+
+// Serve HTTPS on srv when a certificate is configured
+func configureTLS(srv *http.Server, cfg Config, logger *slog.Logger) error {
+	if cfg.TLSCertFile == "" {
+		return nil
+	}
+	reloader, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile, logger)
+	if err != nil {
+		return err
+	}
+	reloader.watchSIGHUP()
+	srv.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	return nil
+}
+
+// Server on HTTP_REDIRECT_PORT sending every request to the same URL over
+// HTTPS on the main port
+func newRedirectServer(cfg Config) *http.Server {
+	port := cfg.listenPort()
+	return &http.Server{
+		Addr:              ":" + cfg.HTTPRedirectPort,
+		ReadHeaderTimeout: cfg.ServerReadHeaderTimeout,
+		IdleTimeout:       cfg.ServerIdleTimeout,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host := r.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			if port != "443" {
+				host = net.JoinHostPort(host, port)
+			}
+
+			// 308 keeps the method and body of non-GET requests
+			status := http.StatusMovedPermanently
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				status = http.StatusPermanentRedirect
+			}
+			http.Redirect(w, r, fmt.Sprintf("https://%s%s", host, r.URL.RequestURI()), status)
+		}),
+	}
+}
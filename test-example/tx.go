@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Attempts at a transaction that keeps losing serialization conflicts
+const maxTxAttempts = 3
+
+// Returned by a transaction function to roll back without it being a failure,
+// e.g. for dry runs or when the response is an expected conflict
+var errRollback = errors.New("transaction rolled back")
+
+// A *sql.DB or *sql.Tx
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Run fn in a transaction, committing when it returns nil and rolling back
+// when it returns an error or panics. A transaction that loses a
+// serialization conflict or deadlock is run again, up to maxTxAttempts
+// times, so fn must start from scratch on every call.
+func runInTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	for attempt := 1; ; attempt++ {
+		err := runTxOnce(ctx, db, fn)
+		if err == nil || !isSerializationFailure(err) || attempt == maxTxAttempts {
+			return err
+		}
+
+		// Short jittered pause so the conflicting transactions don't collide again
+		delay := time.Duration(attempt)*10*time.Millisecond + time.Duration(rand.Int63n(int64(10*time.Millisecond)))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+func runTxOnce(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			takeCommitHooks(tx)
+			panic(p)
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		takeCommitHooks(tx)
+		return err
+	}
+	hooks := takeCommitHooks(tx)
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		hook()
+	}
+	return nil
+}
+
+// Functions waiting for transactions of runInTx to commit
+var commitHooks = struct {
+	sync.Mutex
+	hooks map[*sql.Tx][]func()
+}{hooks: map[*sql.Tx][]func(){}}
+
+// Run fn once q commits, or right away when q is not a transaction; never
+// when it rolls back. fn runs on the committing goroutine, so it must not
+// block. Only for transactions of runInTx and copyPgx.
+func afterCommit(q execer, fn func()) {
+	switch tx := q.(type) {
+	case *sql.Tx:
+		commitHooks.Lock()
+		commitHooks.hooks[tx] = append(commitHooks.hooks[tx], fn)
+		commitHooks.Unlock()
+	case *pgxExecer:
+		tx.hooks = append(tx.hooks, fn)
+	default:
+		fn()
+	}
+}
+
+// Remove and return the functions waiting for tx
+func takeCommitHooks(tx *sql.Tx) []func() {
+	commitHooks.Lock()
+	defer commitHooks.Unlock()
+	hooks := commitHooks.hooks[tx]
+	delete(commitHooks.hooks, tx)
+	return hooks
+}
+
+// Run fn in tx when there is one, otherwise in a new transaction on db
+func inTx(ctx context.Context, db *sql.DB, tx *sql.Tx, fn func(tx *sql.Tx) error) error {
+	if tx != nil {
+		return fn(tx)
+	}
+	return runInTx(ctx, db, fn)
+}
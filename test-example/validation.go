@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Whether email domains may contain non-ASCII characters (ALLOW_IDN_EMAIL).
+// Punycode (xn--) domains are always accepted.
+var allowIDNEmail = false
+
+// Longest accepted user name, in characters
+const maxNameLength = 100
+
+// Normalize a user name to trimmed Unicode NFC and check it is 1-100
+// characters with no control or invisible formatting characters (such as
+// zero-width spaces)
+func normalizeName(name string) (string, error) {
+	name = norm.NFC.String(strings.TrimSpace(name))
+
+	if name == "" {
+		return "", fieldError{Field: "name", Rule: "required", Message: "name cannot be empty"}
+	}
+	if n := utf8.RuneCountInString(name); n > maxNameLength {
+		return "", fieldError{Field: "name", Rule: "max_length", Message: fmt.Sprintf("name cannot be longer than %d characters (got %d)", maxNameLength, n)}
+	}
+	for _, r := range name {
+		if r == utf8.RuneError || unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return "", fieldError{Field: "name", Rule: "printable", Message: fmt.Sprintf("name cannot contain control or invisible characters (found %U)", r)}
+		}
+	}
+	return name, nil
+}
+
+// Normalize an email for storage and comparison: trimmed and lowercased
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Validate an email address: a bare RFC 5322 addr-spec (no display name) with
+// a local part of at most 64 bytes, at most 254 bytes in total, and a dotted
+// domain of valid host labels
+func isValidEmail(email string) bool {
+	if len(email) > 254 || strings.TrimSpace(email) != email || strings.ContainsAny(email, "<>") {
+		return false
+	}
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" {
+		return false
+	}
+
+	at := strings.LastIndex(addr.Address, "@")
+	if at < 1 {
+		return false
+	}
+	local, domain := addr.Address[:at], addr.Address[at+1:]
+	if len(local) > 64 {
+		return false
+	}
+
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if !isValidDomainLabel(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// Check one label of an email domain: 1-63 bytes of letters, digits and
+// hyphens, not starting or ending with a hyphen
+func isValidDomainLabel(label string) bool {
+	if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for _, r := range label {
+		switch {
+		case r == '-', r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+		case r > unicode.MaxASCII && allowIDNEmail && (unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Normalize a phone number to E.164: separators (spaces, dashes, dots and
+// parentheses) are stripped, a leading + is required and 8-15 digits must follow
+func normalizePhone(phone string) (string, error) {
+	normalized := strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "").Replace(strings.TrimSpace(phone))
+
+	invalid := fieldError{Field: "phone", Rule: "e164", Message: "phone must be in E.164 format, e.g. +14155552671"}
+	if !strings.HasPrefix(normalized, "+") {
+		return "", invalid
+	}
+
+	digits := normalized[1:]
+	if len(digits) < 8 || len(digits) > 15 || digits[0] == '0' {
+		return "", invalid
+	}
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return "", invalid
+		}
+	}
+
+	return normalized, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	for _, tt := range []struct{ in, want string }{
+		{"ada@example.com", "ada@example.com"},
+		{"Ada@Example.COM", "ada@example.com"},
+		{"  ada@example.com\t", "ada@example.com"},
+		{"\nADA.KING@EXAMPLE.CO.UK ", "ada.king@example.co.uk"},
+		{"", ""},
+	} {
+		if got := normalizeEmail(tt.in); got != tt.want {
+			t.Errorf("normalizeEmail(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestIsValidEmail(t *testing.T) {
+	for _, tt := range []struct {
+		email string
+		want  bool
+	}{
+		{"ada@example.com", true},
+		{"ada.king+tag@mail.example.co.uk", true},
+		{"a@b.co", true},
+		{"o'brien@example.com", true},
+		{"user@xn--bcher-kva.example", true},
+		{"user@my-host.example", true},
+		{strings.Repeat("a", 64) + "@example.com", true},
+
+		{"", false},
+		{"ada", false},
+		{"ada@", false},
+		{"@example.com", false},
+		{"ada@localhost", false},
+		{"ada@@example.com", false},
+		{"ada@example..com", false},
+		{"ada@-example.com", false},
+		{"ada@example-.com", false},
+		{"ada@exa_mple.com", false},
+		{"ada example@example.com", false},
+		{" ada@example.com", false},
+		{"ada@example.com ", false},
+		{"Ada <ada@example.com>", false},
+		{"<ada@example.com>", false},
+		{strings.Repeat("a", 65) + "@example.com", false},
+		{"a@" + strings.Repeat("b", 64) + ".com", false},
+		{"a@" + strings.Repeat(strings.Repeat("b", 60)+".", 5) + "com", false},
+		{"ada@bücher.example", false},
+	} {
+		if got := isValidEmail(tt.email); got != tt.want {
+			t.Errorf("isValidEmail(%q) = %v, want %v", tt.email, got, tt.want)
+		}
+	}
+}
+
+func TestIsValidEmailWithIDN(t *testing.T) {
+	defer func(allowed bool) { allowIDNEmail = allowed }(allowIDNEmail)
+	allowIDNEmail = true
+
+	for _, tt := range []struct {
+		email string
+		want  bool
+	}{
+		{"ada@bücher.example", true},
+		{"ada@例え.jp", true},
+		{"ada@bücher-.example", false},
+		{"ada@bü_cher.example", false},
+	} {
+		if got := isValidEmail(tt.email); got != tt.want {
+			t.Errorf("isValidEmail(%q) with ALLOW_IDN_EMAIL = %v, want %v", tt.email, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Email verification: creating a user stores a single-use token and mails a
+// link to GET /api/verify?token=..., which marks the user's email verified.
+// Only the token's SHA-256 is stored. A new token replaces the user's
+// earlier ones, and changing a user's email makes it unverified again.
+
+// How long a verification link works (EMAIL_VERIFICATION_TTL)
+var emailVerificationTTL = 24 * time.Hour
+
+// Page the link points to, given the token as ?token= (VERIFICATION_URL)
+var verificationURL = "http://localhost:8080/api/v1/verify"
+
+// Returned for verification tokens that are unknown, used or expired
+var errInvalidToken = errors.New("invalid or expired token")
+
+// A random token for a link, and the hash stored for it
+func newLinkToken() (token, hash string, err error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(secret)
+	return token, hashToken(token), nil
+}
+
+// SHA-256 of a token in hex, as stored
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Store a new verification token for the user through tx, returning it
+func newVerificationToken(ctx context.Context, tx UserRepository, userID string) (string, error) {
+	token, hash, err := newLinkToken()
+	if err != nil {
+		return "", err
+	}
+	if err := tx.StoreVerificationToken(ctx, userID, hash, time.Now().Add(emailVerificationTTL)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Mail a verification link; failures are logged, as the token can be sent
+// again
+func sendVerificationEmail(ctx context.Context, email, token string) error {
+	link, _ := url.Parse(verificationURL)
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	err := mailer.Send(ctx, mailMessage{
+		To:      email,
+		Subject: "Confirm your email address",
+		Body: "Confirm your email address by opening this link:\n\n" + link.String() +
+			"\n\nThe link works once and expires in " + emailVerificationTTL.String() + ".\n",
+	})
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to send verification email", "email", maskEmail(email), "error", err)
+	}
+	return err
+}
+
+// Send a new verification link, invalidating earlier ones
+func resendVerification(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var token string
+	var user User
+	err := repositoriesFrom(ctx).users.WithTx(ctx, func(tx UserRepository) error {
+		var err error
+		if user, err = tx.GetByID(ctx, c.Param("id"), nil, false); err != nil {
+			return err
+		}
+		if user.EmailVerified {
+			return nil
+		}
+		token, err = newVerificationToken(ctx, tx, user.ID)
+		return err
+	})
+	if err == errUserNotFound {
+		respondError(c, codeUserNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		respondInternal(c, "Failed to create verification token")
+		return
+	}
+	if user.EmailVerified {
+		respondError(c, codeAlreadyVerified, "Email is already verified")
+		return
+	}
+
+	if err := sendVerificationEmail(ctx, user.Email, token); err != nil {
+		respondInternal(c, "Failed to send verification email")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// Mark the email of the token's user verified, using up the token. Needs no
+// credentials: the token is the proof.
+func verifyEmail(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	token := c.Query("token")
+	if token == "" {
+		respondError(c, codeInvalidRequest, "token is required")
+		return
+	}
+
+	var user User
+	err := repositoriesFrom(ctx).users.WithTx(ctx, func(tx UserRepository) error {
+		id, err := tx.TakeVerificationToken(ctx, hashToken(token))
+		if err != nil {
+			return err
+		}
+		before, err := tx.GetByID(ctx, id, nil, false)
+		if err != nil {
+			return err
+		}
+		if before.EmailVerified {
+			user = before
+			return nil
+		}
+		verified := true
+		user, err = tx.Update(ctx, id, userPatch{EmailVerified: &verified}, nil)
+		if err != nil {
+			return err
+		}
+		return tx.RecordAudit(ctx, newAuditEntry(ctx, auditUpdate, &before, &user))
+	})
+	// Tokens of deleted users are as good as none
+	if err == errInvalidToken || err == errUserNotFound {
+		respondError(c, codeInvalidToken, "Verification link is invalid or expired")
+		return
+	}
+	if err != nil {
+		respondInternal(c, "Failed to verify email")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user_id": user.ID, "email_verified": true})
+}
+
+// Replace the user's verification tokens with one; the same SQL for every
+// dialect
+func storeVerificationToken(ctx context.Context, q dbtx, userID, hash string, expires time.Time) error {
+	query, args := bindQuery("DELETE FROM email_verification_tokens WHERE user_id = $1", userID)
+	if _, err := q.ExecContext(ctx, query, args...); err != nil {
+		return err
+	}
+	query, args = bindQuery("INSERT INTO email_verification_tokens (token_hash, user_id, expires_at, created_at) VALUES ($1, $2, $3, $4)",
+		hash, userID, expires.UTC(), time.Now().UTC())
+	_, err := q.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Delete a verification token and return its user's id; errInvalidToken
+// when it doesn't exist or has expired. Two requests with the same token
+// can't both succeed: only one DELETE finds the row.
+func takeVerificationToken(ctx context.Context, q dbtx, hash string) (string, error) {
+	var userID string
+	var expires time.Time
+	query, args := bindQuery("SELECT user_id, expires_at FROM email_verification_tokens WHERE token_hash = $1", hash)
+	err := q.QueryRowContext(ctx, query, args...).Scan(&userID, &expires)
+	if err == sql.ErrNoRows {
+		return "", errInvalidToken
+	}
+	if err != nil {
+		return "", err
+	}
+
+	query, args = bindQuery("DELETE FROM email_verification_tokens WHERE token_hash = $1", hash)
+	result, err := q.ExecContext(ctx, query, args...)
+	if err != nil {
+		return "", err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 || !time.Now().Before(expires) {
+		return "", errInvalidToken
+	}
+	return userID, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// API versions: every /api route lives under /api/v1. The unprefixed /api
+// paths are deprecated aliases of v1 until apiSunset: they behave the same
+// and add Deprecation, Sunset and a Link to the v1 path. A breaking change
+// mounts registerAPIRoutes again on /api/v2 with the changed handlers in
+// its apiHandlers; the other routes are shared.
+
+const (
+	apiV1Prefix     = "/api/v1"
+	legacyAPIPrefix = "/api"
+)
+
+// When the unprefixed paths were deprecated
+var legacyAPIDeprecated = time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC)
+
+// When the unprefixed paths go away (API_SUNSET)
+var apiSunset = time.Date(2027, 4, 15, 0, 0, 0, 0, time.UTC)
+
+// First segment after /api of a versioned path
+var apiVersionSegment = regexp.MustCompile(`^v[0-9]+$`)
+
+// Handlers that differ between API versions
+type apiHandlers struct {
+	createUser gin.HandlerFunc
+	updateUser gin.HandlerFunc
+}
+
+var v1Handlers = apiHandlers{createUser: createUser, updateUser: updateUser}
+
+// The v1 path of a route registered under the unprefixed /api; other paths
+// as they are. Tables keyed by route (apiOperations, routeContentTypes,
+// streamingRoutes) use v1 paths.
+func canonicalRoute(path string) string {
+	rest, ok := strings.CutPrefix(path, legacyAPIPrefix+"/")
+	if !ok {
+		return path
+	}
+	if segment, _, _ := strings.Cut(rest, "/"); apiVersionSegment.MatchString(segment) {
+		return path
+	}
+	return apiV1Prefix + "/" + rest
+}
+
+// The prefix the request's route is mounted on, for the paths in Location
+// headers
+func apiBase(c *gin.Context) string {
+	route := c.FullPath()
+	if canonicalRoute(route) != route {
+		return legacyAPIPrefix
+	}
+	rest, _ := strings.CutPrefix(route, legacyAPIPrefix+"/")
+	segment, _, _ := strings.Cut(rest, "/")
+	return legacyAPIPrefix + "/" + segment
+}
+
+// Middleware marking responses of the unprefixed aliases as deprecated
+// (RFC 9745, RFC 8594) and linking the v1 path. It runs for every route,
+// before the middleware that may answer first (validateUserID, limitRate,
+// maintenanceGate), so those answers are marked too.
+func deprecatedAlias() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if route := c.FullPath(); route == "" || canonicalRoute(route) == route {
+			c.Next()
+			return
+		}
+		h := c.Writer.Header()
+		h.Set("Deprecation", "@"+strconv.FormatInt(legacyAPIDeprecated.Unix(), 10))
+		h.Set("Sunset", apiSunset.Format(http.TimeFormat))
+		successor := apiV1Prefix + strings.TrimPrefix(c.Request.URL.Path, legacyAPIPrefix)
+		h.Add("Link", "<"+successor+`>; rel="successor-version"`)
+		c.Next()
+	}
+}
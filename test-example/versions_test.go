@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var deprecationHeaders = []string{"Deprecation", "Sunset", "Link"}
+
+// Check that the alias response has the deprecation headers for successor
+// and the v1 response has none
+func checkDeprecation(t *testing.T, name string, alias, v1 *httptest.ResponseRecorder, successor string) {
+	t.Helper()
+	want := map[string]string{
+		"Deprecation": "@1792022400",
+		"Sunset":      apiSunset.Format(http.TimeFormat),
+		"Link":        "<" + successor + `>; rel="successor-version"`,
+	}
+	for _, header := range deprecationHeaders {
+		if got := alias.Header().Get(header); got != want[header] {
+			t.Errorf("%s alias: %s %q, want %q", name, header, got, want[header])
+		}
+		if got := v1.Header().Get(header); got != "" {
+			t.Errorf("%s v1: has %s %q", name, header, got)
+		}
+	}
+}
+
+func TestLegacyAliasMatchesV1(t *testing.T) {
+	b := newDatabaseBackend(t)
+	u := createTestUser(t, b, "Alias")
+
+	for _, tt := range []struct {
+		method, path string
+		body         interface{}
+	}{
+		{"GET", "/users?sort=name&limit=5", nil},
+		{"GET", "/users/count", nil},
+		{"GET", "/users/" + u.ID, nil},
+		{"HEAD", "/users/" + u.ID, nil},
+		{"GET", "/users/by-email/" + u.Email, nil},
+		{"GET", "/users/00000000-0000-4000-8000-000000000000", nil},
+		{"GET", "/users/not-a-uuid", nil},
+		{"GET", "/users?sort=password", nil},
+		{"PATCH", "/users/" + u.ID, map[string]string{"email": "not an email"}},
+		{"GET", "/users/stats", nil},
+	} {
+		name := tt.method + " " + tt.path
+		headers := []string{"X-API-Key", b.key, "X-Request-ID", "same-request"}
+		alias := request(b.api, tt.method, legacyAPIPrefix+tt.path, tt.body, headers...)
+		v1 := request(b.api, tt.method, apiV1Prefix+tt.path, tt.body, headers...)
+
+		// Error messages name the path as it was requested
+		want := strings.ReplaceAll(v1.Body.String(), " "+apiV1Prefix+"/", " "+legacyAPIPrefix+"/")
+		if alias.Code != v1.Code || alias.Body.String() != want {
+			t.Errorf("%s: alias answered %d %s, v1 %d %s", name, alias.Code, alias.Body, v1.Code, v1.Body)
+		}
+		for _, header := range []string{"Content-Type", "Content-Length", "ETag"} {
+			if alias.Header().Get(header) != v1.Header().Get(header) {
+				t.Errorf("%s: alias %s %q, v1 %q", name, header, alias.Header().Get(header), v1.Header().Get(header))
+			}
+		}
+		path, _, _ := strings.Cut(tt.path, "?")
+		checkDeprecation(t, name, alias, v1, apiV1Prefix+path)
+	}
+}
+
+// Writes behave the same too; Location stays on the prefix the request used
+func TestLegacyAliasWrites(t *testing.T) {
+	b := newDatabaseBackend(t)
+
+	alias := request(b.api, "POST", legacyAPIPrefix+"/users", map[string]string{"email": uniqueEmail("alias"), "name": "Alias"}, "X-API-Key", b.key)
+	v1 := request(b.api, "POST", apiV1Prefix+"/users", map[string]string{"email": uniqueEmail("v1"), "name": "V1"}, "X-API-Key", b.key)
+	if alias.Code != http.StatusCreated || v1.Code != http.StatusCreated {
+		t.Fatalf("create: alias %d %s, v1 %d %s", alias.Code, alias.Body, v1.Code, v1.Body)
+	}
+	var fromAlias, fromV1 User
+	decode(t, alias, &fromAlias)
+	decode(t, v1, &fromV1)
+	if got := alias.Header().Get("Location"); got != legacyAPIPrefix+"/users/"+fromAlias.ID {
+		t.Errorf("alias Location %q", got)
+	}
+	if got := v1.Header().Get("Location"); got != apiV1Prefix+"/users/"+fromV1.ID {
+		t.Errorf("v1 Location %q", got)
+	}
+	checkDeprecation(t, "POST /users", alias, v1, apiV1Prefix+"/users")
+
+	// Each prefix reads what the other wrote
+	if w := request(b.api, "GET", apiV1Prefix+"/users/"+fromAlias.ID, nil, "X-API-Key", b.key); w.Code != http.StatusOK {
+		t.Errorf("v1 read of the alias's user: status %d", w.Code)
+	}
+	if w := request(b.api, "DELETE", legacyAPIPrefix+"/users/"+fromV1.ID, nil, "X-API-Key", b.key); w.Code != http.StatusOK && w.Code != http.StatusNoContent {
+		t.Errorf("alias delete of the v1 user: status %d", w.Code)
+	}
+	if w := request(b.api, "GET", apiV1Prefix+"/users/"+fromV1.ID, nil, "X-API-Key", b.key); w.Code != http.StatusNotFound {
+		t.Errorf("v1 read after the alias deleted: status %d", w.Code)
+	}
+}
@@ -0,0 +1,690 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Webhooks: other services register a URL under /api/webhooks and get a POST
+// for every committed change of a user. The outbox dispatcher turns each
+// event into a delivery for every webhook subscribed to it, recorded in
+// webhook_deliveries, and its workers make them: signed with the webhook's
+// secret and tried again with a doubling delay until one gets a 2xx or
+// WEBHOOK_MAX_ATTEMPTS have failed.
+
+// Events a webhook can subscribe to
+var webhookEvents = []string{eventUserCreated, eventUserUpdated, eventUserDeleted, eventUserRestored}
+
+// Delivery attempts before giving up (WEBHOOK_MAX_ATTEMPTS)
+var webhookMaxAttempts = 5
+
+// Delay before the second attempt, doubled for each further one up to
+// webhookRetryMax (WEBHOOK_RETRY_BASE, WEBHOOK_RETRY_MAX)
+var (
+	webhookRetryBase = 10 * time.Second
+	webhookRetryMax  = 10 * time.Minute
+)
+
+// Time allowed for one delivery attempt, response included (WEBHOOK_TIMEOUT)
+var webhookTimeout = 10 * time.Second
+
+// Workers making deliveries
+const webhookWorkers = 4
+
+// Webhook signatures are "sha256=" and the hex HMAC-SHA256 of the body,
+// keyed with the webhook's secret
+const webhookSignatureHeader = "X-Webhook-Signature"
+
+// Generated secrets are this followed by 43 URL-safe base64 characters
+const webhookSecretPrefix = "whsec_"
+
+// Delivery states
+const (
+	deliveryPending   = "pending"
+	deliverySucceeded = "succeeded"
+	// Every attempt failed, or the webhook was deactivated in between
+	deliveryFailed = "failed"
+)
+
+var errWebhookNotFound = errors.New("webhook not found")
+
+// A registered webhook, without its secret
+type webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Events sent; empty for every event
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Whether the webhook wants event
+func (w webhook) subscribed(event string) bool {
+	return len(w.Events) == 0 || slices.Contains(w.Events, event)
+}
+
+// One event sent to one webhook, with its attempts so far
+type webhookDelivery struct {
+	ID        string `json:"id"`
+	WebhookID string `json:"webhook_id"`
+	Event     string `json:"event"`
+	Status    string `json:"status"`
+	Attempts  int    `json:"attempts"`
+	// Of the last attempt; null when it got no response
+	ResponseStatus *int   `json:"response_status"`
+	Error          string `json:"error,omitempty"`
+	// The body sent, the same on every attempt
+	Payload       json.RawMessage `json:"payload"`
+	CreatedAt     time.Time       `json:"created_at"`
+	LastAttemptAt *time.Time      `json:"last_attempt_at"`
+	NextAttemptAt *time.Time      `json:"next_attempt_at"`
+}
+
+// Columns scanned by scanWebhook
+const webhookColumns = "id, url, events, active, created_at, updated_at"
+
+func scanWebhook(row interface{ Scan(...interface{}) error }, w *webhook, extra ...interface{}) error {
+	var events string
+	err := row.Scan(append([]interface{}{&w.ID, &w.URL, &events, &w.Active, &w.CreatedAt, &w.UpdatedAt}, extra...)...)
+	w.Events = commaList(events)
+	if w.Events == nil {
+		w.Events = []string{}
+	}
+	return err
+}
+
+// A random webhook secret
+func newWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return webhookSecretPrefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// Signature header value for body
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Storage for the webhooks and their deliveries, as the /webhooks handlers
+// and the outbox dispatcher see them
+type webhookRepository interface {
+	// errWebhookNotFound when there is no such webhook
+	Get(ctx context.Context, id string) (webhook, error)
+	// Webhooks, oldest first; only the active ones with activeOnly
+	List(ctx context.Context, activeOnly bool) ([]webhook, error)
+	Create(ctx context.Context, w webhook, secret string) error
+	// Applies the set fields of a validated input; errWebhookNotFound when
+	// there is no such webhook
+	Update(ctx context.Context, id string, input webhookInput) error
+	// Deletes a webhook and its deliveries; errWebhookNotFound when there is
+	// no such webhook
+	Delete(ctx context.Context, id string) error
+	// Count and read a page of a webhook's deliveries, newest first
+	CountDeliveries(ctx context.Context, q webhookDeliveryQuery) (int64, error)
+	ListDeliveries(ctx context.Context, q webhookDeliveryQuery) ([]webhookDelivery, error)
+}
+
+// Filters and page of a webhook_deliveries read
+type webhookDeliveryQuery struct {
+	WebhookID string
+	// Empty for every status
+	Status string
+	Limit  int
+	Offset int
+}
+
+func (q webhookDeliveryQuery) where() *whereBuilder {
+	where := &whereBuilder{}
+	where.add("webhook_id = " + where.arg(q.WebhookID))
+	if q.Status != "" {
+		where.add("status = " + where.arg(q.Status))
+	}
+	return where
+}
+
+// Stores webhooks in the webhooks and webhook_deliveries tables, on every
+// dialect
+type sqlWebhookRepository struct {
+	db *sql.DB
+}
+
+func (r *sqlWebhookRepository) Get(ctx context.Context, id string) (webhook, error) {
+	var w webhook
+	query, args := bindQuery("SELECT "+webhookColumns+" FROM webhooks WHERE id = $1", strings.ToLower(id))
+	err := scanWebhook(r.db.QueryRowContext(ctx, query, args...), &w)
+	if err == sql.ErrNoRows {
+		return webhook{}, errWebhookNotFound
+	}
+	return w, err
+}
+
+func (r *sqlWebhookRepository) List(ctx context.Context, activeOnly bool) ([]webhook, error) {
+	query := "SELECT " + webhookColumns + " FROM webhooks"
+	args := []interface{}{}
+	if activeOnly {
+		query += " WHERE active = $1"
+		args = append(args, true)
+	}
+	query, args = bindQuery(query+" ORDER BY created_at, id", args...)
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []webhook{}
+	for rows.Next() {
+		var w webhook
+		if err := scanWebhook(rows, &w); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+	return webhooks, rows.Err()
+}
+
+func (r *sqlWebhookRepository) Create(ctx context.Context, w webhook, secret string) error {
+	query, args := bindQuery("INSERT INTO webhooks (id, url, secret, events, active, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		w.ID, w.URL, secret, strings.Join(w.Events, ","), w.Active, w.CreatedAt, w.UpdatedAt)
+	_, err := r.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+func (r *sqlWebhookRepository) Update(ctx context.Context, id string, input webhookInput) error {
+	s := &setBuilder{}
+	if input.URL != nil {
+		s.set("url", *input.URL)
+	}
+	if input.Secret != nil {
+		s.set("secret", *input.Secret)
+	}
+	if input.Events != nil {
+		s.set("events", strings.Join(*input.Events, ","))
+	}
+	if input.Active != nil {
+		s.set("active", *input.Active)
+	}
+	s.set("updated_at", time.Now().UTC())
+	s.add("id = " + s.arg(strings.ToLower(id)))
+
+	query, err := s.update("webhooks")
+	if err != nil {
+		return err
+	}
+	query, args := bindQuery(query, s.args...)
+	result, err := r.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errWebhookNotFound
+	}
+	return nil
+}
+
+func (r *sqlWebhookRepository) Delete(ctx context.Context, id string) error {
+	id = strings.ToLower(id)
+	return runInTx(ctx, r.db, func(tx *sql.Tx) error {
+		// SQLite doesn't enforce the foreign key's cascade
+		query, args := bindQuery("DELETE FROM webhook_deliveries WHERE webhook_id = $1", id)
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+		query, args = bindQuery("DELETE FROM webhooks WHERE id = $1", id)
+		result, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return errWebhookNotFound
+		}
+		return nil
+	})
+}
+
+func (r *sqlWebhookRepository) CountDeliveries(ctx context.Context, q webhookDeliveryQuery) (int64, error) {
+	where := q.where()
+	var total int64
+	query, args := bindQuery("SELECT COUNT(*) FROM webhook_deliveries"+where.sql(), where.args...)
+	err := r.db.QueryRowContext(ctx, query, args...).Scan(&total)
+	return total, err
+}
+
+func (r *sqlWebhookRepository) ListDeliveries(ctx context.Context, q webhookDeliveryQuery) ([]webhookDelivery, error) {
+	where := q.where()
+	query := fmt.Sprintf("SELECT %s FROM webhook_deliveries%s ORDER BY created_at DESC, id LIMIT %s OFFSET %s",
+		webhookDeliveryColumns, where.sql(), where.arg(q.Limit), where.arg(q.Offset))
+	query, args := bindQuery(query, where.args...)
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []webhookDelivery{}
+	for rows.Next() {
+		var d webhookDelivery
+		if err := scanWebhookDelivery(rows, &d); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// Fields of a webhook create or update; nil fields are left as they are
+type webhookInput struct {
+	URL    *string   `json:"url"`
+	Secret *string   `json:"secret"`
+	Events *[]string `json:"events"`
+	Active *bool     `json:"active"`
+}
+
+// Validate and normalize the input, returning the first failing field
+func (in *webhookInput) validate() error {
+	if in.URL != nil {
+		*in.URL = strings.TrimSpace(*in.URL)
+		u, err := url.Parse(*in.URL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || len(*in.URL) > 2048 {
+			return fieldError{Field: "url", Rule: "url", Message: "url must be an http(s) URL of at most 2048 characters"}
+		}
+	}
+	if in.Secret != nil && (len(*in.Secret) < 16 || len(*in.Secret) > 255) {
+		return fieldError{Field: "secret", Rule: "len", Message: "secret must be 16 to 255 characters"}
+	}
+	if in.Events != nil {
+		events := []string{}
+		for _, event := range *in.Events {
+			if !slices.Contains(webhookEvents, event) {
+				return fieldError{Field: "events", Rule: "oneof", Message: "events must be some of: " + strings.Join(webhookEvents, ", ")}
+			}
+			if !slices.Contains(events, event) {
+				events = append(events, event)
+			}
+		}
+		*in.Events = events
+	}
+	return nil
+}
+
+// A new webhook with its secret, as answered once
+type createdWebhook struct {
+	webhook
+	Secret string `json:"secret"`
+}
+
+// Register a webhook
+//
+// Body: {"url": "https://...", "events": ["user.created"], "secret": "...",
+// "active": true}; without events every event is sent, without a secret one
+// is generated, and active defaults to true. The response includes the
+// secret, which is not shown again.
+func createWebhook(c *gin.Context) {
+	var input webhookInput
+	if !bindJSON(c, &input) {
+		return
+	}
+	if input.URL == nil {
+		respondInvalid(c, fieldError{Field: "url", Rule: "required", Message: "url is required"})
+		return
+	}
+	if err := input.validate(); err != nil {
+		respondInvalid(c, err)
+		return
+	}
+
+	secret := ""
+	if input.Secret != nil {
+		secret = *input.Secret
+	} else {
+		var err error
+		if secret, err = newWebhookSecret(); err != nil {
+			respondInternal(c, "Failed to create webhook")
+			return
+		}
+	}
+	now := time.Now().UTC()
+	w := webhook{ID: newUUID(), URL: *input.URL, Events: []string{}, Active: true, CreatedAt: now, UpdatedAt: now}
+	if input.Events != nil {
+		w.Events = *input.Events
+	}
+	if input.Active != nil {
+		w.Active = *input.Active
+	}
+
+	ctx := c.Request.Context()
+	if err := repositoriesFrom(ctx).webhooks.Create(ctx, w, secret); err != nil {
+		respondInternal(c, "Failed to create webhook")
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Location", apiBase(c)+"/webhooks/"+w.ID)
+	c.JSON(http.StatusCreated, createdWebhook{w, secret})
+}
+
+// List the webhooks, without their secrets
+func getWebhooks(c *gin.Context) {
+	ctx := c.Request.Context()
+	webhooks, err := repositoriesFrom(ctx).webhooks.List(ctx, false)
+	if err != nil {
+		respondInternal(c, "Failed to list webhooks")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": webhooks})
+}
+
+func getWebhookByID(c *gin.Context) {
+	ctx := c.Request.Context()
+	w, err := repositoriesFrom(ctx).webhooks.Get(ctx, c.Param("id"))
+	if err == errWebhookNotFound {
+		respondError(c, codeWebhookNotFound, "Webhook not found")
+		return
+	}
+	if err != nil {
+		respondInternal(c, "Failed to fetch webhook")
+		return
+	}
+	c.JSON(http.StatusOK, w)
+}
+
+// Change a webhook's url, secret, events or active flag. Deliveries waiting
+// for a retry use the new values.
+func updateWebhook(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var input webhookInput
+	if !bindJSON(c, &input) {
+		return
+	}
+	if err := input.validate(); err != nil {
+		respondInvalid(c, err)
+		return
+	}
+
+	if input.URL == nil && input.Secret == nil && input.Events == nil && input.Active == nil {
+		respondError(c, codeValidationFailed, "No fields to update")
+		return
+	}
+
+	err := repositoriesFrom(ctx).webhooks.Update(ctx, c.Param("id"), input)
+	if err == errWebhookNotFound {
+		respondError(c, codeWebhookNotFound, "Webhook not found")
+		return
+	}
+	if err != nil {
+		respondInternal(c, "Failed to update webhook")
+		return
+	}
+	getWebhookByID(c)
+}
+
+// Delete a webhook and its deliveries
+func deleteWebhook(c *gin.Context) {
+	ctx := c.Request.Context()
+	err := repositoriesFrom(ctx).webhooks.Delete(ctx, c.Param("id"))
+	if err == errWebhookNotFound {
+		respondError(c, codeWebhookNotFound, "Webhook not found")
+		return
+	}
+	if err != nil {
+		respondInternal(c, "Failed to delete webhook")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted"})
+}
+
+// Columns scanned by scanWebhookDelivery
+const webhookDeliveryColumns = "id, webhook_id, event, status, attempts, response_status, error, payload, created_at, last_attempt_at, next_attempt_at"
+
+func scanWebhookDelivery(row interface{ Scan(...interface{}) error }, d *webhookDelivery) error {
+	var payload string
+	err := row.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Status, &d.Attempts, &d.ResponseStatus, &d.Error, &payload,
+		&d.CreatedAt, &d.LastAttemptAt, &d.NextAttemptAt)
+	d.Payload = json.RawMessage(payload)
+	return err
+}
+
+// Deliveries of a webhook, newest first, paginated with limit and offset;
+// ?status=failed (or pending, succeeded) shows only those
+func getWebhookDeliveries(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	webhooks := repositoriesFrom(ctx).webhooks
+	w, err := webhooks.Get(ctx, c.Param("id"))
+	if err == errWebhookNotFound {
+		respondError(c, codeWebhookNotFound, "Webhook not found")
+		return
+	}
+	if err != nil {
+		respondInternal(c, "Failed to fetch webhook")
+		return
+	}
+	q := webhookDeliveryQuery{WebhookID: w.ID, Status: c.Query("status")}
+	if q.Limit, q.Offset, err = parsePagination(c); err != nil {
+		respondError(c, codeInvalidRequest, err.Error())
+		return
+	}
+	if q.Status != "" && q.Status != deliveryPending && q.Status != deliverySucceeded && q.Status != deliveryFailed {
+		respondError(c, codeInvalidRequest, fmt.Sprintf("status must be %s, %s or %s", deliveryPending, deliverySucceeded, deliveryFailed))
+		return
+	}
+
+	total, err := webhooks.CountDeliveries(ctx, q)
+	if err != nil {
+		respondInternal(c, "Failed to count webhook deliveries")
+		return
+	}
+	deliveries, err := webhooks.ListDeliveries(ctx, q)
+	if err != nil {
+		respondInternal(c, "Failed to fetch webhook deliveries")
+		return
+	}
+
+	c.Header("X-Total-Count", strconv.FormatInt(total, 10))
+	c.JSON(http.StatusOK, gin.H{"items": deliveries})
+}
+
+// For deliveries; a redirect is a failed delivery, not something to follow
+var webhookClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// Record a pending delivery of an event to each active webhook of hooks
+// subscribed to it, through tx. payload is the body to send, in
+// EVENT_FORMAT.
+func insertWebhookDeliveries(ctx context.Context, tx dbtx, hooks []webhook, event, payload string) error {
+	now := time.Now().UTC()
+	for _, w := range hooks {
+		if !w.Active || !w.subscribed(event) {
+			continue
+		}
+		query, args := bindQuery("INSERT INTO webhook_deliveries (id, webhook_id, event, status, attempts, error, payload, created_at, next_attempt_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+			newUUID(), w.ID, event, deliveryPending, 0, "", payload, now, now)
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// How long a claimed delivery is left to the instance that claimed it:
+// waiting for a worker, the attempt and the queries around it. A delivery
+// whose instance stopped is claimed again after it.
+func webhookLease() time.Duration {
+	return 3 * webhookTimeout
+}
+
+// Claim up to n pending deliveries that are due, leasing them to this
+// instance so no other one attempts them meanwhile
+func claimWebhookDeliveries(ctx context.Context, n int) ([]string, error) {
+	var ids []string
+	err := runInTx(ctx, db, func(tx *sql.Tx) error {
+		ids = []string{}
+		now := time.Now().UTC()
+		query, args := bindQuery("SELECT id FROM webhook_deliveries WHERE status = $1 AND next_attempt_at <= $2 ORDER BY next_attempt_at LIMIT $3"+skipLocked(),
+			deliveryPending, now, n)
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+		if len(ids) == 0 {
+			return nil
+		}
+
+		placeholders := make([]string, len(ids))
+		args = []interface{}{now.Add(webhookLease())}
+		for i, id := range ids {
+			placeholders[i] = fmt.Sprintf("$%d", i+2)
+			args = append(args, id)
+		}
+		query, args = bindQuery("UPDATE webhook_deliveries SET next_attempt_at = $1 WHERE id IN ("+strings.Join(placeholders, ", ")+")", args...)
+		_, err = tx.ExecContext(ctx, query, args...)
+		return err
+	})
+	return ids, err
+}
+
+// Delay before the attempt after n failed ones
+func webhookBackoff(n int) time.Duration {
+	return doublingDelay(webhookRetryBase, webhookRetryMax, n)
+}
+
+// Make one attempt at a claimed delivery and record its outcome, with the
+// time of the next attempt after a failure
+func attemptWebhookDelivery(id string, logger *slog.Logger) {
+	// The request and the queries around it
+	ctx, cancel := context.WithTimeout(context.Background(), 2*webhookTimeout)
+	defer cancel()
+	logger = logger.With("delivery_id", id)
+	ctx = withLogger(ctx, logger)
+
+	var event, payload, target, secret string
+	var attempts int
+	var active bool
+	query, args := bindQuery(
+		"SELECT d.event, d.attempts, d.payload, w.url, w.secret, w.active FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id WHERE d.id = $1 AND d.status = $2",
+		id, deliveryPending)
+	err := db.QueryRowContext(ctx, query, args...).Scan(&event, &attempts, &payload, &target, &secret, &active)
+	if err == sql.ErrNoRows {
+		// Deleted with its webhook
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to load webhook delivery, trying again once its lease ends", "error", err)
+		return
+	}
+	contentType, requestID := webhookBodyInfo([]byte(payload))
+	// The request that caused the event
+	ctx = withLogger(withRequestID(ctx, requestID), logger.With("request_id", requestID))
+
+	if !active {
+		// Not an attempt, so the last one's outcome stays
+		query, args := bindQuery("UPDATE webhook_deliveries SET status = $1, error = $2, next_attempt_at = NULL WHERE id = $3",
+			deliveryFailed, "webhook was deactivated", id)
+		if _, err := db.ExecContext(ctx, query, args...); err != nil {
+			logger.Error("Failed to record webhook delivery as failed", "error", err)
+		}
+		return
+	}
+
+	status, sendErr := sendWebhook(ctx, id, target, secret, event, contentType, requestID, []byte(payload))
+	attempts++
+	if sendErr == nil {
+		recordWebhookAttempt(ctx, id, deliverySucceeded, attempts, status, "", nil)
+		return
+	}
+	if attempts >= webhookMaxAttempts {
+		loggerFrom(ctx).Warn("Giving up on webhook delivery", "attempts", attempts, "error", sendErr)
+		recordWebhookAttempt(ctx, id, deliveryFailed, attempts, status, sendErr.Error(), nil)
+		return
+	}
+	next := time.Now().UTC().Add(webhookBackoff(attempts))
+	recordWebhookAttempt(ctx, id, deliveryPending, attempts, status, sendErr.Error(), &next)
+}
+
+// POST the payload; the response status, when there is one, and an error
+// unless it is a 2xx
+func sendWebhook(ctx context.Context, id, target, secret, event, contentType, requestID string, payload []byte) (*int, error) {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "sample-api-webhooks")
+	// The same on every attempt, for receivers to drop repeats
+	req.Header.Set("X-Webhook-Delivery", id)
+	req.Header.Set("X-Webhook-Event", event)
+	req.Header.Set(webhookSignatureHeader, signWebhook(secret, payload))
+	if requestID != "" {
+		req.Header.Set(requestIDHeader, requestID)
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// Read a little of the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	status := resp.StatusCode
+	if status < 200 || status > 299 {
+		return &status, fmt.Errorf("webhook answered %d", status)
+	}
+	return &status, nil
+}
+
+// Store the outcome of an attempt
+func recordWebhookAttempt(ctx context.Context, id, status string, attempts int, responseStatus *int, message string, next *time.Time) {
+	if len(message) > 500 {
+		message = message[:500]
+	}
+	var nextAttempt interface{}
+	if next != nil {
+		nextAttempt = *next
+	}
+	query, args := bindQuery("UPDATE webhook_deliveries SET status = $1, attempts = $2, response_status = $3, error = $4, last_attempt_at = $5, next_attempt_at = $6 WHERE id = $7",
+		status, attempts, responseStatus, message, time.Now().UTC(), nextAttempt, id)
+	if _, err := db.ExecContext(ctx, query, args...); err != nil {
+		loggerFrom(ctx).Error("Failed to record attempt at webhook delivery", "delivery_id", id, "error", err)
+	}
+}